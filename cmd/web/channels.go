@@ -0,0 +1,24 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ashparshp/bookings/internal/handlers"
+)
+
+// channelSyncInterval is how often bookings are pulled from channels and availability pushed
+// to them
+const channelSyncInterval = 5 * time.Minute
+
+// listenForChannelSync syncs every active channel now and then at every channelSyncInterval
+func listenForChannelSync(repo *handlers.Repository) {
+	go func() {
+		ticker := time.NewTicker(channelSyncInterval)
+		defer ticker.Stop()
+
+		for {
+			repo.SyncChannels()
+			<-ticker.C
+		}
+	}()
+}
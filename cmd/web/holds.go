@@ -0,0 +1,41 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ashparshp/bookings/internal/handlers"
+	"github.com/ashparshp/bookings/internal/models"
+)
+
+// holdSweepInterval is how often holds that have run out are cleared away
+const holdSweepInterval = time.Minute
+
+// listenForHoldSweep runs sweepHolds now and then at every holdSweepInterval
+func listenForHoldSweep(repo *handlers.Repository) {
+	go func() {
+		ticker := time.NewTicker(holdSweepInterval)
+		defer ticker.Stop()
+
+		for {
+			sweepHolds(repo, time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+// sweepHolds removes the room holds that ran out before now. Searches already ignore them, so
+// this only keeps the table small. It also cancels the reservations whose deposit wasn't paid in
+// time, which do hold their rooms, and returns them.
+func sweepHolds(repo *handlers.Repository, now time.Time) (int64, []models.Reservation, error) {
+	n, err := repo.DB.DeleteExpiredRoomHolds(now)
+	if err != nil {
+		app.ErrorLog.Println("Error sweeping room holds:", err)
+		return 0, nil, err
+	}
+
+	if n > 0 {
+		app.InfoLog.Printf("Released %d room holds that ran out", n)
+	}
+
+	return n, repo.CancelUnpaidReservations(now), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/handlers"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/repository"
+)
+
+// webhookRecorder is a repository keeping the webhook events queued through it
+type webhookRecorder struct {
+	repository.DatabaseRepo
+	events []string
+}
+
+func (m *webhookRecorder) InsertWebhookDeliveries(propertyID int, eventID, event, payload string) (int, error) {
+	m.events = append(m.events, event)
+	return m.DatabaseRepo.InsertWebhookDeliveries(propertyID, eventID, event, payload)
+}
+
+func TestSweepHolds(t *testing.T) {
+	app.InfoLog = log.New(io.Discard, "", 0)
+	app.ErrorLog = log.New(io.Discard, "", 0)
+	app.MailChan = make(chan models.MailData, 10)
+
+	repo := handlers.NewTestRepo(&app)
+	recorder := &webhookRecorder{DatabaseRepo: repo.DB}
+	repo.DB = recorder
+
+	n, cancelled, err := sweepHolds(repo, time.Now())
+	if err != nil {
+		t.Errorf("sweepHolds returned an error: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 holds to be released, got %d", n)
+	}
+	if len(cancelled) != 1 || cancelled[0].ID != 97 || cancelled[0].Status != models.StatusCancelled {
+		t.Fatalf("expected reservation 97 to be cancelled, got %+v", cancelled)
+	}
+
+	queued := false
+	for _, e := range recorder.events {
+		if e == models.EventReservationCancelled {
+			queued = true
+		}
+	}
+	if !queued {
+		t.Errorf("expected a %s webhook to be queued, got %v", models.EventReservationCancelled, recorder.events)
+	}
+
+	sent := false
+	for len(app.MailChan) > 0 {
+		if msg := <-app.MailChan; msg.To == cancelled[0].Email && msg.Subject == "Reservation Cancelled" {
+			sent = true
+		}
+	}
+	if !sent {
+		t.Error("expected the guest to be told the reservation was cancelled")
+	}
+}
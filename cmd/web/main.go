@@ -7,14 +7,22 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
+	// property timezones must load on hosts without a zoneinfo database
+	_ "time/tzdata"
 
+	"github.com/ashparshp/bookings/internal/channels"
 	"github.com/ashparshp/bookings/internal/config"
 	"github.com/ashparshp/bookings/internal/driver"
 	"github.com/ashparshp/bookings/internal/handlers"
 	"github.com/ashparshp/bookings/internal/helpers"
 	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/payments"
+	"github.com/ashparshp/bookings/internal/ratelimit"
 	"github.com/ashparshp/bookings/internal/render"
+	"github.com/ashparshp/bookings/internal/repository/dbrepo"
+	"github.com/ashparshp/bookings/internal/webhooks"
 
 	"github.com/alexedwards/scs/v2"
 )
@@ -35,6 +43,15 @@ func main() {
 	fmt.Println("Starting mail listener...")
 	listenForMail()
 
+	listenForTrashPurge(handlers.Repo.DB)
+	listenForWaitlistOffers(handlers.Repo)
+	listenForHoldSweep(handlers.Repo)
+	listenForChannelSync(handlers.Repo)
+	listenForWebhooks(handlers.Repo)
+	if app.SessionStore == config.SessionStorePostgres {
+		listenForSessionSweep(handlers.Repo.DB)
+	}
+
 	portNumber := getPort()
 	fmt.Println("Server running on port", portNumber)
 
@@ -74,6 +91,30 @@ func run() (*driver.DB, error) {
     mailFromAddress := flag.String("mailfrom", "noreply@bookings.com", "Mail from address")
     mailFromName := flag.String("mailfromname", "Bookings", "Mail from name")
 
+	trashDays := flag.Int("trashdays", 30, "Days a deleted reservation stays in the trash before it is purged")
+	minStay := flag.Int("minstay", 1, "Shortest stay in nights guests can book")
+	maxStay := flag.Int("maxstay", 30, "Longest stay in nights guests can book, 0 for no limit")
+	bookingHorizon := flag.Int("bookinghorizon", 365, "Days ahead guests can book a stay, 0 for no limit")
+	holdMinutes := flag.Int("holdminutes", 15, "Minutes a room is held for a guest while they fill in the booking form, and then pay the deposit")
+	siteURL := flag.String("siteurl", "http://localhost:8080", "Public URL of the site, used for links in emails")
+
+	// Payment configuration flags
+	paymentKey := flag.String("paymentkey", "", "Payment provider secret key; deposits are not taken when empty")
+	paymentPublishableKey := flag.String("paymentpublishablekey", "", "Payment provider publishable key used in the browser")
+	paymentWebhookSecret := flag.String("paymentwebhooksecret", "", "Secret used to sign payment provider webhooks")
+	paymentURL := flag.String("paymenturl", "https://api.stripe.com", "Base URL of the Stripe compatible payment API")
+	depositPercent := flag.Int("depositpercent", 30, "Share of the stay taken as a deposit when booking")
+	freeCancellationDays := flag.Int("freecancellationdays", 7, "Days before arrival a cancellation gets a full refund")
+	lateRefundPercent := flag.Int("laterefundpercent", 0, "Share of the deposit refunded for later cancellations")
+
+	// rate limits
+	trustedProxies := flag.String("trustedproxies", "", "Comma separated addresses or CIDR ranges of reverse proxies trusted to set X-Forwarded-For")
+	rateSearch := flag.String("ratesearch", "30/m,10", "Availability searches a client can make, as requests/period[,burst], 0 for no limit")
+	rateSearchJSON := flag.String("ratesearchjson", "60/m,20", "Room availability checks a client can make, as requests/period[,burst], 0 for no limit")
+	rateReserve := flag.String("ratereserve", "10/m,5", "Reservation form requests a client can make, as requests/period[,burst], 0 for no limit")
+
+	sessionStore := flag.String("sessionstore", config.SessionStorePostgres, "Where sessions are kept (postgres, memory)")
+
 	flag.Parse()
 
 	if *dbName == "" || *dbUser == "" {
@@ -96,14 +137,66 @@ func run() (*driver.DB, error) {
     }
 
 	app.InProduction = *inProduction
+	app.TrashRetentionDays = *trashDays
+	app.SiteURL = strings.TrimRight(*siteURL, "/")
+	app.BookingConfig = config.BookingConfig{
+		MinStayNights: *minStay,
+		MaxStayNights: *maxStay,
+		HorizonDays:   *bookingHorizon,
+		HoldMinutes:   *holdMinutes,
+	}
+
+	if *paymentKey != "" {
+		app.Payments = payments.NewStripe(*paymentKey, *paymentWebhookSecret, *paymentURL)
+	}
+	app.PaymentConfig = config.PaymentConfig{
+		PublishableKey: *paymentPublishableKey,
+		DepositPercent: *depositPercent,
+		RefundPolicy: payments.RefundPolicy{
+			FreeCancellationDays: *freeCancellationDays,
+			LateRefundPercent:    *lateRefundPercent,
+		},
+	}
+	app.Channels = channels.DefaultRegistry()
+	app.Webhooks = webhooks.NewSender(webhookTimeout)
 	app.UseCahce = *useCache
 
+	switch *sessionStore {
+	case config.SessionStorePostgres, config.SessionStoreMemory:
+		app.SessionStore = *sessionStore
+	default:
+		log.Fatalf("-sessionstore: unknown session store %q", *sessionStore)
+	}
+
+	proxies, err := ratelimit.ParseTrustedProxies(*trustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.TrustedProxies = proxies
+	for _, l := range []struct {
+		flag  string
+		value string
+		limit *ratelimit.Limit
+	}{
+		{"ratesearch", *rateSearch, &app.RateLimits.Search},
+		{"ratesearchjson", *rateSearchJSON, &app.RateLimits.SearchJSON},
+		{"ratereserve", *rateReserve, &app.RateLimits.Reserve},
+	} {
+		*l.limit, err = ratelimit.ParseLimit(l.value)
+		if err != nil {
+			log.Fatalf("-%s: %v", l.flag, err)
+		}
+	}
+
 	infoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	app.InfoLog = infoLog
 
 	errorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 	app.ErrorLog = errorLog
 
+	// each instance keeps its own buckets; a shared store can replace the memory store
+	app.RateLimiter = ratelimit.New(ratelimit.NewMemoryStore(), app.TrustedProxies, errorLog)
+
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
 	session.Cookie.Persist = true
@@ -124,6 +217,10 @@ func run() (*driver.DB, error) {
 	}
 	log.Println("Connected to database")
 
+	if app.SessionStore == config.SessionStorePostgres {
+		session.Store = dbrepo.NewSessionStore(db.SQL)
+	}
+
 	tc, err := render.CreateTemplateCache()
 	if err != nil {
 		log.Fatal("Cannot create template cache:", err)
@@ -2,7 +2,12 @@ package main
 
 import (
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/ashparshp/bookings/internal/helpers"
+	"github.com/ashparshp/bookings/internal/ratelimit"
 )
 
 func TestNoSurf(t *testing.T) {
@@ -29,4 +34,87 @@ func TestSessionLoad(t *testing.T) {
 	default:
 		t.Errorf("Type is not http.Handler, but is %T", v)
 	}
-}
\ No newline at end of file
+}
+func TestGuestAuth(t *testing.T) {
+	var myH myHandler
+
+	h := GuestAuth(&myH)
+
+	switch v := h.(type) {
+	case http.Handler:
+		// ok
+	default:
+		t.Errorf("Type is not http.Handler, but is %T", v)
+	}
+}
+
+func TestRealIP(t *testing.T) {
+	proxies, _ := ratelimit.ParseTrustedProxies("10.0.0.1")
+	app.TrustedProxies = proxies
+	defer func() { app.TrustedProxies = nil }()
+
+	var got string
+	h := RealIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.RemoteAddr
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:4000"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 198.51.100.1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "198.51.100.1" {
+		t.Errorf("expected the address the proxy forwarded for, got %s", got)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.5:4000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "203.0.113.5" {
+		t.Errorf("expected headers from untrusted clients to be ignored, got %s", got)
+	}
+}
+
+func TestSecureHeaders(t *testing.T) {
+	defer func() { app.InProduction = false }()
+
+	var nonces []string
+	h := SecureHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonces = append(nonces, helpers.CSPNonce(r))
+	}))
+
+	for _, production := range []bool{false, true} {
+		app.InProduction = production
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+		nonce := nonces[len(nonces)-1]
+		if nonce == "" {
+			t.Fatal("expected a nonce to be given to the handler")
+		}
+
+		csp := rr.Header().Get("Content-Security-Policy")
+		for _, directive := range []string{"script-src 'self' 'nonce-" + nonce + "'", "frame-ancestors 'none'", "object-src 'none'", "report-uri " + cspReportPath} {
+			if !strings.Contains(csp, directive) {
+				t.Errorf("expected the policy to contain %q, got %q", directive, csp)
+			}
+		}
+		if strings.Contains(csp, "'unsafe-inline' https://code.jquery.com") || strings.Contains(csp, "script-src 'self' 'unsafe-inline'") {
+			t.Errorf("expected inline scripts to need the nonce, got %q", csp)
+		}
+
+		if got := rr.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("expected nosniff, got %q", got)
+		}
+		if got := rr.Header().Get("Referrer-Policy"); got != "strict-origin-when-cross-origin" {
+			t.Errorf("expected a referrer policy, got %q", got)
+		}
+		if hsts := rr.Header().Get("Strict-Transport-Security"); (hsts != "") != production {
+			t.Errorf("production %v: unexpected HSTS header %q", production, hsts)
+		}
+	}
+
+	if nonces[0] == nonces[1] {
+		t.Error("expected a new nonce for each request")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ashparshp/bookings/internal/repository"
+)
+
+// trashPurgeInterval is how often the trash is checked for reservations past their retention period
+const trashPurgeInterval = 6 * time.Hour
+
+// listenForTrashPurge runs purgeTrash now and then at every trashPurgeInterval
+func listenForTrashPurge(repo repository.DatabaseRepo) {
+	go func() {
+		ticker := time.NewTicker(trashPurgeInterval)
+		defer ticker.Stop()
+
+		for {
+			purgeTrash(repo, app.TrashRetentionDays, time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+// purgeTrash permanently removes reservations that have been in the trash for longer than
+// days. The repository records the purge in the audit log.
+func purgeTrash(repo repository.DatabaseRepo, days int, now time.Time) (int64, error) {
+	before := now.AddDate(0, 0, -days)
+
+	n, err := repo.PurgeDeletedReservations(before)
+	if err != nil {
+		app.ErrorLog.Println("Error purging trash:", err)
+		return 0, err
+	}
+
+	if n > 0 {
+		app.InfoLog.Printf("Purged %d reservations from the trash", n)
+	}
+	return n, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/repository/dbrepo"
+)
+
+func TestPurgeTrash(t *testing.T) {
+	app.InfoLog = log.New(io.Discard, "", 0)
+	app.ErrorLog = log.New(io.Discard, "", 0)
+
+	n, err := purgeTrash(dbrepo.NewTestRepo(&app), 30, time.Now())
+	if err != nil {
+		t.Errorf("purgeTrash returned an error: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 reservation to be purged, got %d", n)
+	}
+}
@@ -5,12 +5,13 @@ import (
 
 	"github.com/ashparshp/bookings/internal/config"
 	"github.com/ashparshp/bookings/internal/handlers"
+	"github.com/ashparshp/bookings/internal/ratelimit"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
-func routes(_ *config.AppConfig) http.Handler {
+func routes(app *config.AppConfig) http.Handler {
 	
 	/*
 	mux := pat.New()
@@ -21,39 +22,124 @@ func routes(_ *config.AppConfig) http.Handler {
 
 	mux := chi.NewRouter()
 
+	mux.Use(middleware.RequestID)
+	mux.Use(RealIP)
+	mux.Use(SecureHeaders)
 	mux.Use(middleware.Recoverer)
 	mux.Use(NoSurf)
 	mux.Use(SessionLoad)
+	mux.Use(handlers.Repo.ResolveProperty)
 
 	mux.Get("/", handlers.Repo.HomePage)
 	mux.Get("/about", handlers.Repo.AboutPage)
 	mux.Get("/generals-quarters", handlers.Repo.GeneralsPage)
 	mux.Get("/majors-suite", handlers.Repo.MajorsPage)
 	mux.Get("/search-availability", handlers.Repo.AvailabilityPage)
-	mux.Post("/search-availability", handlers.Repo.PostAvailabilityPage)
-	mux.Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
+	mux.With(app.RateLimiter.Middleware("search", app.RateLimits.Search)).Post("/search-availability", handlers.Repo.PostAvailabilityPage)
+	mux.With(app.RateLimiter.Middleware("search-json", app.RateLimits.SearchJSON)).Post("/search-availability-json", handlers.Repo.AvailabilityJSON)
+	mux.Get("/rooms/{id}/calendar", handlers.Repo.RoomCalendarJSON)
 	mux.Get("/choose-room/{id}", handlers.Repo.ChooseRoomPage)
 	mux.Get("/book-room", handlers.Repo.BookRoomPage)
+	mux.Get("/waitlist", handlers.Repo.WaitlistPage)
+	mux.Post("/waitlist", handlers.Repo.PostWaitlistPage)
+	mux.Get("/waitlist/{token}", handlers.Repo.WaitlistOfferPage)
 	mux.Get("/contact", handlers.Repo.ContactPage)
-	mux.Get("/make-reservation", handlers.Repo.ReservationPage)
-	mux.Post("/make-reservation", handlers.Repo.PostReservationPage)
+	mux.With(app.RateLimiter.Middleware("reserve", app.RateLimits.Reserve)).Get("/make-reservation", handlers.Repo.ReservationPage)
+	mux.With(app.RateLimiter.Middleware("reserve", app.RateLimits.Reserve)).Post("/make-reservation", handlers.Repo.PostReservationPage)
+	mux.Get("/make-payment", handlers.Repo.PaymentPage)
+	mux.Post("/make-payment", handlers.Repo.PostPaymentPage)
+	mux.Post("/payments/webhook", handlers.Repo.PaymentWebhook)
+	mux.With(app.RateLimiter.Middleware("csp-report", ratelimit.PerMinute(60, 20))).Post(cspReportPath, handlers.Repo.CSPReport)
 	mux.Get("/reservation-summary", handlers.Repo.ReservationSummaryPage)
 	mux.Post("/reservation-summary", handlers.Repo.ReservationSummaryPage)
 	mux.Get("/user/login", handlers.Repo.LoginPage)
 	mux.Post("/user/login", handlers.Repo.PostLoginPage)
 	mux.Get("/user/logout", handlers.Repo.LogoutPage)
+	mux.Get("/user/login/two-factor", handlers.Repo.TwoFactorLoginPage)
+	mux.Post("/user/login/two-factor", handlers.Repo.PostTwoFactorLoginPage)
+	mux.Get("/user/two-factor", handlers.Repo.TwoFactorPage)
+	mux.Post("/user/two-factor", handlers.Repo.PostTwoFactorPage)
+	mux.With(Auth).Post("/user/two-factor/recovery-codes", handlers.Repo.PostRecoveryCodesPage)
+	mux.With(Auth).Post("/user/two-factor/disable", handlers.Repo.PostDisableTwoFactorPage)
+
+	mux.Get("/guest/signup", handlers.Repo.GuestSignupPage)
+	mux.Post("/guest/signup", handlers.Repo.PostGuestSignupPage)
+	mux.Get("/guest/login", handlers.Repo.GuestLoginPage)
+	mux.Post("/guest/login", handlers.Repo.PostGuestLoginPage)
+	mux.Post("/guest/magic-link", handlers.Repo.PostGuestMagicLinkPage)
+	mux.Get("/guest/verify/{token}", handlers.Repo.GuestVerifyPage)
+	mux.Get("/guest/logout", handlers.Repo.GuestLogoutPage)
+
+	mux.Route("/account", func(mux chi.Router) {
+		mux.Use(GuestAuth)
+		mux.Get("/", handlers.Repo.GuestAccountPage)
+	})
+
 	mux.Route("/admin", func(mux chi.Router) {
-		// mux.Use(Auth)
+		mux.Use(Auth)
+		mux.Use(handlers.Repo.AdminProperty)
 		mux.Get("/dashboard", handlers.Repo.AdminDashboardPage)
 		mux.Get("/reservations-all", handlers.Repo.AdminAllReservationsPage)
 		mux.Get("/reservations-new", handlers.Repo.AdminNewReservationPage)
 		mux.Get("/reservations-calendar", handlers.Repo.AdminReservationCalendarPage)
 		mux.Post("/reservations-calendar", handlers.Repo.AdminPostReservationCalendarPage)
-		mux.Get("/process-reservation/{src}/{id}/do", handlers.Repo.AdminProcessReservationPage)
+		mux.Post("/reservations-calendar/block", handlers.Repo.AdminPostBlockPage)
+		mux.Post("/reservations-calendar/move", handlers.Repo.AdminMoveReservationJSON)
+		mux.Get("/reservation-status/{src}/{id}/{status}/do", handlers.Repo.AdminReservationStatusPage)
 		mux.Get("/delete-reservation/{src}/{id}/do", handlers.Repo.AdminDeleteReservationPage)
+		mux.Get("/reservations-trash", handlers.Repo.AdminTrashPage)
+		mux.Get("/restore-reservation/{id}/do", handlers.Repo.AdminRestoreReservationPage)
 
 		mux.Get("/reservations/{src}/{id}/show", handlers.Repo.AdminShowReservationPage)
 		mux.Post("/reservations/{src}/{id}", handlers.Repo.AdminPostShowReservationPage)
+		mux.Post("/reservations/{src}/{id}/move", handlers.Repo.AdminPostMoveReservationPage)
+		mux.Get("/reservations/{src}/{id}/invoice", handlers.Repo.AdminInvoicePage)
+
+		mux.Get("/waitlist", handlers.Repo.AdminWaitlistPage)
+		mux.Get("/waitlist/{id}/offer/do", handlers.Repo.AdminWaitlistOfferPage)
+		mux.Get("/waitlist/{id}/remove/do", handlers.Repo.AdminWaitlistRemovePage)
+
+		mux.Get("/channels", handlers.Repo.AdminChannelsPage)
+		mux.Get("/channels/{id}/show", handlers.Repo.AdminShowChannelPage)
+		mux.Post("/channels/{id}", handlers.Repo.AdminPostChannelPage)
+		mux.Get("/channels/{id}/sync/do", handlers.Repo.AdminSyncChannelPage)
+
+		mux.Get("/webhooks", handlers.Repo.AdminWebhooksPage)
+		mux.Get("/webhooks/{id}/show", handlers.Repo.AdminShowWebhookPage)
+		mux.Post("/webhooks/{id}", handlers.Repo.AdminPostWebhookPage)
+		mux.Post("/webhooks/{id}/delete", handlers.Repo.AdminDeleteWebhookPage)
+		mux.Post("/webhooks/{id}/deliveries/{delivery}/redeliver", handlers.Repo.AdminRedeliverWebhookPage)
+
+		mux.Get("/restrictions", handlers.Repo.AdminRestrictionsPage)
+		mux.Get("/restrictions/{id}/show", handlers.Repo.AdminShowRestrictionPage)
+		mux.Post("/restrictions/{id}", handlers.Repo.AdminPostRestrictionPage)
+		mux.Get("/delete-restriction/{id}/do", handlers.Repo.AdminDeleteRestrictionPage)
+
+		mux.Get("/guests", handlers.Repo.AdminGuestsPage)
+		mux.Get("/guests/{id}/show", handlers.Repo.AdminShowGuestPage)
+		mux.Post("/guests/{id}", handlers.Repo.AdminPostGuestPage)
+		mux.Post("/guests/{id}/merge", handlers.Repo.AdminMergeGuestPage)
+
+		mux.Get("/pricing", handlers.Repo.AdminPricingPage)
+		mux.Post("/pricing/rules", handlers.Repo.AdminPostChargeRulePage)
+		mux.Get("/pricing/rules/{id}/toggle/do", handlers.Repo.AdminToggleChargeRulePage)
+		mux.Post("/pricing/promos", handlers.Repo.AdminPostPromoCodePage)
+		mux.Get("/pricing/promos/{id}/toggle/do", handlers.Repo.AdminTogglePromoCodePage)
+
+		mux.Get("/properties", handlers.Repo.AdminPropertiesPage)
+		mux.Post("/properties/select", handlers.Repo.AdminSelectPropertyPage)
+		mux.Get("/properties/{id}/show", handlers.Repo.AdminShowPropertyPage)
+		mux.Post("/properties/{id}", handlers.Repo.AdminPostPropertyPage)
+		mux.Post("/properties/{id}/staff", handlers.Repo.AdminPostPropertyStaffPage)
+
+		mux.Get("/security", handlers.Repo.AdminSecurityPage)
+		mux.Post("/security", handlers.Repo.AdminPostSecurityPage)
+		mux.Post("/security/locked/{id}/unlock", handlers.Repo.AdminUnlockAccountPage)
+		mux.Get("/security/users/{id}/sessions", handlers.Repo.AdminSessionsPage)
+		mux.Post("/security/users/{id}/sessions/{session}/revoke", handlers.Repo.AdminRevokeSessionPage)
+		mux.Post("/security/users/{id}/sessions/revoke", handlers.Repo.AdminRevokeAllSessionsPage)
+
+		mux.Get("/audit-log", handlers.Repo.AdminAuditLogPage)
 		
 	})
 	fileServer := http.FileServer(http.Dir("./static/"))
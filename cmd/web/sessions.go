@@ -0,0 +1,38 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ashparshp/bookings/internal/repository"
+)
+
+// sessionSweepInterval is how often expired sessions are cleared from the database
+const sessionSweepInterval = 30 * time.Minute
+
+// listenForSessionSweep runs sweepSessions now and then at every sessionSweepInterval
+func listenForSessionSweep(repo repository.DatabaseRepo) {
+	go func() {
+		ticker := time.NewTicker(sessionSweepInterval)
+		defer ticker.Stop()
+
+		for {
+			sweepSessions(repo, time.Now())
+			<-ticker.C
+		}
+	}()
+}
+
+// sweepSessions removes the sessions that expired before now. The store already ignores them, so
+// this only keeps the table small.
+func sweepSessions(repo repository.DatabaseRepo, now time.Time) (int64, error) {
+	n, err := repo.DeleteExpiredSessions(now)
+	if err != nil {
+		app.ErrorLog.Println("Error sweeping sessions:", err)
+		return 0, err
+	}
+
+	if n > 0 {
+		app.InfoLog.Printf("Removed %d expired sessions", n)
+	}
+	return n, nil
+}
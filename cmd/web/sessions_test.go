@@ -0,0 +1,23 @@
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/repository/dbrepo"
+)
+
+func TestSweepSessions(t *testing.T) {
+	app.InfoLog = log.New(io.Discard, "", 0)
+	app.ErrorLog = log.New(io.Discard, "", 0)
+
+	n, err := sweepSessions(dbrepo.NewTestRepo(&app), time.Now())
+	if err != nil {
+		t.Errorf("sweepSessions returned an error: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 sessions to be removed, got %d", n)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ashparshp/bookings/internal/handlers"
+)
+
+// waitlistOfferInterval is how often waitlist offers are checked for having run out
+const waitlistOfferInterval = 5 * time.Minute
+
+// listenForWaitlistOffers expires waitlist offers that have run out, now and then at every
+// waitlistOfferInterval, so their rooms go to the next guest waiting
+func listenForWaitlistOffers(repo *handlers.Repository) {
+	go func() {
+		ticker := time.NewTicker(waitlistOfferInterval)
+		defer ticker.Stop()
+
+		for {
+			repo.ExpireWaitlistOffers()
+			<-ticker.C
+		}
+	}()
+}
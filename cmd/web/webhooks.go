@@ -0,0 +1,26 @@
+package main
+
+import (
+	"time"
+
+	"github.com/ashparshp/bookings/internal/handlers"
+)
+
+// webhookInterval is how often due webhook deliveries are sent
+const webhookInterval = 15 * time.Second
+
+// webhookTimeout is how long a webhook is given to answer a delivery
+const webhookTimeout = 10 * time.Second
+
+// listenForWebhooks sends due webhook deliveries now and then at every webhookInterval
+func listenForWebhooks(repo *handlers.Repository) {
+	go func() {
+		ticker := time.NewTicker(webhookInterval)
+		defer ticker.Stop()
+
+		for {
+			repo.DeliverWebhooks()
+			<-ticker.C
+		}
+	}()
+}
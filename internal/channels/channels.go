@@ -0,0 +1,107 @@
+package channels
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/models"
+)
+
+// ErrUnknownKind is returned for a channel whose kind has no adapter
+var ErrUnknownKind = errors.New("unknown channel kind")
+
+// Statuses of the bookings channels report
+const (
+	BookingConfirmed = "confirmed"
+	BookingCancelled = "cancelled"
+)
+
+// Adapter talks to one booking site in its own API
+type Adapter interface {
+	// PushAvailability tells the channel which nights of its rooms can be sold and at what price
+	PushAvailability(rates []Rate) error
+	// PullBookings returns the bookings made, changed or cancelled on the channel since the given
+	// time, or all of them for the zero time
+	PullBookings(since time.Time) ([]Booking, error)
+}
+
+// Rate is whether a room can be sold on a channel for a night, and its price. Prices are in
+// the smallest unit of the property's currency.
+type Rate struct {
+	ExternalRoomID string
+	Date models.Date
+	Available bool
+	ClosedToArrival bool
+	ClosedToDeparture bool
+	Price int
+}
+
+// Booking is a booking made on a channel, as the channel last reported it
+type Booking struct {
+	ExternalID string
+	ExternalRoomID string
+	Status string
+	StartDate models.Date
+	EndDate models.Date
+	FirstName string
+	LastName string
+	Email string
+	Phone string
+	Guests int
+	UpdatedAt time.Time
+}
+
+// Factory returns the adapter for a channel from its settings
+type Factory func(c models.Channel) Adapter
+
+// Registry maps channel kinds to the factory for their adapter
+type Registry map[string]Factory
+
+// DefaultRegistry returns the adapters built into the application
+func DefaultRegistry() Registry {
+	return Registry{
+		KindHTTP: NewHTTP,
+	}
+}
+
+// Adapter returns the adapter for c
+func (r Registry) Adapter(c models.Channel) (Adapter, error) {
+	factory, ok := r[c.Kind]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKind, c.Kind)
+	}
+	return factory(c), nil
+}
+
+// Kinds returns the kinds of channel there are adapters for, in order
+func (r Registry) Kinds() []string {
+	kinds := make([]string, 0, len(r))
+	for kind := range r {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// Rates returns the rates to push to c for the nights in grid. Only the rooms mapped on the
+// channel are sold there.
+func Rates(c models.Channel, grid []models.RoomNight) []Rate {
+	var rates []Rate
+	for _, n := range grid {
+		externalID := c.Rooms[n.Room.ID]
+		if externalID == "" {
+			continue
+		}
+		rates = append(rates, Rate{
+			ExternalRoomID:    externalID,
+			Date:              n.Date,
+			Available:         n.Free,
+			ClosedToArrival:   n.ClosedToArrival,
+			ClosedToDeparture: n.ClosedToDeparture,
+			Price:             n.Room.Price,
+		})
+	}
+	return rates
+}
@@ -0,0 +1,44 @@
+package channels
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ashparshp/bookings/internal/models"
+)
+
+func TestRegistry_Adapter(t *testing.T) {
+	r := DefaultRegistry()
+
+	if _, err := r.Adapter(models.Channel{Kind: KindHTTP}); err != nil {
+		t.Errorf("expected an adapter for %s, got %v", KindHTTP, err)
+	}
+	if _, err := r.Adapter(models.Channel{Kind: "carrier-pigeon"}); !errors.Is(err, ErrUnknownKind) {
+		t.Errorf("expected ErrUnknownKind, got %v", err)
+	}
+
+	if kinds := r.Kinds(); len(kinds) != 1 || kinds[0] != KindHTTP {
+		t.Errorf("expected only %s, got %v", KindHTTP, kinds)
+	}
+}
+
+func TestRates(t *testing.T) {
+	c := models.Channel{Rooms: map[int]string{1: "GQ"}}
+	day := models.NewDate(2050, 1, 1)
+	grid := []models.RoomNight{
+		{Room: models.Room{ID: 1, Price: 15000}, Date: day, Free: true},
+		{Room: models.Room{ID: 1, Price: 15000}, Date: day.AddDate(0, 0, 1), Free: false, ClosedToArrival: true},
+		{Room: models.Room{ID: 2, Price: 20000}, Date: day, Free: true},
+	}
+
+	rates := Rates(c, grid)
+	if len(rates) != 2 {
+		t.Fatalf("expected the two nights of the mapped room, got %d", len(rates))
+	}
+	if rates[0].ExternalRoomID != "GQ" || !rates[0].Available || rates[0].Price != 15000 || !rates[0].Date.Equal(day) {
+		t.Errorf("unexpected first rate %+v", rates[0])
+	}
+	if rates[1].Available || !rates[1].ClosedToArrival {
+		t.Errorf("expected the second night taken and closed to arrival, got %+v", rates[1])
+	}
+}
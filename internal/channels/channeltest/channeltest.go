@@ -0,0 +1,164 @@
+// Package channeltest runs a channel that speaks the JSON channel API in memory, for testing
+// channel sync against without reaching a real booking site
+package channeltest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/models"
+)
+
+// Rate is a night of a room as it was pushed to the channel
+type Rate struct {
+	RoomID string `json:"room_id"`
+	Date models.Date `json:"date"`
+	Available bool `json:"available"`
+	ClosedToArrival bool `json:"closed_to_arrival"`
+	ClosedToDeparture bool `json:"closed_to_departure"`
+	Price int `json:"price"`
+}
+
+// Booking is a booking made on the channel
+type Booking struct {
+	ID string `json:"id"`
+	RoomID string `json:"room_id"`
+	Status string `json:"status"`
+	StartDate models.Date `json:"start_date"`
+	EndDate models.Date `json:"end_date"`
+	FirstName string `json:"first_name"`
+	LastName string `json:"last_name"`
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+	Guests int `json:"guests"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Server is a running in-memory channel. Requests must carry its APIKey.
+type Server struct {
+	*httptest.Server
+	APIKey string
+
+	mu sync.Mutex
+	bookings []Booking
+	rates []Rate
+	pushes int
+	failStatus int
+	failMessage string
+}
+
+// NewServer starts a channel that takes requests made with apiKey. Close it when done.
+func NewServer(apiKey string) *Server {
+	s := &Server{APIKey: apiKey}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// AddBooking makes or changes a booking on the channel, stamping it as changed now unless it
+// has its own UpdatedAt
+func (s *Server) AddBooking(b Booking) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if b.UpdatedAt.IsZero() {
+		b.UpdatedAt = time.Now()
+	}
+	for i, existing := range s.bookings {
+		if existing.ID == b.ID {
+			s.bookings[i] = b
+			return
+		}
+	}
+	s.bookings = append(s.bookings, b)
+}
+
+// Rates returns the rates last pushed to the channel
+func (s *Server) Rates() []Rate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Rate(nil), s.rates...)
+}
+
+// Pushes returns how many times availability has been pushed to the channel
+func (s *Server) Pushes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pushes
+}
+
+// Fail makes every request fail with status and message until Fail is called with status 0
+func (s *Server) Fail(status int, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failStatus = status
+	s.failMessage = message
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+s.APIKey {
+		writeError(w, http.StatusUnauthorized, "invalid API key")
+		return
+	}
+	if s.failStatus != 0 {
+		writeError(w, s.failStatus, s.failMessage)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v1/bookings":
+		var since time.Time
+		if v := r.URL.Query().Get("since"); v != "" {
+			var err error
+			since, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "since must be an RFC 3339 time")
+				return
+			}
+		}
+
+		bookings := []Booking{}
+		for _, b := range s.bookings {
+			if !b.UpdatedAt.Before(since) {
+				bookings = append(bookings, b)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"bookings": bookings})
+
+	case r.Method == "PUT" && r.URL.Path == "/v1/availability":
+		var body struct {
+			Rates []Rate `json:"rates"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "can't read the rates")
+			return
+		}
+		for _, rate := range body.Rates {
+			if rate.RoomID == "" || rate.Date.IsZero() {
+				writeError(w, http.StatusBadRequest, "every rate needs a room and a date")
+				return
+			}
+		}
+		s.rates = body.Rates
+		s.pushes++
+		writeJSON(w, http.StatusOK, map[string]interface{}{"updated": len(body.Rates)})
+
+	default:
+		writeError(w, http.StatusNotFound, "no such endpoint")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
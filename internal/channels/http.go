@@ -0,0 +1,161 @@
+package channels
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/models"
+)
+
+// KindHTTP is the kind of channel reached through the JSON channel API
+const KindHTTP = "http"
+
+// HTTP is an Adapter for channels, and channel managers, that speak the JSON channel API:
+// availability is sent with PUT /v1/availability and bookings are read from GET /v1/bookings
+type HTTP struct {
+	APIKey string
+	BaseURL string
+	Client *http.Client
+}
+
+// NewHTTP returns the adapter for a channel reached through the JSON channel API
+func NewHTTP(c models.Channel) Adapter {
+	return &HTTP{
+		APIKey:  c.APIKey,
+		BaseURL: strings.TrimRight(c.BaseURL, "/"),
+		Client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// httpRate is a night of a room as the API takes it
+type httpRate struct {
+	RoomID string `json:"room_id"`
+	Date models.Date `json:"date"`
+	Available bool `json:"available"`
+	ClosedToArrival bool `json:"closed_to_arrival"`
+	ClosedToDeparture bool `json:"closed_to_departure"`
+	Price int `json:"price"`
+}
+
+// httpBooking is a booking as the API returns it
+type httpBooking struct {
+	ID string `json:"id"`
+	RoomID string `json:"room_id"`
+	Status string `json:"status"`
+	StartDate models.Date `json:"start_date"`
+	EndDate models.Date `json:"end_date"`
+	FirstName string `json:"first_name"`
+	LastName string `json:"last_name"`
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+	Guests int `json:"guests"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// httpError is the body the API returns with a failed request
+type httpError struct {
+	Error string `json:"error"`
+}
+
+// PushAvailability sends the rates in a single request
+func (h *HTTP) PushAvailability(rates []Rate) error {
+	body := struct {
+		Rates []httpRate `json:"rates"`
+	}{Rates: make([]httpRate, 0, len(rates))}
+	for _, r := range rates {
+		body.Rates = append(body.Rates, httpRate{
+			RoomID:            r.ExternalRoomID,
+			Date:              r.Date,
+			Available:         r.Available,
+			ClosedToArrival:   r.ClosedToArrival,
+			ClosedToDeparture: r.ClosedToDeparture,
+			Price:             r.Price,
+		})
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	return h.do("PUT", "/v1/availability", bytes.NewReader(payload), nil)
+}
+
+// PullBookings reads the bookings changed since the given time
+func (h *HTTP) PullBookings(since time.Time) ([]Booking, error) {
+	path := "/v1/bookings"
+	if !since.IsZero() {
+		path += "?" + url.Values{"since": {since.UTC().Format(time.RFC3339)}}.Encode()
+	}
+
+	var out struct {
+		Bookings []httpBooking `json:"bookings"`
+	}
+	err := h.do("GET", path, nil, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	bookings := make([]Booking, 0, len(out.Bookings))
+	for _, b := range out.Bookings {
+		bookings = append(bookings, Booking{
+			ExternalID:     b.ID,
+			ExternalRoomID: b.RoomID,
+			Status:         b.Status,
+			StartDate:      b.StartDate,
+			EndDate:        b.EndDate,
+			FirstName:      b.FirstName,
+			LastName:       b.LastName,
+			Email:          b.Email,
+			Phone:          b.Phone,
+			Guests:         b.Guests,
+			UpdatedAt:      b.UpdatedAt,
+		})
+	}
+
+	return bookings, nil
+}
+
+// do sends a request to the API and decodes the JSON response into out, when it isn't nil
+func (h *HTTP) do(method, path string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequest(method, h.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+h.APIKey)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	payload, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		var he httpError
+		_ = json.Unmarshal(payload, &he)
+		if he.Error != "" {
+			return fmt.Errorf("channel returned %d: %s", resp.StatusCode, he.Error)
+		}
+		return fmt.Errorf("channel returned %d", resp.StatusCode)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(payload, out)
+}
@@ -0,0 +1,94 @@
+package channels
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/channels/channeltest"
+	"github.com/ashparshp/bookings/internal/models"
+)
+
+func TestHTTP_PushAvailability(t *testing.T) {
+	srv := channeltest.NewServer("key_test")
+	defer srv.Close()
+
+	adapter := NewHTTP(models.Channel{BaseURL: srv.URL + "/", APIKey: "key_test"})
+	day := models.NewDate(2050, 1, 1)
+
+	err := adapter.PushAvailability([]Rate{
+		{ExternalRoomID: "GQ", Date: day, Available: true, Price: 15000},
+		{ExternalRoomID: "GQ", Date: day.AddDate(0, 0, 1), ClosedToDeparture: true, Price: 15000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rates := srv.Rates()
+	if len(rates) != 2 || srv.Pushes() != 1 {
+		t.Fatalf("expected 2 rates in one push, got %d in %d", len(rates), srv.Pushes())
+	}
+	if rates[0].RoomID != "GQ" || !rates[0].Available || rates[0].Price != 15000 || !rates[0].Date.Equal(day) {
+		t.Errorf("unexpected first rate %+v", rates[0])
+	}
+	if rates[1].Available || !rates[1].ClosedToDeparture {
+		t.Errorf("unexpected second rate %+v", rates[1])
+	}
+
+	// the channel refuses rates it can't place
+	err = adapter.PushAvailability([]Rate{{Date: day}})
+	if err == nil || !strings.Contains(err.Error(), "every rate needs a room") {
+		t.Errorf("expected the channel's error, got %v", err)
+	}
+}
+
+func TestHTTP_PullBookings(t *testing.T) {
+	srv := channeltest.NewServer("key_test")
+	defer srv.Close()
+
+	then := time.Date(2050, 1, 1, 12, 0, 0, 0, time.UTC)
+	srv.AddBooking(channeltest.Booking{ID: "B-1", RoomID: "GQ", Status: BookingConfirmed, StartDate: models.NewDate(2050, 2, 1),
+		EndDate: models.NewDate(2050, 2, 3), FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com", Guests: 2, UpdatedAt: then})
+	srv.AddBooking(channeltest.Booking{ID: "B-2", RoomID: "MS", Status: BookingCancelled, StartDate: models.NewDate(2050, 3, 1),
+		EndDate: models.NewDate(2050, 3, 2), UpdatedAt: then.Add(time.Hour)})
+
+	adapter := NewHTTP(models.Channel{BaseURL: srv.URL, APIKey: "key_test"})
+
+	bookings, err := adapter.PullBookings(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookings) != 2 {
+		t.Fatalf("expected every booking, got %d", len(bookings))
+	}
+	b := bookings[0]
+	if b.ExternalID != "B-1" || b.ExternalRoomID != "GQ" || b.Status != BookingConfirmed || b.FirstName != "Ada" ||
+		b.Guests != 2 || !b.StartDate.Equal(models.NewDate(2050, 2, 1)) || !b.UpdatedAt.Equal(then) {
+		t.Errorf("unexpected booking %+v", b)
+	}
+
+	bookings, err = adapter.PullBookings(then.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookings) != 1 || bookings[0].ExternalID != "B-2" {
+		t.Errorf("expected only the booking changed since, got %+v", bookings)
+	}
+}
+
+func TestHTTP_Errors(t *testing.T) {
+	srv := channeltest.NewServer("key_test")
+	defer srv.Close()
+
+	_, err := NewHTTP(models.Channel{BaseURL: srv.URL, APIKey: "wrong"}).PullBookings(time.Time{})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected a wrong key to be refused, got %v", err)
+	}
+
+	srv.Fail(http.StatusServiceUnavailable, "down for maintenance")
+	_, err = NewHTTP(models.Channel{BaseURL: srv.URL, APIKey: "key_test"}).PullBookings(time.Time{})
+	if err == nil || !strings.Contains(err.Error(), "down for maintenance") {
+		t.Errorf("expected the channel's error, got %v", err)
+	}
+}
@@ -5,7 +5,11 @@ import (
 	"log"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/ashparshp/bookings/internal/channels"
 	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/payments"
+	"github.com/ashparshp/bookings/internal/ratelimit"
+	"github.com/ashparshp/bookings/internal/webhooks"
 )
 
 // AppConfig holds the application config
@@ -18,8 +22,34 @@ type AppConfig struct {
 	Session *scs.SessionManager
 	MailChan chan models.MailData
 	MailConfig    MailConfig
+	TrashRetentionDays int
+	// SiteURL is where links in emails, such as sign in links and waitlist offers, point. It is
+	// configured rather than taken from requests, whose Host header the client controls.
+	SiteURL string
+	// Payments takes deposits; bookings are confirmed without one when it is nil
+	Payments payments.PaymentProvider
+	PaymentConfig PaymentConfig
+	BookingConfig BookingConfig
+	// Channels holds the adapters for the other booking sites rooms are sold on, by kind
+	Channels channels.Registry
+	// Webhooks sends the events queued for the webhooks staff register
+	Webhooks *webhooks.Sender
+	// TrustedProxies are the reverse proxies whose forwarding headers give the client's address
+	TrustedProxies ratelimit.TrustedProxies
+	// RateLimiter limits the public endpoints by client address; nothing is limited when it is nil
+	RateLimiter *ratelimit.Limiter
+	RateLimits RateLimitConfig
+	// SessionStore is where sessions are kept, SessionStorePostgres or SessionStoreMemory
+	SessionStore string
 }
 
+// The places sessions can be kept. Sessions in memory are lost on a restart and can't be shared
+// between instances, or listed and revoked.
+const (
+	SessionStorePostgres = "postgres"
+	SessionStoreMemory   = "memory"
+)
+
 type MailConfig struct {
     Host       string
     Port       int
@@ -28,4 +58,32 @@ type MailConfig struct {
     Encryption string
     FromAddress string
     FromName   string
-}
\ No newline at end of file
+}
+
+// BookingConfig holds the limits on the stays guests can book. Zero means no limit.
+type BookingConfig struct {
+	// MinStayNights is the shortest stay that can be booked
+	MinStayNights int
+	// MaxStayNights is the longest stay that can be booked
+	MaxStayNights int
+	// HorizonDays is how many days ahead of today at the property a stay can start
+	HorizonDays int
+	// HoldMinutes is how long a room is kept for a guest filling in the booking form, and then for
+	// the deposit to be paid
+	HoldMinutes int
+}
+
+// PaymentConfig holds the settings for taking deposits
+type PaymentConfig struct {
+	PublishableKey string
+	DepositPercent int
+	RefundPolicy payments.RefundPolicy
+}
+
+// RateLimitConfig holds how often each client can call the public endpoints that search for and
+// book rooms. A zero limit doesn't limit anything.
+type RateLimitConfig struct {
+	Search ratelimit.Limit
+	SearchJSON ratelimit.Limit
+	Reserve ratelimit.Limit
+}
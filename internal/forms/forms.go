@@ -3,11 +3,17 @@ package forms
 import (
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/asaskevich/govalidator"
 )
 
+// dateLayout is how dates are written in form fields
+const dateLayout = "2006-01-02"
+
 // Form creates a custom form struct and embeds a url.Values object
 type Form struct {
 	url.Values
@@ -62,3 +68,156 @@ func (f *Form) IsEmail(field string) {
 		f.Errors.Add(field, "Invalid email address")
 	}
 }
+
+// The checks below leave blank fields alone, so optional fields can use them; pair them with
+// Required for fields that must be filled in.
+
+// date returns the date in field, adding an error the first time it isn't one so the checks
+// below can be combined. ok is false for blank fields too.
+func (f *Form) date(field string) (d time.Time, ok bool) {
+	x := strings.TrimSpace(f.Get(field))
+	if x == "" {
+		return time.Time{}, false
+	}
+	d, err := time.Parse(dateLayout, x)
+	if err != nil {
+		if f.Errors.Get(field) == "" {
+			f.Errors.Add(field, "Enter a date as yyyy-mm-dd")
+		}
+		return time.Time{}, false
+	}
+	return d, true
+}
+
+// IsDate checks that a field holds a date written as yyyy-mm-dd
+func (f *Form) IsDate(field string) bool {
+	_, ok := f.date(field)
+	return ok || strings.TrimSpace(f.Get(field)) == ""
+}
+
+// DateRange checks that start and end hold dates and that end comes after start. It returns
+// false if either is blank, as the range can't be used.
+func (f *Form) DateRange(start, end string) bool {
+	from, okFrom := f.date(start)
+	to, okTo := f.date(end)
+	if !okFrom || !okTo {
+		return false
+	}
+	if !to.After(from) {
+		f.Errors.Add(end, "The departure date must be after the arrival date")
+		return false
+	}
+	return true
+}
+
+// DateNotBefore checks that the date in field is not earlier than earliest
+func (f *Form) DateNotBefore(field string, earliest time.Time) bool {
+	d, ok := f.date(field)
+	if ok && d.Before(earliest) {
+		f.Errors.Add(field, fmt.Sprintf("Choose a date from %s on", earliest.Format(dateLayout)))
+		return false
+	}
+	return true
+}
+
+// MinStay checks that the stay from start to end is at least nights long
+func (f *Form) MinStay(start, end string, nights int) bool {
+	if nights <= 1 {
+		return true
+	}
+	from, okFrom := f.date(start)
+	to, okTo := f.date(end)
+	if okFrom && okTo && to.Before(from.AddDate(0, 0, nights)) {
+		f.Errors.Add(end, fmt.Sprintf("Stays must be at least %d nights", nights))
+		return false
+	}
+	return true
+}
+
+// MaxStay checks that the stay from start to end is at most nights long. Zero means no limit.
+func (f *Form) MaxStay(start, end string, nights int) bool {
+	if nights <= 0 {
+		return true
+	}
+	from, okFrom := f.date(start)
+	to, okTo := f.date(end)
+	if okFrom && okTo && to.After(from.AddDate(0, 0, nights)) {
+		f.Errors.Add(end, fmt.Sprintf("Stays can be at most %d nights", nights))
+		return false
+	}
+	return true
+}
+
+// BookingHorizon checks that the date in field is no more than days after today, how far ahead
+// bookings are taken. Zero means no limit.
+func (f *Form) BookingHorizon(field string, today time.Time, days int) bool {
+	if days <= 0 {
+		return true
+	}
+	d, ok := f.date(field)
+	last := today.AddDate(0, 0, days)
+	if ok && d.After(last) {
+		f.Errors.Add(field, fmt.Sprintf("Bookings are taken up to %d days ahead, until %s", days, last.Format(dateLayout)))
+		return false
+	}
+	return true
+}
+
+// IntRange checks that a field holds a whole number from min to max
+func (f *Form) IntRange(field string, min, max int) bool {
+	x := strings.TrimSpace(f.Get(field))
+	if x == "" {
+		return true
+	}
+	n, err := strconv.Atoi(x)
+	if err != nil || n < min || n > max {
+		f.Errors.Add(field, fmt.Sprintf("Enter a whole number from %d to %d", min, max))
+		return false
+	}
+	return true
+}
+
+// IsPhone checks that a field holds a phone number: 7 to 15 digits, optionally starting with +
+// and grouped with spaces, dashes, dots or brackets
+func (f *Form) IsPhone(field string) bool {
+	x := strings.TrimSpace(f.Get(field))
+	if x == "" {
+		return true
+	}
+
+	digits := 0
+	for i, r := range x {
+		switch {
+		case unicode.IsDigit(r):
+			digits++
+		case r == '+' && i == 0:
+		case strings.ContainsRune(" -.()", r):
+		default:
+			digits = -1
+		}
+		if digits < 0 {
+			break
+		}
+	}
+
+	if digits < 7 || digits > 15 {
+		f.Errors.Add(field, "Invalid phone number")
+		return false
+	}
+	return true
+}
+
+// In checks that a field holds one of allowed
+func (f *Form) In(field string, allowed ...string) bool {
+	x := f.Get(field)
+	if x == "" {
+		return true
+	}
+	for _, a := range allowed {
+		if x == a {
+			return true
+		}
+	}
+	f.Errors.Add(field, "Choose one of the options given")
+	return false
+}
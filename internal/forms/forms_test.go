@@ -5,6 +5,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func TestForm_Valid(t *testing.T) {
@@ -130,4 +131,135 @@ func TestForm_IsEmail(t *testing.T) {
 	}
 }
 
-*/
\ No newline at end of file
+*/
+
+func TestForm_DateChecks(t *testing.T) {
+	today := time.Date(2050, 1, 13, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		start      string
+		end        string
+		errorField string
+	}{
+		{"valid", "2050-01-13", "2050-01-15", ""},
+		{"blank", "", "", ""},
+		{"bad start", "13/01/2050", "2050-01-15", "start"},
+		{"bad end", "2050-01-13", "2050-02-30", "end"},
+		{"same day", "2050-01-13", "2050-01-13", "end"},
+		{"end before start", "2050-01-15", "2050-01-13", "end"},
+		{"in the past", "2050-01-12", "2050-01-15", "start"},
+		{"longest stay", "2050-01-13", "2050-02-12", ""},
+		{"too long", "2050-01-13", "2050-02-13", "end"},
+		{"last bookable day", "2051-01-13", "2051-01-14", ""},
+		{"beyond the horizon", "2051-01-14", "2051-01-15", "start"},
+	}
+
+	for _, e := range tests {
+		form := New(url.Values{"start": {e.start}, "end": {e.end}})
+		if form.DateRange("start", "end") {
+			form.DateNotBefore("start", today)
+			form.MaxStay("start", "end", 30)
+			form.BookingHorizon("start", today, 365)
+		}
+
+		if e.errorField == "" {
+			if !form.Valid() {
+				t.Errorf("%s: expected no errors, got %v", e.name, form.Errors)
+			}
+			continue
+		}
+		if form.Errors.Get(e.errorField) == "" {
+			t.Errorf("%s: expected an error on %s, got %v", e.name, e.errorField, form.Errors)
+		}
+	}
+}
+
+func TestForm_MinStay(t *testing.T) {
+	tests := []struct {
+		name   string
+		end    string
+		nights int
+		valid  bool
+	}{
+		{"shortest stay", "2050-01-15", 2, true},
+		{"too short", "2050-01-14", 2, false},
+		{"no minimum", "2050-01-14", 0, true},
+		{"blank", "", 2, true},
+	}
+
+	for _, e := range tests {
+		form := New(url.Values{"start": {"2050-01-13"}, "end": {e.end}})
+		if got := form.MinStay("start", "end", e.nights); got != e.valid {
+			t.Errorf("%s: expected %v, got %v", e.name, e.valid, got)
+		}
+		if !e.valid && form.Errors.Get("end") != "Stays must be at least 2 nights" {
+			t.Errorf("%s: expected the error on end, got %v", e.name, form.Errors)
+		}
+	}
+}
+
+func TestForm_IsDate(t *testing.T) {
+	form := New(url.Values{"a": {"2050-01-13"}, "b": {"tomorrow"}})
+
+	if !form.IsDate("a") || !form.IsDate("blank") {
+		t.Error("expected a date and a blank field to pass")
+	}
+	if form.IsDate("b") || form.IsDate("b") {
+		t.Error("expected a word to fail")
+	}
+	if len(form.Errors["b"]) != 1 {
+		t.Errorf("expected one error for a bad date however often it is checked, got %v", form.Errors["b"])
+	}
+}
+
+func TestForm_IntRange(t *testing.T) {
+	tests := map[string]bool{
+		"":    true,
+		"1":   true,
+		"10":  true,
+		"0":   false,
+		"11":  false,
+		"2.5": false,
+		"two": false,
+	}
+
+	for value, valid := range tests {
+		form := New(url.Values{"guests": {value}})
+		if got := form.IntRange("guests", 1, 10); got != valid || form.Valid() != valid {
+			t.Errorf("IntRange(%q): expected %v, got %v", value, valid, got)
+		}
+	}
+}
+
+func TestForm_IsPhone(t *testing.T) {
+	tests := map[string]bool{
+		"":                   true,
+		"123456789":          true,
+		"+44 20 7946 0958":   true,
+		"(555) 555-5555":     true,
+		"555.555.5555":       true,
+		"12345":              false,
+		"1234567890123456":   false,
+		"555-CALL-NOW":       false,
+		"44+ 20 7946 0958":   false,
+	}
+
+	for value, valid := range tests {
+		form := New(url.Values{"phone": {value}})
+		if got := form.IsPhone("phone"); got != valid || form.Valid() != valid {
+			t.Errorf("IsPhone(%q): expected %v, got %v", value, valid, got)
+		}
+	}
+}
+
+func TestForm_In(t *testing.T) {
+	form := New(url.Values{"kind": {"fee"}, "basis": {"both"}})
+
+	if !form.In("kind", "tax", "fee") || !form.In("blank", "tax", "fee") {
+		t.Error("expected a listed value and a blank field to pass")
+	}
+	if form.In("basis", "flat", "percent") || form.Errors.Get("basis") == "" {
+		t.Error("expected a value not in the set to fail")
+	}
+}
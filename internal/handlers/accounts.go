@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/forms"
+	"github.com/ashparshp/bookings/internal/helpers"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/render"
+	"github.com/ashparshp/bookings/internal/repository"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// guestLinkLifetime is how long a guest sign in link can be used for
+const guestLinkLifetime = 30 * time.Minute
+
+// guestTokenHash returns the hash of a sign in link token, which is all the database stores
+func guestTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sendGuestLink emails a guest a link that signs them in. passwordHash is set for links that
+// confirm a sign up, and becomes the guest's password when the link is used. The link points at
+// the configured site URL, never at the Host of the request, which the client controls.
+func (m *Repository) sendGuestLink(guestID int, email, passwordHash, subject string) error {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	err := m.DB.InsertGuestToken(guestID, guestTokenHash(token), passwordHash, time.Now().Add(guestLinkLifetime))
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/guest/verify/%s", m.App.SiteURL, token)
+	htmlMessage := fmt.Sprintf(`
+	<strong>%s</strong><br>
+	Use the link below to sign in to your account. It can be used once, within %d minutes.<br>
+	<a href="%s">%s</a><br>
+	If you didn't ask for this, you can ignore this email.
+	`, subject, int(guestLinkLifetime.Minutes()), link, link)
+
+	m.App.MailChan <- models.MailData{
+		To:       email,
+		From:     m.App.MailConfig.FromAddress,
+		Subject:  subject,
+		Content:  htmlMessage,
+		Template: "basic.html",
+	}
+
+	return nil
+}
+
+// signGuestIn starts a guest session, ending any staff session in the same browser
+func (m *Repository) signGuestIn(r *http.Request, guestID int) {
+	_ = m.App.Session.RenewToken(r.Context())
+	m.App.Session.Remove(r.Context(), "user_id")
+	m.App.Session.Put(r.Context(), "guest_id", guestID)
+}
+
+// GuestSignupPage shows the guest sign up form
+func (m *Repository) GuestSignupPage(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "guest-signup.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+		Data: map[string]interface{}{"guest": models.Guest{}},
+	})
+}
+
+// PostGuestSignupPage creates a guest account, or claims the guest record left by earlier
+// bookings, once the guest confirms their email address from the link we send
+func (m *Repository) PostGuestSignupPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	guest := models.Guest{
+		FirstName: strings.TrimSpace(r.Form.Get("first_name")),
+		LastName:  strings.TrimSpace(r.Form.Get("last_name")),
+		Email:     strings.TrimSpace(r.Form.Get("email")),
+		Phone:     strings.TrimSpace(r.Form.Get("phone")),
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email", "password")
+	form.IsEmail("email")
+	form.MinLength("password", 8)
+	if !form.Valid() {
+		render.Template(w, r, "guest-signup.page.tmpl", &models.TemplateData{
+			Form: form,
+			Data: map[string]interface{}{"guest": guest},
+		})
+		return
+	}
+
+	existing, err := m.DB.GetGuestByEmail(guest.Email)
+	switch {
+	case err == nil && existing.HasAccount:
+		form.Errors.Add("email", "There is already an account for this email address, please sign in")
+		render.Template(w, r, "guest-signup.page.tmpl", &models.TemplateData{
+			Form: form,
+			Data: map[string]interface{}{"guest": guest},
+		})
+		return
+	case err == nil:
+		guest.ID = existing.ID
+	case errors.Is(err, sql.ErrNoRows):
+		guest.ID, err = m.db(r).InsertGuest(guest)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	default:
+		helpers.ServerError(w, err)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(r.Form.Get("password")), 12)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.sendGuestLink(guest.ID, guest.Email, string(hashedPassword), "Confirm your account")
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("We've sent a link to %s, use it to confirm your account", guest.Email))
+	http.Redirect(w, r, "/guest/login", http.StatusSeeOther)
+}
+
+// GuestLoginPage shows the guest sign in form
+func (m *Repository) GuestLoginPage(w http.ResponseWriter, r *http.Request) {
+	render.Template(w, r, "guest-login.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostGuestLoginPage signs a guest in with their email and password
+func (m *Repository) PostGuestLoginPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email", "password")
+	form.IsEmail("email")
+	if !form.Valid() {
+		render.Template(w, r, "guest-login.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	id, err := m.DB.AuthenticateGuest(r.Form.Get("email"), r.Form.Get("password"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
+		http.Redirect(w, r, "/guest/login", http.StatusSeeOther)
+		return
+	}
+
+	m.signGuestIn(r, id)
+	m.App.Session.Put(r.Context(), "flash", "Signed in successfully")
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// PostGuestMagicLinkPage emails a sign in link to a guest. The response is the same whether
+// or not the address belongs to a guest, so it can't be used to find out who has stayed.
+func (m *Repository) PostGuestMagicLinkPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		render.Template(w, r, "guest-login.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	email := r.Form.Get("email")
+	guest, err := m.DB.GetGuestByEmail(email)
+	if err == nil {
+		err = m.sendGuestLink(guest.ID, guest.Email, "", "Your sign in link")
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		m.App.ErrorLog.Println("Error sending guest sign in link:", err)
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("If %s has booked with us, a sign in link is on its way", email))
+	http.Redirect(w, r, "/guest/login", http.StatusSeeOther)
+}
+
+// GuestVerifyPage signs a guest in from an emailed link
+func (m *Repository) GuestVerifyPage(w http.ResponseWriter, r *http.Request) {
+	id, err := m.DB.ConsumeGuestToken(guestTokenHash(chi.URLParam(r, "token")))
+	if errors.Is(err, repository.ErrInvalidToken) {
+		m.App.Session.Put(r.Context(), "error", "That link is invalid or has expired, please ask for a new one")
+		http.Redirect(w, r, "/guest/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.signGuestIn(r, id)
+	m.App.Session.Put(r.Context(), "flash", "Signed in successfully")
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// GuestLogoutPage signs a guest out
+func (m *Repository) GuestLogoutPage(w http.ResponseWriter, r *http.Request) {
+	_ = m.App.Session.Destroy(r.Context())
+	_ = m.App.Session.RenewToken(r.Context())
+	m.App.Session.Put(r.Context(), "flash", "Signed out successfully")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// GuestAccountPage shows a signed in guest their upcoming and past reservations
+func (m *Repository) GuestAccountPage(w http.ResponseWriter, r *http.Request) {
+	guestID := m.App.Session.GetInt(r.Context(), "guest_id")
+
+	guest, err := m.DB.GetGuestByID(guestID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	reservations, err := m.DB.GetReservationsForGuest(guestID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	today := propertyToday(r)
+	var upcoming, past []models.Reservation
+	for _, res := range reservations {
+		if !res.DeletedAt.IsZero() {
+			continue
+		}
+		if res.EndDate.Before(today) {
+			past = append(past, res)
+		} else {
+			// reservations come newest first, upcoming ones read better soonest first
+			upcoming = append([]models.Reservation{res}, upcoming...)
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["guest"] = guest
+	data["upcoming"] = upcoming
+	data["past"] = past
+
+	render.Template(w, r, "account.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/helpers"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/render"
+	"github.com/ashparshp/bookings/internal/repository"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// auditActor returns who the audit log records the changes made for r as made by
+func (m *Repository) auditActor(r *http.Request) models.AuditActor {
+	actor := models.AuditActor{
+		UserID:     m.App.Session.GetInt(r.Context(), "user_id"),
+		Actor:      "guest",
+		IPAddress:  clientIP(r),
+		RequestID:  middleware.GetReqID(r.Context()),
+		PropertyID: helpers.CurrentProperty(r).ID,
+	}
+	if actor.UserID > 0 {
+		actor.Actor = "staff"
+	}
+	return actor
+}
+
+// db returns the repository to make the changes for r through, so the audit log records who
+// made them. Changes made through m.DB are recorded as made by the system.
+func (m *Repository) db(r *http.Request) repository.DatabaseRepo {
+	return m.DB.As(m.auditActor(r))
+}
+
+// clientIP returns the address of the client that made the request, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// AdminAuditLogPage shows the audit log of the selected property, filtered by the search form.
+// Owners also see the changes that apply to every property, such as those to staff accounts.
+func (m *Repository) AdminAuditLogPage(w http.ResponseWriter, r *http.Request) {
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	q := r.URL.Query()
+	layout := "2006-01-02"
+
+	filter := models.AuditFilter{
+		Query:      strings.TrimSpace(q.Get("q")),
+		Action:     q.Get("action"),
+		EntityType: q.Get("entity_type"),
+		PropertyID: helpers.CurrentProperty(r).ID,
+		Unscoped:   user.IsOwner(),
+	}
+
+	if id, err := strconv.Atoi(q.Get("entity_id")); err == nil {
+		filter.EntityID = id
+	}
+	if from, err := time.Parse(layout, q.Get("from")); err == nil {
+		filter.From = from
+	}
+	// the to date is inclusive on the form
+	if to, err := time.Parse(layout, q.Get("to")); err == nil {
+		filter.To = to.AddDate(0, 0, 1)
+	}
+
+	entries, err := m.DB.SearchAuditEntries(filter)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	stringMap := make(map[string]string)
+	for _, k := range []string{"q", "action", "entity_type", "entity_id", "from", "to"} {
+		stringMap[k] = q.Get(k)
+	}
+
+	data := make(map[string]interface{})
+	data["entries"] = entries
+	data["actions"] = []string{models.AuditCreate, models.AuditUpdate, models.AuditDelete, models.AuditStatus,
+		models.AuditMove, models.AuditRestore, models.AuditPurge, models.AuditMerge, models.AuditRefund, models.AuditUnlock,
+		models.AuditRevoke}
+	data["entity_types"] = []string{models.EntityReservation, models.EntityRoomRestriction, models.EntityBlock,
+		models.EntityRestriction, models.EntityGuest, models.EntityPayment, models.EntityChargeRule,
+		models.EntityPromoCode, models.EntityProperty, models.EntityWaitlistEntry, models.EntityChannel,
+		models.EntityWebhook, models.EntityUser, models.EntitySettings, models.EntityInvoice, models.EntityRoomHold}
+
+	render.Template(w, r, "admin-audit-log.page.tmpl", &models.TemplateData{
+		StringMap: stringMap,
+		Data:      data,
+	})
+}
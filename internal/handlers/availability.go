@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/forms"
+	"github.com/ashparshp/bookings/internal/helpers"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/render"
+	"github.com/go-chi/chi/v5"
+)
+
+// calendarMonths is the most months the room calendar is sent at once
+const calendarMonths = 3
+
+// calendarDay is one day of a room's availability calendar
+type calendarDay struct {
+	Date models.Date `json:"date"`
+	// Available is whether the night starting on the day can be booked
+	Available bool `json:"available"`
+	Arrival   bool `json:"arrival"`
+	Departure bool `json:"departure"`
+	Price     int  `json:"price"`
+	// PriceLabel is the nightly price as shown to guests
+	PriceLabel string `json:"price_label"`
+}
+
+// calendarResponse is a room's availability and prices for the days of one or more months
+type calendarResponse struct {
+	OK       bool              `json:"ok"`
+	Message  string            `json:"message,omitempty"`
+	Errors   map[string]string `json:"errors,omitempty"`
+	RoomID   int               `json:"room_id"`
+	RoomName string            `json:"room_name"`
+	Currency string            `json:"currency"`
+	MinStay  int               `json:"min_stay"`
+	MaxStay  int               `json:"max_stay"`
+	Today    models.Date       `json:"today"`
+	// LastArrival is the last day a stay can start, or null when there is no limit
+	LastArrival models.Date   `json:"last_arrival"`
+	Days        []calendarDay `json:"days"`
+}
+
+// RoomCalendarJSON sends the availability and nightly price of a room for each day of the
+// months asked for, month as yyyy-mm (this month when blank) and months how many from it
+func (m *Repository) RoomCalendarJSON(w http.ResponseWriter, r *http.Request) {
+	property := helpers.CurrentProperty(r)
+
+	roomID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	var room models.Room
+	if err == nil {
+		room, err = m.DB.GetRoomByID(roomID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+	if err != nil || room.PropertyID != property.ID {
+		writeCalendar(w, http.StatusNotFound, calendarResponse{Message: "Room not found"})
+		return
+	}
+
+	today := propertyToday(r)
+
+	q := r.URL.Query()
+	if q.Get("month") == "" {
+		q.Set("month", today.Format("2006-01"))
+	}
+	if q.Get("months") == "" {
+		q.Set("months", "1")
+	}
+
+	form := forms.New(q)
+	month, err := time.Parse("2006-01", q.Get("month"))
+	if err != nil {
+		form.Errors.Add("month", "Enter a month as yyyy-mm")
+	}
+	form.IntRange("months", 1, calendarMonths)
+	if !form.Valid() {
+		resp := calendarResponse{Errors: make(map[string]string)}
+		for _, field := range []string{"month", "months"} {
+			if msg := form.Errors.Get(field); msg != "" {
+				resp.Errors[field] = msg
+				if resp.Message == "" {
+					resp.Message = msg
+				}
+			}
+		}
+		writeCalendar(w, http.StatusUnprocessableEntity, resp)
+		return
+	}
+
+	months, _ := strconv.Atoi(q.Get("months"))
+	from := models.DateOf(month)
+	to := from.AddDate(0, months, 0)
+
+	grid, err := m.DB.RoomNights(from, to, property.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	resp := calendarResponse{
+		OK:       true,
+		RoomID:   room.ID,
+		RoomName: room.RoomName,
+		Currency: property.Currency,
+		MinStay:  m.App.BookingConfig.MinStayNights,
+		MaxStay:  m.App.BookingConfig.MaxStayNights,
+		Today:    today,
+		Days:     []calendarDay{},
+	}
+	if days := m.App.BookingConfig.HorizonDays; days > 0 {
+		resp.LastArrival = today.AddDate(0, 0, days)
+	}
+
+	for _, n := range grid {
+		if n.Room.ID != room.ID || !n.Date.Before(to) {
+			continue
+		}
+
+		// nights already past can't be booked, and stays can only start up to the horizon
+		available := n.Free && !n.Date.Before(today)
+		arrival := available && !n.ClosedToArrival && (resp.LastArrival.IsZero() || !n.Date.After(resp.LastArrival))
+
+		resp.Days = append(resp.Days, calendarDay{
+			Date:      n.Date,
+			Available: available,
+			Arrival:   arrival,
+			Departure: n.Date.After(today) && !n.ClosedToDeparture,
+			Price:     room.Price,
+			PriceLabel: render.FormatMoney(room.Price, property.Currency),
+		})
+	}
+
+	writeCalendar(w, http.StatusOK, resp)
+}
+
+// writeCalendar sends resp as JSON with status
+func writeCalendar(w http.ResponseWriter, status int, resp calendarResponse) {
+	out, err := json.MarshalIndent(resp, "", "     ")
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
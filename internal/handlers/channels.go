@@ -0,0 +1,568 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/channels"
+	"github.com/ashparshp/bookings/internal/forms"
+	"github.com/ashparshp/bookings/internal/helpers"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/render"
+	"github.com/ashparshp/bookings/internal/repository"
+	"github.com/go-chi/chi/v5"
+)
+
+// channelPullOverlap is how far before the last pull bookings are asked for again, so a booking
+// changed on the channel while a pull was running isn't missed. Bookings seen before are
+// recognised by their channel ID, so pulling them twice does no harm.
+const channelPullOverlap = 10 * time.Minute
+
+// channelPushDays is how many days of availability are pushed when there is no booking horizon
+const channelPushDays = 365
+
+// channelLogLimit is how many sync log entries are shown for a channel
+const channelLogLimit = 100
+
+// channelSyncResult counts what a sync of a channel did
+type channelSyncResult struct {
+	Nights    int
+	Imported  int
+	Modified  int
+	Cancelled int
+	Conflicts int
+	Errors    int
+}
+
+// SyncChannels pulls the bookings from and pushes availability to the active channels of every
+// property. It is run regularly, as channels don't tell us when guests book.
+func (m *Repository) SyncChannels() {
+	properties, err := m.DB.AllProperties()
+	if err != nil {
+		m.App.ErrorLog.Println("Error retrieving properties:", err)
+		return
+	}
+
+	for _, property := range properties {
+		chans, err := m.DB.AllChannels(property.ID)
+		if err != nil {
+			m.App.ErrorLog.Println("Error retrieving channels:", err)
+			continue
+		}
+		for _, ch := range chans {
+			if ch.Active {
+				m.syncChannel(property, ch)
+			}
+		}
+	}
+}
+
+// syncChannel pulls a channel's bookings and then pushes the property's availability to it, so
+// the nights just booked there are closed on it straight away
+func (m *Repository) syncChannel(property models.Property, ch models.Channel) channelSyncResult {
+	var result channelSyncResult
+
+	adapter, err := m.App.Channels.Adapter(ch)
+	if err != nil {
+		m.channelLog(ch.ID, models.SyncPull, models.SyncError, "", err.Error())
+		result.Errors++
+		return result
+	}
+
+	m.pullChannel(property, ch, adapter, &result)
+	m.pushChannel(property, ch, adapter, &result)
+
+	if result.Imported+result.Modified+result.Cancelled+result.Conflicts+result.Errors > 0 {
+		m.App.InfoLog.Printf("Synced %s: %d imported, %d changed, %d cancelled, %d conflicts, %d errors", ch.Name,
+			result.Imported, result.Modified, result.Cancelled, result.Conflicts, result.Errors)
+	}
+	return result
+}
+
+// pullChannel applies the bookings changed on a channel since it was last pulled. The time of
+// the pull is only recorded when every booking was applied, so failed ones are tried again.
+func (m *Repository) pullChannel(property models.Property, ch models.Channel, adapter channels.Adapter, result *channelSyncResult) {
+	started := time.Now()
+	since := ch.LastPulledAt
+	if !since.IsZero() {
+		since = since.Add(-channelPullOverlap)
+	}
+
+	bookings, err := adapter.PullBookings(since)
+	if err != nil {
+		m.channelLog(ch.ID, models.SyncPull, models.SyncError, "", err.Error())
+		result.Errors++
+		return
+	}
+
+	failed := false
+	for _, b := range bookings {
+		err := m.applyChannelBooking(property, ch, b, result)
+		if err != nil {
+			m.channelLog(ch.ID, models.SyncPull, models.SyncError, b.ExternalID, err.Error())
+			result.Errors++
+			failed = true
+		}
+	}
+
+	if !failed {
+		err = m.DB.SetChannelPulledAt(ch.ID, started)
+		if err != nil {
+			m.App.ErrorLog.Println("Error recording channel pull:", err)
+		}
+	}
+}
+
+// applyChannelBooking imports, changes or cancels the reservation for a booking on a channel
+// to match what the channel reports
+func (m *Repository) applyChannelBooking(property models.Property, ch models.Channel, b channels.Booking, result *channelSyncResult) error {
+	existing, err := m.DB.GetChannelBooking(ch.ID, b.ExternalID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	found := err == nil
+
+	switch {
+	case b.Status == channels.BookingCancelled:
+		return m.cancelChannelBooking(property, ch, b, existing, found, result)
+	case b.Status != channels.BookingConfirmed:
+		if found {
+			return nil
+		}
+		return m.channelConflict(property, ch, b, 0, fmt.Sprintf("The channel reported the booking as %q", b.Status), result)
+	case !found:
+		return m.importChannelBooking(property, ch, b, result)
+	case existing.Status == models.ChannelBookingImported:
+		return m.modifyChannelBooking(property, ch, b, existing, result)
+	default:
+		// bookings that were cancelled or couldn't be honoured are left to staff
+		return nil
+	}
+}
+
+// importChannelBooking makes a confirmed reservation for a new booking on a channel
+func (m *Repository) importChannelBooking(property models.Property, ch models.Channel, b channels.Booking, result *channelSyncResult) error {
+	roomID := ch.RoomFor(b.ExternalRoomID)
+	if roomID == 0 {
+		return m.channelConflict(property, ch, b, 0, fmt.Sprintf("No room is mapped to the channel's room %q", b.ExternalRoomID), result)
+	}
+	if b.StartDate.IsZero() || !b.StartDate.Before(b.EndDate) {
+		return m.channelConflict(property, ch, b, 0, "The booking's departure isn't after its arrival", result)
+	}
+
+	res := models.Reservation{
+		FirstName: b.FirstName,
+		LastName:  b.LastName,
+		Email:     b.Email,
+		Phone:     b.Phone,
+		StartDate: b.StartDate,
+		EndDate:   b.EndDate,
+		RoomID:    roomID,
+		Guests:    b.Guests,
+	}
+
+	id, err := m.DB.ImportChannelReservation(ch.ID, b.ExternalID, res)
+	if errors.Is(err, repository.ErrChannelBookingExists) {
+		// another sync got to it first
+		return nil
+	}
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		return m.channelConflict(property, ch, b, 0, "The room is already taken for some of those nights", result)
+	}
+	if err != nil {
+		return err
+	}
+
+	result.Imported++
+	m.channelLog(ch.ID, models.SyncPull, models.SyncOK, b.ExternalID,
+		fmt.Sprintf("Imported as reservation %d for %s to %s", id, b.StartDate, b.EndDate))
+
+	res.ID = id
+	res.Status = models.StatusConfirmed
+	m.reservationWebhook(property.ID, models.EventReservationCreated, res)
+	return nil
+}
+
+// modifyChannelBooking moves the reservation for a booking to the room and dates the channel
+// now has for it
+func (m *Repository) modifyChannelBooking(property models.Property, ch models.Channel, b channels.Booking, existing models.ChannelBooking, result *channelSyncResult) error {
+	res, err := m.DB.GetReservationByID(existing.ReservationID)
+	if err != nil {
+		return err
+	}
+
+	roomID := ch.RoomFor(b.ExternalRoomID)
+	if roomID == res.RoomID && b.StartDate.Equal(res.StartDate) && b.EndDate.Equal(res.EndDate) {
+		return nil
+	}
+	if roomID == 0 {
+		return m.channelConflict(property, ch, b, res.ID, fmt.Sprintf("No room is mapped to the channel's room %q", b.ExternalRoomID), result)
+	}
+	if b.StartDate.IsZero() || !b.StartDate.Before(b.EndDate) {
+		return m.channelConflict(property, ch, b, res.ID, "The booking's departure isn't after its arrival", result)
+	}
+
+	err = m.DB.MoveReservation(models.ReservationChange{
+		ReservationID: res.ID,
+		NewRoomID:     roomID,
+		NewStartDate:  b.StartDate,
+		NewEndDate:    b.EndDate,
+	})
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		return m.channelConflict(property, ch, b, res.ID,
+			fmt.Sprintf("Reservation %d can't be moved to the new room or dates, they are already taken", res.ID), result)
+	}
+	if errors.Is(err, repository.ErrReservationReleased) {
+		return m.channelConflict(property, ch, b, res.ID,
+			fmt.Sprintf("Reservation %d was cancelled or marked a no-show, so it can't be moved", res.ID), result)
+	}
+	if err != nil {
+		return err
+	}
+
+	result.Modified++
+	m.channelLog(ch.ID, models.SyncPull, models.SyncOK, b.ExternalID,
+		fmt.Sprintf("Moved reservation %d to %s to %s", res.ID, b.StartDate, b.EndDate))
+
+	if roomID != res.RoomID {
+		res.Room, err = m.DB.GetRoomByID(roomID)
+		if err != nil {
+			m.App.ErrorLog.Println("Error retrieving room:", err)
+		}
+	}
+	res.RoomID = roomID
+	res.StartDate = b.StartDate
+	res.EndDate = b.EndDate
+	m.reservationWebhook(property.ID, models.EventReservationUpdated, res)
+	m.offerWaitlist(property.ID)
+	return nil
+}
+
+// cancelChannelBooking cancels the reservation for a booking cancelled on the channel. A booking
+// cancelled before it was pulled is recorded so it is never imported.
+func (m *Repository) cancelChannelBooking(property models.Property, ch models.Channel, b channels.Booking, existing models.ChannelBooking, found bool, result *channelSyncResult) error {
+	if found && existing.Status == models.ChannelBookingCancelled {
+		return nil
+	}
+
+	message := "Cancelled before it was imported"
+	var cancelled models.Reservation
+	if found && existing.ReservationID > 0 {
+		res, err := m.DB.GetReservationByID(existing.ReservationID)
+		if err != nil {
+			return err
+		}
+		err = m.DB.UpdateReservationStatus(existing.ReservationID, models.StatusCancelled)
+		if errors.Is(err, repository.ErrInvalidTransition) {
+			return m.channelConflict(property, ch, b, existing.ReservationID,
+				fmt.Sprintf("The channel cancelled reservation %d, which can no longer be cancelled", existing.ReservationID), result)
+		}
+		if err != nil {
+			return err
+		}
+		message = fmt.Sprintf("Cancelled reservation %d", existing.ReservationID)
+		cancelled = res
+		cancelled.Status = models.StatusCancelled
+	}
+
+	err := m.DB.SaveChannelBooking(models.ChannelBooking{
+		ChannelID:     ch.ID,
+		ExternalID:    b.ExternalID,
+		ReservationID: existing.ReservationID,
+		Status:        models.ChannelBookingCancelled,
+	})
+	if err != nil {
+		return err
+	}
+
+	result.Cancelled++
+	m.channelLog(ch.ID, models.SyncPull, models.SyncOK, b.ExternalID, message)
+	if cancelled.ID > 0 {
+		m.reservationWebhook(property.ID, models.EventReservationCancelled, cancelled)
+		m.offerWaitlist(property.ID)
+	}
+	return nil
+}
+
+// channelConflict records a booking on a channel that can't be honoured as it stands and alerts
+// the property. The booking isn't looked at again until the channel cancels it, so the alert is
+// only sent once.
+func (m *Repository) channelConflict(property models.Property, ch models.Channel, b channels.Booking, reservationID int, reason string, result *channelSyncResult) error {
+	err := m.DB.SaveChannelBooking(models.ChannelBooking{
+		ChannelID:     ch.ID,
+		ExternalID:    b.ExternalID,
+		ReservationID: reservationID,
+		Status:        models.ChannelBookingConflict,
+	})
+	if err != nil {
+		return err
+	}
+
+	result.Conflicts++
+	m.channelLog(ch.ID, models.SyncPull, models.SyncConflict, b.ExternalID, reason)
+
+	// properties without their own address are notified at the sending address
+	notify := property.NotifyEmail
+	if notify == "" {
+		notify = m.App.MailConfig.FromAddress
+	}
+
+	htmlMessage := fmt.Sprintf(`
+	<strong>Booking conflict on %s</strong><br>
+	%s<br>
+	Booking %s for %s %s, room %s, from %s to %s.<br>
+	Email: %s<br>
+	Phone: %s<br>
+	Please find the guest another room or contact them through %s.
+	`, ch.Name, reason, b.ExternalID, b.FirstName, b.LastName, b.ExternalRoomID, b.StartDate, b.EndDate,
+		b.Email, b.Phone, ch.Name)
+
+	m.App.MailChan <- models.MailData{
+		To:       notify,
+		From:     m.App.MailConfig.FromAddress,
+		Subject:  "Booking conflict on " + ch.Name,
+		Content:  htmlMessage,
+		Template: "basic.html",
+	}
+
+	return nil
+}
+
+// pushChannel sends a channel the availability and prices of the rooms sold on it, from today
+// at the property to the booking horizon
+func (m *Repository) pushChannel(property models.Property, ch models.Channel, adapter channels.Adapter, result *channelSyncResult) {
+	days := m.App.BookingConfig.HorizonDays
+	if days <= 0 {
+		days = channelPushDays
+	}
+	today := models.Today(property.Location())
+
+	grid, err := m.DB.RoomNights(today, today.AddDate(0, 0, days), property.ID)
+	if err != nil {
+		m.channelLog(ch.ID, models.SyncPush, models.SyncError, "", err.Error())
+		result.Errors++
+		return
+	}
+
+	rates := channels.Rates(ch, grid)
+	if len(rates) == 0 {
+		return
+	}
+
+	err = adapter.PushAvailability(rates)
+	if err != nil {
+		m.channelLog(ch.ID, models.SyncPush, models.SyncError, "", err.Error())
+		result.Errors++
+		return
+	}
+
+	result.Nights = len(rates)
+	m.channelLog(ch.ID, models.SyncPush, models.SyncOK, "", fmt.Sprintf("Sent %d nights", len(rates)))
+}
+
+// channelLog adds an entry to a channel's sync log
+func (m *Repository) channelLog(channelID int, direction, status, externalID, message string) {
+	err := m.DB.InsertChannelSyncLog(models.ChannelSyncLog{
+		ChannelID:  channelID,
+		Direction:  direction,
+		Status:     status,
+		ExternalID: externalID,
+		Message:    message,
+	})
+	if err != nil {
+		m.App.ErrorLog.Println("Error writing channel sync log:", err)
+	}
+}
+
+// AdminChannelsPage lists the channels of the property being managed
+func (m *Repository) AdminChannelsPage(w http.ResponseWriter, r *http.Request) {
+	chans, err := m.DB.AllChannels(helpers.CurrentProperty(r).ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["channels"] = chans
+
+	render.Template(w, r, "admin-channels.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// adminChannel returns the channel in the URL, or a new one for ID 0, redirecting back to the
+// channels with an error when it can't be found or managed
+func (m *Repository) adminChannel(w http.ResponseWriter, r *http.Request) (models.Channel, bool) {
+	kinds := m.App.Channels.Kinds()
+	ch := models.Channel{PropertyID: helpers.CurrentProperty(r).ID, Active: true}
+	if len(kinds) > 0 {
+		ch.Kind = kinds[0]
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err == nil && id > 0 {
+		ch, err = m.DB.GetChannelByID(id)
+	}
+	if err != nil || !canManage(r, ch.PropertyID) {
+		m.App.Session.Put(r.Context(), "error", "Channel not found")
+		http.Redirect(w, r, "/admin/channels", http.StatusSeeOther)
+		return ch, false
+	}
+	return ch, true
+}
+
+// AdminShowChannelPage shows the settings and sync log of a channel, or the form for a new one
+func (m *Repository) AdminShowChannelPage(w http.ResponseWriter, r *http.Request) {
+	ch, ok := m.adminChannel(w, r)
+	if !ok {
+		return
+	}
+
+	m.renderChannel(w, r, ch, forms.New(nil))
+}
+
+// renderChannel renders the channel form with the property's rooms and the channel's sync log
+func (m *Repository) renderChannel(w http.ResponseWriter, r *http.Request, ch models.Channel, form *forms.Form) {
+	rooms, err := m.DB.AllRooms(ch.PropertyID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["channel"] = ch
+	data["rooms"] = rooms
+	data["kinds"] = m.App.Channels.Kinds()
+
+	if ch.ID > 0 {
+		logs, err := m.DB.GetChannelSyncLogs(ch.ID, channelLogLimit)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		data["logs"] = logs
+	}
+
+	if !form.Valid() {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	render.Template(w, r, "admin-channel.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// AdminPostChannelPage saves a new or edited channel and the rooms sold on it
+func (m *Repository) AdminPostChannelPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	before, ok := m.adminChannel(w, r)
+	if !ok {
+		return
+	}
+
+	rooms, err := m.DB.AllRooms(before.PropertyID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	ch := models.Channel{
+		ID:         before.ID,
+		PropertyID: before.PropertyID,
+		Name:       strings.TrimSpace(r.Form.Get("name")),
+		Kind:       r.Form.Get("kind"),
+		BaseURL:    strings.TrimSpace(r.Form.Get("base_url")),
+		APIKey:     strings.TrimSpace(r.Form.Get("api_key")),
+		Active:     r.Form.Get("active") != "",
+		Rooms:      make(map[int]string),
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name", "kind", "base_url")
+	form.In("kind", m.App.Channels.Kinds()...)
+	if u, err := url.Parse(ch.BaseURL); ch.BaseURL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		form.Errors.Add("base_url", "Enter the channel's address, such as https://api.example.com")
+	}
+	if ch.ID == 0 {
+		form.Required("api_key")
+	}
+
+	// each of the channel's rooms can only stand for one of ours
+	mapped := make(map[string]bool)
+	for _, room := range rooms {
+		field := fmt.Sprintf("room_%d", room.ID)
+		externalID := strings.TrimSpace(r.Form.Get(field))
+		if externalID == "" {
+			continue
+		}
+		if mapped[externalID] {
+			form.Errors.Add(field, "Another room is already mapped to this channel room")
+		}
+		mapped[externalID] = true
+		ch.Rooms[room.ID] = externalID
+	}
+
+	if !form.Valid() {
+		m.renderChannel(w, r, ch, form)
+		return
+	}
+
+	if ch.ID == 0 {
+		ch.ID, err = m.db(r).InsertChannel(ch)
+	} else {
+		err = m.db(r).UpdateChannel(ch)
+	}
+	if err != nil {
+		m.App.ErrorLog.Println("Error saving channel:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to save channel")
+		http.Redirect(w, r, "/admin/channels", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Channel saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/channels/%d/show", ch.ID), http.StatusSeeOther)
+}
+
+// AdminSyncChannelPage syncs a channel now rather than waiting for the next regular sync
+func (m *Repository) AdminSyncChannelPage(w http.ResponseWriter, r *http.Request) {
+	ch, ok := m.adminChannel(w, r)
+	if !ok {
+		return
+	}
+	if ch.ID == 0 {
+		m.App.Session.Put(r.Context(), "error", "Channel not found")
+		http.Redirect(w, r, "/admin/channels", http.StatusSeeOther)
+		return
+	}
+
+	property, err := m.DB.GetPropertyByID(ch.PropertyID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	result := m.syncChannel(property, ch)
+
+	summary := fmt.Sprintf("Synced %s: %d imported, %d changed, %d cancelled, %d nights sent", ch.Name,
+		result.Imported, result.Modified, result.Cancelled, result.Nights)
+	switch {
+	case result.Errors > 0:
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("%s, but %d steps failed. See the sync log.", summary, result.Errors))
+	case result.Conflicts > 0:
+		m.App.Session.Put(r.Context(), "warning", fmt.Sprintf("%s. %d bookings conflict and need sorting out, see the sync log.", summary, result.Conflicts))
+	default:
+		m.App.Session.Put(r.Context(), "flash", summary)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/channels/%d/show", ch.ID), http.StatusSeeOther)
+}
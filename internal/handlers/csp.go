@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// cspViolation is the part of a Content-Security-Policy violation report worth logging
+type cspViolation struct {
+	DocumentURL string
+	Directive string
+	BlockedURL string
+	SourceFile string
+	Line int
+}
+
+// legacyCSPReport is a report sent for the report-uri directive
+type legacyCSPReport struct {
+	Report struct {
+		DocumentURI string `json:"document-uri"`
+		ViolatedDirective string `json:"violated-directive"`
+		EffectiveDirective string `json:"effective-directive"`
+		BlockedURI string `json:"blocked-uri"`
+		SourceFile string `json:"source-file"`
+		LineNumber int `json:"line-number"`
+	} `json:"csp-report"`
+}
+
+// reportingAPIReport is a report sent for the report-to directive, which comes in a list
+type reportingAPIReport struct {
+	Type string `json:"type"`
+	Body struct {
+		DocumentURL string `json:"documentURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		BlockedURL string `json:"blockedURL"`
+		SourceFile string `json:"sourceFile"`
+		LineNumber int `json:"lineNumber"`
+	} `json:"body"`
+}
+
+// parseCSPReport reads the violations in a report in either format browsers send
+func parseCSPReport(payload []byte) ([]cspViolation, error) {
+	var reports []reportingAPIReport
+	if err := json.Unmarshal(payload, &reports); err == nil {
+		var violations []cspViolation
+		for _, rep := range reports {
+			if rep.Type != "csp-violation" {
+				continue
+			}
+			violations = append(violations, cspViolation{
+				DocumentURL: rep.Body.DocumentURL,
+				Directive:   rep.Body.EffectiveDirective,
+				BlockedURL:  rep.Body.BlockedURL,
+				SourceFile:  rep.Body.SourceFile,
+				Line:        rep.Body.LineNumber,
+			})
+		}
+		return violations, nil
+	}
+
+	var legacy legacyCSPReport
+	if err := json.Unmarshal(payload, &legacy); err != nil {
+		return nil, err
+	}
+	directive := legacy.Report.EffectiveDirective
+	if directive == "" {
+		directive = legacy.Report.ViolatedDirective
+	}
+	return []cspViolation{{
+		DocumentURL: legacy.Report.DocumentURI,
+		Directive:   directive,
+		BlockedURL:  legacy.Report.BlockedURI,
+		SourceFile:  legacy.Report.SourceFile,
+		Line:        legacy.Report.LineNumber,
+	}}, nil
+}
+
+// CSPReport logs the Content-Security-Policy violations browsers report, so content the policy
+// blocks by mistake shows up in the logs
+func (m *Repository) CSPReport(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, "unable to read body", http.StatusBadRequest)
+		return
+	}
+
+	violations, err := parseCSPReport(payload)
+	if err != nil {
+		http.Error(w, "invalid report", http.StatusBadRequest)
+		return
+	}
+
+	for _, v := range violations {
+		m.App.ErrorLog.Printf("CSP violation: %s blocked %q on %s (%s:%d) from %s",
+			v.Directive, v.BlockedURL, v.DocumentURL, v.SourceFile, v.Line, clientIP(r))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/ashparshp/bookings/internal/helpers"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/render"
+)
+
+// flexibleStaysPerRoom is how many stays a flexible search shows for each room
+const flexibleStaysPerRoom = 3
+
+// alternativeShiftDays is how far either way arrival is moved looking for alternatives when
+// nothing is free for the dates searched
+const alternativeShiftDays = 3
+
+// flexDayChoices are the windows a flexible search can look either side of the arrival date
+var flexDayChoices = []string{"0", "1", "3", "7"}
+
+// stayWindow returns the arrival dates within flexDays of start that can be booked, and the
+// room nights of the property from the first of them to the last departure
+func (m *Repository) stayWindow(r *http.Request, start models.Date, nights, flexDays int) ([]models.RoomNight, models.Date, models.Date, error) {
+	today := propertyToday(r)
+
+	earliest := start.AddDate(0, 0, -flexDays)
+	if earliest.Before(today) {
+		earliest = today
+	}
+	latest := start.AddDate(0, 0, flexDays)
+	if days := m.App.BookingConfig.HorizonDays; days > 0 && latest.After(today.AddDate(0, 0, days)) {
+		latest = today.AddDate(0, 0, days)
+	}
+
+	grid, err := m.DB.RoomNights(earliest, latest.AddDate(0, 0, nights), helpers.CurrentProperty(r).ID)
+	return grid, earliest, latest, err
+}
+
+// renderStayOptions shows stays guests can book instead of the one they searched for: the
+// nearest dates in each room, and a split of the stay across rooms when there is one. It
+// returns false, having written nothing, when there are none.
+func (m *Repository) renderStayOptions(w http.ResponseWriter, r *http.Request, start, end models.Date, options, split []models.StayOption, flexDays int) bool {
+	if len(options) == 0 && len(split) == 0 {
+		return false
+	}
+
+	data := make(map[string]interface{})
+	data["options"] = options
+	data["split"] = split
+	data["start"] = start
+
+	render.Template(w, r, "stay-options.page.tmpl", &models.TemplateData{
+		StringMap: map[string]string{"start": start.String(), "end": end.String()},
+		IntMap:    map[string]int{"flex_days": flexDays, "nights": start.DaysUntil(end)},
+		Data:      data,
+	})
+	return true
+}
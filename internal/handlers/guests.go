@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ashparshp/bookings/internal/forms"
+	"github.com/ashparshp/bookings/internal/helpers"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/render"
+	"github.com/ashparshp/bookings/internal/repository"
+	"github.com/go-chi/chi/v5"
+)
+
+// AdminGuestsPage lists the guests who have booked at the selected property, filtered by the
+// search box
+func (m *Repository) AdminGuestsPage(w http.ResponseWriter, r *http.Request) {
+	search := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	guests, err := m.DB.AllGuests(helpers.CurrentProperty(r).ID, search)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["guests"] = guests
+
+	stringMap := make(map[string]string)
+	stringMap["q"] = search
+
+	render.Template(w, r, "admin-guests.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// guestAccess reports whether a guest has booked at the selected property, and so can be seen
+// there, and whether the signed in staff member can manage every property the guest has booked
+// at, which merging the guest needs as it moves all of their reservations
+func (m *Repository) guestAccess(r *http.Request, guestID int) (bool, bool, error) {
+	propertyIDs, err := m.DB.GetGuestPropertyIDs(guestID)
+	if err != nil {
+		return false, false, err
+	}
+
+	atProperty, manageAll := false, true
+	for _, id := range propertyIDs {
+		if id == helpers.CurrentProperty(r).ID {
+			atProperty = true
+		}
+		if !canManage(r, id) {
+			manageAll = false
+		}
+	}
+	return atProperty, manageAll, nil
+}
+
+// AdminShowGuestPage shows a guest's details and stay history
+func (m *Repository) AdminShowGuestPage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid guest ID")
+		http.Redirect(w, r, "/admin/guests", http.StatusSeeOther)
+		return
+	}
+
+	guest, err := m.DB.GetGuestByID(id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Unable to retrieve guest")
+		http.Redirect(w, r, "/admin/guests", http.StatusSeeOther)
+		return
+	}
+	if atProperty, _, err := m.guestAccess(r, id); err != nil || !atProperty {
+		m.App.Session.Put(r.Context(), "error", "Guest not found")
+		http.Redirect(w, r, "/admin/guests", http.StatusSeeOther)
+		return
+	}
+
+	m.renderGuest(w, r, guest, forms.New(nil))
+}
+
+// renderGuest renders the guest page for guest, with its stay history at the properties the
+// signed in staff member can manage
+func (m *Repository) renderGuest(w http.ResponseWriter, r *http.Request, guest models.Guest, form *forms.Form) {
+	all, err := m.DB.GetReservationsForGuest(guest.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	var reservations []models.Reservation
+	for _, res := range all {
+		if canManage(r, res.Room.PropertyID) {
+			reservations = append(reservations, res)
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["guest"] = guest
+	data["reservations"] = reservations
+
+	stringMap := make(map[string]string)
+	stringMap["tags"] = strings.Join(guest.Tags, ", ")
+
+	render.Template(w, r, "admin-guest.page.tmpl", &models.TemplateData{
+		Data:      data,
+		StringMap: stringMap,
+		Form:      form,
+	})
+}
+
+// AdminPostGuestPage saves a guest's details, notes and tags
+func (m *Repository) AdminPostGuestPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid guest ID")
+		http.Redirect(w, r, "/admin/guests", http.StatusSeeOther)
+		return
+	}
+
+	before, err := m.DB.GetGuestByID(id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Unable to retrieve guest")
+		http.Redirect(w, r, "/admin/guests", http.StatusSeeOther)
+		return
+	}
+	if atProperty, _, err := m.guestAccess(r, id); err != nil || !atProperty {
+		m.App.Session.Put(r.Context(), "error", "Guest not found")
+		http.Redirect(w, r, "/admin/guests", http.StatusSeeOther)
+		return
+	}
+
+	guest := before
+	guest.FirstName = strings.TrimSpace(r.Form.Get("first_name"))
+	guest.LastName = strings.TrimSpace(r.Form.Get("last_name"))
+	guest.Email = strings.TrimSpace(r.Form.Get("email"))
+	guest.Phone = strings.TrimSpace(r.Form.Get("phone"))
+	guest.Notes = strings.TrimSpace(r.Form.Get("notes"))
+	guest.Tags = models.ParseTags(r.Form.Get("tags"))
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		m.renderGuest(w, r, guest, form)
+		return
+	}
+
+	err = m.db(r).UpdateGuest(guest)
+	if errors.Is(err, repository.ErrGuestExists) {
+		form.Errors.Add("email", "Another guest already has this email address, merge the two guests instead")
+		m.renderGuest(w, r, guest, form)
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println("Error saving guest:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to save guest")
+		http.Redirect(w, r, fmt.Sprintf("/admin/guests/%d/show", id), http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Guest saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/guests/%d/show", id), http.StatusSeeOther)
+}
+
+// AdminMergeGuestPage merges the posted duplicate_id guest into this one, which staff can only do
+// when they manage every property either guest has booked at
+func (m *Repository) AdminMergeGuestPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid guest ID")
+		http.Redirect(w, r, "/admin/guests", http.StatusSeeOther)
+		return
+	}
+	redirectURL := fmt.Sprintf("/admin/guests/%d/show", id)
+
+	duplicateID, err := strconv.Atoi(r.Form.Get("duplicate_id"))
+	if err != nil || duplicateID == id {
+		m.App.Session.Put(r.Context(), "error", "Choose a different guest to merge into this one")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+
+	_, err = m.DB.GetGuestByID(id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Unable to retrieve guest")
+		http.Redirect(w, r, "/admin/guests", http.StatusSeeOther)
+		return
+	}
+
+	duplicate, err := m.DB.GetGuestByID(duplicateID)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Unable to retrieve the guest to merge")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+
+	atProperty, manageAll, err := m.guestAccess(r, id)
+	if err == nil && manageAll {
+		_, manageAll, err = m.guestAccess(r, duplicateID)
+	}
+	if err != nil || !atProperty || !manageAll {
+		m.App.Session.Put(r.Context(), "error", "You can only merge guests who have only booked at properties you manage")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+
+	err = m.db(r).MergeGuests(id, duplicateID)
+	if err != nil {
+		m.App.ErrorLog.Println("Error merging guests:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to merge guests")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s %s merged into this guest", duplicate.FirstName, duplicate.LastName))
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
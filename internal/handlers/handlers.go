@@ -1,9 +1,14 @@
 package handlers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -22,6 +27,11 @@ import (
 // Repo is the repository used by the handler
 var Repo *Repository
 
+var hexColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// maxCalendarDays is the longest custom range the admin reservations calendar will show
+const maxCalendarDays = 92
+
 // Repository is the repository type
 type Repository struct {
 	App *config.AppConfig
@@ -78,6 +88,28 @@ func (m *Repository) ReservationPage (w http.ResponseWriter, r *http.Request) {
 
 	res.Room.RoomName = room.RoomName
 
+	hold, err := m.holdRoom(r, res)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, someone else has just taken that room for those dates")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// a signed in guest doesn't have to type their details again
+	if guestID := m.App.Session.GetInt(r.Context(), "guest_id"); guestID > 0 && res.Email == "" {
+		guest, err := m.DB.GetGuestByID(guestID)
+		if err == nil {
+			res.FirstName = guest.FirstName
+			res.LastName = guest.LastName
+			res.Email = guest.Email
+			res.Phone = guest.Phone
+		}
+	}
+
 	m.App.Session.Put(r.Context(), "reservation", res)
 
 	sd := res.StartDate.Format("2006-01-02")
@@ -86,6 +118,7 @@ func (m *Repository) ReservationPage (w http.ResponseWriter, r *http.Request) {
 	StringMap := (map[string]string{})
 	StringMap["start_date"] = sd
 	StringMap["end_date"] = ed
+	StringMap["hold_expires_at"] = hold.ExpiresAt.Format(time.RFC3339)
 
 	data := make(map[string]interface{})
 	data["reservation"] = res
@@ -142,6 +175,7 @@ func (m *Repository) PostReservationPage (w http.ResponseWriter, r *http.Request
 	reservation.LastName = r.Form.Get("last_name")
 	reservation.Email = r.Form.Get("email")
 	reservation.Phone = r.Form.Get("phone")
+	reservation.GuestID = m.App.Session.GetInt(r.Context(), "guest_id")
 
 	/*
 	reservation := models.Reservation{
@@ -155,52 +189,135 @@ func (m *Repository) PostReservationPage (w http.ResponseWriter, r *http.Request
 	}
 	*/
 
+	// the hold normally still stands, but if it ran out the room can be held again while it is free
+	hold, err := m.holdRoom(r, reservation)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "Sorry, your hold on the room ran out and someone else has taken it")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
 	form := forms.New(r.PostForm)
 
 	form.Required("first_name", "last_name", "email", "phone")
 	form.MinLength("first_name", 3)
 	form.IsEmail("email")
+	form.IsPhone("phone")
+
+	reservation.Guests = 1
+	if v := strings.TrimSpace(r.Form.Get("guests")); v != "" {
+		reservation.Guests, err = strconv.Atoi(v)
+		if err != nil || reservation.Guests < 1 {
+			form.Errors.Add("guests", "Enter the number of guests")
+		}
+	}
+
+	promo, err := m.promoFor(form, reservation)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
 
 	if !form.Valid() {
+		m.renderReservationForm(w, r, reservation, hold, form)
+		return
+	}
 
-		sd := reservation.StartDate.Format("2006-01-02")
-        ed := reservation.EndDate.Format("2006-01-02")
-        
-        StringMap := make(map[string]string)
-        StringMap["start_date"] = sd
-        StringMap["end_date"] = ed
+	reservation.PromoCodeID = 0
+	if promo != nil {
+		reservation.PromoCodeID = promo.ID
+	}
+	reservation.Charges, err = m.priceStay(reservation, promo)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
 
-		data := make(map[string]interface{})
-		data["reservation"] = reservation
-		render.Template(w, r, "make-reservation.page.tmpl", &models.TemplateData{
-			Form: form,
-			Data: data,
-			StringMap: StringMap,
-		})
+	// a reservation with a deposit to pay is confirmed once it is paid, and gives the room back
+	// if it isn't paid within the hold time
+	deposit, err := m.depositFor(reservation)
+	if err != nil {
+		helpers.ServerError(w, err)
 		return
 	}
+	if deposit > 0 {
+		reservation.PaymentDueAt = time.Now().Add(time.Duration(m.App.BookingConfig.HoldMinutes) * time.Minute)
+	}
 
-	newReservationID, err := m.DB.InsertReservation(reservation)
+	newReservationID, err := m.db(r).InsertReservation(reservation)
+	if errors.Is(err, models.ErrPromoUsedUp) {
+		form.Errors.Add("promo_code", err.Error())
+		m.renderReservationForm(w, r, reservation, hold, form)
+		return
+	}
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't insert reservation into database")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
+	reservation.ID = newReservationID
+	reservation.Status = models.StatusPending
 
 	restriction := models.RoomRestriction{
 		StartDate: reservation.StartDate,
 		EndDate:   reservation.EndDate,
 		RoomID:    reservation.RoomID,
 		ReservationID: newReservationID,
-		RestrictionID: 1,
+		RestrictionID: models.RestrictionReservation,
 	}
 
-	err = m.DB.InsertRoomRestriction(restriction)
+	_, err = m.db(r).InsertRoomRestriction(restriction)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "can't insert room restriction")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
+	m.reservationWebhook(helpers.CurrentProperty(r).ID, models.EventReservationCreated, reservation)
+	m.releaseHold(r)
+	m.bookedFromWaitlist(r, reservation)
+
+	if deposit > 0 {
+		m.App.Session.Put(r.Context(), "reservation", reservation)
+		http.Redirect(w, r, "/make-payment", http.StatusSeeOther)
+		return
+	}
+
+	m.sendReservationEmails(reservation)
+
+	m.App.Session.Put(r.Context(), "reservation", reservation)
+	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+}
+
+// renderReservationForm shows the reservation form again with the errors in form
+func (m *Repository) renderReservationForm(w http.ResponseWriter, r *http.Request, reservation models.Reservation, hold models.RoomHold, form *forms.Form) {
+	sd := reservation.StartDate.Format("2006-01-02")
+	ed := reservation.EndDate.Format("2006-01-02")
+
+	StringMap := make(map[string]string)
+	StringMap["start_date"] = sd
+	StringMap["end_date"] = ed
+	StringMap["hold_expires_at"] = hold.ExpiresAt.Format(time.RFC3339)
+
+	data := make(map[string]interface{})
+	data["reservation"] = reservation
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	render.Template(w, r, "make-reservation.page.tmpl", &models.TemplateData{
+		Form: form,
+		Data: data,
+		StringMap: StringMap,
+	})
+}
+
+// sendReservationEmails sends the confirmation to the guest and the notice to the property
+func (m *Repository) sendReservationEmails(reservation models.Reservation) {
+	property, err := m.roomProperty(reservation.RoomID)
+	if err != nil {
+		m.App.ErrorLog.Println("Error retrieving property for reservation", reservation.ID, err)
+	}
 
 	// send an email to the user
 	htmlMessage := fmt.Sprintf(`
@@ -216,6 +333,7 @@ func (m *Repository) PostReservationPage (w http.ResponseWriter, r *http.Request
         Subject: "Reservation Confirmation",
         Content: htmlMessage,
         Template: "basic.html",
+        Attachments: m.invoiceAttachment(reservation),
     }
 
 	m.App.MailChan <- msg
@@ -229,8 +347,14 @@ func (m *Repository) PostReservationPage (w http.ResponseWriter, r *http.Request
     Room ID: %d<br>
     `, reservation.FirstName, reservation.LastName, reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"), reservation.Email, reservation.Phone, reservation.RoomID)
     
+    // properties without their own address are notified at the sending address
+    notify := property.NotifyEmail
+    if notify == "" {
+        notify = m.App.MailConfig.FromAddress
+    }
+
     adminMsg := models.MailData{
-        To:      "ashparshp1@gmail.com",
+        To:      notify,
         From:    m.App.MailConfig.FromAddress,
         Subject: "New Reservation",
         Content: adminMessage,
@@ -238,10 +362,26 @@ func (m *Repository) PostReservationPage (w http.ResponseWriter, r *http.Request
     }
 
     m.App.MailChan <- adminMsg
+}
 
+// reservationCancelled tells connected tools and the guest that res has been cancelled, with the
+// reason given to the guest when there is one
+func (m *Repository) reservationCancelled(res models.Reservation, reason string) {
+	m.reservationWebhook(res.Room.PropertyID, models.EventReservationCancelled, res)
 
-	m.App.Session.Put(r.Context(), "reservation", reservation)
-	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+	htmlMessage := fmt.Sprintf(`
+	<strong>Reservation Cancelled</strong><br>
+	Dear %s, <br>
+	Your reservation from %s to %s has been cancelled.%s<br>
+	`, res.FirstName, res.StartDate.Format("2006-01-02"), res.EndDate.Format("2006-01-02"), reason)
+
+	m.App.MailChan <- models.MailData{
+		To:       res.Email,
+		From:     m.App.MailConfig.FromAddress,
+		Subject:  "Reservation Cancelled",
+		Content:  htmlMessage,
+		Template: "basic.html",
+	}
 }
 
 // GeneralsPage renders the room page
@@ -256,52 +396,115 @@ func (m *Repository) MajorsPage (w http.ResponseWriter, r *http.Request) {
 
 // AvailabilityPage renders the room page
 func (m *Repository) AvailabilityPage (w http.ResponseWriter, r *http.Request) {
-	render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{})
+	render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// validateStay checks the stay dates in the start and end fields of form: the departure must
+// be after the arrival, the arrival no earlier than today at the property, and the stay within
+// the booking limits. It returns the dates, which are only usable when the form is valid.
+func (m *Repository) validateStay(r *http.Request, form *forms.Form, start, end string) (models.Date, models.Date) {
+	form.Required(start, end)
+	if form.DateRange(start, end) {
+		today := propertyToday(r).Time()
+		form.DateNotBefore(start, today)
+		form.BookingHorizon(start, today, m.App.BookingConfig.HorizonDays)
+		form.MinStay(start, end, m.App.BookingConfig.MinStayNights)
+		form.MaxStay(start, end, m.App.BookingConfig.MaxStayNights)
+	}
+
+	startDate, _ := models.ParseDate(form.Get(start))
+	endDate, _ := models.ParseDate(form.Get(end))
+	return startDate, endDate
+}
+
+// renderSearchForm shows the availability search again with the errors in form
+func (m *Repository) renderSearchForm(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{
+		Form: form,
+	})
 }
 
 // PostAvailabilityPage handles post
 func (m *Repository) PostAvailabilityPage (w http.ResponseWriter, r *http.Request) {
-	start := r.Form.Get("start")
-	end := r.Form.Get("end")
-
-	layout := "2006-01-02"
-	startDate, err := time.Parse(layout, start)
+	err := r.ParseForm()
 	if err != nil {
-		helpers.ServerError(w, err)
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
 		return
 	}
 
-	endDate, err := time.Parse(layout, end)
-	if err != nil {
-		helpers.ServerError(w, err)
+	form := forms.New(r.PostForm)
+	startDate, endDate := m.validateStay(r, form, "start", "end")
+	form.In("flex_days", flexDayChoices...)
+	if !form.Valid() {
+		m.renderSearchForm(w, r, form)
 		return
 	}
+	nights := startDate.DaysUntil(endDate)
+	flexDays, _ := strconv.Atoi(form.Get("flex_days"))
 
-	rooms, err := m.DB.SearchAvailabilityForAllRooms(startDate, endDate)
+	if flexDays == 0 {
+		rooms, err := m.DB.SearchAvailabilityForAllRooms(startDate, endDate, helpers.CurrentProperty(r).ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		if len(rooms) > 0 {
+			data := make(map[string]interface{})
+			data["rooms"] = rooms
+
+			res := models.Reservation{
+				StartDate: startDate,
+				EndDate:   endDate,
+			}
+
+			m.App.Session.Put(r.Context(), "reservation", res)
+
+			render.Template(w, r, "choose-room.page.tmpl", &models.TemplateData{
+				Data: data,
+			})
+			return
+		}
+	}
+
+	// a flexible search looks for stays of the same length arriving within flex_days of start.
+	// When nothing is free for exactly the dates searched, the nearest stay a few days either way
+	// in each room and a split of the stay across rooms are suggested instead.
+	window := flexDays
+	if flexDays == 0 {
+		window = alternativeShiftDays
+	}
+	grid, earliest, latest, err := m.stayWindow(r, startDate, nights, window)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	if len(rooms) == 0 {
-		m.App.Session.Put(r.Context(), "error", "No availability")
-		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
-		return
+	var options, split []models.StayOption
+	if flexDays > 0 {
+		options = models.FlexibleStays(grid, nights, earliest, latest, startDate, flexibleStaysPerRoom)
+	} else {
+		options = models.FlexibleStays(grid, nights, earliest, latest, startDate, 1)
+		split = models.SplitStay(grid, startDate, endDate)
+		// each part is booked on its own, so each has to meet the minimum stay
+		for _, part := range split {
+			if part.Nights() < m.App.BookingConfig.MinStayNights {
+				split = nil
+				break
+			}
+		}
 	}
-
-	data := make(map[string]interface{})
-	data["rooms"] = rooms
-
-	res := models.Reservation{
-		StartDate: startDate,
-		EndDate:   endDate,
+	if m.renderStayOptions(w, r, startDate, endDate, options, split, flexDays) {
+		return
 	}
 
-	m.App.Session.Put(r.Context(), "reservation", res)
-
-	render.Template(w, r, "choose-room.page.tmpl", &models.TemplateData{
-		Data: data,
-	})
+	m.App.Session.Put(r.Context(), "warning", "No rooms are free for those dates. Join the waitlist and we'll email you if one comes free.")
+	q := url.Values{"start": {startDate.String()}, "end": {endDate.String()}}
+	http.Redirect(w, r, "/waitlist?"+q.Encode(), http.StatusSeeOther)
 }
 
 type jsonResponse struct {
@@ -310,31 +513,51 @@ type jsonResponse struct {
 	RoomID  string    `json:"room_id"`
 	StartDate string `json:"start_date"`
 	EndDate   string `json:"end_date"`
+	// Errors holds the first error for each field that failed validation
+	Errors map[string]string `json:"errors,omitempty"`
 }
 
 // AvailabilityJSON handles request for availability and sends JSON response
 func (m *Repository) AvailabilityJSON(w http.ResponseWriter, r *http.Request) {
-	sd := r.Form.Get("start")
-	ed := r.Form.Get("end")
-
-	layout := "2006-01-02"
-	startDate, err := time.Parse(layout, sd)
-	if err != nil {
-		helpers.ServerError(w, err)
-		return
-	}
-	endDate, err := time.Parse(layout, ed)
+	err := r.ParseForm()
 	if err != nil {
-		helpers.ServerError(w, err)
+		http.Error(w, "can't parse form", http.StatusBadRequest)
 		return
 	}
 
-	roomID, err := strconv.Atoi(r.Form.Get("room_id"))
-	if err != nil {
-		helpers.ServerError(w, err)
+	sd := r.Form.Get("start")
+	ed := r.Form.Get("end")
+
+	form := forms.New(r.PostForm)
+	form.Required("room_id")
+	form.IntRange("room_id", 1, math.MaxInt32)
+	startDate, endDate := m.validateStay(r, form, "start", "end")
+	if !form.Valid() {
+		resp := jsonResponse{
+			StartDate: sd,
+			EndDate:   ed,
+			RoomID: r.Form.Get("room_id"),
+			Errors: make(map[string]string),
+		}
+		// the message is the first error, for clients that show just one
+		for _, field := range []string{"start", "end", "room_id"} {
+			if msg := form.Errors.Get(field); msg != "" {
+				resp.Errors[field] = msg
+				if resp.Message == "" {
+					resp.Message = msg
+				}
+			}
+		}
+
+		out, _ := json.MarshalIndent(resp, "", "     ")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write(out)
 		return
 	}
 
+	roomID, _ := strconv.Atoi(r.Form.Get("room_id"))
+
 	available, err := m.DB.SearchAvailabilityByDatesByRoomID(startDate, endDate, roomID)
 	if err != nil {
 		helpers.ServerError(w, err)
@@ -375,17 +598,46 @@ func (m *Repository) ReservationSummaryPage (w http.ResponseWriter, r *http.Requ
 	}
 
 	m.App.Session.Remove(r.Context(), "reservation")
+
+	var payments []models.Payment
+	if reservation.ID > 0 {
+		var err error
+		payments, err = m.DB.GetPaymentsForReservation(reservation.ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	charges, err := m.chargesFor(reservation)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	property, err := m.roomProperty(reservation.RoomID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
 	data := make(map[string]interface{})
 	data["reservation"] = reservation
+	data["payments"] = payments
+	data["charges"] = charges
 
 	sd := reservation.StartDate.Format("2006-01-02")
 	ed := reservation.EndDate.Format("2006-01-02")
 	StringMap := (map[string]string{})
 	StringMap["start_date"] = sd
 	StringMap["end_date"] = ed
+	StringMap["currency"] = property.Currency
 
+	IntMap := make(map[string]int)
+	IntMap["total"] = models.ChargesTotal(charges)
 
 	render.Template(w, r, "reservation-summary.page.tmpl", &models.TemplateData{
+		IntMap: IntMap,
 		Data: data,
 		StringMap: StringMap,
 	})
@@ -405,7 +657,31 @@ func (m *Repository) ChooseRoomPage (w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// only the rooms of the property the site is for can be booked on it
+	room, err := m.DB.GetRoomByID(roomID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		helpers.ServerError(w, err)
+		return
+	}
+	if err != nil || room.PropertyID != helpers.CurrentProperty(r).ID {
+		m.App.Session.Put(r.Context(), "error", "That room can't be booked, please search again")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+
 	res.RoomID = roomID
+
+	_, err = m.holdRoom(r, res)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "Someone else is booking that room for those dates, please choose another")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
 	m.App.Session.Put(r.Context(), "reservation", res)
 
 	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
@@ -413,39 +689,50 @@ func (m *Repository) ChooseRoomPage (w http.ResponseWriter, r *http.Request) {
 
 // BookRoomPage takes URL parameters, builds a sessional variable and redirects to make reservation page
 func (m *Repository) BookRoomPage (w http.ResponseWriter, r *http.Request) {
-	roomID, err := strconv.Atoi(r.URL.Query().Get("id"))
-    if err != nil {
-        helpers.ServerError(w, err)
-        return
-    }
-	
-	sd := r.URL.Query().Get("s")
-	ed := r.URL.Query().Get("e")
+	q := r.URL.Query()
 
-	layout := "2006-01-02"
-	startDate, err := time.Parse(layout, sd)
-	if err != nil {
-		helpers.ServerError(w, err)
+	// the dates come in as s and e, and errors are shown against the search form's fields
+	form := forms.New(url.Values{"start": {q.Get("s")}, "end": {q.Get("e")}})
+	startDate, endDate := m.validateStay(r, form, "start", "end")
+	if !form.Valid() {
+		m.renderSearchForm(w, r, form)
 		return
 	}
 
-	endDate, err := time.Parse(layout, ed)
-	if err != nil {
-		helpers.ServerError(w, err)
+	roomID, err := strconv.Atoi(q.Get("id"))
+	var room models.Room
+	if err == nil {
+		room, err = m.DB.GetRoomByID(roomID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+	if err != nil || room.PropertyID != helpers.CurrentProperty(r).ID {
+		m.App.Session.Put(r.Context(), "error", "That room can't be booked, please search again")
+		w.WriteHeader(http.StatusNotFound)
+		render.Template(w, r, "search-availability.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
 		return
 	}
-	
+
 	var res models.Reservation
 	res.RoomID = roomID
 	res.StartDate = startDate
 	res.EndDate = endDate
+	res.Room.RoomName = room.RoomName
 
-	room, err := m.DB.GetRoomByID(roomID)
+	_, err = m.holdRoom(r, res)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "Someone else is booking that room for those dates, please choose another")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
-	res.Room.RoomName = room.RoomName
 
 	m.App.Session.Put(r.Context(), "reservation", res)
 	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
@@ -482,13 +769,57 @@ func (m *Repository) PostLoginPage (w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, _, err := m.DB.AuthenticateUser(email, password)
+	// attempts are throttled per account and per address, and counted the same way whether or
+	// not the email belongs to anyone
+	key := models.NormalizeEmail(email)
+	failures, throttled, err := m.loginThrottled(r, key)
 	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if throttled {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	id, _, err := m.DB.AuthenticateUser(email, password)
+	if errors.Is(err, repository.ErrInvalidCredentials) {
+		m.loginFailed(r, key, failures)
 		m.App.Session.Put(r.Context(), "error", "Invalid login credentials")
 		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 		return
 	}
-	m.App.Session.Put(r.Context(), "user_id", id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	settings, err := m.DB.GetSecuritySettings()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// staff with two-factor authentication give a code before they are signed in, and those
+	// whose role requires it set it up first
+	switch {
+	case user.TwoFactorEnabled():
+		m.startPendingLogin(r, id)
+		http.Redirect(w, r, "/user/login/two-factor", http.StatusSeeOther)
+		return
+	case settings.RequiresTwoFactor(user):
+		m.startPendingLogin(r, id)
+		m.App.Session.Put(r.Context(), "warning", "Your role requires two-factor authentication, set it up to finish signing in")
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	m.signStaffIn(r, user)
 	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
@@ -509,7 +840,7 @@ func (m *Repository) AdminDashboardPage(w http.ResponseWriter, r *http.Request)
 
 // AdminNewReservationPage renders the admin new reservations page
 func (m *Repository) AdminNewReservationPage(w http.ResponseWriter, r *http.Request) {
-	newReservations, err := m.DB.AllNewReservations()
+	newReservations, err := m.DB.AllNewReservations(helpers.CurrentProperty(r).ID)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "Unable to retrieve new reservations")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -524,7 +855,7 @@ func (m *Repository) AdminNewReservationPage(w http.ResponseWriter, r *http.Requ
 
 // AdminAllReservationsPage renders the admin all reservations page
 func (m *Repository) AdminAllReservationsPage(w http.ResponseWriter, r *http.Request) {
-	reservations, err := m.DB.AllReservations()
+	reservations, err := m.DB.AllReservations(helpers.CurrentProperty(r).ID)
 	if err != nil {
 		m.App.Session.Put(r.Context(), "error", "Unable to retrieve reservations")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -579,30 +910,74 @@ func (m *Repository) AdminShowReservationPage(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	data := make(map[string]interface{})
-	data["reservation"] = res
-
-	render.Template(w, r, "admin-show-reservation.page.tmpl", &models.TemplateData{
-		Data: data,
-		StringMap: stringMap,
-		Form: forms.New(nil),
-	})
-}
+	if !canManage(r, res.Room.PropertyID) {
+		m.App.Session.Put(r.Context(), "error", "You can't manage reservations for that property")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
 
-// AdminPostShowReservationPage handles the post request for showing a reservation
-func (m *Repository) AdminPostShowReservationPage(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+	rooms, err := m.DB.AllRooms(res.Room.PropertyID)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	pathSegments := strings.Split(r.RequestURI, "/")
-
-	id, err := strconv.Atoi(pathSegments[4])
+	changes, err := m.DB.GetReservationChanges(id)
 	if err != nil {
 		helpers.ServerError(w, err)
-		m.App.Session.Put(r.Context(), "error", "Invalid reservation ID")
+		return
+	}
+
+	history, err := m.DB.GetAuditEntriesForEntity(models.EntityReservation, id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	var guest models.Guest
+	if res.GuestID > 0 {
+		guest, err = m.DB.GetGuestByID(res.GuestID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	payments, err := m.DB.GetPaymentsForReservation(id)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservation"] = res
+	data["rooms"] = rooms
+	data["changes"] = changes
+	data["history"] = history
+	data["guest"] = guest
+	data["payments"] = payments
+
+	render.Template(w, r, "admin-show-reservation.page.tmpl", &models.TemplateData{
+		Data: data,
+		StringMap: stringMap,
+		Form: forms.New(nil),
+	})
+}
+
+// AdminPostShowReservationPage handles the post request for showing a reservation
+func (m *Repository) AdminPostShowReservationPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	pathSegments := strings.Split(r.RequestURI, "/")
+
+	id, err := strconv.Atoi(pathSegments[4])
+	if err != nil {
+		helpers.ServerError(w, err)
+		m.App.Session.Put(r.Context(), "error", "Invalid reservation ID")
 		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
 		return
 	}
@@ -619,16 +994,23 @@ func (m *Repository) AdminPostShowReservationPage(w http.ResponseWriter, r *http
 		return
 	}
 
+	if !canManage(r, res.Room.PropertyID) {
+		m.App.Session.Put(r.Context(), "error", "You can't manage reservations for that property")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
 	res.FirstName = r.Form.Get("first_name")
 	res.LastName = r.Form.Get("last_name")
 	res.Email = r.Form.Get("email")
 	res.Phone = r.Form.Get("phone")
 	
-	err = m.DB.UpdateReservation(res, id)
+	err = m.db(r).UpdateReservation(res, id)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
+	m.reservationWebhook(res.Room.PropertyID, models.EventReservationUpdated, res)
 
 	month := r.Form.Get("month")
 	year := r.Form.Get("year")
@@ -642,134 +1024,276 @@ func (m *Repository) AdminPostShowReservationPage(w http.ResponseWriter, r *http
 	}
 }
 
-// AdminReservationCalendarPage renders the admin reservation calendar page
-func (m *Repository) AdminReservationCalendarPage(w http.ResponseWriter, r *http.Request) {
-	// assume that there is no month/year specified
-	now := time.Now()
+// calendarView works out the range of dates shown on the admin reservations calendar from
+// the query string. Month view (the default) takes y and m, week view takes a start date and
+// shows the seven days of that week, and range view takes a start and end date (inclusive).
+// It returns the first date shown, the day after the last one, and the view name.
+func calendarView(q url.Values, today models.Date) (models.Date, models.Date, string, error) {
+	view := q.Get("view")
+
+	switch view {
+	case "week":
+		start := today
+		if q.Get("start") != "" {
+			d, err := models.ParseDate(q.Get("start"))
+			if err != nil {
+				return models.Date{}, models.Date{}, view, err
+			}
+			start = d
+		}
+		// weeks start on a Monday
+		offset := (int(start.Weekday()) + 6) % 7
+		start = start.AddDate(0, 0, -offset)
+		return start, start.AddDate(0, 0, 7), view, nil
 
-	if r.URL.Query().Get("y") != "" {
-		year, err := strconv.Atoi(r.URL.Query().Get("y"))
+	case "range":
+		start, err := models.ParseDate(q.Get("start"))
 		if err != nil {
-			helpers.ServerError(w, err)
-			return
+			return models.Date{}, models.Date{}, view, err
 		}
-
-		month, err := strconv.Atoi(r.URL.Query().Get("m"))
+		last, err := models.ParseDate(q.Get("end"))
 		if err != nil {
-			helpers.ServerError(w, err)
-			return
+			return models.Date{}, models.Date{}, view, err
+		}
+		if last.Before(start) {
+			return models.Date{}, models.Date{}, view, errors.New("end date is before start date")
 		}
+		end := last.AddDate(0, 0, 1)
+		if end.After(start.AddDate(0, 0, maxCalendarDays)) {
+			return models.Date{}, models.Date{}, view, fmt.Errorf("the calendar can show at most %d days", maxCalendarDays)
+		}
+		return start, end, view, nil
 
-		now = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		start := models.NewDate(today.Year(), today.Month(), 1)
+		if q.Get("y") != "" {
+			year, err := strconv.Atoi(q.Get("y"))
+			if err != nil {
+				return models.Date{}, models.Date{}, "month", err
+			}
+			month, err := strconv.Atoi(q.Get("m"))
+			if err != nil || month < 1 || month > 12 {
+				return models.Date{}, models.Date{}, "month", errors.New("invalid month")
+			}
+			start = models.NewDate(year, time.Month(month), 1)
+		}
+		return start, start.AddDate(0, 1, 0), "month", nil
 	}
+}
 
-	data := make(map[string]interface{})
-	data["now"] = now
+// calendarQuery returns the query string that shows a calendar view again
+func calendarQuery(view string, start, end models.Date) string {
+	q := url.Values{}
+	switch view {
+	case "week":
+		q.Set("view", view)
+		q.Set("start", start.Format("2006-01-02"))
+	case "range":
+		q.Set("view", view)
+		q.Set("start", start.Format("2006-01-02"))
+		q.Set("end", end.AddDate(0, 0, -1).Format("2006-01-02"))
+	default:
+		q.Set("y", start.Format("2006"))
+		q.Set("m", start.Format("01"))
+	}
+	return q.Encode()
+}
 
-	next := now.AddDate(0, 1, 0)
-	previous := now.AddDate(0, -1, 0)
-	
-	nextMonth := next.Format("01")
-	nextMonthYear := next.Format("2006")
-	previousMonth := previous.Format("01")
-	previousMonthYear := previous.Format("2006")
-	stringMap := make(map[string]string)
-	stringMap["next_month"] = nextMonth
-	stringMap["next_month_year"] = nextMonthYear
-	stringMap["previous_month"] = previousMonth
-	stringMap["previous_month_year"] = previousMonthYear
-	stringMap["this_month"] = now.Format("01")
-	stringMap["this_month_year"] = now.Format("2006")
-
-	// get the first and last day of the month
-	currentYear, currentMonth, _ := now.Date()
-	currentLocation := now.Location()
-	firstOfMonth := time.Date(currentYear, currentMonth, 1, 0, 0, 0, 0, currentLocation)
-	lastOfMonth := firstOfMonth.AddDate(0, 1, -1)
+// calendarRedirectURL returns the calendar URL for the view described by posted form values
+func calendarRedirectURL(form url.Values, today models.Date) string {
+	start, end, view, err := calendarView(form, today)
+	if err != nil {
+		return "/admin/reservations-calendar"
+	}
+	return "/admin/reservations-calendar?" + calendarQuery(view, start, end)
+}
 
-	intMap := make(map[string]int)
-	intMap["days_in_month"] = lastOfMonth.Day()
+// AdminReservationCalendarPage renders the admin reservation calendar page
+func (m *Repository) AdminReservationCalendarPage(w http.ResponseWriter, r *http.Request) {
+	start, end, view, err := calendarView(r.URL.Query(), propertyToday(r))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid calendar dates: "+err.Error())
+		http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
+		return
+	}
 
-	rooms, err := m.DB.AllRooms()
+	var previous, next models.Date
+	switch view {
+	case "week":
+		previous, next = start.AddDate(0, 0, -7), start.AddDate(0, 0, 7)
+	case "range":
+		days := start.DaysUntil(end)
+		previous, next = start.AddDate(0, 0, -days), end
+	default:
+		previous, next = start.AddDate(0, -1, 0), end
+	}
+
+	stringMap := make(map[string]string)
+	stringMap["view"] = view
+	stringMap["start"] = start.Format("2006-01-02")
+	stringMap["end"] = end.AddDate(0, 0, -1).Format("2006-01-02")
+	stringMap["this_month"] = start.Format("01")
+	stringMap["this_month_year"] = start.Format("2006")
+	stringMap["previous_url"] = "/admin/reservations-calendar?" + calendarQuery(view, previous, previous.AddDate(0, 0, start.DaysUntil(end)))
+	stringMap["next_url"] = "/admin/reservations-calendar?" + calendarQuery(view, next, next.AddDate(0, 0, start.DaysUntil(end)))
+
+	rooms, err := m.DB.AllRooms(helpers.CurrentProperty(r).ID)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	data["rooms"] = rooms
+	restrictionTypes, err := m.DB.AllRestrictions()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
 
-	for _, room := range rooms {
-		reservationMap := make(map[string]int)
-		blockMap := make(map[string]int)
+	restrictions, err := m.DB.GetRestrictionsByDate(start, end)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
 
-		for d := firstOfMonth; !d.After(lastOfMonth); d = d.AddDate(0, 0, 1) {
-			reservationMap[d.Format("2006-01-2")] = 0
-			blockMap[d.Format("2006-01-2")] = 0
-		}
+	var dates []models.Date
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		dates = append(dates, d)
+	}
 
-		restrictions , err := m.DB.GetRestrictionsForRoomByDate(room.ID, firstOfMonth, lastOfMonth)
-		if err != nil {
-			helpers.ServerError(w, err)
-			return
+	rows := make([]models.CalendarRow, 0, len(rooms))
+	rowIndex := make(map[int]int)
+	for i, room := range rooms {
+		cells := make([]models.CalendarCell, len(dates))
+		for j, d := range dates {
+			cells[j].Date = d
 		}
+		rows = append(rows, models.CalendarRow{Room: room, Cells: cells})
+		rowIndex[room.ID] = i
+	}
 
-		for _, restriction := range restrictions {
+	for _, restriction := range restrictions {
+		i, ok := rowIndex[restriction.RoomID]
+		if !ok {
+			continue
+		}
+		first := true
+		for j, d := range dates {
+			if d.Before(restriction.StartDate) || !d.Before(restriction.EndDate) {
+				continue
+			}
+			cell := &rows[i].Cells[j]
 			if restriction.ReservationID > 0 {
-				for d := restriction.StartDate; !d.After(restriction.EndDate); d = d.AddDate(0, 0, 1) {
-					reservationMap[d.Format("2006-01-2")] = restriction.ReservationID
-				}
+				cell.ReservationID = restriction.ReservationID
+				cell.Reservation = restriction.Reservation
 			} else {
-				blockMap[restriction.StartDate.Format("2006-01-2")] = restriction.ID
+				cell.BlockID = restriction.ID
+				cell.BlockStart = restriction.StartDate
+				cell.BlockEnd = restriction.EndDate
+				cell.FirstOfBlock = first
+				cell.Restriction = restriction.Restriction
+				cell.Notes = restriction.Notes
 			}
+			first = false
 		}
-
-		m.App.Session.Put(r.Context(), fmt.Sprintf("reservation_map_%d", room.ID), reservationMap)
-		m.App.Session.Put(r.Context(), fmt.Sprintf("block_map_%d", room.ID), blockMap)
-
-		data[fmt.Sprintf("reservation_map_%d", room.ID)] = reservationMap
-		data[fmt.Sprintf("block_map_%d", room.ID)] = blockMap
 	}
 
+	data := make(map[string]interface{})
+	data["dates"] = dates
+	data["rows"] = rows
+	data["restrictions"] = restrictionTypes
+
 	render.Template(w, r, "admin-reservations-calendar.page.tmpl", &models.TemplateData{
 		StringMap: stringMap,
-		Data: data,
-		IntMap: intMap,
+		Data:      data,
 	})
 }
 
-// AdminProcessReservationPage processes a reservation based on the source and ID
-func (m *Repository) AdminProcessReservationPage(w http.ResponseWriter, r *http.Request) {
+// AdminReservationStatusPage moves a reservation to a new status based on the source and ID
+func (m *Repository) AdminReservationStatusPage(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		helpers.ServerError(w, err)
 		m.App.Session.Put(r.Context(), "error", "Invalid reservation ID")
 		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
 		return
 	}
 	src := chi.URLParam(r, "src")
 
-	err = m.DB.UpdateProcessedForReservation(id, 1)
+	status := models.ReservationStatus(chi.URLParam(r, "status"))
+	if !status.Valid() {
+		m.App.Session.Put(r.Context(), "error", "Invalid reservation status")
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations/%s/%d/show", src, id), http.StatusSeeOther)
+		return
+	}
+
+	before, err := m.DB.GetReservationByID(id)
 	if err != nil {
-		helpers.ServerError(w, err)
-		m.App.Session.Put(r.Context(), "error", "Unable to process reservation")
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Unable to retrieve reservation")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	if !canManage(r, before.Room.PropertyID) {
+		m.App.Session.Put(r.Context(), "error", "You can't manage reservations for that property")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	err = m.db(r).UpdateReservationStatus(id, status)
+	if errors.Is(err, repository.ErrInvalidTransition) {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("This reservation can't be marked as %s", status.Label()))
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations/%s/%d/show", src, id), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Unable to update reservation status")
 		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
 		return
 	}
 
+	after := before
+	after.Status = status
+	if status == models.StatusCancelled {
+		m.reservationCancelled(after, "")
+	} else {
+		m.reservationWebhook(before.Room.PropertyID, models.EventReservationUpdated, after)
+	}
+
+	flash := fmt.Sprintf("Reservation marked as %s", status.Label())
+	if status == models.StatusCancelled {
+		refunded, err := m.refundCancellation(r, before)
+		if err != nil {
+			m.App.ErrorLog.Println("Error refunding cancelled reservation:", err)
+			m.App.Session.Put(r.Context(), "error", "The reservation was cancelled but the refund failed, refund it from the payment provider's dashboard")
+		}
+		if refunded > 0 {
+			property, err := m.DB.GetPropertyByID(before.Room.PropertyID)
+			if err != nil {
+				m.App.ErrorLog.Println("Error retrieving property:", err)
+			}
+			flash += fmt.Sprintf(", %s refunded", render.FormatMoney(refunded, property.Currency))
+		}
+	}
+	if status == models.StatusCheckedOut {
+		m.sendCheckoutEmail(after)
+	}
+	if status.ReleasesInventory() {
+		m.offerWaitlist(before.Room.PropertyID)
+	}
+
 	year := r.URL.Query().Get("y")
 	month := r.URL.Query().Get("m")
-	m.App.Session.Put(r.Context(), "flash", "Reservation processed!")
+	m.App.Session.Put(r.Context(), "flash", flash)
 
 	if year == "" {
-	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
 	} else {
 		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%s&m=%s", year, month), http.StatusSeeOther)
-		return
 	}
-
 }
 
-// AdminDeleteReservationPage deletes a reservation based on the source and ID
+// AdminDeleteReservationPage moves a reservation to the trash based on the source and ID
 func (m *Repository) AdminDeleteReservationPage(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
@@ -780,18 +1304,55 @@ func (m *Repository) AdminDeleteReservationPage(w http.ResponseWriter, r *http.R
 	}
 	src := chi.URLParam(r, "src")
 
-	err = m.DB.DeleteReservation(id)
+	before, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Unable to retrieve reservation")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	if !canManage(r, before.Room.PropertyID) {
+		m.App.Session.Put(r.Context(), "error", "You can't manage reservations for that property")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	userID := m.App.Session.GetInt(r.Context(), "user_id")
+	err = m.db(r).DeleteReservation(id, userID)
 	if err != nil {
 		helpers.ServerError(w, err)
 		m.App.Session.Put(r.Context(), "error", "Unable to delete reservation")
 		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
 		return
 	}
+
+	// a reservation still holding its room is cancelled by moving it to the trash, and its
+	// deposit refunded as a cancellation's would be
+	flash := "Reservation moved to trash"
+	if !before.Status.ReleasesInventory() {
+		m.reservationWebhook(before.Room.PropertyID, models.EventReservationCancelled, before)
+
+		refunded, err := m.refundCancellation(r, before)
+		if err != nil {
+			m.App.ErrorLog.Println("Error refunding deleted reservation:", err)
+			m.App.Session.Put(r.Context(), "error", "The reservation was deleted but the refund failed, refund it from the payment provider's dashboard")
+		}
+		if refunded > 0 {
+			property, err := m.DB.GetPropertyByID(before.Room.PropertyID)
+			if err != nil {
+				m.App.ErrorLog.Println("Error retrieving property:", err)
+			}
+			flash += fmt.Sprintf(", %s refunded", render.FormatMoney(refunded, property.Currency))
+		}
+	}
+
+	m.offerWaitlist(before.Room.PropertyID)
 	
 	year := r.URL.Query().Get("y")
 	month := r.URL.Query().Get("m")
 
-	m.App.Session.Put(r.Context(), "flash", "Reservation deleted!")
+	m.App.Session.Put(r.Context(), "flash", flash)
 	if year == "" {
 		http.Redirect(w, r, fmt.Sprintf("/admin/reservations-%s", src), http.StatusSeeOther)
 	} else {
@@ -800,7 +1361,74 @@ func (m *Repository) AdminDeleteReservationPage(w http.ResponseWriter, r *http.R
 	}
 }
 
-// AdminPostReservationCalendarPage handles the post request for the admin reservation calendar
+// AdminTrashPage lists the reservations in the trash
+func (m *Repository) AdminTrashPage(w http.ResponseWriter, r *http.Request) {
+	reservations, err := m.DB.AllDeletedReservations(helpers.CurrentProperty(r).ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservations"] = reservations
+
+	intMap := make(map[string]int)
+	intMap["retention_days"] = m.App.TrashRetentionDays
+
+	render.Template(w, r, "admin-trash.page.tmpl", &models.TemplateData{
+		Data:   data,
+		IntMap: intMap,
+	})
+}
+
+// AdminRestoreReservationPage takes a reservation out of the trash, if its room is still free
+func (m *Repository) AdminRestoreReservationPage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid reservation ID")
+		http.Redirect(w, r, "/admin/reservations-trash", http.StatusSeeOther)
+		return
+	}
+
+	before, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Unable to retrieve reservation")
+		http.Redirect(w, r, "/admin/reservations-trash", http.StatusSeeOther)
+		return
+	}
+
+	if !canManage(r, before.Room.PropertyID) {
+		m.App.Session.Put(r.Context(), "error", "You can't manage reservations for that property")
+		http.Redirect(w, r, "/admin/reservations-trash", http.StatusSeeOther)
+		return
+	}
+
+	err = m.db(r).RestoreReservation(id)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.App.Session.Put(r.Context(), "error", "The room has been booked for those dates since this reservation was deleted, so it can't be restored")
+		http.Redirect(w, r, "/admin/reservations-trash", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Unable to restore reservation")
+		http.Redirect(w, r, "/admin/reservations-trash", http.StatusSeeOther)
+		return
+	}
+
+	restored := before
+	restored.DeletedAt = time.Time{}
+	restored.DeletedBy = 0
+	m.reservationWebhook(before.Room.PropertyID, models.EventReservationUpdated, restored)
+
+	m.App.Session.Put(r.Context(), "flash", "Reservation restored")
+	http.Redirect(w, r, fmt.Sprintf("/admin/reservations/all/%d/show", id), http.StatusSeeOther)
+}
+
+// AdminPostReservationCalendarPage applies the add_block and remove_block operations posted
+// from the admin reservation calendar. Every operation is validated first, then all are applied
+// in one transaction.
 func (m *Repository) AdminPostReservationCalendarPage(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
@@ -808,68 +1436,496 @@ func (m *Repository) AdminPostReservationCalendarPage(w http.ResponseWriter, r *
 		return
 	}
 
-	year, _ := strconv.Atoi(r.Form.Get("y"))
-	month, _ := strconv.Atoi(r.Form.Get("m"))
+	redirectURL := calendarRedirectURL(r.PostForm, propertyToday(r))
 
-	// process blocks
-	rooms, err := m.DB.AllRooms()
+	rooms, err := m.DB.AllRooms(helpers.CurrentProperty(r).ID)
 	if err != nil {
 		helpers.ServerError(w, err)
 		return
 	}
 
-	forms := forms.New(r.PostForm)
-
+	validRooms := make(map[int]bool)
 	for _, room := range rooms {
-		curMap := m.App.Session.Get(r.Context(), fmt.Sprintf("block_map_%d", room.ID)).(map[string]int)
-		for name, value := range curMap {
-			if val, ok := curMap[name]; ok {
-				if val > 0 {
-					if !forms.Has(fmt.Sprintf("remove_block_%d_%s", room.ID, name)) {
-						// delete the restriction by id
-						err = m.DB.DeleteBlockByID(value)
-						if err != nil {
-							m.App.Session.Put(r.Context(), "error", "Unable to delete block")
-							http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
-							return
-						}
-					}
+		validRooms[room.ID] = true
+	}
+
+	var adds []models.RoomRestriction
+	var first, last models.Date
+	queued := make(map[string]bool)
+	for _, op := range r.PostForm["add_block"] {
+		// each add operation is posted as <room id>_<yyyy-mm-dd>
+		parts := strings.SplitN(op, "_", 2)
+		if len(parts) != 2 {
+			m.App.Session.Put(r.Context(), "error", "Invalid block operation")
+			http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+			return
+		}
+
+		roomID, err := strconv.Atoi(parts[0])
+		if err != nil || !validRooms[roomID] {
+			m.App.Session.Put(r.Context(), "error", "Invalid room ID")
+			http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+			return
+		}
+
+		blockDate, err := models.ParseDate(parts[1])
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Invalid date format")
+			http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+			return
+		}
+
+		// a night posted twice for a room is only blocked once
+		key := fmt.Sprintf("%d_%s", roomID, blockDate.Format("2006-01-02"))
+		if queued[key] {
+			continue
+		}
+		queued[key] = true
+
+		if first.IsZero() || blockDate.Before(first) {
+			first = blockDate
+		}
+		if blockDate.After(last) {
+			last = blockDate
+		}
+
+		adds = append(adds, models.RoomRestriction{
+			StartDate:     blockDate,
+			EndDate:       blockDate.AddDate(0, 0, 1),
+			RoomID:        roomID,
+			RestrictionID: models.RestrictionOwnerBlock,
+		})
+	}
+
+	var removes []int
+	seen := make(map[int]bool)
+	for _, op := range r.PostForm["remove_block"] {
+		id, err := strconv.Atoi(op)
+		if err != nil || id <= 0 {
+			m.App.Session.Put(r.Context(), "error", "Invalid block ID")
+			http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+			return
+		}
+		// a block over several nights is posted once for each night
+		if !seen[id] {
+			seen[id] = true
+			removes = append(removes, id)
+		}
+	}
+
+	if len(adds) > 0 {
+		existing, err := m.DB.GetRestrictionsByDate(first, last.AddDate(0, 0, 1))
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		for _, add := range adds {
+			for _, e := range existing {
+				if e.RoomID != add.RoomID || !e.Restriction.BlocksStay || seen[e.ID] {
+					continue
+				}
+				if add.StartDate.Before(e.EndDate) && add.EndDate.After(e.StartDate) {
+					m.App.Session.Put(r.Context(), "error",
+						fmt.Sprintf("Room %d is already taken on %s", add.RoomID, add.StartDate.Format("2006-01-02")))
+					http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+					return
 				}
 			}
 		}
 	}
 
-	// now handle new blocks
-	for name, _ := range r.PostForm {
-		if strings.HasPrefix(name, "add_block_") {
-			parts := strings.Split(name, "_")
+	removed, added, err := m.db(r).ApplyBlockChanges(helpers.CurrentProperty(r).ID, removes, adds)
+	if err != nil {
+		m.App.ErrorLog.Println("Error updating blocks:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to update the calendar, no changes were made")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
 
-			roomID, err := strconv.Atoi(parts[2])
-			if err != nil {
-				m.App.Session.Put(r.Context(), "error", "Invalid room ID")
-				http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
-				return
-			}
+	for _, block := range removed {
+		m.blockWebhook(helpers.CurrentProperty(r).ID, models.EventBlockDeleted, block)
+	}
+	for _, block := range added {
+		m.blockWebhook(helpers.CurrentProperty(r).ID, models.EventBlockCreated, block)
+	}
 
-			dateStr := parts[3]
-			layout := "2006-01-2"
-			blockDate, err := time.Parse(layout, dateStr)
-			if err != nil {
-				m.App.Session.Put(r.Context(), "error", "Invalid date format")
-				http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
-				return
-			}
+	if len(removes) > 0 {
+		m.offerWaitlist(helpers.CurrentProperty(r).ID)
+	}
 
-			err = m.DB.InsertBlockForRoom(roomID, blockDate)
-			if err != nil {
-				m.App.ErrorLog.Println("Error inserting block for room:", err)
-				m.App.Session.Put(r.Context(), "error", "Unable to insert block")
-				http.Redirect(w, r, "/admin/reservations-calendar", http.StatusSeeOther)
-				return
-			}
+	m.App.Session.Put(r.Context(), "flash", "Calendar updated")
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+// AdminPostBlockPage adds a block of any restriction type over a range of nights for a room
+func (m *Repository) AdminPostBlockPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	redirectURL := calendarRedirectURL(r.PostForm, propertyToday(r))
+
+	form := forms.New(r.PostForm)
+	form.Required("room_id", "restriction_id", "block_start", "block_end")
+	if !form.Valid() {
+		m.App.Session.Put(r.Context(), "error", "Room, type and dates are required to add a block")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+
+	roomID, err := strconv.Atoi(r.Form.Get("room_id"))
+	if err == nil {
+		var room models.Room
+		room, err = m.DB.GetRoomByID(roomID)
+		if err == nil && room.PropertyID != helpers.CurrentProperty(r).ID {
+			err = errors.New("room belongs to another property")
 		}
 	}
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid room ID")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
 
-	m.App.Session.Put(r.Context(), "flash", "Calendar updated")
-	http.Redirect(w, r, fmt.Sprintf("/admin/reservations-calendar?y=%d&m=%d", year, month), http.StatusSeeOther)
-}
\ No newline at end of file
+	restrictionID, err := strconv.Atoi(r.Form.Get("restriction_id"))
+	if err != nil || restrictionID == models.RestrictionReservation {
+		m.App.Session.Put(r.Context(), "error", "Invalid restriction type")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+
+	startDate, err := models.ParseDate(r.Form.Get("block_start"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid date format")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+
+	// the end date on the form is the last blocked night, so the stored range ends a day later
+	lastNight, err := models.ParseDate(r.Form.Get("block_end"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid date format")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+
+	if lastNight.Before(startDate) {
+		m.App.Session.Put(r.Context(), "error", "The block must end on or after its start date")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+
+	block := models.RoomRestriction{
+		StartDate:     startDate,
+		EndDate:       lastNight.AddDate(0, 0, 1),
+		RoomID:        roomID,
+		RestrictionID: restrictionID,
+		Notes:         strings.TrimSpace(r.Form.Get("notes")),
+	}
+
+	block.ID, err = m.db(r).InsertBlockForRoom(block)
+	if err != nil {
+		m.App.ErrorLog.Println("Error inserting block for room:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to insert block")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+	m.blockWebhook(helpers.CurrentProperty(r).ID, models.EventBlockCreated, block)
+
+	m.App.Session.Put(r.Context(), "flash", "Block added")
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+// AdminRestrictionsPage lists the restriction types
+func (m *Repository) AdminRestrictionsPage(w http.ResponseWriter, r *http.Request) {
+	restrictions, err := m.DB.AllRestrictions()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["restrictions"] = restrictions
+
+	render.Template(w, r, "admin-restrictions.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminShowRestrictionPage shows the form to add or edit a restriction type
+func (m *Repository) AdminShowRestrictionPage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid restriction ID")
+		http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+		return
+	}
+
+	restriction := models.Restriction{
+		Color:      "#6c757d",
+		BlocksStay: true,
+	}
+	if id > 0 {
+		restriction, err = m.DB.GetRestrictionByID(id)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Unable to retrieve restriction")
+			http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+			return
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["restriction"] = restriction
+
+	render.Template(w, r, "admin-restriction.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: forms.New(nil),
+	})
+}
+
+// AdminPostRestrictionPage saves a new or edited restriction type
+func (m *Repository) AdminPostRestrictionPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid restriction ID")
+		http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+		return
+	}
+
+	restriction := models.Restriction{
+		ID:                id,
+		RestrictionName:   strings.TrimSpace(r.Form.Get("restriction_name")),
+		Color:             r.Form.Get("color"),
+		BlocksStay:        r.Form.Get("kind") == "block",
+		ClosedToArrival:   r.Form.Get("kind") == "cta",
+		ClosedToDeparture: r.Form.Get("kind") == "ctd",
+	}
+
+	// the reservation type always blocks the stay, whatever is posted
+	if id == models.RestrictionReservation {
+		restriction.BlocksStay = true
+		restriction.ClosedToArrival = false
+		restriction.ClosedToDeparture = false
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("restriction_name", "color", "kind")
+	// anything else would save a type that neither blocks nor restricts anything
+	form.In("kind", "block", "cta", "ctd")
+	if !hexColor.MatchString(restriction.Color) {
+		form.Errors.Add("color", "Colour must be a hex value such as #6c757d")
+	}
+
+	if !form.Valid() {
+		data := make(map[string]interface{})
+		data["restriction"] = restriction
+		render.Template(w, r, "admin-restriction.page.tmpl", &models.TemplateData{
+			Data: data,
+			Form: form,
+		})
+		return
+	}
+
+	if id == 0 {
+		restriction.ID, err = m.db(r).InsertRestriction(restriction)
+		if err != nil {
+			m.App.ErrorLog.Println("Error saving restriction:", err)
+			m.App.Session.Put(r.Context(), "error", "Unable to save restriction")
+			http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+			return
+		}
+	} else {
+		_, err = m.DB.GetRestrictionByID(id)
+		if err == nil {
+			err = m.db(r).UpdateRestriction(restriction)
+		}
+		if err != nil {
+			m.App.ErrorLog.Println("Error saving restriction:", err)
+			m.App.Session.Put(r.Context(), "error", "Unable to save restriction")
+			http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+			return
+		}
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Restriction saved")
+	http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+}
+
+// AdminDeleteRestrictionPage deletes a restriction type that is not in use
+func (m *Repository) AdminDeleteRestrictionPage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid restriction ID")
+		http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+		return
+	}
+
+	if id == models.RestrictionReservation || id == models.RestrictionOwnerBlock {
+		m.App.Session.Put(r.Context(), "error", "Built-in restriction types can't be deleted")
+		http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+		return
+	}
+
+	_, err = m.DB.GetRestrictionByID(id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Unable to retrieve restriction")
+		http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+		return
+	}
+
+	err = m.db(r).DeleteRestriction(id)
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Unable to delete restriction, it may still be used by blocks")
+		http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Restriction deleted")
+	http.Redirect(w, r, "/admin/restrictions", http.StatusSeeOther)
+}
+
+// moveReservation moves reservation id to the room and dates in form (room_id, start_date and
+// end_date). It returns a message for staff when the move is refused, or "" on success.
+func (m *Repository) moveReservation(r *http.Request, id int, form url.Values) string {
+
+	roomID, err := strconv.Atoi(form.Get("room_id"))
+	if err != nil {
+		return "Invalid room"
+	}
+
+	startDate, err := models.ParseDate(form.Get("start_date"))
+	if err != nil {
+		return "Invalid arrival date"
+	}
+
+	endDate, err := models.ParseDate(form.Get("end_date"))
+	if err != nil {
+		return "Invalid departure date"
+	}
+
+	if !endDate.After(startDate) {
+		return "Departure must be after arrival"
+	}
+
+	before, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		m.App.ErrorLog.Println("Error moving reservation:", err)
+		return "Unable to move reservation"
+	}
+
+	if !canManage(r, before.Room.PropertyID) {
+		return "You can't manage reservations for that property"
+	}
+
+	room, err := m.DB.GetRoomByID(roomID)
+	if err != nil || room.PropertyID != before.Room.PropertyID {
+		return "Invalid room"
+	}
+
+	err = m.db(r).MoveReservation(models.ReservationChange{
+		ReservationID: id,
+		UserID:        m.App.Session.GetInt(r.Context(), "user_id"),
+		NewRoomID:     roomID,
+		NewStartDate:  startDate,
+		NewEndDate:    endDate,
+	})
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		return "That room is not available for those dates"
+	}
+	if errors.Is(err, repository.ErrReservationReleased) {
+		return "Cancelled and no-show reservations can't be moved"
+	}
+	if err != nil {
+		m.App.ErrorLog.Println("Error moving reservation:", err)
+		return "Unable to move reservation"
+	}
+
+	after := before
+	after.RoomID = roomID
+	after.Room = room
+	after.StartDate = startDate
+	after.EndDate = endDate
+	m.reservationWebhook(before.Room.PropertyID, models.EventReservationUpdated, after)
+
+	// the room and nights moved from may be wanted by someone on the waitlist
+	m.offerWaitlist(before.Room.PropertyID)
+
+	return ""
+}
+
+// AdminPostMoveReservationPage moves a reservation to the room and dates posted from the show reservation page
+func (m *Repository) AdminPostMoveReservationPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	src := chi.URLParam(r, "src")
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid reservation ID")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	redirectURL := fmt.Sprintf("/admin/reservations/%s/%d/show", src, id)
+	if r.Form.Get("year") != "" {
+		redirectURL = fmt.Sprintf("%s?y=%s&m=%s", redirectURL, r.Form.Get("year"), r.Form.Get("month"))
+	}
+
+	if msg := m.moveReservation(r, id, r.PostForm); msg != "" {
+		m.App.Session.Put(r.Context(), "error", msg)
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Reservation moved")
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+// AdminMoveReservationJSON moves a reservation dragged to a new room or date on the calendar and sends JSON response
+func (m *Repository) AdminMoveReservationJSON(w http.ResponseWriter, r *http.Request) {
+	resp := jsonResponse{OK: true}
+
+	err := r.ParseForm()
+	if err != nil {
+		resp.OK = false
+		resp.Message = "Can't parse form"
+	}
+
+	resp.RoomID = r.Form.Get("room_id")
+	resp.StartDate = r.Form.Get("start_date")
+	resp.EndDate = r.Form.Get("end_date")
+
+	id, err := strconv.Atoi(r.Form.Get("reservation_id"))
+	if resp.OK && err != nil {
+		resp.OK = false
+		resp.Message = "Invalid reservation ID"
+	}
+
+	if resp.OK {
+		if msg := m.moveReservation(r, id, r.Form); msg != "" {
+			resp.OK = false
+			resp.Message = msg
+		}
+	}
+
+	out, err := json.MarshalIndent(resp, "", "     ")
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/models"
+)
+
+// holdRoom holds the room and nights of res for the guest in the session while they book it,
+// keeping the hold they already have when it still covers the stay and letting go of it when it
+// doesn't. It returns repository.ErrRoomUnavailable when someone else has the room.
+func (m *Repository) holdRoom(r *http.Request, res models.Reservation) (models.RoomHold, error) {
+	now := time.Now()
+
+	if id := m.App.Session.GetInt(r.Context(), "hold_id"); id > 0 {
+		hold, err := m.DB.GetRoomHoldByID(id)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return hold, err
+		}
+		if err == nil && hold.Covers(res, now) {
+			return hold, nil
+		}
+		m.releaseHold(r)
+	}
+
+	hold := models.RoomHold{
+		RoomID:    res.RoomID,
+		StartDate: res.StartDate,
+		EndDate:   res.EndDate,
+		ExpiresAt: now.Add(time.Duration(m.App.BookingConfig.HoldMinutes) * time.Minute),
+	}
+
+	var err error
+	hold.ID, err = m.db(r).InsertRoomHold(hold)
+	if err != nil {
+		return hold, err
+	}
+
+	m.App.Session.Put(r.Context(), "hold_id", hold.ID)
+	return hold, nil
+}
+
+// releaseHold lets go of the hold of the guest in the session, if they have one
+func (m *Repository) releaseHold(r *http.Request) {
+	id := m.App.Session.PopInt(r.Context(), "hold_id")
+	if id == 0 {
+		return
+	}
+
+	err := m.db(r).DeleteRoomHold(id)
+	if err != nil {
+		m.App.ErrorLog.Println("Error releasing room hold:", err)
+	}
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/ashparshp/bookings/internal/invoices"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// invoiceFor returns the invoice for a reservation, issuing it the first time it is asked for
+func (m *Repository) invoiceFor(res models.Reservation) (models.Invoice, error) {
+	inv, err := m.DB.GetInvoiceByReservationID(res.ID)
+	if err == nil {
+		return inv, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return inv, err
+	}
+
+	charges, err := m.chargesFor(res)
+	if err != nil {
+		return inv, err
+	}
+
+	property, err := m.roomProperty(res.RoomID)
+	if err != nil {
+		return inv, err
+	}
+
+	return m.DB.CreateInvoice(models.NewInvoice(res, charges, property))
+}
+
+// invoicePDF returns the invoice for a reservation as a PDF, with the payments taken so far
+func (m *Repository) invoicePDF(res models.Reservation) (models.Invoice, []byte, error) {
+	inv, err := m.invoiceFor(res)
+	if err != nil {
+		return inv, nil, err
+	}
+
+	list, err := m.DB.GetPaymentsForReservation(res.ID)
+	if err != nil {
+		return inv, nil, err
+	}
+
+	// invoices are issued by the property that was stayed at
+	property, err := m.DB.GetPropertyByID(inv.PropertyID)
+	if err != nil {
+		return inv, nil, err
+	}
+
+	return inv, invoices.PDF(inv, list, property.Name), nil
+}
+
+// invoiceAttachment returns the invoice for a reservation ready to attach to an email. Emails
+// still go out without it if it can't be produced.
+func (m *Repository) invoiceAttachment(res models.Reservation) []models.MailAttachment {
+	inv, data, err := m.invoicePDF(res)
+	if err != nil {
+		m.App.ErrorLog.Println("Error producing invoice for reservation", res.ID, err)
+		return nil
+	}
+
+	return []models.MailAttachment{
+		{Name: fmt.Sprintf("invoice-%s.pdf", inv.Number()), ContentType: "application/pdf", Data: data},
+	}
+}
+
+// sendCheckoutEmail thanks the guest for their stay and sends them the final invoice
+func (m *Repository) sendCheckoutEmail(res models.Reservation) {
+	htmlMessage := fmt.Sprintf(`
+	<strong>Thank you for staying with us</strong><br>
+	Dear %s, <br>
+	We hope you enjoyed your stay from %s to %s. Your invoice is attached.<br>
+	`, res.FirstName, res.StartDate.Format("2006-01-02"), res.EndDate.Format("2006-01-02"))
+
+	m.App.MailChan <- models.MailData{
+		To:          res.Email,
+		From:        m.App.MailConfig.FromAddress,
+		Subject:     "Thank you for staying",
+		Content:     htmlMessage,
+		Template:    "basic.html",
+		Attachments: m.invoiceAttachment(res),
+	}
+}
+
+// AdminInvoicePage downloads the invoice for a reservation as a PDF
+func (m *Repository) AdminInvoicePage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid reservation ID")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+	src := chi.URLParam(r, "src")
+
+	res, err := m.DB.GetReservationByID(id)
+	if err != nil {
+		m.App.ErrorLog.Println(err)
+		m.App.Session.Put(r.Context(), "error", "Unable to retrieve reservation")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	if !canManage(r, res.Room.PropertyID) {
+		m.App.Session.Put(r.Context(), "error", "You can't manage reservations for that property")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	inv, data, err := m.invoicePDF(res)
+	if err != nil {
+		m.App.ErrorLog.Println("Error producing invoice:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to produce the invoice")
+		http.Redirect(w, r, fmt.Sprintf("/admin/reservations/%s/%d/show", src, id), http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="invoice-%s.pdf"`, inv.Number()))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
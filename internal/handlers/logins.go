@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/helpers"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// waitText describes a wait in whole seconds or minutes, rounding up
+func waitText(d time.Duration) string {
+	if d <= time.Minute {
+		n := int((d + time.Second - 1) / time.Second)
+		if n == 1 {
+			return "1 second"
+		}
+		return fmt.Sprintf("%d seconds", n)
+	}
+	n := int((d + time.Minute - 1) / time.Minute)
+	return fmt.Sprintf("%d minutes", n)
+}
+
+// loginThrottled returns the failed sign ins to email and from the request's address, and puts
+// an error in the session when the next attempt has to wait
+func (m *Repository) loginThrottled(r *http.Request, email string) (models.LoginFailures, bool, error) {
+	now := time.Now()
+	failures, err := m.DB.GetLoginFailures(email, clientIP(r), now)
+	if err != nil {
+		return failures, false, err
+	}
+
+	wait := failures.Wait(now)
+	switch {
+	case wait <= 0:
+		return failures, false, nil
+	case failures.Locked():
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("This account is locked after too many failed sign in attempts, please try again in %s", waitText(wait)))
+	default:
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("Too many failed sign in attempts, please try again in %s", waitText(wait)))
+	}
+	return failures, true, nil
+}
+
+// loginFailed records a failed sign in to email, which failures counted before it, and reports
+// whether it locked the account. The account's owner is told when it is locked. This happens the
+// same way for emails that don't belong to anyone, so the response doesn't give them away.
+func (m *Repository) loginFailed(r *http.Request, email string, failures models.LoginFailures) bool {
+	err := m.DB.InsertLoginAttempt(models.LoginAttempt{Email: email, IPAddress: clientIP(r)})
+	if err != nil {
+		m.App.ErrorLog.Println("Error recording sign in attempt:", err)
+	}
+
+	failures.Account++
+	if failures.Account == models.LoginLockoutAttempts {
+		m.sendLockoutNotice(r, email)
+	}
+	return failures.Locked()
+}
+
+// loginSucceeded records a sign in to email, clearing its failed sign ins
+func (m *Repository) loginSucceeded(r *http.Request, email string) {
+	err := m.DB.InsertLoginAttempt(models.LoginAttempt{Email: email, IPAddress: clientIP(r), Succeeded: true})
+	if err != nil {
+		m.App.ErrorLog.Println("Error recording sign in attempt:", err)
+	}
+}
+
+// sendLockoutNotice emails a staff user to say their account has been locked, in case someone
+// else is trying to sign in as them
+func (m *Repository) sendLockoutNotice(r *http.Request, email string) {
+	user, err := m.DB.GetUserByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println("Error retrieving locked account:", err)
+		return
+	}
+
+	htmlMessage := fmt.Sprintf(`
+	<strong>Your account has been locked</strong><br>
+	Dear %s,<br>
+	There have been %d failed attempts in a row to sign in to your account, the last from %s, so it has
+	been locked for %d minutes.<br>
+	If this wasn't you, someone may be trying to guess your password. Ask an owner to check the security
+	page, and consider changing your password.
+	`, user.FirstName, models.LoginLockoutAttempts, clientIP(r), int(models.LoginLockoutPeriod.Minutes()))
+
+	m.App.MailChan <- models.MailData{
+		To:       user.Email,
+		From:     m.App.MailConfig.FromAddress,
+		Subject:  "Your account has been locked",
+		Content:  htmlMessage,
+		Template: "basic.html",
+	}
+}
+
+// AdminUnlockAccountPage unlocks a staff account locked by failed sign ins, which only owners
+// can do
+func (m *Repository) AdminUnlockAccountPage(w http.ResponseWriter, r *http.Request) {
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if !user.IsOwner() {
+		m.App.Session.Put(r.Context(), "error", "Only owners can unlock accounts")
+		http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	var locked models.User
+	if err == nil {
+		locked, err = m.DB.GetUserByID(id)
+	}
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Account not found")
+		http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+		return
+	}
+
+	err = m.db(r).ClearLoginFailures(models.NormalizeEmail(locked.Email))
+	if err != nil {
+		m.App.ErrorLog.Println("Error unlocking account:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to unlock the account")
+		http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s %s can sign in again", locked.FirstName, locked.LastName))
+	http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+}
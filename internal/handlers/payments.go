@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/forms"
+	"github.com/ashparshp/bookings/internal/helpers"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/payments"
+	"github.com/ashparshp/bookings/internal/render"
+)
+
+// depositFor returns the deposit due when booking res, which is nothing when payments are off
+func (m *Repository) depositFor(res models.Reservation) (int, error) {
+	if m.App.Payments == nil {
+		return 0, nil
+	}
+
+	charges, err := m.chargesFor(res)
+	if err != nil {
+		return 0, err
+	}
+
+	return payments.Deposit(models.ChargesTotal(charges), m.App.PaymentConfig.DepositPercent), nil
+}
+
+// PaymentPage shows the deposit due for the reservation in the session and the card form
+func (m *Repository) PaymentPage(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
+	if !ok || res.ID == 0 {
+		m.App.Session.Put(r.Context(), "error", "Can't get reservation from session")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// nothing more to pay once the reservation is confirmed
+	if res.Status != models.StatusPending {
+		http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+		return
+	}
+	if m.paymentExpired(w, r, res) {
+		return
+	}
+
+	amount, err := m.depositFor(res)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if amount == 0 {
+		http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+		return
+	}
+
+	m.renderPayment(w, r, res, amount, forms.New(nil))
+}
+
+// CancelUnpaidReservations cancels the reservations whose deposit wasn't paid by now, telling
+// connected tools and the guests, and offers the rooms they held to the waitlist. It is run
+// regularly and returns the reservations it cancelled.
+func (m *Repository) CancelUnpaidReservations(now time.Time) []models.Reservation {
+	cancelled, err := m.DB.CancelUnpaidReservations(now)
+	if err != nil {
+		m.App.ErrorLog.Println("Error cancelling unpaid reservations:", err)
+	}
+
+	offered := make(map[int]bool)
+	for _, res := range cancelled {
+		m.App.InfoLog.Printf("Cancelled reservation %d as its deposit wasn't paid in time", res.ID)
+		m.reservationCancelled(res, " We didn't receive the deposit in time, so the room has been released.")
+		if !offered[res.Room.PropertyID] {
+			offered[res.Room.PropertyID] = true
+			m.offerWaitlist(res.Room.PropertyID)
+		}
+	}
+	return cancelled
+}
+
+// paymentExpired sends the guest back to the start when the deposit for res wasn't paid in
+// time, as the reservation has been or is about to be cancelled and its room given back
+func (m *Repository) paymentExpired(w http.ResponseWriter, r *http.Request, res models.Reservation) bool {
+	current, err := m.DB.GetReservationByID(res.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return true
+	}
+	if current.Status == models.StatusPending && (current.PaymentDueAt.IsZero() || time.Now().Before(current.PaymentDueAt)) {
+		return false
+	}
+
+	m.App.Session.Remove(r.Context(), "reservation")
+	m.App.Session.Put(r.Context(), "error", "Your reservation expired before the deposit was paid, please book again")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return true
+}
+
+// renderPayment renders the payment page for a deposit of amount on res
+func (m *Repository) renderPayment(w http.ResponseWriter, r *http.Request, res models.Reservation, amount int, form *forms.Form) {
+	property, err := m.roomProperty(res.RoomID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["reservation"] = res
+
+	stringMap := make(map[string]string)
+	stringMap["amount"] = render.FormatMoney(amount, property.Currency)
+	stringMap["publishable_key"] = m.App.PaymentConfig.PublishableKey
+	stringMap["start_date"] = res.StartDate.Format("2006-01-02")
+	stringMap["end_date"] = res.EndDate.Format("2006-01-02")
+
+	intMap := make(map[string]int)
+	intMap["deposit_percent"] = m.App.PaymentConfig.DepositPercent
+	intMap["free_cancellation_days"] = m.App.PaymentConfig.RefundPolicy.FreeCancellationDays
+	intMap["late_refund_percent"] = m.App.PaymentConfig.RefundPolicy.LateRefundPercent
+
+	render.Template(w, r, "make-payment.page.tmpl", &models.TemplateData{
+		Form:      form,
+		Data:      data,
+		StringMap: stringMap,
+		IntMap:    intMap,
+	})
+}
+
+// PostPaymentPage takes the deposit for the reservation in the session and confirms it
+func (m *Repository) PostPaymentPage(w http.ResponseWriter, r *http.Request) {
+	res, ok := m.App.Session.Get(r.Context(), "reservation").(models.Reservation)
+	if !ok || res.ID == 0 {
+		m.App.Session.Put(r.Context(), "error", "Can't get reservation from session")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if res.Status != models.StatusPending {
+		http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+		return
+	}
+	if m.paymentExpired(w, r, res) {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	amount, err := m.depositFor(res)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if amount == 0 {
+		http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("payment_method")
+	if !form.Valid() {
+		m.renderPayment(w, r, res, amount, form)
+		return
+	}
+
+	property, err := m.roomProperty(res.RoomID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	paymentMethod := r.Form.Get("payment_method")
+	charge, err := m.App.Payments.Authorize(payments.AuthorizeRequest{
+		Amount:         amount,
+		Currency:       property.Currency,
+		PaymentMethod:  paymentMethod,
+		Description:    fmt.Sprintf("Deposit for reservation %d", res.ID),
+		Email:          res.Email,
+		IdempotencyKey: fmt.Sprintf("reservation-%d-%s", res.ID, paymentMethod),
+	})
+	if errors.Is(err, payments.ErrDeclined) {
+		form.Errors.Add("payment_method", err.Error())
+		m.renderPayment(w, r, res, amount, form)
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println("Error authorizing payment:", err)
+		m.App.Session.Put(r.Context(), "error", "We couldn't reach our payment provider, please try again")
+		http.Redirect(w, r, "/make-payment", http.StatusSeeOther)
+		return
+	}
+
+	payment := models.Payment{
+		ReservationID:     res.ID,
+		Provider:          m.App.Payments.Name(),
+		ProviderPaymentID: charge.ID,
+		Amount:            amount,
+		Currency:          property.Currency,
+		Status:            models.PaymentAuthorized,
+	}
+	payment.ID, err = m.db(r).InsertPayment(payment)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	_, err = m.App.Payments.Capture(charge.ID, amount)
+	if err != nil {
+		m.App.ErrorLog.Println("Error capturing payment:", err)
+		m.App.Session.Put(r.Context(), "error", "Your card was authorized but we couldn't complete the payment, please contact us")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	payment.Status = models.PaymentCaptured
+	err = m.db(r).UpdatePayment(payment)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.db(r).UpdateReservationStatus(res.ID, models.StatusConfirmed)
+	if err != nil {
+		m.App.ErrorLog.Println("Error confirming paid reservation:", err)
+	} else {
+		confirmed := res
+		confirmed.Status = models.StatusConfirmed
+		m.reservationWebhook(property.ID, models.EventReservationUpdated, confirmed)
+		res = confirmed
+	}
+
+	m.sendReservationEmails(res)
+
+	m.App.Session.Put(r.Context(), "reservation", res)
+	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+}
+
+// refundCancellation refunds the payments for a cancelled reservation as the refund policy
+// allows, returning the total refunded
+func (m *Repository) refundCancellation(r *http.Request, res models.Reservation) (int, error) {
+	if m.App.Payments == nil {
+		return 0, nil
+	}
+
+	list, err := m.DB.GetPaymentsForReservation(res.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	property, err := m.roomProperty(res.RoomID)
+	if err != nil {
+		return 0, err
+	}
+	// the arrival day starts at midnight where the property is
+	arrival := res.StartDate.In(property.Location())
+
+	total := 0
+	for _, payment := range list {
+		if payment.Provider != m.App.Payments.Name() {
+			continue
+		}
+
+		amount := m.App.PaymentConfig.RefundPolicy.RefundAmount(payment.Refundable(), arrival, time.Now())
+		if amount == 0 {
+			continue
+		}
+
+		_, err := m.App.Payments.Refund(payment.ProviderPaymentID, amount)
+		if err != nil {
+			return total, err
+		}
+
+		payment.ApplyRefund(amount)
+		err = m.db(r).UpdatePayment(payment)
+		if err != nil {
+			return total, err
+		}
+
+		total += amount
+	}
+
+	return total, nil
+}
+
+// PaymentWebhook receives payment events from the payment provider and keeps the stored
+// payments in step with payments changed outside the application, such as refunds made from
+// the provider's dashboard
+func (m *Repository) PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	if m.App.Payments == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, "unable to read body", http.StatusBadRequest)
+		return
+	}
+
+	event, err := m.App.Payments.VerifyWebhook(payload, r.Header)
+	if err != nil {
+		m.App.ErrorLog.Println("Rejected payment webhook:", err)
+		http.Error(w, "invalid webhook", http.StatusBadRequest)
+		return
+	}
+
+	payment, err := m.DB.GetPaymentByProviderID(m.App.Payments.Name(), event.PaymentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// not a payment we took, nothing to do
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	before := payment
+	switch event.Type {
+	case payments.EventPaymentSucceeded:
+		if payment.Status == models.PaymentAuthorized {
+			payment.Status = models.PaymentCaptured
+		}
+	case payments.EventPaymentFailed:
+		if payment.Status == models.PaymentAuthorized {
+			payment.Status = models.PaymentFailed
+		}
+	case payments.EventPaymentCancelled:
+		if payment.Status == models.PaymentAuthorized {
+			payment.Status = models.PaymentCancelled
+		}
+	case payments.EventRefunded:
+		if event.AmountRefunded > payment.RefundedAmount {
+			payment.SetRefundedAmount(event.AmountRefunded)
+		}
+	}
+
+	if payment.Status != before.Status || payment.RefundedAmount != before.RefundedAmount {
+		// the change is made by the payment provider, not by whoever holds the session
+		actor := m.auditActor(r)
+		actor.UserID = 0
+		actor.Actor = "system"
+		err = m.DB.As(actor).UpdatePayment(payment)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
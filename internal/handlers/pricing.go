@@ -0,0 +1,392 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ashparshp/bookings/internal/forms"
+	"github.com/ashparshp/bookings/internal/helpers"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/render"
+	"github.com/go-chi/chi/v5"
+)
+
+// priceStay works out the charges for res with the active tax and fee rules of the room's
+// property and promo, which may be nil
+func (m *Repository) priceStay(res models.Reservation, promo *models.PromoCode) ([]models.Charge, error) {
+	room, err := m.DB.GetRoomByID(res.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := m.DB.AllChargeRules(room.PropertyID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return models.PriceStay(res, room, rules, promo), nil
+}
+
+// chargesFor returns the charges for res as they were booked, working them out from the
+// current rules for reservations booked before charges were kept
+func (m *Repository) chargesFor(res models.Reservation) ([]models.Charge, error) {
+	if len(res.Charges) > 0 {
+		return res.Charges, nil
+	}
+
+	if res.ID > 0 {
+		charges, err := m.DB.GetReservationCharges(res.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(charges) > 0 {
+			return charges, nil
+		}
+	}
+
+	return m.priceStay(res, nil)
+}
+
+// promoFor looks up the promo code entered on the reservation form among those of the room's
+// property and checks it can be used for res, adding the reason to the form when it can't. It
+// returns nil when no code was entered.
+func (m *Repository) promoFor(form *forms.Form, res models.Reservation) (*models.PromoCode, error) {
+	code := models.NormalizePromoCode(form.Get("promo_code"))
+	if code == "" {
+		return nil, nil
+	}
+
+	room, err := m.DB.GetRoomByID(res.RoomID)
+	if err != nil {
+		return nil, err
+	}
+
+	promo, err := m.DB.GetPromoCodeByCode(room.PropertyID, code)
+	if errors.Is(err, sql.ErrNoRows) {
+		form.Errors.Add("promo_code", models.ErrPromoInvalid.Error())
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	property, err := m.DB.GetPropertyByID(room.PropertyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := promo.Check(res.RoomID, models.Today(property.Location())); err != nil {
+		form.Errors.Add("promo_code", err.Error())
+		return nil, nil
+	}
+
+	return &promo, nil
+}
+
+// parseMoney reads an amount such as "12.50" into the smallest unit of the currency
+func parseMoney(s string) (int, bool) {
+	s = strings.TrimSpace(s)
+	whole, frac, _ := strings.Cut(s, ".")
+	if len(frac) > 2 {
+		return 0, false
+	}
+	frac = (frac + "00")[:2]
+
+	units, err := strconv.Atoi(whole)
+	if err != nil || units < 0 {
+		return 0, false
+	}
+	cents, err := strconv.Atoi(frac)
+	if err != nil || cents < 0 {
+		return 0, false
+	}
+
+	return units*100 + cents, true
+}
+
+// AdminPricingPage shows the tax and fee rules and the promo codes
+func (m *Repository) AdminPricingPage(w http.ResponseWriter, r *http.Request) {
+	m.renderPricing(w, r, forms.New(nil))
+}
+
+// renderPricing renders the pricing page with the given form, which holds any errors from
+// adding a rule or promo code
+func (m *Repository) renderPricing(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	property := helpers.CurrentProperty(r)
+
+	rules, err := m.DB.AllChargeRules(property.ID, false)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	promos, err := m.DB.AllPromoCodes(property.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	rooms, err := m.DB.AllRooms(property.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	roomNames := make(map[int]string)
+	for _, room := range rooms {
+		roomNames[room.ID] = room.RoomName
+	}
+
+	data := make(map[string]interface{})
+	data["rules"] = rules
+	data["promos"] = promos
+	data["rooms"] = rooms
+	data["room_names"] = roomNames
+
+	stringMap := make(map[string]string)
+	stringMap["currency"] = property.Currency
+
+	render.Template(w, r, "admin-pricing.page.tmpl", &models.TemplateData{
+		Form:      form,
+		Data:      data,
+		StringMap: stringMap,
+	})
+}
+
+// AdminPostChargeRulePage adds a tax or fee rule
+func (m *Repository) AdminPostChargeRulePage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("rule_name", "rule_kind", "rule_basis", "rule_amount")
+
+	rule := models.ChargeRule{
+		PropertyID: helpers.CurrentProperty(r).ID,
+		Name:       strings.TrimSpace(r.Form.Get("rule_name")),
+		Kind:       r.Form.Get("rule_kind"),
+		Basis:      r.Form.Get("rule_basis"),
+		Per:        r.Form.Get("rule_per"),
+		Active:     true,
+	}
+
+	if rule.Kind != models.ChargeTax && rule.Kind != models.ChargeFee {
+		form.Errors.Add("rule_kind", "Choose tax or fee")
+	}
+
+	switch rule.Basis {
+	case models.BasisPercent:
+		rule.Per = models.PerStay
+		rule.Amount, err = strconv.Atoi(strings.TrimSpace(r.Form.Get("rule_amount")))
+		if err != nil || rule.Amount <= 0 || rule.Amount > 100 {
+			form.Errors.Add("rule_amount", "Enter a whole percentage between 1 and 100")
+		}
+	case models.BasisFlat:
+		switch rule.Per {
+		case models.PerStay, models.PerNight, models.PerGuest, models.PerGuestNight:
+		default:
+			form.Errors.Add("rule_per", "Choose what the amount is charged per")
+		}
+		var ok bool
+		rule.Amount, ok = parseMoney(r.Form.Get("rule_amount"))
+		if !ok || rule.Amount == 0 {
+			form.Errors.Add("rule_amount", "Enter an amount such as 2.50")
+		}
+	default:
+		form.Errors.Add("rule_basis", "Choose a percentage or a flat amount")
+	}
+
+	if !form.Valid() {
+		m.renderPricing(w, r, form)
+		return
+	}
+
+	rule.ID, err = m.db(r).InsertChargeRule(rule)
+	if err != nil {
+		m.App.ErrorLog.Println("Error saving charge rule:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to save the rule")
+		http.Redirect(w, r, "/admin/pricing", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s added", rule.Name))
+	http.Redirect(w, r, "/admin/pricing", http.StatusSeeOther)
+}
+
+// AdminToggleChargeRulePage switches a tax or fee rule on or off. Reservations already made
+// keep the charges they were booked with.
+func (m *Repository) AdminToggleChargeRulePage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid rule ID")
+		http.Redirect(w, r, "/admin/pricing", http.StatusSeeOther)
+		return
+	}
+
+	before, err := m.DB.GetChargeRuleByID(id)
+	if err != nil || !canManage(r, before.PropertyID) {
+		m.App.Session.Put(r.Context(), "error", "Unable to retrieve the rule")
+		http.Redirect(w, r, "/admin/pricing", http.StatusSeeOther)
+		return
+	}
+
+	err = m.db(r).SetChargeRuleActive(id, !before.Active)
+	if err != nil {
+		m.App.ErrorLog.Println("Error updating charge rule:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to update the rule")
+		http.Redirect(w, r, "/admin/pricing", http.StatusSeeOther)
+		return
+	}
+
+	after := before
+	after.Active = !before.Active
+
+	state := "switched off"
+	if after.Active {
+		state = "switched on"
+	}
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s %s", after.Name, state))
+	http.Redirect(w, r, "/admin/pricing", http.StatusSeeOther)
+}
+
+// AdminPostPromoCodePage adds a promo code
+func (m *Repository) AdminPostPromoCodePage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code", "discount_type", "discount")
+
+	promo := models.PromoCode{
+		PropertyID:  helpers.CurrentProperty(r).ID,
+		Code:        models.NormalizePromoCode(r.Form.Get("code")),
+		Description: strings.TrimSpace(r.Form.Get("description")),
+		Active:      true,
+	}
+
+	if promo.Code != "" && strings.ContainsAny(promo.Code, " \t") {
+		form.Errors.Add("code", "Codes can't contain spaces")
+	}
+	if _, err := m.DB.GetPromoCodeByCode(promo.PropertyID, promo.Code); err == nil {
+		form.Errors.Add("code", "That code already exists")
+	}
+
+	switch r.Form.Get("discount_type") {
+	case "percent":
+		promo.PercentOff, err = strconv.Atoi(strings.TrimSpace(r.Form.Get("discount")))
+		if err != nil || promo.PercentOff <= 0 || promo.PercentOff > 100 {
+			form.Errors.Add("discount", "Enter a whole percentage between 1 and 100")
+		}
+	case "amount":
+		var ok bool
+		promo.AmountOff, ok = parseMoney(r.Form.Get("discount"))
+		if !ok || promo.AmountOff == 0 {
+			form.Errors.Add("discount", "Enter an amount such as 25.00")
+		}
+	default:
+		form.Errors.Add("discount_type", "Choose a percentage or an amount off")
+	}
+
+	if v := r.Form.Get("valid_from"); v != "" {
+		promo.ValidFrom, err = models.ParseDate(v)
+		if err != nil {
+			form.Errors.Add("valid_from", "Enter a date")
+		}
+	}
+	if v := r.Form.Get("valid_until"); v != "" {
+		promo.ValidUntil, err = models.ParseDate(v)
+		if err != nil {
+			form.Errors.Add("valid_until", "Enter a date")
+		}
+	}
+	if !promo.ValidFrom.IsZero() && !promo.ValidUntil.IsZero() && promo.ValidUntil.Before(promo.ValidFrom) {
+		form.Errors.Add("valid_until", "The code must end after it starts")
+	}
+
+	if v := strings.TrimSpace(r.Form.Get("max_uses")); v != "" {
+		promo.MaxUses, err = strconv.Atoi(v)
+		if err != nil || promo.MaxUses < 0 {
+			form.Errors.Add("max_uses", "Enter a number, or leave empty for no limit")
+		}
+	}
+
+	rooms, err := m.DB.AllRooms(promo.PropertyID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	propertyRooms := make(map[int]bool)
+	for _, room := range rooms {
+		propertyRooms[room.ID] = true
+	}
+
+	for _, v := range r.Form["room_ids"] {
+		roomID, err := strconv.Atoi(v)
+		if err != nil || !propertyRooms[roomID] {
+			form.Errors.Add("room_ids", "Invalid room")
+			break
+		}
+		promo.RoomIDs = append(promo.RoomIDs, roomID)
+	}
+
+	if !form.Valid() {
+		m.renderPricing(w, r, form)
+		return
+	}
+
+	promo.ID, err = m.db(r).InsertPromoCode(promo)
+	if err != nil {
+		m.App.ErrorLog.Println("Error saving promo code:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to save the promo code")
+		http.Redirect(w, r, "/admin/pricing", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Promo code %s added", promo.Code))
+	http.Redirect(w, r, "/admin/pricing", http.StatusSeeOther)
+}
+
+// AdminTogglePromoCodePage switches a promo code on or off
+func (m *Repository) AdminTogglePromoCodePage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Invalid promo code ID")
+		http.Redirect(w, r, "/admin/pricing", http.StatusSeeOther)
+		return
+	}
+
+	before, err := m.DB.GetPromoCodeByID(id)
+	if err != nil || !canManage(r, before.PropertyID) {
+		m.App.Session.Put(r.Context(), "error", "Unable to retrieve the promo code")
+		http.Redirect(w, r, "/admin/pricing", http.StatusSeeOther)
+		return
+	}
+
+	err = m.db(r).SetPromoCodeActive(id, !before.Active)
+	if err != nil {
+		m.App.ErrorLog.Println("Error updating promo code:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to update the promo code")
+		http.Redirect(w, r, "/admin/pricing", http.StatusSeeOther)
+		return
+	}
+
+	after := before
+	after.Active = !before.Active
+
+	state := "switched off"
+	if after.Active {
+		state = "switched on"
+	}
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("Promo code %s %s", after.Code, state))
+	http.Redirect(w, r, "/admin/pricing", http.StatusSeeOther)
+}
@@ -0,0 +1,384 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/forms"
+	"github.com/ashparshp/bookings/internal/helpers"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/render"
+	"github.com/ashparshp/bookings/internal/repository"
+	"github.com/go-chi/chi/v5"
+)
+
+// propertySlug matches the slugs used in /p/{slug}/ path prefixes
+var propertySlug = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// ResolveProperty works out which property a public request is for and puts it on the request
+// context. A /p/{slug}/ path prefix wins and is remembered in the session, then the hostname,
+// then the property remembered in the session, then the first property.
+func (m *Repository) ResolveProperty(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var property models.Property
+		var err error
+
+		if rest, ok := strings.CutPrefix(r.URL.Path, "/p/"); ok {
+			slug, path, _ := strings.Cut(rest, "/")
+			property, err = m.DB.GetPropertyBySlug(slug)
+			if errors.Is(err, sql.ErrNoRows) {
+				http.NotFound(w, r)
+				return
+			}
+			if err != nil {
+				helpers.ServerError(w, err)
+				return
+			}
+			m.App.Session.Put(r.Context(), "property_id", property.ID)
+
+			// route the rest of the path as if there were no prefix
+			u := *r.URL
+			u.Path = "/" + path
+			u.RawPath = ""
+			r.URL = &u
+		} else {
+			property, err = m.hostProperty(r)
+			if err != nil {
+				helpers.ServerError(w, err)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(helpers.WithProperty(r.Context(), property)))
+	})
+}
+
+// hostProperty returns the property served on the request's hostname, falling back to the one
+// remembered in the session and then the first property
+func (m *Repository) hostProperty(r *http.Request) (models.Property, error) {
+	property, err := m.DB.GetPropertyByHostname(r.Host)
+	if err == nil || !errors.Is(err, sql.ErrNoRows) {
+		return property, err
+	}
+
+	if id := m.App.Session.GetInt(r.Context(), "property_id"); id > 0 {
+		property, err = m.DB.GetPropertyByID(id)
+		if err == nil || !errors.Is(err, sql.ErrNoRows) {
+			return property, err
+		}
+	}
+
+	properties, err := m.DB.AllProperties()
+	if err != nil {
+		return property, err
+	}
+	if len(properties) == 0 {
+		return property, errors.New("no properties have been set up")
+	}
+	return properties[0], nil
+}
+
+// AdminProperty scopes the admin area to the property the signed in staff member has selected,
+// putting it and the other properties they can manage on the request context
+func (m *Repository) AdminProperty(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		properties, err := m.DB.PropertiesForUser(m.App.Session.GetInt(r.Context(), "user_id"))
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		if len(properties) == 0 {
+			m.App.Session.Put(r.Context(), "error", "You haven't been given access to any property yet")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		selected := properties[0]
+		id := m.App.Session.GetInt(r.Context(), "admin_property_id")
+		for _, p := range properties {
+			if p.ID == id {
+				selected = p
+			}
+		}
+
+		ctx := helpers.WithProperties(r.Context(), properties)
+		ctx = helpers.WithProperty(ctx, selected)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// canManage reports whether the signed in staff member has access to a property
+func canManage(r *http.Request, propertyID int) bool {
+	for _, p := range helpers.AllowedProperties(r) {
+		if p.ID == propertyID {
+			return true
+		}
+	}
+	return false
+}
+
+// propertyToday returns today's date at the property the request is for
+func propertyToday(r *http.Request) models.Date {
+	return models.Today(helpers.CurrentProperty(r).Location())
+}
+
+// roomProperty returns the property a room belongs to
+func (m *Repository) roomProperty(roomID int) (models.Property, error) {
+	room, err := m.DB.GetRoomByID(roomID)
+	if err != nil {
+		return models.Property{}, err
+	}
+	return m.DB.GetPropertyByID(room.PropertyID)
+}
+
+// AdminSelectPropertyPage switches the admin area to the posted property_id
+func (m *Repository) AdminSelectPropertyPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(r.Form.Get("property_id"))
+	if err != nil || !canManage(r, id) {
+		m.App.Session.Put(r.Context(), "error", "You can't manage that property")
+		http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "admin_property_id", id)
+	http.Redirect(w, r, "/admin/dashboard", http.StatusSeeOther)
+}
+
+// AdminPropertiesPage lists the properties the signed in staff member can manage
+func (m *Repository) AdminPropertiesPage(w http.ResponseWriter, r *http.Request) {
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["user"] = user
+
+	render.Template(w, r, "admin-properties.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// ownerOnly refuses to add a property unless the signed in staff member is an owner, as a new
+// property isn't covered by anyone's access yet. It reports whether the request was refused.
+func (m *Repository) ownerOnly(w http.ResponseWriter, r *http.Request) bool {
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return true
+	}
+	if !user.IsOwner() {
+		m.App.Session.Put(r.Context(), "error", "Only owners can add properties")
+		http.Redirect(w, r, "/admin/properties", http.StatusSeeOther)
+		return true
+	}
+	return false
+}
+
+// AdminShowPropertyPage shows the settings and staff of a property, or an empty form to add one
+func (m *Repository) AdminShowPropertyPage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || (id > 0 && !canManage(r, id)) {
+		m.App.Session.Put(r.Context(), "error", "Invalid property ID")
+		http.Redirect(w, r, "/admin/properties", http.StatusSeeOther)
+		return
+	}
+	if id == 0 && m.ownerOnly(w, r) {
+		return
+	}
+
+	property := models.Property{
+		Currency:   "usd",
+		Timezone:   "UTC",
+		BrandColor: "#0d6efd",
+	}
+	if id > 0 {
+		property, err = m.DB.GetPropertyByID(id)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Unable to retrieve property")
+			http.Redirect(w, r, "/admin/properties", http.StatusSeeOther)
+			return
+		}
+	}
+
+	m.renderProperty(w, r, property, forms.New(nil))
+}
+
+// renderProperty renders the property page for property with the given form, which holds any
+// errors from saving it
+func (m *Repository) renderProperty(w http.ResponseWriter, r *http.Request, property models.Property, form *forms.Form) {
+	data := make(map[string]interface{})
+	data["property"] = property
+
+	if property.ID > 0 {
+		staff, err := m.DB.AllStaff()
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		ids, err := m.DB.GetPropertyStaffIDs(property.ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+
+		access := make(map[int]bool)
+		for _, id := range ids {
+			access[id] = true
+		}
+
+		data["staff"] = staff
+		data["access"] = access
+	}
+
+	render.Template(w, r, "admin-property.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// AdminPostPropertyPage saves a new or edited property
+func (m *Repository) AdminPostPropertyPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || (id > 0 && !canManage(r, id)) {
+		m.App.Session.Put(r.Context(), "error", "Invalid property ID")
+		http.Redirect(w, r, "/admin/properties", http.StatusSeeOther)
+		return
+	}
+	if id == 0 && m.ownerOnly(w, r) {
+		return
+	}
+
+	property := models.Property{
+		ID:          id,
+		Name:        strings.TrimSpace(r.Form.Get("name")),
+		Slug:        strings.ToLower(strings.TrimSpace(r.Form.Get("slug"))),
+		Hostname:    models.NormalizeHostname(r.Form.Get("hostname")),
+		Currency:    strings.ToLower(strings.TrimSpace(r.Form.Get("currency"))),
+		Timezone:    strings.TrimSpace(r.Form.Get("timezone")),
+		NotifyEmail: strings.TrimSpace(r.Form.Get("notify_email")),
+		BrandColor:  r.Form.Get("brand_color"),
+		LogoURL:     strings.TrimSpace(r.Form.Get("logo_url")),
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("name", "slug", "currency", "timezone", "brand_color")
+	if property.Slug != "" && !propertySlug.MatchString(property.Slug) {
+		form.Errors.Add("slug", "Use lower case letters, numbers and dashes only")
+	}
+	if property.Currency != "" && len(property.Currency) != 3 {
+		form.Errors.Add("currency", "Use a three letter currency code such as usd")
+	}
+	if _, err := time.LoadLocation(property.Timezone); property.Timezone != "" && err != nil {
+		form.Errors.Add("timezone", "Use a timezone name such as Europe/London")
+	}
+	if property.NotifyEmail != "" {
+		form.IsEmail("notify_email")
+	}
+	if property.BrandColor != "" && !hexColor.MatchString(property.BrandColor) {
+		form.Errors.Add("brand_color", "Colour must be a hex value such as #0d6efd")
+	}
+
+	if !form.Valid() {
+		m.renderProperty(w, r, property, form)
+		return
+	}
+
+	if id == 0 {
+		property.ID, err = m.db(r).InsertProperty(property, m.App.Session.GetInt(r.Context(), "user_id"))
+	} else {
+		err = m.db(r).UpdateProperty(property)
+	}
+	if errors.Is(err, repository.ErrPropertyExists) {
+		form.Errors.Add("slug", "Another property already uses this slug or hostname")
+		m.renderProperty(w, r, property, form)
+		return
+	}
+	if err != nil {
+		m.App.ErrorLog.Println("Error saving property:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to save property")
+		http.Redirect(w, r, "/admin/properties", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Property saved")
+	http.Redirect(w, r, fmt.Sprintf("/admin/properties/%d/show", property.ID), http.StatusSeeOther)
+}
+
+// AdminPostPropertyStaffPage sets which staff users can manage a property from the posted
+// user_ids
+func (m *Repository) AdminPostPropertyStaffPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || !canManage(r, id) {
+		m.App.Session.Put(r.Context(), "error", "Invalid property ID")
+		http.Redirect(w, r, "/admin/properties", http.StatusSeeOther)
+		return
+	}
+	redirectURL := fmt.Sprintf("/admin/properties/%d/show", id)
+
+	var userIDs []int
+	for _, v := range r.PostForm["user_ids"] {
+		userID, err := strconv.Atoi(v)
+		if err != nil {
+			m.App.Session.Put(r.Context(), "error", "Invalid staff member")
+			http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+			return
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	// keep staff from locking themselves out of the property they are editing
+	userID := m.App.Session.GetInt(r.Context(), "user_id")
+	if !containsID(userIDs, userID) {
+		m.App.Session.Put(r.Context(), "error", "You can't remove your own access to a property")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+
+	err = m.db(r).SetPropertyStaff(id, userIDs)
+	if err != nil {
+		m.App.ErrorLog.Println("Error saving property staff:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to save staff access")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Staff access saved")
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+// containsID reports whether ids holds id
+func containsID(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/config"
+	"github.com/ashparshp/bookings/internal/helpers"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/render"
+	"github.com/go-chi/chi/v5"
+)
+
+// sessionsUser returns the staff user whose sessions a request is for. Owners can manage anyone's
+// sessions and other staff only their own; for anyone else an error is put in the session.
+func (m *Repository) sessionsUser(r *http.Request) (models.User, bool, error) {
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		return models.User{}, false, err
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "Account not found")
+		return models.User{}, false, nil
+	}
+	if id == user.ID {
+		return user, true, nil
+	}
+	if !user.IsOwner() {
+		m.App.Session.Put(r.Context(), "error", "Only owners can manage other staff's sessions")
+		return models.User{}, false, nil
+	}
+
+	target, err := m.DB.GetUserByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "Account not found")
+		return models.User{}, false, nil
+	}
+	return target, err == nil, err
+}
+
+// endCurrentSession signs the request's own session out, as a revoke would if the session
+// weren't saved again at the end of the request
+func (m *Repository) endCurrentSession(w http.ResponseWriter, r *http.Request) {
+	_ = m.App.Session.Destroy(r.Context())
+	_ = m.App.Session.RenewToken(r.Context())
+	m.App.Session.Put(r.Context(), "flash", "You have been signed out")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// AdminSessionsPage lists a staff user's active sessions
+func (m *Repository) AdminSessionsPage(w http.ResponseWriter, r *http.Request) {
+	target, ok, err := m.sessionsUser(r)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if !ok {
+		http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+		return
+	}
+
+	var sessions []models.Session
+	if m.App.SessionStore == config.SessionStorePostgres {
+		sessions, err = m.DB.UserSessions(target.ID, m.App.Session.Token(r.Context()), time.Now())
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	data := make(map[string]interface{})
+	data["target"] = target
+	data["sessions"] = sessions
+	data["listed"] = m.App.SessionStore == config.SessionStorePostgres
+
+	render.Template(w, r, "admin-sessions.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// AdminRevokeSessionPage signs one of a staff user's sessions out
+func (m *Repository) AdminRevokeSessionPage(w http.ResponseWriter, r *http.Request) {
+	target, ok, err := m.sessionsUser(r)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if !ok {
+		http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+		return
+	}
+	back := fmt.Sprintf("/admin/security/users/%d/sessions", target.ID)
+
+	if m.App.SessionStore != config.SessionStorePostgres {
+		m.App.Session.Put(r.Context(), "error", "Sessions are kept in memory, so they can't be revoked")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	id, _ := strconv.Atoi(chi.URLParam(r, "session"))
+	sessions, err := m.DB.UserSessions(target.ID, m.App.Session.Token(r.Context()), time.Now())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	current := false
+	for _, s := range sessions {
+		if s.ID == id && s.Current {
+			current = true
+		}
+	}
+
+	err = m.db(r).RevokeSession(target.ID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		m.App.Session.Put(r.Context(), "error", "That session has already ended")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// the request's own session has to be ended as well, or it would be saved again at the end
+	// of the request
+	if current {
+		m.endCurrentSession(w, r)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "The session has been signed out")
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// AdminRevokeAllSessionsPage signs a staff user out everywhere, including from the request's own
+// session when it is theirs
+func (m *Repository) AdminRevokeAllSessionsPage(w http.ResponseWriter, r *http.Request) {
+	target, ok, err := m.sessionsUser(r)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if !ok {
+		http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+		return
+	}
+	back := fmt.Sprintf("/admin/security/users/%d/sessions", target.ID)
+
+	if m.App.SessionStore != config.SessionStorePostgres {
+		m.App.Session.Put(r.Context(), "error", "Sessions are kept in memory, so they can't be revoked")
+		http.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+
+	_, err = m.db(r).RevokeUserSessions(target.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if target.ID == m.App.Session.GetInt(r.Context(), "user_id") {
+		m.endCurrentSession(w, r)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s %s has been signed out everywhere", target.FirstName, target.LastName))
+	http.Redirect(w, r, back, http.StatusSeeOther)
+}
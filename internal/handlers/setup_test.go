@@ -2,20 +2,29 @@ package handlers
 
 import (
 	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/ashparshp/bookings/internal/channels"
+	"github.com/ashparshp/bookings/internal/channels/channeltest"
 	"github.com/ashparshp/bookings/internal/config"
+	"github.com/ashparshp/bookings/internal/helpers"
 	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/payments"
 	"github.com/ashparshp/bookings/internal/render"
+	"github.com/ashparshp/bookings/internal/repository"
+	"github.com/ashparshp/bookings/internal/webhooks"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/justinas/nosurf"
@@ -26,6 +35,7 @@ var functions = template.FuncMap{
 	"formatDate": render.FormatDate,
 	"iterate": render.Iterate,
 	"add": render.Add,
+	"formatMoney": render.FormatMoney,
 }
 var app config.AppConfig
 var session *scs.SessionManager
@@ -48,6 +58,11 @@ func TestMain(m *testing.M) {
     errorLog := log.New(io.Discard, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
     app.ErrorLog = errorLog
 
+	app.SiteURL = "https://bookings.example.com"
+	app.BookingConfig = config.BookingConfig{MinStayNights: 1, MaxStayNights: 30, HorizonDays: 365, HoldMinutes: 15}
+	app.Channels = channels.DefaultRegistry()
+	app.Webhooks = webhooks.NewSender(time.Second)
+
 	session = scs.New()
 	session.Lifetime = 24 * time.Hour
 	session.Cookie.Persist = true
@@ -76,15 +91,17 @@ func TestMain(m *testing.M) {
 	NewHandler(repo)
 
 	render.NewRenderer(&app)
+	helpers.NewHelpers(&app)
 	app.Session = session
 
 	os.Exit(m.Run())
 }
 
 func listenForMail() {
+	mailChan := app.MailChan
 	go func() {
 		for {
-			_ = <-app.MailChan
+			_ = <-mailChan
 		}
 	}()
 }
@@ -96,6 +113,7 @@ func getRoutes() http.Handler {
 	mux.Use(middleware.Recoverer)
 	// mux.Use(NoSurf)
 	mux.Use(SessionLoad)
+	mux.Use(Repo.ResolveProperty)
 
 	mux.Get("/", Repo.HomePage)
 	mux.Get("/about", Repo.AboutPage)
@@ -104,6 +122,10 @@ func getRoutes() http.Handler {
 	mux.Get("/search-availability", Repo.AvailabilityPage)
 	mux.Post("/search-availability", Repo.PostAvailabilityPage)
 	mux.Post("/search-availability-json", Repo.AvailabilityJSON)
+	mux.Get("/rooms/{id}/calendar", Repo.RoomCalendarJSON)
+	mux.Get("/waitlist", Repo.WaitlistPage)
+	mux.Post("/waitlist", Repo.PostWaitlistPage)
+	mux.Get("/waitlist/{token}", Repo.WaitlistOfferPage)
 	mux.Get("/contact", Repo.ContactPage)
 	mux.Get("/make-reservation", Repo.ReservationPage)
 	mux.Post("/make-reservation", Repo.PostReservationPage)
@@ -168,4 +190,102 @@ func CreateTestTemplateCache() (map[string]*template.Template, error) {
 		myCache[name] = ts
 	}
 	return myCache, nil
-}
\ No newline at end of file
+}
+
+// testProvider is a payment provider that never leaves the process
+type testProvider struct {
+	refunded int
+}
+
+func (p *testProvider) Name() string {
+	return "test"
+}
+
+func (p *testProvider) Authorize(req payments.AuthorizeRequest) (payments.Charge, error) {
+	switch req.PaymentMethod {
+	case "pm_card_chargeDeclined":
+		return payments.Charge{}, fmt.Errorf("%w: Your card was declined.", payments.ErrDeclined)
+	case "pm_provider_down":
+		return payments.Charge{}, errors.New("payment provider returned 500")
+	}
+	return payments.Charge{ID: "pi_1", Status: "requires_capture", Amount: req.Amount}, nil
+}
+
+func (p *testProvider) Capture(paymentID string, amount int) (payments.Charge, error) {
+	return payments.Charge{ID: paymentID, Status: "succeeded", Amount: amount, AmountCaptured: amount}, nil
+}
+
+func (p *testProvider) Refund(paymentID string, amount int) (payments.Refund, error) {
+	p.refunded += amount
+	return payments.Refund{ID: "re_1", Amount: amount, Status: "succeeded"}, nil
+}
+
+// VerifyWebhook accepts any payload signed "ok", which is the event as JSON
+func (p *testProvider) VerifyWebhook(payload []byte, header http.Header) (payments.Event, error) {
+	var event payments.Event
+	if header.Get("X-Test-Signature") != "ok" {
+		return event, payments.ErrInvalidSignature
+	}
+	err := json.Unmarshal(payload, &event)
+	return event, err
+}
+
+// withPayments runs f with deposits taken by provider
+// webhookRecorder is a repository keeping the webhook events queued through it
+type webhookRecorder struct {
+	repository.DatabaseRepo
+	events []string
+}
+
+func (m *webhookRecorder) InsertWebhookDeliveries(propertyID int, eventID, event, payload string) (int, error) {
+	m.events = append(m.events, event)
+	return m.DatabaseRepo.InsertWebhookDeliveries(propertyID, eventID, event, payload)
+}
+
+func withPayments(provider payments.PaymentProvider, f func()) {
+	app.Payments = provider
+	app.PaymentConfig = config.PaymentConfig{
+		DepositPercent: 30,
+		RefundPolicy:   payments.RefundPolicy{FreeCancellationDays: 7, LateRefundPercent: 0},
+	}
+	defer func() {
+		app.Payments = nil
+	}()
+	f()
+}
+
+// withChannel runs f with every channel of the JSON channel API kind reached at srv, whatever
+// address it has in the test repo
+func withChannel(srv *channeltest.Server, f func()) {
+	app.Channels = channels.Registry{
+		channels.KindHTTP: func(c models.Channel) channels.Adapter {
+			c.BaseURL = srv.URL
+			return channels.NewHTTP(c)
+		},
+	}
+	defer func() {
+		app.Channels = channels.DefaultRegistry()
+	}()
+	f()
+}
+
+// handlerTransport answers requests with a handler instead of sending them anywhere
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rr := httptest.NewRecorder()
+	t.handler.ServeHTTP(rr, req)
+	return rr.Result(), nil
+}
+
+// withWebhookReceiver runs f with every webhook delivery answered by h, whatever its address
+func withWebhookReceiver(h http.HandlerFunc, f func()) {
+	app.Webhooks = &webhooks.Sender{Client: &http.Client{Transport: handlerTransport{h}}}
+	defer func() {
+		app.Webhooks = webhooks.NewSender(time.Second)
+	}()
+	f()
+}
+
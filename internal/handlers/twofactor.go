@@ -0,0 +1,544 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/forms"
+	"github.com/ashparshp/bookings/internal/helpers"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/render"
+	"github.com/ashparshp/bookings/internal/totp"
+)
+
+// twoFactorIssuer names the account in authenticator apps
+const twoFactorIssuer = "Bookings"
+
+// twoFactorWindow is how long staff have after giving their password to give a code or finish
+// setting up two-factor authentication
+const twoFactorWindow = 10 * time.Minute
+
+// twoFactorAttempts is how many wrong codes can be given before the password has to be given again
+const twoFactorAttempts = 5
+
+// recoveryCodeCount is how many recovery codes staff are given at a time
+const recoveryCodeCount = 10
+
+// newRecoveryCodes returns recovery codes to show the user once, and the hashes of them that are
+// all the database stores
+func newRecoveryCodes() ([]string, []string, error) {
+	var codes, hashes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, recoveryCodeHash(code))
+	}
+	return codes, hashes, nil
+}
+
+// recoveryCodeHash returns the hash of a recovery code, ignoring case, spaces and dashes
+func recoveryCodeHash(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkTwoFactorCode checks a code from the user's authenticator app, or one of their recovery
+// codes, using it up so it can't be given again. recovery reports whether it was a recovery code.
+func (m *Repository) checkTwoFactorCode(user models.User, code string) (recovery bool, ok bool, err error) {
+	if step, valid := totp.Validate(user.TOTPSecret, code, time.Now()); valid {
+		ok, err = m.DB.UseTOTPStep(user.ID, step)
+		return false, ok, err
+	}
+
+	ok, err = m.DB.UseRecoveryCode(user.ID, recoveryCodeHash(code))
+	return ok, ok, err
+}
+
+// startPendingLogin remembers a staff user who has given their password but still has to give a
+// code, or set up two-factor authentication, before they are signed in
+func (m *Repository) startPendingLogin(r *http.Request, userID int) {
+	m.App.Session.Remove(r.Context(), "user_id")
+	m.App.Session.Put(r.Context(), "pending_user_id", userID)
+	m.App.Session.Put(r.Context(), "pending_user_at", time.Now().Unix())
+	m.App.Session.Remove(r.Context(), "pending_attempts")
+}
+
+// clearPendingLogin forgets a staff user who was part way through signing in
+func (m *Repository) clearPendingLogin(r *http.Request) {
+	m.App.Session.Remove(r.Context(), "pending_user_id")
+	m.App.Session.Remove(r.Context(), "pending_user_at")
+	m.App.Session.Remove(r.Context(), "pending_attempts")
+	m.App.Session.Remove(r.Context(), "totp_secret")
+}
+
+// pendingUser returns the staff user who is part way through signing in, ending their sign in
+// when it has taken too long
+func (m *Repository) pendingUser(r *http.Request) (models.User, bool) {
+	id := m.App.Session.GetInt(r.Context(), "pending_user_id")
+	if id == 0 {
+		return models.User{}, false
+	}
+
+	started := time.Unix(m.App.Session.GetInt64(r.Context(), "pending_user_at"), 0)
+	if time.Since(started) > twoFactorWindow {
+		m.clearPendingLogin(r)
+		return models.User{}, false
+	}
+
+	user, err := m.DB.GetUserByID(id)
+	if err != nil {
+		m.App.ErrorLog.Println("Error retrieving user signing in:", err)
+		m.clearPendingLogin(r)
+		return user, false
+	}
+	return user, true
+}
+
+// signStaffIn starts a staff session, ending any guest session in the same browser, and clears
+// the failed sign ins to the account. Where it signed in from is kept so staff can tell their
+// sessions apart.
+func (m *Repository) signStaffIn(r *http.Request, user models.User) {
+	_ = m.App.Session.RenewToken(r.Context())
+	m.clearPendingLogin(r)
+	m.App.Session.Remove(r.Context(), "guest_id")
+	m.App.Session.Put(r.Context(), models.SessionUserKey, user.ID)
+	m.App.Session.Put(r.Context(), models.SessionIPKey, clientIP(r))
+	m.App.Session.Put(r.Context(), models.SessionUserAgentKey, models.TrimUserAgent(r.UserAgent()))
+	m.loginSucceeded(r, models.NormalizeEmail(user.Email))
+}
+
+// TwoFactorLoginPage asks staff who have given their password for a code from their
+// authenticator app
+func (m *Repository) TwoFactorLoginPage(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.pendingUser(r)
+	if !ok || !user.TwoFactorEnabled() {
+		m.App.Session.Put(r.Context(), "error", "Please sign in again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	render.Template(w, r, "two-factor-login.page.tmpl", &models.TemplateData{
+		Form: forms.New(nil),
+	})
+}
+
+// PostTwoFactorLoginPage signs staff in once they give a code from their authenticator app or a
+// recovery code. After too many wrong codes they have to give their password again.
+func (m *Repository) PostTwoFactorLoginPage(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.pendingUser(r)
+	if !ok || !user.TwoFactorEnabled() {
+		m.App.Session.Put(r.Context(), "error", "Your sign in has expired, please sign in again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	// wrong codes count towards locking the account as wrong passwords do, so someone who knows
+	// the password can't keep guessing codes by signing in again
+	email := models.NormalizeEmail(user.Email)
+	failures, err := m.DB.GetLoginFailures(email, clientIP(r), time.Now())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if failures.Locked() && failures.Wait(time.Now()) > 0 {
+		m.clearPendingLogin(r)
+		m.App.Session.Put(r.Context(), "error", "This account is locked after too many failed sign in attempts, please try again later")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+
+	var recovery bool
+	if form.Valid() {
+		recovery, ok, err = m.checkTwoFactorCode(user, r.Form.Get("code"))
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		if !ok {
+			if m.loginFailed(r, email, failures) {
+				m.clearPendingLogin(r)
+				m.App.Session.Put(r.Context(), "error", "This account is locked after too many failed sign in attempts, please try again later")
+				http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+				return
+			}
+			attempts := m.App.Session.GetInt(r.Context(), "pending_attempts") + 1
+			if attempts >= twoFactorAttempts {
+				m.clearPendingLogin(r)
+				m.App.Session.Put(r.Context(), "error", "Too many incorrect codes, please sign in again")
+				http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+				return
+			}
+			m.App.Session.Put(r.Context(), "pending_attempts", attempts)
+			form.Errors.Add("code", "That code isn't right, please try again")
+		}
+	}
+
+	if !form.Valid() {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		render.Template(w, r, "two-factor-login.page.tmpl", &models.TemplateData{
+			Form: form,
+		})
+		return
+	}
+
+	m.signStaffIn(r, user)
+	m.App.Session.Put(r.Context(), "flash", "Logged in successfully")
+
+	if recovery {
+		remaining, err := m.DB.CountRecoveryCodes(user.ID)
+		if err != nil {
+			m.App.ErrorLog.Println("Error counting recovery codes:", err)
+		}
+		if remaining <= 3 {
+			m.App.Session.Put(r.Context(), "warning", "You are running out of recovery codes, make new ones from your two-factor settings")
+		}
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// twoFactorUser returns the staff user whose two-factor authentication is being managed: the
+// signed in user, or a user part way through signing in who has to set it up first. Anyone else
+// is sent to sign in.
+func (m *Repository) twoFactorUser(w http.ResponseWriter, r *http.Request) (user models.User, pending bool, ok bool) {
+	if id := m.App.Session.GetInt(r.Context(), "user_id"); id > 0 {
+		user, err := m.DB.GetUserByID(id)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return user, false, false
+		}
+		return user, false, true
+	}
+
+	user, ok = m.pendingUser(r)
+	if !ok || user.TwoFactorEnabled() {
+		m.App.Session.Put(r.Context(), "error", "You must be logged in to access that page")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return user, false, false
+	}
+	return user, true, true
+}
+
+// TwoFactorPage shows staff their two-factor authentication: the QR code to scan while it is off,
+// and their recovery codes and the forms to replace them or turn it off once it is on
+func (m *Repository) TwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	user, pending, ok := m.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+
+	m.renderTwoFactor(w, r, user, pending, forms.New(nil))
+}
+
+// renderTwoFactor renders the two-factor page for user. A secret to set up is kept in the session
+// until it is confirmed, so the QR code stays the same when the page is shown again.
+func (m *Repository) renderTwoFactor(w http.ResponseWriter, r *http.Request, user models.User, pending bool, form *forms.Form) {
+	settings, err := m.DB.GetSecuritySettings()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["user"] = user
+	data["pending"] = pending
+	data["required"] = settings.RequiresTwoFactor(user)
+
+	if codes := m.App.Session.PopString(r.Context(), "recovery_codes"); codes != "" {
+		data["recovery_codes"] = strings.Fields(codes)
+	}
+
+	if user.TwoFactorEnabled() {
+		remaining, err := m.DB.CountRecoveryCodes(user.ID)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		data["remaining"] = remaining
+	} else {
+		secret := m.App.Session.GetString(r.Context(), "totp_secret")
+		if secret == "" {
+			secret, err = totp.GenerateSecret()
+			if err != nil {
+				helpers.ServerError(w, err)
+				return
+			}
+			m.App.Session.Put(r.Context(), "totp_secret", secret)
+		}
+		data["secret"] = secret
+		data["uri"] = totp.URI(twoFactorIssuer, user.Email, secret)
+	}
+
+	if !form.Valid() {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	render.Template(w, r, "two-factor.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// PostTwoFactorPage turns on two-factor authentication once staff confirm they have added the
+// secret to their authenticator app by giving a code from it. Staff who had to set it up to sign
+// in are signed in, and everyone is shown their recovery codes.
+func (m *Repository) PostTwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user, pending, ok := m.twoFactorUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TwoFactorEnabled() {
+		m.App.Session.Put(r.Context(), "flash", "Two-factor authentication is already on")
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	secret := m.App.Session.GetString(r.Context(), "totp_secret")
+	if secret == "" {
+		m.App.Session.Put(r.Context(), "error", "Please scan the QR code and try again")
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code")
+	step, valid := totp.Validate(secret, r.Form.Get("code"), time.Now())
+	if form.Valid() && !valid {
+		form.Errors.Add("code", "That code isn't right, check the time on your device and try again")
+	}
+	if !form.Valid() {
+		m.renderTwoFactor(w, r, user, pending, form)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.db(r).EnableTwoFactor(user.ID, secret, step, hashes)
+	if err != nil {
+		m.App.ErrorLog.Println("Error enabling two-factor authentication:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to turn on two-factor authentication")
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+	m.App.Session.Remove(r.Context(), "totp_secret")
+
+	if pending {
+		m.signStaffIn(r, user)
+	}
+
+	m.App.Session.Put(r.Context(), "recovery_codes", strings.Join(codes, " "))
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication is on")
+	http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+}
+
+// signedInTwoFactorUser returns the signed in user for the forms that change two-factor
+// authentication once it is on, checking the code they gave in field
+func (m *Repository) signedInTwoFactorUser(w http.ResponseWriter, r *http.Request, field string) (models.User, bool) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return models.User{}, false
+	}
+
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return user, false
+	}
+	if !user.TwoFactorEnabled() {
+		m.App.Session.Put(r.Context(), "error", "Two-factor authentication is off")
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return user, false
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required(field)
+	if form.Valid() {
+		_, ok, err := m.checkTwoFactorCode(user, r.Form.Get(field))
+		if err != nil {
+			helpers.ServerError(w, err)
+			return user, false
+		}
+		if !ok {
+			form.Errors.Add(field, "That code isn't right, please try again")
+		}
+	}
+	if !form.Valid() {
+		m.renderTwoFactor(w, r, user, false, form)
+		return user, false
+	}
+
+	return user, true
+}
+
+// PostRecoveryCodesPage replaces the signed in user's recovery codes, for when they have used
+// most of them or may have lost them
+func (m *Repository) PostRecoveryCodesPage(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.signedInTwoFactorUser(w, r, "regenerate_code")
+	if !ok {
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	err = m.db(r).ReplaceRecoveryCodes(user.ID, hashes)
+	if err != nil {
+		m.App.ErrorLog.Println("Error replacing recovery codes:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to make new recovery codes")
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "recovery_codes", strings.Join(codes, " "))
+	m.App.Session.Put(r.Context(), "flash", "New recovery codes made, the old ones no longer work")
+	http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+}
+
+// PostDisableTwoFactorPage turns off the signed in user's two-factor authentication, unless the
+// security settings require it for their role
+func (m *Repository) PostDisableTwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	settings, err := m.DB.GetSecuritySettings()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if settings.RequiresTwoFactor(user) {
+		m.App.Session.Put(r.Context(), "error", "Two-factor authentication is required for your role")
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	user, ok := m.signedInTwoFactorUser(w, r, "disable_code")
+	if !ok {
+		return
+	}
+
+	err = m.db(r).DisableTwoFactor(user.ID)
+	if err != nil {
+		m.App.ErrorLog.Println("Error disabling two-factor authentication:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to turn off two-factor authentication")
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Two-factor authentication is off")
+	http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+}
+
+// AdminSecurityPage shows which staff use two-factor authentication, the sign in rules and the
+// accounts locked by failed sign ins
+func (m *Repository) AdminSecurityPage(w http.ResponseWriter, r *http.Request) {
+	staff, err := m.DB.AllStaff()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	settings, err := m.DB.GetSecuritySettings()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	locked, err := m.DB.LockedAccounts(time.Now())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["staff"] = staff
+	data["settings"] = settings
+	data["user"] = user
+	data["locked"] = locked
+
+	intMap := make(map[string]int)
+	intMap["lockout_attempts"] = models.LoginLockoutAttempts
+	intMap["lockout_minutes"] = int(models.LoginLockoutPeriod.Minutes())
+
+	render.Template(w, r, "admin-security.page.tmpl", &models.TemplateData{
+		Data:   data,
+		IntMap: intMap,
+	})
+}
+
+// AdminPostSecurityPage saves the sign in rules, which only owners can change
+func (m *Repository) AdminPostSecurityPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	user, err := m.DB.GetUserByID(m.App.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if !user.IsOwner() {
+		m.App.Session.Put(r.Context(), "error", "Only owners can change the sign in rules")
+		http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+		return
+	}
+
+	settings := models.SecuritySettings{
+		RequireTwoFactor: r.Form.Get("require_two_factor") != "",
+	}
+
+	err = m.db(r).UpdateSecuritySettings(settings)
+	if err != nil {
+		m.App.ErrorLog.Println("Error saving security settings:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to save security settings")
+		http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+		return
+	}
+
+	flash := "Security settings saved"
+	if settings.RequiresTwoFactor(user) && !user.TwoFactorEnabled() {
+		flash = "Security settings saved, set up two-factor authentication before you next sign in"
+	}
+	m.App.Session.Put(r.Context(), "flash", flash)
+	http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+}
@@ -0,0 +1,448 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/forms"
+	"github.com/ashparshp/bookings/internal/helpers"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/render"
+	"github.com/ashparshp/bookings/internal/repository"
+	"github.com/go-chi/chi/v5"
+)
+
+// waitlistOfferLifetime is how long a guest offered a room from the waitlist has to book it
+// before it is offered to the next guest
+const waitlistOfferLifetime = 12 * time.Hour
+
+// WaitlistPage shows the form to join the waitlist, filled in with the dates that were searched
+func (m *Repository) WaitlistPage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	form := forms.New(url.Values{"start": {q.Get("start")}, "end": {q.Get("end")}})
+	m.renderWaitlist(w, r, form)
+}
+
+// renderWaitlist renders the waitlist form with the rooms of the property to choose from
+func (m *Repository) renderWaitlist(w http.ResponseWriter, r *http.Request, form *forms.Form) {
+	rooms, err := m.DB.AllRooms(helpers.CurrentProperty(r).ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["rooms"] = rooms
+
+	render.Template(w, r, "waitlist.page.tmpl", &models.TemplateData{
+		Form: form,
+		Data: data,
+	})
+}
+
+// PostWaitlistPage puts a guest on the waitlist for the posted dates and room, where a room_id
+// of 0 means any room
+func (m *Repository) PostWaitlistPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.App.Session.Put(r.Context(), "error", "can't parse form")
+		http.Redirect(w, r, "/waitlist", http.StatusSeeOther)
+		return
+	}
+
+	property := helpers.CurrentProperty(r)
+
+	rooms, err := m.DB.AllRooms(property.ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	roomIDs := []string{"0"}
+	for _, room := range rooms {
+		roomIDs = append(roomIDs, strconv.Itoa(room.ID))
+	}
+
+	form := forms.New(r.PostForm)
+	startDate, endDate := m.validateStay(r, form, "start", "end")
+	form.Required("first_name", "last_name", "email")
+	form.IsEmail("email")
+	form.IsPhone("phone")
+	form.In("room_id", roomIDs...)
+	if !form.Valid() {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		m.renderWaitlist(w, r, form)
+		return
+	}
+
+	roomID, _ := strconv.Atoi(form.Get("room_id"))
+	entry := models.WaitlistEntry{
+		PropertyID: property.ID,
+		RoomID:     roomID,
+		StartDate:  startDate,
+		EndDate:    endDate,
+		FirstName:  strings.TrimSpace(form.Get("first_name")),
+		LastName:   strings.TrimSpace(form.Get("last_name")),
+		Email:      strings.TrimSpace(form.Get("email")),
+		Phone:      strings.TrimSpace(form.Get("phone")),
+		Status:     models.WaitlistWaiting,
+	}
+
+	entry.ID, err = m.db(r).InsertWaitlistEntry(entry)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	htmlMessage := fmt.Sprintf(`
+	<strong>You're on the waitlist</strong><br>
+	Dear %s,<br>
+	You're on the waitlist at %s for %s to %s. If a room comes free we'll email you a link to book it.<br>
+	`, entry.FirstName, property.Name, entry.StartDate.Format("2006-01-02"), entry.EndDate.Format("2006-01-02"))
+
+	m.App.MailChan <- models.MailData{
+		To:       entry.Email,
+		From:     m.App.MailConfig.FromAddress,
+		Subject:  "You're on the waitlist",
+		Content:  htmlMessage,
+		Template: "basic.html",
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "You're on the waitlist, we'll email you if a room comes free")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// WaitlistOfferPage takes a guest from the link in an offer email to the booking form, with
+// the offered room and their dates and details filled in
+func (m *Repository) WaitlistOfferPage(w http.ResponseWriter, r *http.Request) {
+	entry, err := m.DB.GetWaitlistEntryByToken(guestTokenHash(chi.URLParam(r, "token")))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !entry.OfferOpen(time.Now())) {
+		m.App.Session.Put(r.Context(), "error", "This offer has run out or has already been used")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	res := models.Reservation{
+		FirstName: entry.FirstName,
+		LastName:  entry.LastName,
+		Email:     entry.Email,
+		Phone:     entry.Phone,
+		StartDate: entry.StartDate,
+		EndDate:   entry.EndDate,
+		RoomID:    entry.OfferedRoomID,
+		Room:      entry.OfferedRoom,
+	}
+
+	// the offer doesn't keep the room from other guests searching, so it may have been booked
+	// in the meantime
+	_, err = m.holdRoom(r, res)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		err = m.db(r).UpdateWaitlistStatus(entry.ID, models.WaitlistWaiting)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		m.App.Session.Put(r.Context(), "error", "Sorry, that room has just been booked. You're still on the waitlist.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "reservation", res)
+	m.App.Session.Put(r.Context(), "waitlist_entry_id", entry.ID)
+	http.Redirect(w, r, "/make-reservation", http.StatusSeeOther)
+}
+
+// bookedFromWaitlist marks the waitlist entry a guest came from as booked when res is the stay
+// they were offered
+func (m *Repository) bookedFromWaitlist(r *http.Request, res models.Reservation) {
+	id := m.App.Session.PopInt(r.Context(), "waitlist_entry_id")
+	if id == 0 {
+		return
+	}
+
+	entry, err := m.DB.GetWaitlistEntryByID(id)
+	if err != nil {
+		m.App.ErrorLog.Println("Error retrieving waitlist entry:", err)
+		return
+	}
+	if entry.OfferedRoomID != res.RoomID || !entry.StartDate.Equal(res.StartDate) || !entry.EndDate.Equal(res.EndDate) {
+		return
+	}
+
+	err = m.db(r).UpdateWaitlistStatus(id, models.WaitlistBooked)
+	if err != nil {
+		m.App.ErrorLog.Println("Error updating waitlist entry:", err)
+		return
+	}
+}
+
+// offerWaitlist offers the rooms that are free to the guests waiting for them at a property, in
+// the order they joined the waitlist. A room on offer to one guest isn't offered to another for
+// the same nights until the offer is booked or runs out.
+func (m *Repository) offerWaitlist(propertyID int) {
+	entries, err := m.DB.AllWaitlistEntries(propertyID)
+	if err != nil {
+		m.App.ErrorLog.Println("Error retrieving waitlist:", err)
+		return
+	}
+
+	property, err := m.DB.GetPropertyByID(propertyID)
+	if err != nil {
+		m.App.ErrorLog.Println("Error retrieving property:", err)
+		return
+	}
+	today := models.Today(property.Location())
+	now := time.Now()
+
+	for i, entry := range entries {
+		if entry.Status != models.WaitlistWaiting || entry.StartDate.Before(today) {
+			continue
+		}
+
+		roomID, err := m.waitlistRoom(entry, entries, now)
+		if err != nil {
+			m.App.ErrorLog.Println("Error searching availability for waitlist:", err)
+			continue
+		}
+		if roomID == 0 {
+			continue
+		}
+
+		offered, err := m.sendWaitlistOffer(m.DB, property, entry, roomID)
+		if err != nil {
+			m.App.ErrorLog.Println("Error sending waitlist offer:", err)
+			continue
+		}
+		entries[i] = offered
+	}
+}
+
+// waitlistRoom returns a room that is free for an entry's stay and isn't on offer to another
+// guest in entries for any of its nights, or 0 when there isn't one
+func (m *Repository) waitlistRoom(entry models.WaitlistEntry, entries []models.WaitlistEntry, now time.Time) (int, error) {
+	var candidates []int
+	if entry.RoomID > 0 {
+		available, err := m.DB.SearchAvailabilityByDatesByRoomID(entry.StartDate, entry.EndDate, entry.RoomID)
+		if err != nil {
+			return 0, err
+		}
+		if available {
+			candidates = append(candidates, entry.RoomID)
+		}
+	} else {
+		rooms, err := m.DB.SearchAvailabilityForAllRooms(entry.StartDate, entry.EndDate, entry.PropertyID)
+		if err != nil {
+			return 0, err
+		}
+		for _, room := range rooms {
+			candidates = append(candidates, room.ID)
+		}
+	}
+
+	for _, roomID := range candidates {
+		onOffer := false
+		for _, other := range entries {
+			if other.ID != entry.ID && other.OfferedRoomID == roomID && other.OfferOpen(now) &&
+				other.Overlaps(entry.StartDate, entry.EndDate) {
+				onOffer = true
+				break
+			}
+		}
+		if !onOffer {
+			return roomID, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// sendWaitlistOffer emails a guest a link to book roomID and records the offer through db,
+// returning the entry as it now stands
+func (m *Repository) sendWaitlistOffer(db repository.DatabaseRepo, property models.Property, entry models.WaitlistEntry, roomID int) (models.WaitlistEntry, error) {
+	room, err := m.DB.GetRoomByID(roomID)
+	if err != nil {
+		return entry, err
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return entry, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	expiresAt := time.Now().Add(waitlistOfferLifetime)
+
+	err = db.OfferWaitlistEntry(entry.ID, roomID, guestTokenHash(token), expiresAt)
+	if err != nil {
+		return entry, err
+	}
+
+	// the property prefix makes the booking happen at the right property whatever the host
+	link := fmt.Sprintf("%s/p/%s/waitlist/%s", m.App.SiteURL, property.Slug, token)
+	htmlMessage := fmt.Sprintf(`
+	<strong>A room has come free</strong><br>
+	Dear %s,<br>
+	%s at %s has come free for %s to %s. It is held for you until %s.<br>
+	<a href="%s">Book it now</a><br>
+	If you no longer need it, you can ignore this email and it will be offered to the next guest.
+	`, entry.FirstName, room.RoomName, property.Name, entry.StartDate.Format("2006-01-02"),
+		entry.EndDate.Format("2006-01-02"), expiresAt.In(property.Location()).Format("2006-01-02 15:04 MST"), link)
+
+	m.App.MailChan <- models.MailData{
+		To:       entry.Email,
+		From:     m.App.MailConfig.FromAddress,
+		Subject:  "A room has come free",
+		Content:  htmlMessage,
+		Template: "basic.html",
+	}
+
+	entry.Status = models.WaitlistOffered
+	entry.OfferedRoomID = roomID
+	entry.OfferedRoom = room
+	entry.OfferExpiresAt = expiresAt
+	return entry, nil
+}
+
+// ExpireWaitlistOffers ends the offers that have run out and offers the free rooms of every
+// property to the guests waiting for them. Offers run out with no request to notice, so this is
+// run regularly.
+func (m *Repository) ExpireWaitlistOffers() {
+	expired, err := m.DB.ExpireWaitlistOffers(time.Now())
+	if err != nil {
+		m.App.ErrorLog.Println("Error expiring waitlist offers:", err)
+	}
+	if len(expired) > 0 {
+		m.App.InfoLog.Printf("%d waitlist offers ran out", len(expired))
+	}
+
+	properties, err := m.DB.AllProperties()
+	if err != nil {
+		m.App.ErrorLog.Println("Error retrieving properties:", err)
+		return
+	}
+	for _, property := range properties {
+		m.offerWaitlist(property.ID)
+	}
+}
+
+// AdminWaitlistPage lists the waitlist of the property being managed
+func (m *Repository) AdminWaitlistPage(w http.ResponseWriter, r *http.Request) {
+	entries, err := m.DB.AllWaitlistEntries(helpers.CurrentProperty(r).ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["entries"] = entries
+	data["now"] = time.Now()
+
+	render.Template(w, r, "admin-waitlist.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// adminWaitlistEntry returns the waitlist entry in the URL, redirecting back to the waitlist
+// with an error when it can't be found or managed
+func (m *Repository) adminWaitlistEntry(w http.ResponseWriter, r *http.Request) (models.WaitlistEntry, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	var entry models.WaitlistEntry
+	if err == nil {
+		entry, err = m.DB.GetWaitlistEntryByID(id)
+	}
+	if err != nil || !canManage(r, entry.PropertyID) {
+		m.App.Session.Put(r.Context(), "error", "Waitlist entry not found")
+		http.Redirect(w, r, "/admin/waitlist", http.StatusSeeOther)
+		return entry, false
+	}
+	return entry, true
+}
+
+// AdminWaitlistOfferPage offers a guest on the waitlist a free room now, ahead of anyone
+// waiting before them
+func (m *Repository) AdminWaitlistOfferPage(w http.ResponseWriter, r *http.Request) {
+	entry, ok := m.adminWaitlistEntry(w, r)
+	if !ok {
+		return
+	}
+
+	if entry.Status != models.WaitlistWaiting && entry.Status != models.WaitlistExpired {
+		m.App.Session.Put(r.Context(), "error", fmt.Sprintf("This guest can't be offered a room, their entry is %s", strings.ToLower(entry.Status.Label())))
+		http.Redirect(w, r, "/admin/waitlist", http.StatusSeeOther)
+		return
+	}
+
+	entries, err := m.DB.AllWaitlistEntries(entry.PropertyID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	roomID, err := m.waitlistRoom(entry, entries, time.Now())
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+	if roomID == 0 {
+		m.App.Session.Put(r.Context(), "error", "No room is free for those dates")
+		http.Redirect(w, r, "/admin/waitlist", http.StatusSeeOther)
+		return
+	}
+
+	property, err := m.DB.GetPropertyByID(entry.PropertyID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	after, err := m.sendWaitlistOffer(m.db(r), property, entry, roomID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s offered to %s %s", after.OfferedRoom.RoomName, entry.FirstName, entry.LastName))
+	http.Redirect(w, r, "/admin/waitlist", http.StatusSeeOther)
+}
+
+// AdminWaitlistRemovePage takes a guest off the waitlist, passing any room on offer to them to
+// the next guest
+func (m *Repository) AdminWaitlistRemovePage(w http.ResponseWriter, r *http.Request) {
+	entry, ok := m.adminWaitlistEntry(w, r)
+	if !ok {
+		return
+	}
+
+	if entry.Status == models.WaitlistBooked || entry.Status == models.WaitlistCancelled {
+		m.App.Session.Put(r.Context(), "error", "This guest is no longer on the waitlist")
+		http.Redirect(w, r, "/admin/waitlist", http.StatusSeeOther)
+		return
+	}
+
+	err := m.db(r).UpdateWaitlistStatus(entry.ID, models.WaitlistCancelled)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	if entry.Status == models.WaitlistOffered {
+		m.offerWaitlist(entry.PropertyID)
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("%s %s taken off the waitlist", entry.FirstName, entry.LastName))
+	http.Redirect(w, r, "/admin/waitlist", http.StatusSeeOther)
+}
@@ -0,0 +1,337 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/forms"
+	"github.com/ashparshp/bookings/internal/helpers"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/render"
+	"github.com/ashparshp/bookings/internal/webhooks"
+	"github.com/go-chi/chi/v5"
+)
+
+// webhookBatch is how many deliveries are sent each time the worker runs
+const webhookBatch = 50
+
+// webhookLease is how long a delivery being sent is kept from other workers. It is longer than
+// a webhook is given to answer, so a delivery is only sent twice when a worker stops mid-send.
+const webhookLease = 2 * time.Minute
+
+// webhookLogLimit is how many deliveries are shown for a webhook
+const webhookLogLimit = 100
+
+// webhookResult counts what a run of the delivery worker did
+type webhookResult struct {
+	Delivered int
+	Retrying int
+	Failed int
+}
+
+// webhook queues an event about data for the property's webhooks that subscribe to it. Like
+// the audit log, a failure is reported but does not fail the request, since the change has
+// already been made.
+func (m *Repository) webhook(propertyID int, event string, data interface{}) {
+	ev := webhooks.NewEvent(event, propertyID, data)
+	payload, err := webhooks.Payload(ev)
+	if err == nil {
+		_, err = m.DB.InsertWebhookDeliveries(propertyID, ev.ID, event, payload)
+	}
+	if err != nil {
+		m.App.ErrorLog.Printf("Error queueing %s webhook: %v", event, err)
+	}
+}
+
+// reservationWebhook queues an event about a reservation of the property
+func (m *Repository) reservationWebhook(propertyID int, event string, res models.Reservation) {
+	m.webhook(propertyID, event, webhooks.ReservationData(res))
+}
+
+// blockWebhook queues an event about a block on a room of the property
+func (m *Repository) blockWebhook(propertyID int, event string, block models.RoomRestriction) {
+	m.webhook(propertyID, event, webhooks.BlockData(block))
+}
+
+// DeliverWebhooks sends the webhook deliveries that are due. It is run regularly, and a delivery
+// that fails is tried again later until it runs out of attempts.
+func (m *Repository) DeliverWebhooks() {
+	result := m.deliverWebhooks()
+	if result.Delivered+result.Retrying+result.Failed > 0 {
+		m.App.InfoLog.Printf("Sent webhooks: %d delivered, %d to retry, %d failed", result.Delivered, result.Retrying, result.Failed)
+	}
+}
+
+// deliverWebhooks sends a batch of due deliveries
+func (m *Repository) deliverWebhooks() webhookResult {
+	var result webhookResult
+
+	deliveries, err := m.DB.ClaimWebhookDeliveries(webhookBatch, webhookLease)
+	if err != nil {
+		m.App.ErrorLog.Println("Error retrieving webhook deliveries:", err)
+		return result
+	}
+
+	for _, d := range deliveries {
+		d = m.deliverWebhook(d)
+
+		switch d.Status {
+		case models.DeliveryDelivered:
+			result.Delivered++
+		case models.DeliveryFailed:
+			result.Failed++
+		default:
+			result.Retrying++
+		}
+
+		err := m.DB.SaveWebhookAttempt(d)
+		if err != nil {
+			m.App.ErrorLog.Println("Error saving webhook delivery:", err)
+		}
+	}
+
+	return result
+}
+
+// deliverWebhook makes an attempt to send d and returns it as it stands after the attempt
+func (m *Repository) deliverWebhook(d models.WebhookDelivery) models.WebhookDelivery {
+	now := time.Now()
+
+	// deliveries queued before their webhook was turned off aren't sent
+	if !d.Webhook.Active {
+		d.Status = models.DeliveryFailed
+		d.ResponseCode = 0
+		d.Response = "The webhook was turned off"
+		d.NextAttemptAt = now
+		return d
+	}
+
+	result := m.App.Webhooks.Send(d)
+	d.Attempts++
+	d.ResponseCode = result.StatusCode
+	d.Response = result.Response
+	d.NextAttemptAt = now
+
+	if result.OK() {
+		d.Status = models.DeliveryDelivered
+		d.DeliveredAt = now
+		return d
+	}
+
+	wait, ok := webhooks.Backoff(d.Attempts)
+	if !ok {
+		d.Status = models.DeliveryFailed
+		return d
+	}
+	d.Status = models.DeliveryPending
+	d.NextAttemptAt = now.Add(wait)
+	return d
+}
+
+// AdminWebhooksPage lists the webhooks of the property being managed
+func (m *Repository) AdminWebhooksPage(w http.ResponseWriter, r *http.Request) {
+	hooks, err := m.DB.AllWebhooks(helpers.CurrentProperty(r).ID)
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["webhooks"] = hooks
+
+	render.Template(w, r, "admin-webhooks.page.tmpl", &models.TemplateData{
+		Data: data,
+	})
+}
+
+// adminWebhook returns the webhook in the URL, or a new one subscribed to every event for ID 0,
+// redirecting back to the webhooks with an error when it can't be found or managed
+func (m *Repository) adminWebhook(w http.ResponseWriter, r *http.Request) (models.Webhook, bool) {
+	hook := models.Webhook{
+		PropertyID: helpers.CurrentProperty(r).ID,
+		Events:     append([]string(nil), models.WebhookEvents...),
+		Active:     true,
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err == nil && id > 0 {
+		hook, err = m.DB.GetWebhookByID(id)
+	}
+	if err != nil || !canManage(r, hook.PropertyID) {
+		m.App.Session.Put(r.Context(), "error", "Webhook not found")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return hook, false
+	}
+	return hook, true
+}
+
+// AdminShowWebhookPage shows the settings and delivery log of a webhook, or the form for a new one
+func (m *Repository) AdminShowWebhookPage(w http.ResponseWriter, r *http.Request) {
+	hook, ok := m.adminWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	m.renderWebhook(w, r, hook, forms.New(nil))
+}
+
+// renderWebhook renders the webhook form with the webhook's delivery log
+func (m *Repository) renderWebhook(w http.ResponseWriter, r *http.Request, hook models.Webhook, form *forms.Form) {
+	subscribed := make(map[string]bool)
+	for _, e := range hook.Events {
+		subscribed[e] = true
+	}
+
+	data := make(map[string]interface{})
+	data["webhook"] = hook
+	data["events"] = models.WebhookEvents
+	data["subscribed"] = subscribed
+
+	if hook.ID > 0 {
+		deliveries, err := m.DB.GetWebhookDeliveries(hook.ID, webhookLogLimit)
+		if err != nil {
+			helpers.ServerError(w, err)
+			return
+		}
+		data["deliveries"] = deliveries
+	}
+
+	if !form.Valid() {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	render.Template(w, r, "admin-webhook.page.tmpl", &models.TemplateData{
+		Data: data,
+		Form: form,
+	})
+}
+
+// AdminPostWebhookPage saves a new or edited webhook. New webhooks are given a secret to sign
+// their payloads with, and staff can ask for a new one when it may have leaked.
+func (m *Repository) AdminPostWebhookPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		helpers.ServerError(w, err)
+		return
+	}
+
+	before, ok := m.adminWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	hook := models.Webhook{
+		ID:         before.ID,
+		PropertyID: before.PropertyID,
+		URL:        strings.TrimSpace(r.Form.Get("url")),
+		Secret:     before.Secret,
+		Events:     r.Form["events"],
+		Active:     r.Form.Get("active") != "",
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("url")
+	if u, err := url.Parse(hook.URL); hook.URL != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		form.Errors.Add("url", "Enter the address to post events to, such as https://hooks.example.com/bookings")
+	}
+	if len(hook.Events) == 0 {
+		form.Errors.Add("events", "Choose at least one event")
+	}
+	known := make(map[string]bool)
+	for _, e := range models.WebhookEvents {
+		known[e] = true
+	}
+	for _, e := range hook.Events {
+		if !known[e] {
+			form.Errors.Add("events", "Choose from the events given")
+			break
+		}
+	}
+
+	if !form.Valid() {
+		m.renderWebhook(w, r, hook, form)
+		return
+	}
+
+	rotated := hook.ID > 0 && r.Form.Get("new_secret") != ""
+	if hook.ID == 0 || rotated {
+		hook.Secret = webhooks.NewSecret()
+	}
+
+	if hook.ID == 0 {
+		hook.ID, err = m.db(r).InsertWebhook(hook)
+	} else {
+		err = m.db(r).UpdateWebhook(hook)
+	}
+	if err != nil {
+		m.App.ErrorLog.Println("Error saving webhook:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to save webhook")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return
+	}
+
+	flash := "Webhook saved"
+	if rotated {
+		flash = "Webhook saved with a new secret, update it wherever the webhook is received"
+	}
+	m.App.Session.Put(r.Context(), "flash", flash)
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d/show", hook.ID), http.StatusSeeOther)
+}
+
+// AdminDeleteWebhookPage removes a webhook and its delivery log
+func (m *Repository) AdminDeleteWebhookPage(w http.ResponseWriter, r *http.Request) {
+	hook, ok := m.adminWebhook(w, r)
+	if !ok {
+		return
+	}
+	if hook.ID == 0 {
+		m.App.Session.Put(r.Context(), "error", "Webhook not found")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return
+	}
+
+	err := m.db(r).DeleteWebhook(hook.ID)
+	if err != nil {
+		m.App.ErrorLog.Println("Error deleting webhook:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to delete webhook")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", "Webhook deleted")
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+// AdminRedeliverWebhookPage queues a delivery to be sent again, for when the webhook missed it
+// or staff want it to process the event again
+func (m *Repository) AdminRedeliverWebhookPage(w http.ResponseWriter, r *http.Request) {
+	hook, ok := m.adminWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	deliveryID, err := strconv.Atoi(chi.URLParam(r, "delivery"))
+	var d models.WebhookDelivery
+	if err == nil {
+		d, err = m.DB.GetWebhookDeliveryByID(deliveryID)
+	}
+	if err != nil || hook.ID == 0 || d.WebhookID != hook.ID {
+		m.App.Session.Put(r.Context(), "error", "Delivery not found")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return
+	}
+
+	_, err = m.DB.RedeliverWebhookDelivery(d.ID)
+	if err != nil {
+		m.App.ErrorLog.Println("Error redelivering webhook:", err)
+		m.App.Session.Put(r.Context(), "error", "Unable to redeliver the event")
+		http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d/show", hook.ID), http.StatusSeeOther)
+		return
+	}
+
+	m.App.Session.Put(r.Context(), "flash", fmt.Sprintf("The %s event will be sent again shortly", d.Event))
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d/show", hook.ID), http.StatusSeeOther)
+}
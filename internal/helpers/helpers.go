@@ -1,15 +1,26 @@
 package helpers
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"runtime/debug"
 
 	"github.com/ashparshp/bookings/internal/config"
+	"github.com/ashparshp/bookings/internal/models"
 )
 
 var app *config.AppConfig
 
+// contextKey keys the values the middleware stores on a request
+type contextKey string
+
+const (
+	propertyKey   contextKey = "property"
+	propertiesKey contextKey = "properties"
+	cspNonceKey   contextKey = "csp_nonce"
+)
+
 // NewHelpers sets up app config for helpers
 func NewHelpers(a *config.AppConfig) {
 	app = a
@@ -28,4 +39,43 @@ func ServerError(w http.ResponseWriter, err error) {
 
 func IsAuthenticated(r *http.Request) bool {
 	return app.Session.Exists(r.Context(), "user_id")
-}
\ No newline at end of file
+}
+
+// IsGuestAuthenticated reports whether a guest, rather than staff, is signed in
+func IsGuestAuthenticated(r *http.Request) bool {
+	return app.Session.Exists(r.Context(), "guest_id")
+}
+
+// WithProperty returns ctx carrying the property a request is for
+func WithProperty(ctx context.Context, p models.Property) context.Context {
+	return context.WithValue(ctx, propertyKey, p)
+}
+
+// CurrentProperty returns the property a request is for, or a zero Property when none was resolved
+func CurrentProperty(r *http.Request) models.Property {
+	p, _ := r.Context().Value(propertyKey).(models.Property)
+	return p
+}
+
+// WithProperties returns ctx carrying the properties the signed in staff member can manage
+func WithProperties(ctx context.Context, properties []models.Property) context.Context {
+	return context.WithValue(ctx, propertiesKey, properties)
+}
+
+// AllowedProperties returns the properties the signed in staff member can manage
+func AllowedProperties(r *http.Request) []models.Property {
+	properties, _ := r.Context().Value(propertiesKey).([]models.Property)
+	return properties
+}
+
+// WithCSPNonce returns ctx carrying the nonce the request's Content-Security-Policy allows inline
+// scripts with
+func WithCSPNonce(ctx context.Context, nonce string) context.Context {
+	return context.WithValue(ctx, cspNonceKey, nonce)
+}
+
+// CSPNonce returns the nonce for the request's inline scripts, or an empty string when there is none
+func CSPNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceKey).(string)
+	return nonce
+}
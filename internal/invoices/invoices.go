@@ -0,0 +1,103 @@
+package invoices
+
+import (
+	"fmt"
+
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/pdf"
+	"github.com/ashparshp/bookings/internal/render"
+)
+
+// Layout of the invoice, in points
+const (
+	left       = 50.0
+	right      = 545.0
+	qtyRight   = 380.0
+	unitRight  = 460.0
+	lineHeight = 16.0
+	pageBottom = 780.0
+)
+
+// PDF lays out an invoice, with the payments made against it, as a PDF document. seller is
+// the business name printed at the top.
+func PDF(inv models.Invoice, payments []models.Payment, seller string) []byte {
+	doc := pdf.New()
+	p := doc.AddPage()
+	money := func(amount int) string {
+		return render.FormatMoney(amount, inv.Currency)
+	}
+
+	p.Text(left, 70, pdf.HelveticaBold, 20, seller)
+	p.TextRight(right, 70, pdf.HelveticaBold, 20, "INVOICE")
+
+	p.TextRight(right, 95, pdf.Helvetica, 10, "Invoice "+inv.Number())
+	p.TextRight(right, 110, pdf.Helvetica, 10, "Issued "+inv.IssuedAt.Format("2 January 2006"))
+	p.TextRight(right, 125, pdf.Helvetica, 10, fmt.Sprintf("Reservation #%d", inv.ReservationID))
+
+	p.Text(left, 95, pdf.HelveticaBold, 10, "Bill to")
+	p.Text(left, 110, pdf.Helvetica, 10, inv.BillToName)
+	p.Text(left, 125, pdf.Helvetica, 10, inv.BillToEmail)
+
+	header := func(y float64) {
+		p.FillRect(left, y-12, right-left, 18, 0.92)
+		p.Text(left+4, y, pdf.HelveticaBold, 10, "Description")
+		p.TextRight(qtyRight, y, pdf.HelveticaBold, 10, "Qty")
+		p.TextRight(unitRight, y, pdf.HelveticaBold, 10, "Unit price")
+		p.TextRight(right-4, y, pdf.HelveticaBold, 10, "Amount")
+	}
+
+	y := 170.0
+	header(y)
+	y += lineHeight + 6
+
+	for _, l := range inv.Lines {
+		if y > pageBottom {
+			p = doc.AddPage()
+			y = 70
+			header(y)
+			y += lineHeight + 6
+		}
+		p.Text(left+4, y, pdf.Helvetica, 10, l.Description)
+		p.TextRight(qtyRight, y, pdf.Helvetica, 10, fmt.Sprint(l.Quantity))
+		p.TextRight(unitRight, y, pdf.Helvetica, 10, money(l.UnitAmount))
+		p.TextRight(right-4, y, pdf.Helvetica, 10, money(l.Amount))
+		y += lineHeight
+	}
+
+	// the totals block is kept together on one page
+	if y+float64(5+len(payments))*lineHeight > pageBottom {
+		p = doc.AddPage()
+		y = 70
+	}
+
+	p.Line(unitRight-120, y-8, right, y-8, 0.5)
+	y += 6
+	total := func(label, amount string, font pdf.Font) {
+		p.TextRight(unitRight, y, font, 10, label)
+		p.TextRight(right-4, y, font, 10, amount)
+		y += lineHeight
+	}
+
+	total("Subtotal", money(inv.Subtotal()), pdf.Helvetica)
+	if inv.TaxTotal() > 0 {
+		total("Tax", money(inv.TaxTotal()), pdf.Helvetica)
+	}
+	total("Total", money(inv.Total()), pdf.HelveticaBold)
+
+	for _, pay := range payments {
+		kept := models.AmountPaid([]models.Payment{pay})
+		if kept == 0 {
+			continue
+		}
+		total(fmt.Sprintf("Paid %s", pay.CreatedAt.Format("2 Jan 2006")), money(-kept), pdf.Helvetica)
+	}
+
+	balance := inv.Total() - models.AmountPaid(payments)
+	p.Line(unitRight-120, y-8, right, y-8, 0.5)
+	y += 6
+	total("Balance due", money(balance), pdf.HelveticaBold)
+
+	p.Text(left, pageBottom+30, pdf.Helvetica, 9, "Thank you for staying with us.")
+
+	return doc.Bytes()
+}
@@ -0,0 +1,67 @@
+package invoices
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/models"
+)
+
+func TestPDF(t *testing.T) {
+	res := models.Reservation{
+		ID:        7,
+		FirstName: "John",
+		LastName:  "Smith",
+		Email:     "john@smith.com",
+		StartDate: models.NewDate(2050, 1, 1),
+		EndDate:   models.NewDate(2050, 1, 3),
+	}
+	room := models.Room{RoomName: "General's Quarters", Price: 15000}
+	rules := []models.ChargeRule{{Name: "VAT", Kind: models.ChargeTax, Basis: models.BasisPercent, Amount: 10}}
+	inv := models.NewInvoice(res, models.PriceStay(res, room, rules, nil), models.Property{ID: 1, Currency: "usd"})
+	inv.Year = 2050
+	inv.Sequence = 3
+	inv.IssuedAt = time.Date(2049, 12, 1, 0, 0, 0, 0, time.UTC)
+
+	payments := []models.Payment{
+		{Amount: 9000, Currency: "usd", Status: models.PaymentCaptured, CreatedAt: inv.IssuedAt},
+		{Amount: 5000, Currency: "usd", Status: models.PaymentFailed, CreatedAt: inv.IssuedAt},
+	}
+
+	out := PDF(inv, payments, "Bookings")
+
+	for _, want := range []string{
+		"%PDF-1.4",
+		"(Invoice INV-2050-00003)",
+		"(General's Quarters, night of Sat 1 Jan 2050)",
+		"(USD 300.00)",
+		"(USD 30.00)",
+		"(USD 330.00)",
+		"(USD -90.00)",
+		"(USD 240.00)",
+	} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("invoice PDF does not contain %s", want)
+		}
+	}
+
+	if bytes.Contains(out, []byte("(USD -50.00)")) {
+		t.Error("a failed payment should not be shown as paid")
+	}
+}
+
+func TestPDF_ManyLinesAddPages(t *testing.T) {
+	res := models.Reservation{
+		StartDate: models.NewDate(2050, 1, 1),
+		EndDate:   models.NewDate(2050, 3, 1),
+	}
+	room := models.Room{RoomName: "Major's Suite", Price: 22500}
+	inv := models.NewInvoice(res, models.PriceStay(res, room, nil, nil), models.Property{ID: 1, Currency: "usd"})
+
+	out := PDF(inv, nil, "Bookings")
+
+	if !bytes.Contains(out, []byte("/Count 2")) {
+		t.Error("expected a two page invoice for a 59 night stay")
+	}
+}
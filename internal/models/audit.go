@@ -0,0 +1,150 @@
+package models
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// Audit actions
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditStatus  = "status"
+	AuditMove    = "move"
+	AuditRestore = "restore"
+	AuditPurge   = "purge"
+	AuditMerge   = "merge"
+	AuditRefund  = "refund"
+	AuditUnlock  = "unlock"
+	AuditRevoke  = "revoke"
+)
+
+// Audited entity types
+const (
+	EntityReservation     = "reservation"
+	EntityRoomRestriction = "room_restriction"
+	EntityBlock           = "block"
+	EntityRestriction     = "restriction"
+	EntityGuest           = "guest"
+	EntityPayment         = "payment"
+	EntityChargeRule      = "charge_rule"
+	EntityPromoCode       = "promo_code"
+	EntityProperty        = "property"
+	EntityWaitlistEntry   = "waitlist_entry"
+	EntityChannel         = "channel"
+	EntityWebhook         = "webhook"
+	EntityUser            = "user"
+	EntitySettings        = "settings"
+	EntityInvoice         = "invoice"
+	EntityRoomHold        = "room_hold"
+)
+
+// AuditActor is who the audit log records a change as made by
+type AuditActor struct {
+	UserID int
+	// Actor is "staff", "guest" or "system"
+	Actor string
+	IPAddress string
+	RequestID string
+	// PropertyID is the property the actor is working on, which changes to entities that don't
+	// belong to a property of their own are recorded against
+	PropertyID int
+}
+
+// SystemActor makes the changes the site makes by itself, such as those of the background workers
+var SystemActor = AuditActor{Actor: "system"}
+
+// AuditEntry is one row of the append-only audit log
+type AuditEntry struct {
+	ID int
+	UserID int
+	Actor string
+	Action string
+	EntityType string
+	EntityID int
+	// PropertyID is the property the change was made at, or zero for changes to staff accounts,
+	// settings and other things that apply to every property
+	PropertyID int
+	Before string
+	After string
+	IPAddress string
+	RequestID string
+	CreatedAt time.Time
+	User User
+}
+
+// AuditFilter narrows an audit log search. Zero values match everything.
+type AuditFilter struct {
+	Query string
+	Action string
+	EntityType string
+	EntityID int
+	From time.Time
+	To time.Time
+	// PropertyID limits the search to the changes made at a property
+	PropertyID int
+	// Unscoped also matches the changes that don't belong to any property, which only owners see
+	Unscoped bool
+	Limit int
+}
+
+// AuditChange is a single field that differs between the before and after values of an entry
+type AuditChange struct {
+	Field string
+	Before string
+	After string
+}
+
+// Changes compares the top level fields of the before and after JSON and returns those that
+// differ, sorted by field name
+func (e AuditEntry) Changes() []AuditChange {
+	before := auditFields(e.Before)
+	after := auditFields(e.After)
+
+	fields := make(map[string]bool)
+	for k := range before {
+		fields[k] = true
+	}
+	for k := range after {
+		fields[k] = true
+	}
+
+	var changes []AuditChange
+	for k := range fields {
+		if before[k] != after[k] {
+			changes = append(changes, AuditChange{Field: k, Before: before[k], After: after[k]})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Field < changes[j].Field
+	})
+
+	return changes
+}
+
+// auditFields flattens a JSON object into its top level fields, formatted for display
+func auditFields(data string) map[string]string {
+	fields := make(map[string]string)
+	if data == "" {
+		return fields
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &values); err != nil {
+		return fields
+	}
+
+	for k, v := range values {
+		var s string
+		if err := json.Unmarshal(v, &s); err == nil {
+			fields[k] = s
+		} else {
+			fields[k] = string(v)
+		}
+	}
+
+	return fields
+}
@@ -0,0 +1,35 @@
+package models
+
+import "testing"
+
+func TestAuditEntry_Changes(t *testing.T) {
+	e := AuditEntry{
+		Before: `{"FirstName":"John","LastName":"Smith","RoomID":1}`,
+		After:  `{"FirstName":"Jane","LastName":"Smith","RoomID":2,"Notes":"late arrival"}`,
+	}
+
+	changes := e.Changes()
+	expected := []AuditChange{
+		{Field: "FirstName", Before: "John", After: "Jane"},
+		{Field: "Notes", Before: "", After: "late arrival"},
+		{Field: "RoomID", Before: "1", After: "2"},
+	}
+
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes but got %d: %v", len(expected), len(changes), changes)
+	}
+	for i, c := range changes {
+		if c != expected[i] {
+			t.Errorf("change %d: expected %v but got %v", i, expected[i], c)
+		}
+	}
+
+	created := AuditEntry{After: `{"ID":3}`}
+	if got := created.Changes(); len(got) != 1 || got[0].Before != "" || got[0].After != "3" {
+		t.Errorf("expected a single change from nothing for a created entity, got %v", got)
+	}
+
+	if got := (AuditEntry{Before: "not json"}).Changes(); len(got) != 0 {
+		t.Errorf("expected no changes for invalid json, got %v", got)
+	}
+}
@@ -0,0 +1,176 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RoomNight is what a room allows on one date: whether the night from Date to the next day can
+// be booked, and whether a stay can arrive or leave on Date
+type RoomNight struct {
+	Room Room
+	Date Date
+	Free bool
+	ClosedToArrival bool
+	ClosedToDeparture bool
+}
+
+// StayOption is a room that is free for a stay from StartDate to EndDate
+type StayOption struct {
+	Room Room
+	StartDate Date
+	EndDate Date
+}
+
+// Nights returns the number of nights of the stay
+func (o StayOption) Nights() int {
+	return o.StartDate.DaysUntil(o.EndDate)
+}
+
+// Shift describes how the stay's arrival differs from from, such as "1 day earlier"
+func (o StayOption) Shift(from Date) string {
+	days := from.DaysUntil(o.StartDate)
+	switch {
+	case days == 0:
+		return "Your dates"
+	case days == 1:
+		return "1 day later"
+	case days == -1:
+		return "1 day earlier"
+	case days > 0:
+		return fmt.Sprintf("%d days later", days)
+	default:
+		return fmt.Sprintf("%d days earlier", -days)
+	}
+}
+
+// roomCalendar is one room's nights keyed by date
+type roomCalendar struct {
+	room Room
+	nights map[string]RoomNight
+}
+
+// calendars groups grid by room, keeping the rooms in the order they first appear
+func calendars(grid []RoomNight) []roomCalendar {
+	var rooms []roomCalendar
+	index := make(map[int]int)
+	for _, n := range grid {
+		i, ok := index[n.Room.ID]
+		if !ok {
+			i = len(rooms)
+			index[n.Room.ID] = i
+			rooms = append(rooms, roomCalendar{room: n.Room, nights: make(map[string]RoomNight)})
+		}
+		rooms[i].nights[n.Date.String()] = n
+	}
+	return rooms
+}
+
+// canArrive reports whether a stay can arrive on d; a date missing from the calendar can't be
+// arrived on
+func (c roomCalendar) canArrive(d Date) bool {
+	n, ok := c.nights[d.String()]
+	return ok && !n.ClosedToArrival
+}
+
+// canLeave reports whether a stay can leave on d; only a closed to departure rule stops it
+func (c roomCalendar) canLeave(d Date) bool {
+	return !c.nights[d.String()].ClosedToDeparture
+}
+
+// free reports whether the night starting on d can be booked
+func (c roomCalendar) free(d Date) bool {
+	return c.nights[d.String()].Free
+}
+
+// fits reports whether the room can be booked from start to end
+func (c roomCalendar) fits(start, end Date) bool {
+	if !c.canArrive(start) || !c.canLeave(end) {
+		return false
+	}
+	for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+		if !c.free(d) {
+			return false
+		}
+	}
+	return true
+}
+
+// FlexibleStays returns the stays of nights nights arriving from earliest to latest that the
+// rooms in grid are free for, at most perRoom for each room, nearest to preferred first. grid
+// must cover every date from earliest to latest plus nights.
+func FlexibleStays(grid []RoomNight, nights int, earliest, latest, preferred Date, perRoom int) []StayOption {
+	var options []StayOption
+
+	for _, c := range calendars(grid) {
+		var fits []StayOption
+		for start := earliest; !start.After(latest); start = start.AddDate(0, 0, 1) {
+			end := start.AddDate(0, 0, nights)
+			if c.fits(start, end) {
+				fits = append(fits, StayOption{Room: c.room, StartDate: start, EndDate: end})
+			}
+		}
+
+		// nearest first, and the earlier of two stays as near as each other
+		sort.SliceStable(fits, func(i, j int) bool {
+			di, dj := absDays(preferred.DaysUntil(fits[i].StartDate)), absDays(preferred.DaysUntil(fits[j].StartDate))
+			if di != dj {
+				return di < dj
+			}
+			return fits[i].StartDate.Before(fits[j].StartDate)
+		})
+		if len(fits) > perRoom {
+			fits = fits[:perRoom]
+		}
+		options = append(options, fits...)
+	}
+
+	return options
+}
+
+// SplitStay returns the fewest stays in different rooms that together cover start to end, each
+// moving into the next room on the day it leaves the last, or nil when the rooms in grid can't
+// cover the stay or one room can take all of it
+func SplitStay(grid []RoomNight, start, end Date) []StayOption {
+	rooms := calendars(grid)
+
+	var parts []StayOption
+	for at := start; at.Before(end); {
+		// take the room that stays free the longest from at, which needs the fewest moves
+		best := StayOption{StartDate: at, EndDate: at}
+		for _, c := range rooms {
+			if !c.canArrive(at) {
+				continue
+			}
+			leave := at
+			for leave.Before(end) && c.free(leave) {
+				leave = leave.AddDate(0, 0, 1)
+			}
+			for leave.After(at) && !c.canLeave(leave) {
+				leave = leave.AddDate(0, 0, -1)
+			}
+			if leave.After(best.EndDate) {
+				best = StayOption{Room: c.room, StartDate: at, EndDate: leave}
+			}
+		}
+
+		if !best.EndDate.After(at) {
+			return nil
+		}
+		parts = append(parts, best)
+		at = best.EndDate
+	}
+
+	if len(parts) < 2 {
+		return nil
+	}
+	return parts
+}
+
+// absDays returns the size of a number of days, earlier or later
+func absDays(days int) int {
+	if days < 0 {
+		return -days
+	}
+	return days
+}
@@ -0,0 +1,110 @@
+package models
+
+import "testing"
+
+// testGrid builds room nights from a row per room, one character per date from start: '.' is
+// free, 'x' is taken, 'a' is free but closed to arrival and 'd' is free but closed to departure
+func testGrid(start Date, rows map[int]string) []RoomNight {
+	var grid []RoomNight
+	for id := 1; id <= len(rows); id++ {
+		for i, c := range rows[id] {
+			grid = append(grid, RoomNight{
+				Room:              Room{ID: id},
+				Date:              start.AddDate(0, 0, i),
+				Free:              c != 'x',
+				ClosedToArrival:   c == 'a',
+				ClosedToDeparture: c == 'd',
+			})
+		}
+	}
+	return grid
+}
+
+func TestFlexibleStays(t *testing.T) {
+	start := NewDate(2050, 6, 1)
+	grid := testGrid(start, map[int]string{
+		1: "..xx.....x",
+		2: "xx..a..d..",
+	})
+
+	// two nights arriving from the 3rd to the 7th, preferring the 5th
+	got := FlexibleStays(grid, 2, start.AddDate(0, 0, 2), start.AddDate(0, 0, 6), start.AddDate(0, 0, 4), 2)
+
+	expected := []StayOption{
+		// room 1 is free from the 5th; the 5th itself is nearest, then the 6th before the 7th
+		{Room: Room{ID: 1}, StartDate: start.AddDate(0, 0, 4), EndDate: start.AddDate(0, 0, 6)},
+		{Room: Room{ID: 1}, StartDate: start.AddDate(0, 0, 5), EndDate: start.AddDate(0, 0, 7)},
+		// room 2 can't be arrived at on the 5th or left on the 8th, which leaves the 4th, then
+		// the 3rd, as near as the 7th but earlier
+		{Room: Room{ID: 2}, StartDate: start.AddDate(0, 0, 3), EndDate: start.AddDate(0, 0, 5)},
+		{Room: Room{ID: 2}, StartDate: start.AddDate(0, 0, 2), EndDate: start.AddDate(0, 0, 4)},
+	}
+
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d stays, got %d: %+v", len(expected), len(got), got)
+	}
+	for i := range expected {
+		if got[i].Room.ID != expected[i].Room.ID || !got[i].StartDate.Equal(expected[i].StartDate) || !got[i].EndDate.Equal(expected[i].EndDate) {
+			t.Errorf("stay %d: expected room %d %s to %s, got room %d %s to %s", i, expected[i].Room.ID, expected[i].StartDate,
+				expected[i].EndDate, got[i].Room.ID, got[i].StartDate, got[i].EndDate)
+		}
+	}
+}
+
+func TestSplitStay(t *testing.T) {
+	start := NewDate(2050, 6, 1)
+
+	tests := []struct {
+		name     string
+		rows     map[int]string
+		nights   int
+		expected []int
+	}{
+		{"two-rooms", map[int]string{1: "..xxx", 2: "x...."}, 4, []int{1, 2}},
+		{"longest-first", map[int]string{1: ".xxxx", 2: "...xx", 3: "xx..."}, 4, []int{2, 3}},
+		{"one-room-is-enough", map[int]string{1: ".....", 2: "x...."}, 4, nil},
+		{"gap", map[int]string{1: "..xxx", 2: "xxx.."}, 4, nil},
+		{"closed-to-arrival", map[int]string{1: "..xxx", 2: "xxa.."}, 4, nil},
+		{"closed-to-departure", map[int]string{1: "..dxx", 2: "x...."}, 4, []int{1, 2}},
+	}
+
+	for _, e := range tests {
+		got := SplitStay(testGrid(start, e.rows), start, start.AddDate(0, 0, e.nights))
+
+		if len(got) != len(e.expected) {
+			t.Errorf("%s: expected %d parts, got %+v", e.name, len(e.expected), got)
+			continue
+		}
+		at := start
+		for i, part := range got {
+			if part.Room.ID != e.expected[i] || !part.StartDate.Equal(at) {
+				t.Errorf("%s: part %d: expected room %d from %s, got room %d from %s", e.name, i, e.expected[i], at, part.Room.ID, part.StartDate)
+			}
+			at = part.EndDate
+		}
+		if len(got) > 0 && !at.Equal(start.AddDate(0, 0, e.nights)) {
+			t.Errorf("%s: expected the parts to end on the last day, got %s", e.name, at)
+		}
+	}
+}
+
+func TestStayOption_Shift(t *testing.T) {
+	from := NewDate(2050, 6, 10)
+
+	tests := []struct {
+		start    Date
+		expected string
+	}{
+		{from, "Your dates"},
+		{from.AddDate(0, 0, 1), "1 day later"},
+		{from.AddDate(0, 0, -1), "1 day earlier"},
+		{from.AddDate(0, 0, 3), "3 days later"},
+		{from.AddDate(0, 0, -7), "7 days earlier"},
+	}
+
+	for _, e := range tests {
+		if got := (StayOption{StartDate: e.start}).Shift(from); got != e.expected {
+			t.Errorf("expected %q for %s, got %q", e.expected, e.start, got)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package models
+
+import "time"
+
+// Channel sync directions
+const (
+	SyncPush = "push"
+	SyncPull = "pull"
+)
+
+// Channel sync outcomes. A conflict is a booking from a channel that can't be honoured as it
+// stands, which staff have to sort out by hand.
+const (
+	SyncOK       = "ok"
+	SyncError    = "error"
+	SyncConflict = "conflict"
+)
+
+// Statuses of a booking made on a channel
+const (
+	ChannelBookingImported  = "imported"
+	ChannelBookingCancelled = "cancelled"
+	ChannelBookingConflict  = "conflict"
+)
+
+// Channel is another booking site a property's rooms are sold on. Availability and prices are
+// pushed to it, and the bookings guests make there are pulled in as reservations.
+type Channel struct {
+	ID int
+	PropertyID int
+	Name string
+	// Kind picks the adapter that talks to the channel
+	Kind string
+	BaseURL string
+	// APIKey is kept out of JSON so it never reaches the audit log
+	APIKey string `json:"-"`
+	Active bool
+	// Rooms maps the IDs of the property's rooms to the channel's IDs for them. Rooms that
+	// aren't mapped aren't sold on the channel.
+	Rooms map[int]string
+	// LastPulledAt is when bookings were last pulled in full
+	LastPulledAt time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// RoomFor returns the ID of the room the channel calls externalID, or 0 when no room is mapped
+// to it
+func (c Channel) RoomFor(externalID string) int {
+	if externalID == "" {
+		return 0
+	}
+	for roomID, id := range c.Rooms {
+		if id == externalID {
+			return roomID
+		}
+	}
+	return 0
+}
+
+// ChannelBooking ties a booking on a channel to the reservation made for it. A channel's
+// booking is only ever imported once, however often it is pulled.
+type ChannelBooking struct {
+	ID int
+	ChannelID int
+	ExternalID string
+	// ReservationID is zero when the booking was never imported
+	ReservationID int
+	Status string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ChannelSyncLog is one entry in the record of what syncing a channel did
+type ChannelSyncLog struct {
+	ID int
+	ChannelID int
+	Direction string
+	Status string
+	// ExternalID is the channel's booking the entry is about, if any
+	ExternalID string
+	Message string
+	CreatedAt time.Time
+}
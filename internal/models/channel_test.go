@@ -0,0 +1,37 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestChannel_RoomFor(t *testing.T) {
+	c := Channel{Rooms: map[int]string{1: "GQ", 2: "MS", 3: ""}}
+
+	tests := []struct {
+		externalID string
+		expected   int
+	}{
+		{"GQ", 1},
+		{"MS", 2},
+		{"gq", 0},
+		{"", 0},
+	}
+
+	for _, e := range tests {
+		if got := c.RoomFor(e.externalID); got != e.expected {
+			t.Errorf("RoomFor(%q) = %d, expected %d", e.externalID, got, e.expected)
+		}
+	}
+}
+
+func TestChannel_JSONHidesAPIKey(t *testing.T) {
+	out, err := json.Marshal(Channel{Name: "Booking Site", APIKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "secret") {
+		t.Errorf("expected the API key to be left out, got %s", out)
+	}
+}
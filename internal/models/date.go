@@ -0,0 +1,202 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// DateLayout is how dates are written in forms, JSON, URLs and the database
+const DateLayout = "2006-01-02"
+
+// Date is a calendar day with no time of day or timezone, such as the night a stay starts. It
+// is the same day wherever it is read, so it never shifts by a day around midnight or a
+// daylight saving change. The zero Date is no date.
+type Date struct {
+	// t is midnight UTC on the day, which keeps date arithmetic free of zone offsets
+	t time.Time
+}
+
+// NewDate returns the date for year, month and day, normalizing them as time.Date does
+func NewDate(year int, month time.Month, day int) Date {
+	return Date{t: time.Date(year, month, day, 0, 0, 0, 0, time.UTC)}
+}
+
+// DateOf returns the calendar day t falls on in t's own location
+func DateOf(t time.Time) Date {
+	if t.IsZero() {
+		return Date{}
+	}
+	return NewDate(t.Year(), t.Month(), t.Day())
+}
+
+// Today returns the current date in loc
+func Today(loc *time.Location) Date {
+	return DateOf(time.Now().In(loc))
+}
+
+// ParseDate reads a date written as 2006-01-02
+func ParseDate(s string) (Date, error) {
+	t, err := time.Parse(DateLayout, s)
+	if err != nil {
+		return Date{}, fmt.Errorf("invalid date %q, expected yyyy-mm-dd", s)
+	}
+	return Date{t: t}, nil
+}
+
+// IsZero reports whether d is no date
+func (d Date) IsZero() bool {
+	return d.t.IsZero()
+}
+
+// Year returns the year of d
+func (d Date) Year() int {
+	return d.t.Year()
+}
+
+// Month returns the month of d
+func (d Date) Month() time.Month {
+	return d.t.Month()
+}
+
+// Day returns the day of the month of d
+func (d Date) Day() int {
+	return d.t.Day()
+}
+
+// Weekday returns the day of the week of d
+func (d Date) Weekday() time.Weekday {
+	return d.t.Weekday()
+}
+
+// Before reports whether d is earlier than u
+func (d Date) Before(u Date) bool {
+	return d.t.Before(u.t)
+}
+
+// After reports whether d is later than u
+func (d Date) After(u Date) bool {
+	return d.t.After(u.t)
+}
+
+// Equal reports whether d and u are the same day
+func (d Date) Equal(u Date) bool {
+	return d.t.Equal(u.t)
+}
+
+// AddDate returns d moved by years, months and days, normalizing as time.Time.AddDate does
+func (d Date) AddDate(years, months, days int) Date {
+	return Date{t: d.t.AddDate(years, months, days)}
+}
+
+// DaysUntil returns the number of days from d to u, negative when u is earlier
+func (d Date) DaysUntil(u Date) int {
+	return int(u.t.Sub(d.t).Hours()) / 24
+}
+
+// Format writes d with a time.Time layout; the time of day is always midnight
+func (d Date) Format(layout string) string {
+	return d.t.Format(layout)
+}
+
+// String returns d as 2006-01-02, or an empty string for the zero Date
+func (d Date) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.t.Format(DateLayout)
+}
+
+// Time returns midnight UTC on d
+func (d Date) Time() time.Time {
+	return d.t
+}
+
+// In returns the moment d starts in loc. On a day a daylight saving change skips midnight
+// it is the first moment of the day that exists.
+func (d Date) In(loc *time.Location) time.Time {
+	t := time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, loc)
+	if DateOf(t).Before(d) {
+		// midnight was skipped and time.Date went back to the day before, so start when the
+		// clocks went forward
+		_, t = t.ZoneBounds()
+	}
+	return t
+}
+
+// MarshalText writes d as 2006-01-02
+func (d Date) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText reads a date written as 2006-01-02, or the zero Date from an empty string
+func (d *Date) UnmarshalText(b []byte) error {
+	if len(b) == 0 {
+		*d = Date{}
+		return nil
+	}
+	parsed, err := ParseDate(string(b))
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// MarshalBinary writes d as text so it can be kept in the gob encoded session
+func (d Date) MarshalBinary() ([]byte, error) {
+	return d.MarshalText()
+}
+
+// UnmarshalBinary reads a date written by MarshalBinary
+func (d *Date) UnmarshalBinary(b []byte) error {
+	return d.UnmarshalText(b)
+}
+
+// MarshalJSON writes d as "2006-01-02", or null for the zero Date
+func (d Date) MarshalJSON() ([]byte, error) {
+	if d.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON reads a date written as "2006-01-02" or null
+func (d *Date) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*d = Date{}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+// Scan reads a Postgres date column, which may be null
+func (d *Date) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*d = Date{}
+	case time.Time:
+		// the driver reads dates as midnight UTC, so take the day as it was written
+		*d = NewDate(v.Year(), v.Month(), v.Day())
+	case string:
+		return d.UnmarshalText([]byte(v))
+	case []byte:
+		return d.UnmarshalText(v)
+	default:
+		return fmt.Errorf("can't scan %T into a date", src)
+	}
+	return nil
+}
+
+// Value writes d to a Postgres date column as 2006-01-02, or null for the zero Date
+func (d Date) Value() (driver.Value, error) {
+	if d.IsZero() {
+		return nil, nil
+	}
+	return d.String(), nil
+}
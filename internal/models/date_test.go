@@ -0,0 +1,220 @@
+package models
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected Date
+		ok       bool
+	}{
+		{"2050-01-13", NewDate(2050, 1, 13), true},
+		{"2024-02-29", NewDate(2024, 2, 29), true},
+		{"2023-02-29", Date{}, false},
+		{"13/01/2050", Date{}, false},
+		{"2050-01-13T10:00:00Z", Date{}, false},
+		{"", Date{}, false},
+	}
+
+	for _, e := range tests {
+		got, err := ParseDate(e.in)
+		if (err == nil) != e.ok {
+			t.Errorf("ParseDate(%q): expected ok %v, got error %v", e.in, e.ok, err)
+			continue
+		}
+		if !got.Equal(e.expected) {
+			t.Errorf("ParseDate(%q) = %s, expected %s", e.in, got, e.expected)
+		}
+		if e.ok && got.String() != e.in {
+			t.Errorf("ParseDate(%q) formats back as %q", e.in, got.String())
+		}
+	}
+}
+
+func TestDateOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		instant  time.Time
+		zone     string
+		expected Date
+	}{
+		{"utc", time.Date(2026, 3, 29, 23, 30, 0, 0, time.UTC), "UTC", NewDate(2026, 3, 29)},
+		{"ahead of utc", time.Date(2026, 3, 29, 23, 30, 0, 0, time.UTC), "Pacific/Auckland", NewDate(2026, 3, 30)},
+		{"behind utc", time.Date(2026, 1, 1, 2, 0, 0, 0, time.UTC), "America/New_York", NewDate(2025, 12, 31)},
+		{"london before spring forward", time.Date(2026, 3, 29, 0, 59, 0, 0, time.UTC), "Europe/London", NewDate(2026, 3, 29)},
+		{"london bst midnight", time.Date(2026, 3, 29, 23, 0, 0, 0, time.UTC), "Europe/London", NewDate(2026, 3, 30)},
+		{"london just before bst midnight", time.Date(2026, 3, 29, 22, 59, 0, 0, time.UTC), "Europe/London", NewDate(2026, 3, 29)},
+		{"london after fall back", time.Date(2026, 10, 25, 23, 30, 0, 0, time.UTC), "Europe/London", NewDate(2026, 10, 25)},
+		{"new york spring forward", time.Date(2026, 3, 9, 3, 30, 0, 0, time.UTC), "America/New_York", NewDate(2026, 3, 8)},
+		{"new york fall back", time.Date(2026, 11, 2, 4, 30, 0, 0, time.UTC), "America/New_York", NewDate(2026, 11, 1)},
+		{"auckland dst ends", time.Date(2026, 4, 4, 11, 30, 0, 0, time.UTC), "Pacific/Auckland", NewDate(2026, 4, 5)},
+	}
+
+	for _, e := range tests {
+		got := DateOf(e.instant.In(mustLoad(t, e.zone)))
+		if !got.Equal(e.expected) {
+			t.Errorf("%s: expected %s, got %s", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestDate_DaylightSaving(t *testing.T) {
+	tests := []struct {
+		name   string
+		zone   string
+		day    Date
+		length time.Duration
+	}{
+		{"london spring forward", "Europe/London", NewDate(2026, 3, 29), 23 * time.Hour},
+		{"london fall back", "Europe/London", NewDate(2026, 10, 25), 25 * time.Hour},
+		{"new york spring forward", "America/New_York", NewDate(2026, 3, 8), 23 * time.Hour},
+		{"new york fall back", "America/New_York", NewDate(2026, 11, 1), 25 * time.Hour},
+		{"auckland dst starts", "Pacific/Auckland", NewDate(2026, 9, 27), 23 * time.Hour},
+		{"auckland dst ends", "Pacific/Auckland", NewDate(2026, 4, 5), 25 * time.Hour},
+		{"lisbon ordinary day", "Europe/Lisbon", NewDate(2026, 6, 1), 24 * time.Hour},
+	}
+
+	for _, e := range tests {
+		loc := mustLoad(t, e.zone)
+		next := e.day.AddDate(0, 0, 1)
+
+		if got := next.In(loc).Sub(e.day.In(loc)); got != e.length {
+			t.Errorf("%s: expected the day to last %s, got %s", e.name, e.length, got)
+		}
+
+		// a stay over the change is still counted in whole nights
+		stay := Reservation{StartDate: e.day.AddDate(0, 0, -1), EndDate: next}
+		if stay.Nights() != 2 {
+			t.Errorf("%s: expected 2 nights, got %d", e.name, stay.Nights())
+		}
+
+		// the day a date starts on is the date itself, whatever the clocks do
+		if got := DateOf(e.day.In(loc)); !got.Equal(e.day) {
+			t.Errorf("%s: expected the day to start on %s, got %s", e.name, e.day, got)
+		}
+	}
+}
+
+func TestDate_Midnight(t *testing.T) {
+	// São Paulo skipped midnight when daylight saving started in 2018
+	loc := mustLoad(t, "America/Sao_Paulo")
+	day := NewDate(2018, 11, 4)
+
+	if got := DateOf(day.In(loc)); !got.Equal(day) {
+		t.Errorf("expected a skipped midnight to stay on %s, got %s", day, got)
+	}
+}
+
+func TestDate_JSON(t *testing.T) {
+	tests := []struct {
+		date Date
+		json string
+	}{
+		{NewDate(2050, 1, 13), `{"date":"2050-01-13"}`},
+		{Date{}, `{"date":null}`},
+	}
+
+	for _, e := range tests {
+		out, err := json.Marshal(struct {
+			Date Date `json:"date"`
+		}{e.date})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != e.json {
+			t.Errorf("expected %s, got %s", e.json, out)
+		}
+
+		var in struct {
+			Date Date `json:"date"`
+		}
+		if err := json.Unmarshal(out, &in); err != nil {
+			t.Fatal(err)
+		}
+		if !in.Date.Equal(e.date) {
+			t.Errorf("expected %s back from JSON, got %s", e.date, in.Date)
+		}
+	}
+
+	var bad struct {
+		Date Date `json:"date"`
+	}
+	if err := json.Unmarshal([]byte(`{"date":"2050-13-01"}`), &bad); err == nil {
+		t.Error("expected an invalid date in JSON to fail")
+	}
+}
+
+func TestDate_Gob(t *testing.T) {
+	// reservations are kept in the session, which is gob encoded
+	res := Reservation{StartDate: NewDate(2050, 1, 13), EndDate: NewDate(2050, 1, 15)}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(res); err != nil {
+		t.Fatal(err)
+	}
+
+	var out Reservation
+	if err := gob.NewDecoder(&buf).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !out.StartDate.Equal(res.StartDate) || !out.EndDate.Equal(res.EndDate) {
+		t.Errorf("expected %s to %s from the session, got %s to %s", res.StartDate, res.EndDate, out.StartDate, out.EndDate)
+	}
+}
+
+func TestDate_Scan(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      interface{}
+		expected Date
+	}{
+		{"null", nil, Date{}},
+		{"driver time", time.Date(2050, 1, 13, 0, 0, 0, 0, time.UTC), NewDate(2050, 1, 13)},
+		{"driver time with a zone", time.Date(2050, 1, 13, 0, 0, 0, 0, time.FixedZone("", -5*3600)), NewDate(2050, 1, 13)},
+		{"text", "2050-01-13", NewDate(2050, 1, 13)},
+		{"bytes", []byte("2050-01-13"), NewDate(2050, 1, 13)},
+	}
+
+	for _, e := range tests {
+		var d Date
+		if err := d.Scan(e.src); err != nil {
+			t.Errorf("%s: %v", e.name, err)
+			continue
+		}
+		if !d.Equal(e.expected) {
+			t.Errorf("%s: expected %s, got %s", e.name, e.expected, d)
+		}
+
+		v, err := d.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.IsZero() && v != nil {
+			t.Errorf("%s: expected no date to be written as null, got %v", e.name, v)
+		}
+		if !d.IsZero() && v != e.expected.String() {
+			t.Errorf("%s: expected %s to be written, got %v", e.name, e.expected, v)
+		}
+	}
+
+	var d Date
+	if err := d.Scan(42); err == nil {
+		t.Error("expected scanning a number to fail")
+	}
+}
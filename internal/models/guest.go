@@ -0,0 +1,72 @@
+package models
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Guest tags with a meaning of their own; any other tag is free text
+const (
+	TagVIP       = "vip"
+	TagDoNotRent = "do-not-rent"
+)
+
+// Guest is a person who has made one or more reservations
+type Guest struct {
+	ID int
+	FirstName string
+	LastName string
+	Email string
+	Phone string
+	Notes string
+	Tags []string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	HasAccount bool
+	Stays int
+	TotalNights int
+	LastStay time.Time
+}
+
+// HasTag reports whether the guest carries tag
+func (g Guest) HasTag(tag string) bool {
+	for _, t := range g.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeEmail returns the form of an email address used to match guests
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// NormalizePhone returns the digits of a phone number, which is the form used to match guests
+func NormalizePhone(phone string) string {
+	var b strings.Builder
+	for _, r := range phone {
+		if unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// ParseTags splits a comma separated list of tags, lower casing them and dropping blanks
+// and duplicates
+func ParseTags(s string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	return tags
+}
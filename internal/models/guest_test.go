@@ -0,0 +1,46 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	if got := NormalizeEmail("  John.Smith@Example.COM "); got != "john.smith@example.com" {
+		t.Errorf("unexpected normalized email %q", got)
+	}
+}
+
+func TestNormalizePhone(t *testing.T) {
+	tests := map[string]string{
+		"+1 (555) 123-4567": "15551234567",
+		"555.123.4567":      "5551234567",
+		"":                  "",
+		"none":              "",
+	}
+
+	for in, expected := range tests {
+		if got := NormalizePhone(in); got != expected {
+			t.Errorf("NormalizePhone(%q): expected %q but got %q", in, expected, got)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	got := ParseTags(" VIP, do-not-rent,,vip , Late Checkout")
+	expected := []string{"vip", "do-not-rent", "late checkout"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v but got %v", expected, got)
+	}
+
+	if got := ParseTags(""); got != nil {
+		t.Errorf("expected no tags for an empty string, got %v", got)
+	}
+}
+
+func TestGuest_HasTag(t *testing.T) {
+	g := Guest{Tags: []string{TagVIP}}
+	if !g.HasTag(TagVIP) || g.HasTag(TagDoNotRent) {
+		t.Errorf("unexpected tags on %v", g.Tags)
+	}
+}
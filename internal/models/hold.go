@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// RoomHold keeps a room for a guest's stay while they fill in the booking form, so nobody else
+// can book it until they finish or ExpiresAt passes
+type RoomHold struct {
+	ID int
+	RoomID int
+	StartDate Date
+	EndDate Date
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Covers reports whether the hold still keeps the room and nights of res at now
+func (h RoomHold) Covers(res Reservation, now time.Time) bool {
+	return h.RoomID == res.RoomID && h.StartDate.Equal(res.StartDate) && h.EndDate.Equal(res.EndDate) &&
+		now.Before(h.ExpiresAt)
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoomHold_Covers(t *testing.T) {
+	now := time.Date(2050, 1, 1, 12, 0, 0, 0, time.UTC)
+	hold := RoomHold{RoomID: 1, StartDate: NewDate(2050, 3, 1), EndDate: NewDate(2050, 3, 3), ExpiresAt: now.Add(time.Minute)}
+	stay := Reservation{RoomID: 1, StartDate: NewDate(2050, 3, 1), EndDate: NewDate(2050, 3, 3)}
+
+	if !hold.Covers(stay, now) {
+		t.Error("expected the hold to cover its own stay")
+	}
+	if hold.Covers(stay, now.Add(time.Minute)) {
+		t.Error("expected a hold that has run out not to cover the stay")
+	}
+
+	other := stay
+	other.RoomID = 2
+	if hold.Covers(other, now) {
+		t.Error("expected the hold not to cover another room")
+	}
+
+	longer := stay
+	longer.EndDate = NewDate(2050, 3, 4)
+	if hold.Covers(longer, now) {
+		t.Error("expected the hold not to cover a longer stay")
+	}
+}
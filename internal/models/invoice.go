@@ -0,0 +1,110 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Invoice line kinds
+const (
+	LineNight    = "night"
+	LineDiscount = "discount"
+	LineFee      = "fee"
+	LineTax      = "tax"
+)
+
+// Invoice is the bill for a reservation. Its lines are fixed when it is issued; payments are
+// read as they stand whenever the invoice is shown, so the balance reflects later refunds.
+type Invoice struct {
+	ID int
+	ReservationID int
+	PropertyID int
+	Year int
+	Sequence int
+	Currency string
+	BillToName string
+	BillToEmail string
+	IssuedAt time.Time
+	Lines []InvoiceLine
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// InvoiceLine is one charge on an invoice. Amounts are in the smallest unit of the currency.
+type InvoiceLine struct {
+	ID int
+	InvoiceID int
+	Kind string
+	Description string
+	Quantity int
+	UnitAmount int
+	Amount int
+}
+
+// Number returns the invoice number, which runs in sequence per property and year
+func (i Invoice) Number() string {
+	return fmt.Sprintf("INV-%d-%05d", i.Year, i.Sequence)
+}
+
+// Subtotal returns the total of the lines before tax, after any discount
+func (i Invoice) Subtotal() int {
+	total := 0
+	for _, l := range i.Lines {
+		if l.Kind != LineTax {
+			total += l.Amount
+		}
+	}
+	return total
+}
+
+// TaxTotal returns the total of the tax lines
+func (i Invoice) TaxTotal() int {
+	total := 0
+	for _, l := range i.Lines {
+		if l.Kind == LineTax {
+			total += l.Amount
+		}
+	}
+	return total
+}
+
+// Total returns the amount the invoice is for
+func (i Invoice) Total() int {
+	return i.Subtotal() + i.TaxTotal()
+}
+
+// AmountPaid returns how much of the payments has been taken and kept
+func AmountPaid(payments []Payment) int {
+	total := 0
+	for _, p := range payments {
+		switch p.Status {
+		case PaymentCaptured, PaymentPartiallyRefunded, PaymentRefunded:
+			total += p.Amount - p.RefundedAmount
+		}
+	}
+	return total
+}
+
+// NewInvoice drafts the invoice for a reservation at property from the charges for the stay.
+// The number is given when it is saved.
+func NewInvoice(res Reservation, charges []Charge, property Property) Invoice {
+	inv := Invoice{
+		ReservationID: res.ID,
+		PropertyID:    property.ID,
+		Currency:      property.Currency,
+		BillToName:    res.FirstName + " " + res.LastName,
+		BillToEmail:   res.Email,
+	}
+
+	for _, c := range charges {
+		inv.Lines = append(inv.Lines, InvoiceLine{
+			Kind:        c.Kind,
+			Description: c.Description,
+			Quantity:    c.Quantity,
+			UnitAmount:  c.UnitAmount,
+			Amount:      c.Amount,
+		})
+	}
+
+	return inv
+}
@@ -0,0 +1,57 @@
+package models
+
+import "testing"
+
+func TestNewInvoice(t *testing.T) {
+	res := Reservation{
+		ID:        7,
+		FirstName: "John",
+		LastName:  "Smith",
+		Email:     "john@smith.com",
+		StartDate: NewDate(2050, 1, 1),
+		EndDate:   NewDate(2050, 1, 4),
+	}
+	room := Room{RoomName: "Major's Suite", Price: 22500}
+	rules := []ChargeRule{{Name: "VAT", Kind: ChargeTax, Basis: BasisPercent, Amount: 10}}
+
+	property := Property{ID: 2, Currency: "eur"}
+
+	inv := NewInvoice(res, PriceStay(res, room, rules, nil), property)
+
+	if len(inv.Lines) != 4 {
+		t.Fatalf("expected 3 nights and a tax line, got %d lines", len(inv.Lines))
+	}
+	if inv.Lines[0].Description != "Major's Suite, night of Sat 1 Jan 2050" {
+		t.Errorf("unexpected first line %q", inv.Lines[0].Description)
+	}
+	if inv.Subtotal() != 67500 || inv.TaxTotal() != 6750 || inv.Total() != 74250 {
+		t.Errorf("unexpected totals %d + %d = %d", inv.Subtotal(), inv.TaxTotal(), inv.Total())
+	}
+	if inv.BillToName != "John Smith" || inv.ReservationID != 7 {
+		t.Errorf("unexpected bill to %q for reservation %d", inv.BillToName, inv.ReservationID)
+	}
+	if inv.PropertyID != 2 || inv.Currency != "eur" {
+		t.Errorf("expected the invoice in eur for property 2, got %s for property %d", inv.Currency, inv.PropertyID)
+	}
+}
+
+func TestInvoice_Number(t *testing.T) {
+	inv := Invoice{Year: 2026, Sequence: 42}
+	if inv.Number() != "INV-2026-00042" {
+		t.Errorf("unexpected invoice number %s", inv.Number())
+	}
+}
+
+func TestAmountPaid(t *testing.T) {
+	payments := []Payment{
+		{Amount: 9000, Status: PaymentCaptured},
+		{Amount: 5000, RefundedAmount: 2000, Status: PaymentPartiallyRefunded},
+		{Amount: 4000, RefundedAmount: 4000, Status: PaymentRefunded},
+		{Amount: 7000, Status: PaymentAuthorized},
+		{Amount: 7000, Status: PaymentFailed},
+	}
+
+	if got := AmountPaid(payments); got != 12000 {
+		t.Errorf("expected 12000 paid, got %d", got)
+	}
+}
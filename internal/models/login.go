@@ -0,0 +1,99 @@
+package models
+
+import "time"
+
+// Sign in throttling. Failed sign ins to an account are counted until it next signs in, over
+// LoginAccountWindow, and failed sign ins from an address over LoginIPWindow. After a few failures
+// each attempt has to wait twice as long as the last, and an account that keeps failing is locked.
+const (
+	// LoginAccountWindow is how far back failed sign ins to an account are counted
+	LoginAccountWindow = 24 * time.Hour
+	// LoginAccountFreeAttempts is how many failed sign ins an account gets before it has to wait
+	LoginAccountFreeAttempts = 3
+	// LoginLockoutAttempts is how many failed sign ins in a row lock an account
+	LoginLockoutAttempts = 10
+	// LoginLockoutPeriod is how long a locked account stays locked after its last failed sign in
+	LoginLockoutPeriod = 30 * time.Minute
+
+	// LoginIPWindow is how far back failed sign ins from an address are counted
+	LoginIPWindow = 15 * time.Minute
+	// LoginIPFreeAttempts is how many failed sign ins an address gets before it has to wait, which
+	// is more than an account gets since staff may share an address
+	LoginIPFreeAttempts = 10
+
+	// loginMaxBackoff is the longest wait between attempts short of a lockout
+	loginMaxBackoff = 15 * time.Minute
+)
+
+// LoginAttempt is a staff sign in. Attempts are kept for emails that don't belong to anyone as
+// well, so they are throttled the same way and can't be told apart.
+type LoginAttempt struct {
+	ID int
+	Email string
+	IPAddress string
+	Succeeded bool
+	CreatedAt time.Time
+}
+
+// LoginBackoff returns how long to wait after failures failed sign ins when the first free of
+// them don't count: a second, doubling with each failure up to a limit
+func LoginBackoff(failures, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+	n := failures - free
+	if n >= 10 {
+		return loginMaxBackoff
+	}
+	wait := time.Second << n
+	if wait > loginMaxBackoff {
+		return loginMaxBackoff
+	}
+	return wait
+}
+
+// LoginFailures counts the recent failed sign ins to an account and from an address
+type LoginFailures struct {
+	// Account is the failed sign ins to the account since it last signed in or was unlocked
+	Account int
+	AccountLastAt time.Time
+	IP int
+	IPLastAt time.Time
+}
+
+// Locked reports whether the account has failed to sign in too many times in a row
+func (f LoginFailures) Locked() bool {
+	return f.Account >= LoginLockoutAttempts
+}
+
+// Wait returns how long from now until another sign in can be tried, or zero when one can be
+// tried now
+func (f LoginFailures) Wait(now time.Time) time.Duration {
+	account := LoginBackoff(f.Account, LoginAccountFreeAttempts)
+	if f.Locked() {
+		account = LoginLockoutPeriod
+	}
+
+	wait := f.AccountLastAt.Add(account).Sub(now)
+	if ip := f.IPLastAt.Add(LoginBackoff(f.IP, LoginIPFreeAttempts)).Sub(now); ip > wait {
+		wait = ip
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// LockedAccount is a staff account that has failed to sign in too many times in a row
+type LockedAccount struct {
+	User User
+	Failures int
+	LastAttemptAt time.Time
+	// IPAddress is where the last failed sign in came from
+	IPAddress string
+}
+
+// LockedUntil returns when the account can next be signed in to
+func (a LockedAccount) LockedUntil() time.Time {
+	return a.LastAttemptAt.Add(LoginLockoutPeriod)
+}
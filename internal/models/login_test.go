@@ -0,0 +1,59 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{8, 32 * time.Second},
+		{12, 512 * time.Second},
+		{13, loginMaxBackoff},
+		{100, loginMaxBackoff},
+	}
+
+	for _, e := range tests {
+		if got := LoginBackoff(e.failures, 3); got != e.expected {
+			t.Errorf("%d failures: expected %s, got %s", e.failures, e.expected, got)
+		}
+	}
+}
+
+func TestLoginFailures_Wait(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		failures LoginFailures
+		expected time.Duration
+	}{
+		{"none", LoginFailures{}, 0},
+		{"free", LoginFailures{Account: 2, AccountLastAt: now, IP: 2, IPLastAt: now}, 0},
+		{"account", LoginFailures{Account: 5, AccountLastAt: now.Add(-time.Second)}, 3 * time.Second},
+		{"account-waited", LoginFailures{Account: 5, AccountLastAt: now.Add(-time.Minute)}, 0},
+		{"ip", LoginFailures{Account: 1, AccountLastAt: now, IP: 12, IPLastAt: now}, 4 * time.Second},
+		{"locked", LoginFailures{Account: LoginLockoutAttempts, AccountLastAt: now.Add(-10 * time.Minute)}, 20 * time.Minute},
+		{"lock-over", LoginFailures{Account: LoginLockoutAttempts, AccountLastAt: now.Add(-time.Hour)}, 0},
+	}
+
+	for _, e := range tests {
+		if got := e.failures.Wait(now); got != e.expected {
+			t.Errorf("%s: expected %s, got %s", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestLockedAccount_LockedUntil(t *testing.T) {
+	last := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	if got := (LockedAccount{LastAttemptAt: last}).LockedUntil(); !got.Equal(last.Add(LoginLockoutPeriod)) {
+		t.Errorf("expected the lock to end %s after the last attempt, got %s", LoginLockoutPeriod, got)
+	}
+}
@@ -12,6 +12,11 @@ type User struct {
 	Email     string
 	Password string
 	AccessLevel int
+	// TOTPSecret is the key the user's authenticator app makes sign in codes from. It is kept
+	// out of JSON so it never reaches the audit log.
+	TOTPSecret string `json:"-"`
+	// TwoFactorEnabledAt is when the user turned on two-factor authentication, zero while it is off
+	TwoFactorEnabledAt time.Time
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
@@ -20,14 +25,27 @@ type User struct {
 type Room struct {
 	ID int
 	RoomName string
+	PropertyID int
+	// Price is the nightly rate in the smallest unit of the currency
+	Price int
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+// Restriction IDs seeded by the migrations
+const (
+	RestrictionReservation = 1
+	RestrictionOwnerBlock  = 2
+)
+
 // Restriction is the restriction model
 type Restriction struct {
 	ID int
 	RestrictionName string
+	Color string
+	BlocksStay bool
+	ClosedToArrival bool
+	ClosedToDeparture bool
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
@@ -39,28 +57,88 @@ type Reservation struct {
 	LastName string
 	Email string
 	Phone string
-	StartDate time.Time
-	EndDate time.Time
+	StartDate Date
+	EndDate Date
 	RoomID int
 	CreatedAt time.Time
 	UpdatedAt time.Time
-	Processed int
+	Status ReservationStatus
+	ConfirmedAt time.Time
+	CheckedInAt time.Time
+	CheckedOutAt time.Time
+	CancelledAt time.Time
+	NoShowAt time.Time
+	DeletedAt time.Time
+	DeletedBy int
+	// PaymentDueAt is when a pending reservation is cancelled unless its deposit has been paid,
+	// and is zero when no deposit is due
+	PaymentDueAt time.Time
+	GuestID int
+	Guests int
+	PromoCodeID int
+	Charges []Charge
 	Room Room
+	DeletedByUser User
+}
+
+// Nights returns the number of nights the reservation covers
+func (r Reservation) Nights() int {
+	return r.StartDate.DaysUntil(r.EndDate)
 }
 
 // RoomRestriction is the room restriction model
 type RoomRestriction struct {
 	ID int
-	StartDate time.Time
-	EndDate time.Time
+	StartDate Date
+	EndDate Date
 	RoomID int
 	ReservationID int
 	RestrictionID int
+	Notes string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Room Room
+	Reservation Reservation
+	Restriction Restriction
+}
+
+// ReservationChange records a move of a reservation to another room or other dates
+type ReservationChange struct {
+	ID int
+	ReservationID int
+	UserID int
+	OldRoomID int
+	NewRoomID int
+	OldStartDate Date
+	OldEndDate Date
+	NewStartDate Date
+	NewEndDate Date
 	CreatedAt time.Time
 	UpdatedAt time.Time
+	OldRoom Room
+	NewRoom Room
+	User User
+}
+
+// CalendarRow is one room on the admin reservations calendar
+type CalendarRow struct {
 	Room Room
+	Cells []CalendarCell
+}
+
+// CalendarCell is one night of a room on the admin reservations calendar
+type CalendarCell struct {
+	Date Date
+	ReservationID int
 	Reservation Reservation
+	BlockID int
+	// BlockStart and BlockEnd are the nights the block covers, which may reach outside the calendar
+	BlockStart Date
+	BlockEnd Date
+	// FirstOfBlock is set on the first cell of a block shown, which holds the control removing it
+	FirstOfBlock bool
 	Restriction Restriction
+	Notes string
 }
 
 // MailData holds an email message
@@ -70,4 +148,12 @@ type MailData struct {
 	Subject string
 	Content string
 	Template string
+	Attachments []MailAttachment
+}
+
+// MailAttachment is a file sent with an email
+type MailAttachment struct {
+	Name string
+	ContentType string
+	Data []byte
 }
\ No newline at end of file
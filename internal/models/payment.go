@@ -0,0 +1,72 @@
+package models
+
+import "time"
+
+// PaymentStatus is the state of a payment taken for a reservation
+type PaymentStatus string
+
+// Payment statuses
+const (
+	PaymentAuthorized        PaymentStatus = "authorized"
+	PaymentCaptured          PaymentStatus = "captured"
+	PaymentPartiallyRefunded PaymentStatus = "partially_refunded"
+	PaymentRefunded          PaymentStatus = "refunded"
+	PaymentFailed            PaymentStatus = "failed"
+	PaymentCancelled         PaymentStatus = "cancelled"
+)
+
+var paymentStatusLabels = map[PaymentStatus]string{
+	PaymentAuthorized:        "Authorized",
+	PaymentCaptured:          "Paid",
+	PaymentPartiallyRefunded: "Partially Refunded",
+	PaymentRefunded:          "Refunded",
+	PaymentFailed:            "Failed",
+	PaymentCancelled:         "Cancelled",
+}
+
+// Label returns the status as shown to staff and guests
+func (s PaymentStatus) Label() string {
+	if label, ok := paymentStatusLabels[s]; ok {
+		return label
+	}
+	return string(s)
+}
+
+// Payment is a payment taken through a payment provider. Amounts are in the smallest unit of
+// the currency.
+type Payment struct {
+	ID int
+	ReservationID int
+	Provider string
+	ProviderPaymentID string
+	Amount int
+	RefundedAmount int
+	Currency string
+	Status PaymentStatus
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Refundable returns how much of the payment has been taken and not yet refunded
+func (p Payment) Refundable() int {
+	if p.Status != PaymentCaptured && p.Status != PaymentPartiallyRefunded {
+		return 0
+	}
+	return p.Amount - p.RefundedAmount
+}
+
+// ApplyRefund records that amount more of the payment has been refunded
+func (p *Payment) ApplyRefund(amount int) {
+	p.SetRefundedAmount(p.RefundedAmount + amount)
+}
+
+// SetRefundedAmount records the total refunded so far and updates the status to match
+func (p *Payment) SetRefundedAmount(total int) {
+	p.RefundedAmount = total
+	switch {
+	case total >= p.Amount:
+		p.Status = PaymentRefunded
+	case total > 0:
+		p.Status = PaymentPartiallyRefunded
+	}
+}
@@ -0,0 +1,29 @@
+package models
+
+import "testing"
+
+func TestPayment_ApplyRefund(t *testing.T) {
+	p := Payment{Amount: 9000, Status: PaymentCaptured}
+	if p.Refundable() != 9000 {
+		t.Errorf("expected 9000 refundable, got %d", p.Refundable())
+	}
+
+	p.ApplyRefund(4000)
+	if p.Status != PaymentPartiallyRefunded || p.Refundable() != 5000 {
+		t.Errorf("after a partial refund got status %s and %d refundable", p.Status, p.Refundable())
+	}
+
+	p.ApplyRefund(5000)
+	if p.Status != PaymentRefunded || p.Refundable() != 0 {
+		t.Errorf("after a full refund got status %s and %d refundable", p.Status, p.Refundable())
+	}
+}
+
+func TestPayment_RefundableOnlyWhenCaptured(t *testing.T) {
+	for _, status := range []PaymentStatus{PaymentAuthorized, PaymentFailed, PaymentCancelled, PaymentRefunded} {
+		p := Payment{Amount: 9000, Status: status}
+		if p.Refundable() != 0 {
+			t.Errorf("%s: expected nothing refundable, got %d", status, p.Refundable())
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Charge rule kinds
+const (
+	ChargeTax = "tax"
+	ChargeFee = "fee"
+)
+
+// How a charge rule's amount is applied: a percentage of the room charges, or a flat amount
+const (
+	BasisPercent = "percent"
+	BasisFlat    = "flat"
+)
+
+// What a flat charge is counted per
+const (
+	PerStay       = "stay"
+	PerNight      = "night"
+	PerGuest      = "guest"
+	PerGuestNight = "guest_night"
+)
+
+// Reasons a promo code can't be used
+var (
+	ErrPromoInvalid    = errors.New("this promo code isn't valid")
+	ErrPromoNotStarted = errors.New("this promo code isn't valid yet")
+	ErrPromoExpired    = errors.New("this promo code has expired")
+	ErrPromoUsedUp     = errors.New("this promo code has been used up")
+	ErrPromoWrongRoom  = errors.New("this promo code can't be used for this room")
+)
+
+// ChargeRule is a tax or fee added to every booking while it is active. Amount is a whole
+// percentage for percent rules and in the smallest unit of the currency for flat ones.
+type ChargeRule struct {
+	ID int
+	PropertyID int
+	Name string
+	Kind string
+	Basis string
+	Per string
+	Amount int
+	Active bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Describe returns how the rule is charged, such as "5% of the room" or "2.50 per guest per night"
+func (c ChargeRule) Describe(currency string) string {
+	if c.Basis == BasisPercent {
+		return fmt.Sprintf("%d%% of the room", c.Amount)
+	}
+
+	per := map[string]string{
+		PerStay:       "per stay",
+		PerNight:      "per night",
+		PerGuest:      "per guest",
+		PerGuestNight: "per guest per night",
+	}[c.Per]
+
+	return fmt.Sprintf("%s %d.%02d %s", strings.ToUpper(currency), c.Amount/100, c.Amount%100, per)
+}
+
+// PromoCode is a discount guests enter when booking. Zero times leave the window open at that
+// end, no rooms means every room, and a MaxUses of zero means no limit.
+type PromoCode struct {
+	ID int
+	PropertyID int
+	Code string
+	Description string
+	PercentOff int
+	AmountOff int
+	ValidFrom Date
+	ValidUntil Date
+	MaxUses int
+	Uses int
+	RoomIDs []int
+	Active bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// NormalizePromoCode returns code as promo codes are stored, so they match however they are typed
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Check returns why the code can't be used for a booking of roomID made on today, the date at
+// the property, or nil if it can
+func (p PromoCode) Check(roomID int, today Date) error {
+	if !p.Active {
+		return ErrPromoInvalid
+	}
+	if !p.ValidFrom.IsZero() && today.Before(p.ValidFrom) {
+		return ErrPromoNotStarted
+	}
+	// the last day of the window is included
+	if !p.ValidUntil.IsZero() && today.After(p.ValidUntil) {
+		return ErrPromoExpired
+	}
+	if p.MaxUses > 0 && p.Uses >= p.MaxUses {
+		return ErrPromoUsedUp
+	}
+	if len(p.RoomIDs) > 0 && !containsInt(p.RoomIDs, roomID) {
+		return ErrPromoWrongRoom
+	}
+	return nil
+}
+
+// Discount returns the amount taken off roomTotal, which is never more than roomTotal
+func (p PromoCode) Discount(roomTotal int) int {
+	discount := (roomTotal*p.PercentOff+50)/100 + p.AmountOff
+	if discount > roomTotal {
+		discount = roomTotal
+	}
+	return discount
+}
+
+// Charge is one line of the price of a stay. Amounts are in the smallest unit of the currency
+// and discounts are negative.
+type Charge struct {
+	Kind string
+	Description string
+	Quantity int
+	UnitAmount int
+	Amount int
+}
+
+// ChargesTotal returns the price of a stay
+func ChargesTotal(charges []Charge) int {
+	total := 0
+	for _, c := range charges {
+		total += c.Amount
+	}
+	return total
+}
+
+// PriceStay works out the price of a stay in room: a line for each night, the promo discount
+// when there is one, then a line for each rule. Percent rules are taken on the room charges
+// after the discount.
+func PriceStay(res Reservation, room Room, rules []ChargeRule, promo *PromoCode) []Charge {
+	var charges []Charge
+
+	for d := res.StartDate; d.Before(res.EndDate); d = d.AddDate(0, 0, 1) {
+		charges = append(charges, Charge{
+			Kind:        LineNight,
+			Description: fmt.Sprintf("%s, night of %s", room.RoomName, d.Format("Mon 2 Jan 2006")),
+			Quantity:    1,
+			UnitAmount:  room.Price,
+			Amount:      room.Price,
+		})
+	}
+
+	roomTotal := ChargesTotal(charges)
+
+	if promo != nil {
+		if discount := promo.Discount(roomTotal); discount > 0 {
+			charges = append(charges, Charge{
+				Kind:        LineDiscount,
+				Description: fmt.Sprintf("Promo code %s", promo.Code),
+				Quantity:    1,
+				UnitAmount:  -discount,
+				Amount:      -discount,
+			})
+			roomTotal -= discount
+		}
+	}
+
+	guests := res.Guests
+	if guests < 1 {
+		guests = 1
+	}
+
+	for _, rule := range rules {
+		kind := LineFee
+		if rule.Kind == ChargeTax {
+			kind = LineTax
+		}
+
+		if rule.Basis == BasisPercent {
+			amount := (roomTotal*rule.Amount + 50) / 100
+			charges = append(charges, Charge{
+				Kind:        kind,
+				Description: fmt.Sprintf("%s (%d%%)", rule.Name, rule.Amount),
+				Quantity:    1,
+				UnitAmount:  amount,
+				Amount:      amount,
+			})
+			continue
+		}
+
+		quantity := 1
+		switch rule.Per {
+		case PerNight:
+			quantity = res.Nights()
+		case PerGuest:
+			quantity = guests
+		case PerGuestNight:
+			quantity = guests * res.Nights()
+		}
+
+		charges = append(charges, Charge{
+			Kind:        kind,
+			Description: rule.Name,
+			Quantity:    quantity,
+			UnitAmount:  rule.Amount,
+			Amount:      rule.Amount * quantity,
+		})
+	}
+
+	return charges
+}
+
+// containsInt reports whether list holds n
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package models
+
+import "testing"
+
+func TestPriceStay(t *testing.T) {
+	res := Reservation{
+		Guests:    2,
+		StartDate: NewDate(2050, 1, 1),
+		EndDate:   NewDate(2050, 1, 4),
+	}
+	room := Room{RoomName: "General's Quarters", Price: 10000}
+	rules := []ChargeRule{
+		{Name: "Cleaning fee", Kind: ChargeFee, Basis: BasisFlat, Per: PerStay, Amount: 2500},
+		{Name: "City tax", Kind: ChargeTax, Basis: BasisFlat, Per: PerGuestNight, Amount: 150},
+		{Name: "Towels", Kind: ChargeFee, Basis: BasisFlat, Per: PerGuest, Amount: 300},
+		{Name: "Resort fee", Kind: ChargeFee, Basis: BasisFlat, Per: PerNight, Amount: 1000},
+		{Name: "VAT", Kind: ChargeTax, Basis: BasisPercent, Amount: 10},
+	}
+	promo := &PromoCode{Code: "WINTER", PercentOff: 20}
+
+	charges := PriceStay(res, room, rules, promo)
+
+	expected := []Charge{
+		{LineNight, "General's Quarters, night of Sat 1 Jan 2050", 1, 10000, 10000},
+		{LineNight, "General's Quarters, night of Sun 2 Jan 2050", 1, 10000, 10000},
+		{LineNight, "General's Quarters, night of Mon 3 Jan 2050", 1, 10000, 10000},
+		{LineDiscount, "Promo code WINTER", 1, -6000, -6000},
+		{LineFee, "Cleaning fee", 1, 2500, 2500},
+		{LineTax, "City tax", 6, 150, 900},
+		{LineFee, "Towels", 2, 300, 600},
+		{LineFee, "Resort fee", 3, 1000, 3000},
+		{LineTax, "VAT (10%)", 1, 2400, 2400},
+	}
+
+	if len(charges) != len(expected) {
+		t.Fatalf("expected %d charges but got %d: %v", len(expected), len(charges), charges)
+	}
+	for i := range expected {
+		if charges[i] != expected[i] {
+			t.Errorf("charge %d: expected %v but got %v", i, expected[i], charges[i])
+		}
+	}
+
+	if total := ChargesTotal(charges); total != 33400 {
+		t.Errorf("expected a total of 33400, got %d", total)
+	}
+}
+
+func TestPromoCode_Discount(t *testing.T) {
+	if got := (PromoCode{AmountOff: 5000}).Discount(20000); got != 5000 {
+		t.Errorf("expected a flat 5000 off, got %d", got)
+	}
+	if got := (PromoCode{AmountOff: 50000}).Discount(20000); got != 20000 {
+		t.Errorf("expected the discount to stop at the room total, got %d", got)
+	}
+	if got := (PromoCode{PercentOff: 15}).Discount(9999); got != 1500 {
+		t.Errorf("expected 15%% off rounded to 1500, got %d", got)
+	}
+}
+
+func TestPromoCode_Check(t *testing.T) {
+	today := NewDate(2050, 6, 15)
+	day := func(d int) Date { return NewDate(2050, 6, d) }
+
+	tests := []struct {
+		name     string
+		promo    PromoCode
+		roomID   int
+		expected error
+	}{
+		{"open", PromoCode{Active: true}, 1, nil},
+		{"inactive", PromoCode{}, 1, ErrPromoInvalid},
+		{"in window", PromoCode{Active: true, ValidFrom: day(1), ValidUntil: day(30)}, 1, nil},
+		{"last day", PromoCode{Active: true, ValidUntil: day(15)}, 1, nil},
+		{"not started", PromoCode{Active: true, ValidFrom: day(16)}, 1, ErrPromoNotStarted},
+		{"expired", PromoCode{Active: true, ValidUntil: day(14)}, 1, ErrPromoExpired},
+		{"uses left", PromoCode{Active: true, MaxUses: 10, Uses: 9}, 1, nil},
+		{"used up", PromoCode{Active: true, MaxUses: 10, Uses: 10}, 1, ErrPromoUsedUp},
+		{"right room", PromoCode{Active: true, RoomIDs: []int{1, 2}}, 2, nil},
+		{"wrong room", PromoCode{Active: true, RoomIDs: []int{1}}, 2, ErrPromoWrongRoom},
+	}
+
+	for _, e := range tests {
+		if got := e.promo.Check(e.roomID, today); got != e.expected {
+			t.Errorf("%s: expected %v but got %v", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestChargeRule_Describe(t *testing.T) {
+	tests := []struct {
+		rule     ChargeRule
+		expected string
+	}{
+		{ChargeRule{Basis: BasisPercent, Amount: 12}, "12% of the room"},
+		{ChargeRule{Basis: BasisFlat, Per: PerGuestNight, Amount: 250}, "USD 2.50 per guest per night"},
+		{ChargeRule{Basis: BasisFlat, Per: PerStay, Amount: 5000}, "USD 50.00 per stay"},
+	}
+
+	for _, e := range tests {
+		if got := e.rule.Describe("usd"); got != e.expected {
+			t.Errorf("expected %q but got %q", e.expected, got)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// DefaultPropertyID is the property created by the migrations for the data that existed before
+// there were several properties
+const DefaultPropertyID = 1
+
+// Property is a guesthouse run from the application. It owns its rooms, prices and staff, and
+// sets the currency, timezone, notification address and branding used for its bookings.
+type Property struct {
+	ID int
+	Name string
+	// Slug selects the property in a path prefix such as /p/seaview/
+	Slug string
+	// Hostname selects the property when the site is reached on that host, and may be empty
+	Hostname string
+	Currency string
+	Timezone string
+	NotifyEmail string
+	BrandColor string
+	LogoURL string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Location returns the property's timezone, falling back to UTC when it isn't a known zone
+func (p Property) Location() *time.Location {
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil || p.Timezone == "" {
+		return time.UTC
+	}
+	return loc
+}
+
+// NormalizeHostname returns host as property hostnames are stored, without a port or a
+// trailing dot and in lower case
+func NormalizeHostname(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	return strings.TrimSuffix(host, ".")
+}
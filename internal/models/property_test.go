@@ -0,0 +1,35 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := map[string]string{
+		"Seaview.Example.com":      "seaview.example.com",
+		"seaview.example.com:8080": "seaview.example.com",
+		"seaview.example.com.":     "seaview.example.com",
+		" localhost ":              "localhost",
+		"[::1]:8080":               "[::1]",
+		"[::1]":                    "[::1]",
+	}
+
+	for in, expected := range tests {
+		if got := NormalizeHostname(in); got != expected {
+			t.Errorf("NormalizeHostname(%q) = %q, expected %q", in, got, expected)
+		}
+	}
+}
+
+func TestProperty_Location(t *testing.T) {
+	if loc := (Property{Timezone: "Europe/Lisbon"}).Location(); loc.String() != "Europe/Lisbon" {
+		t.Errorf("expected Europe/Lisbon, got %s", loc)
+	}
+	if loc := (Property{Timezone: "Mars/Olympus"}).Location(); loc != time.UTC {
+		t.Errorf("expected an unknown timezone to fall back to UTC, got %s", loc)
+	}
+	if loc := (Property{}).Location(); loc != time.UTC {
+		t.Errorf("expected no timezone to fall back to UTC, got %s", loc)
+	}
+}
@@ -0,0 +1,43 @@
+package models
+
+// Staff access levels, stored in users.access_level
+const (
+	AccessStaff   = 1
+	AccessManager = 2
+	AccessOwner   = 3
+)
+
+// Role returns the name of the user's access level
+func (u User) Role() string {
+	switch {
+	case u.AccessLevel >= AccessOwner:
+		return "Owner"
+	case u.AccessLevel == AccessManager:
+		return "Manager"
+	default:
+		return "Staff"
+	}
+}
+
+// IsOwner reports whether the user can change settings that apply to every property
+func (u User) IsOwner() bool {
+	return u.AccessLevel >= AccessOwner
+}
+
+// TwoFactorEnabled reports whether the user has to give a code from their authenticator app when
+// they sign in
+func (u User) TwoFactorEnabled() bool {
+	return !u.TwoFactorEnabledAt.IsZero() && u.TOTPSecret != ""
+}
+
+// SecuritySettings are the sign in rules that apply to every staff user
+type SecuritySettings struct {
+	// RequireTwoFactor makes managers and owners set up two-factor authentication before they
+	// can use the admin area
+	RequireTwoFactor bool
+}
+
+// RequiresTwoFactor reports whether the settings make u use two-factor authentication
+func (s SecuritySettings) RequiresTwoFactor(u User) bool {
+	return s.RequireTwoFactor && u.AccessLevel >= AccessManager
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUser_Role(t *testing.T) {
+	tests := map[int]string{
+		0:             "Staff",
+		AccessStaff:   "Staff",
+		AccessManager: "Manager",
+		AccessOwner:   "Owner",
+	}
+
+	for level, expected := range tests {
+		if got := (User{AccessLevel: level}).Role(); got != expected {
+			t.Errorf("access level %d: expected %s, got %s", level, expected, got)
+		}
+	}
+}
+
+func TestUser_TwoFactorEnabled(t *testing.T) {
+	if (User{TOTPSecret: "JBSWY3DPEHPK3PXP"}).TwoFactorEnabled() {
+		t.Error("expected a secret that was never confirmed not to count")
+	}
+	if !(User{TOTPSecret: "JBSWY3DPEHPK3PXP", TwoFactorEnabledAt: time.Now()}).TwoFactorEnabled() {
+		t.Error("expected two-factor authentication to be on")
+	}
+}
+
+func TestSecuritySettings_RequiresTwoFactor(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings SecuritySettings
+		level    int
+		expected bool
+	}{
+		{"off", SecuritySettings{}, AccessOwner, false},
+		{"staff", SecuritySettings{RequireTwoFactor: true}, AccessStaff, false},
+		{"manager", SecuritySettings{RequireTwoFactor: true}, AccessManager, true},
+		{"owner", SecuritySettings{RequireTwoFactor: true}, AccessOwner, true},
+	}
+
+	for _, e := range tests {
+		if got := e.settings.RequiresTwoFactor(User{AccessLevel: e.level}); got != e.expected {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestUser_JSONHidesTOTPSecret(t *testing.T) {
+	out, err := json.Marshal(User{Email: "admin@admin.com", TOTPSecret: "JBSWY3DPEHPK3PXP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "JBSWY3DPEHPK3PXP") {
+		t.Errorf("expected the secret to be left out, got %s", out)
+	}
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"time"
+	"unicode/utf8"
+)
+
+// The session keys that say who a session belongs to. The Postgres session store copies them into
+// their own columns, so a staff member's sessions can be listed and revoked.
+const (
+	SessionUserKey      = "user_id"
+	SessionIPKey        = "signed_in_ip"
+	SessionUserAgentKey = "signed_in_user_agent"
+)
+
+// sessionUserAgentLength is as much of a browser's user agent as is kept
+const sessionUserAgentLength = 255
+
+// Session is a staff member's session kept by the Postgres session store. The token that
+// identifies it is never shown.
+type Session struct {
+	ID int
+	UserID int
+	// IPAddress and UserAgent are where the session signed in from
+	IPAddress string
+	UserAgent string
+	CreatedAt time.Time
+	// LastActiveAt is when the session was last saved
+	LastActiveAt time.Time
+	Expiry time.Time
+	// Current is set on the session making the request
+	Current bool
+}
+
+// SessionOwner returns who session values belong to: the staff user signed in, or 0 when nobody
+// is, and where they signed in from
+func SessionOwner(values map[string]interface{}) (userID int, ipAddress, userAgent string) {
+	userID, _ = values[SessionUserKey].(int)
+	if userID == 0 {
+		return 0, "", ""
+	}
+	ipAddress, _ = values[SessionIPKey].(string)
+	userAgent, _ = values[SessionUserAgentKey].(string)
+	return userID, ipAddress, TrimUserAgent(userAgent)
+}
+
+// TrimUserAgent cuts a user agent down to the length kept with a session
+func TrimUserAgent(userAgent string) string {
+	if len(userAgent) <= sessionUserAgentLength {
+		return userAgent
+	}
+	userAgent = userAgent[:sessionUserAgentLength]
+	for !utf8.ValidString(userAgent) {
+		userAgent = userAgent[:len(userAgent)-1]
+	}
+	return userAgent
+}
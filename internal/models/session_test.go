@@ -0,0 +1,35 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSessionOwner(t *testing.T) {
+	id, ip, agent := SessionOwner(map[string]interface{}{
+		SessionUserKey:      3,
+		SessionIPKey:        "203.0.113.5",
+		SessionUserAgentKey: "Mozilla/5.0",
+	})
+	if id != 3 || ip != "203.0.113.5" || agent != "Mozilla/5.0" {
+		t.Errorf("unexpected owner %d, %q, %q", id, ip, agent)
+	}
+
+	// guests and visitors aren't staff
+	id, ip, agent = SessionOwner(map[string]interface{}{"guest_id": 7, SessionIPKey: "203.0.113.5"})
+	if id != 0 || ip != "" || agent != "" {
+		t.Errorf("expected no owner, got %d, %q, %q", id, ip, agent)
+	}
+}
+
+func TestTrimUserAgent(t *testing.T) {
+	if got := TrimUserAgent("Mozilla/5.0"); got != "Mozilla/5.0" {
+		t.Errorf("expected a short user agent to be kept, got %q", got)
+	}
+
+	got := TrimUserAgent(strings.Repeat("a", sessionUserAgentLength-1) + "é")
+	if len(got) != sessionUserAgentLength-1 || !utf8.ValidString(got) {
+		t.Errorf("expected the user agent to be cut before the split character, got %d bytes", len(got))
+	}
+}
@@ -0,0 +1,68 @@
+package models
+
+// ReservationStatus is the state of a reservation in its lifecycle
+type ReservationStatus string
+
+// Reservation statuses
+const (
+	StatusPending    ReservationStatus = "pending"
+	StatusConfirmed  ReservationStatus = "confirmed"
+	StatusCheckedIn  ReservationStatus = "checked_in"
+	StatusCheckedOut ReservationStatus = "checked_out"
+	StatusCancelled  ReservationStatus = "cancelled"
+	StatusNoShow     ReservationStatus = "no_show"
+)
+
+// reservationTransitions lists the statuses each status may move to. This is the only
+// place the allowed transitions are defined.
+var reservationTransitions = map[ReservationStatus][]ReservationStatus{
+	StatusPending:    {StatusConfirmed, StatusCancelled},
+	StatusConfirmed:  {StatusCheckedIn, StatusNoShow, StatusCancelled},
+	StatusCheckedIn:  {StatusCheckedOut},
+	StatusCheckedOut: {},
+	StatusCancelled:  {},
+	StatusNoShow:     {},
+}
+
+var statusLabels = map[ReservationStatus]string{
+	StatusPending:    "Pending",
+	StatusConfirmed:  "Confirmed",
+	StatusCheckedIn:  "Checked In",
+	StatusCheckedOut: "Checked Out",
+	StatusCancelled:  "Cancelled",
+	StatusNoShow:     "No Show",
+}
+
+// Valid reports whether s is a known status
+func (s ReservationStatus) Valid() bool {
+	_, ok := reservationTransitions[s]
+	return ok
+}
+
+// Label returns the status as shown to staff
+func (s ReservationStatus) Label() string {
+	if label, ok := statusLabels[s]; ok {
+		return label
+	}
+	return string(s)
+}
+
+// CanTransitionTo reports whether a reservation in status s may move to status next
+func (s ReservationStatus) CanTransitionTo(next ReservationStatus) bool {
+	for _, allowed := range reservationTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// ReleasesInventory reports whether a reservation in status s no longer holds its room
+func (s ReservationStatus) ReleasesInventory() bool {
+	return s == StatusCancelled || s == StatusNoShow
+}
+
+// NextStatuses returns the statuses the reservation may move to
+func (r Reservation) NextStatuses() []ReservationStatus {
+	return reservationTransitions[r.Status]
+}
@@ -0,0 +1,49 @@
+package models
+
+import "testing"
+
+var transitionTests = []struct {
+	from     ReservationStatus
+	to       ReservationStatus
+	expected bool
+}{
+	{StatusPending, StatusConfirmed, true},
+	{StatusPending, StatusCancelled, true},
+	{StatusPending, StatusCheckedIn, false},
+	{StatusConfirmed, StatusCheckedIn, true},
+	{StatusConfirmed, StatusNoShow, true},
+	{StatusCheckedIn, StatusCheckedOut, true},
+	{StatusCheckedIn, StatusCancelled, false},
+	{StatusCheckedOut, StatusCheckedIn, false},
+	{StatusCancelled, StatusConfirmed, false},
+	{StatusNoShow, StatusCheckedIn, false},
+	{"unknown", StatusConfirmed, false},
+}
+
+func TestReservationStatus_CanTransitionTo(t *testing.T) {
+	for _, e := range transitionTests {
+		if got := e.from.CanTransitionTo(e.to); got != e.expected {
+			t.Errorf("%s -> %s: expected %v, got %v", e.from, e.to, e.expected, got)
+		}
+	}
+}
+
+func TestReservationStatus_Valid(t *testing.T) {
+	if !StatusNoShow.Valid() {
+		t.Error("no_show should be a valid status")
+	}
+	if ReservationStatus("processed").Valid() {
+		t.Error("processed should not be a valid status")
+	}
+}
+
+func TestReservationStatus_ReleasesInventory(t *testing.T) {
+	for _, s := range []ReservationStatus{StatusCancelled, StatusNoShow} {
+		if !s.ReleasesInventory() {
+			t.Errorf("%s should release inventory", s)
+		}
+	}
+	if StatusCheckedOut.ReleasesInventory() {
+		t.Error("checked_out should keep its inventory")
+	}
+}
@@ -9,9 +9,16 @@ type TemplateData struct {
 	FloatMap map[string]float32
 	Data map[string]interface{}
 	CSRFToken string
+	// CSPNonce must be set as the nonce of inline scripts, which the Content-Security-Policy blocks otherwise
+	CSPNonce string
 	Flash string
 	Warning string
 	Error string
 	Form *forms.Form
 	IsAuthenticated int
+	IsGuestAuthenticated int
+	Property Property
+	Properties []Property
+	// Today is the date at the property, which can differ from the date on the server or in the browser
+	Today Date
 }
\ No newline at end of file
@@ -0,0 +1,63 @@
+package models
+
+import "time"
+
+// WaitlistStatus is where a guest is on the waitlist
+type WaitlistStatus string
+
+// Waitlist statuses
+const (
+	WaitlistWaiting   WaitlistStatus = "waiting"
+	WaitlistOffered   WaitlistStatus = "offered"
+	WaitlistBooked    WaitlistStatus = "booked"
+	WaitlistExpired   WaitlistStatus = "expired"
+	WaitlistCancelled WaitlistStatus = "cancelled"
+)
+
+var waitlistStatusLabels = map[WaitlistStatus]string{
+	WaitlistWaiting:   "Waiting",
+	WaitlistOffered:   "Offered",
+	WaitlistBooked:    "Booked",
+	WaitlistExpired:   "Offer Expired",
+	WaitlistCancelled: "Removed",
+}
+
+// Label returns the status as shown to staff
+func (s WaitlistStatus) Label() string {
+	if label, ok := waitlistStatusLabels[s]; ok {
+		return label
+	}
+	return string(s)
+}
+
+// WaitlistEntry is a guest waiting for a room to come free for their dates. RoomID is zero when
+// any room of the property will do. When a room comes free the guest is offered it, and it is
+// theirs to book until OfferExpiresAt.
+type WaitlistEntry struct {
+	ID int
+	PropertyID int
+	RoomID int
+	Room Room
+	StartDate Date
+	EndDate Date
+	FirstName string
+	LastName string
+	Email string
+	Phone string
+	Status WaitlistStatus
+	OfferedRoomID int
+	OfferedRoom Room
+	OfferExpiresAt time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Overlaps reports whether the entry's stay shares a night with the stay from start to end
+func (e WaitlistEntry) Overlaps(start, end Date) bool {
+	return e.StartDate.Before(end) && start.Before(e.EndDate)
+}
+
+// OfferOpen reports whether the entry has been offered a room it can still book at now
+func (e WaitlistEntry) OfferOpen(now time.Time) bool {
+	return e.Status == WaitlistOffered && now.Before(e.OfferExpiresAt)
+}
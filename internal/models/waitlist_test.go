@@ -0,0 +1,50 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWaitlistEntry_Overlaps(t *testing.T) {
+	entry := WaitlistEntry{StartDate: NewDate(2050, 3, 10), EndDate: NewDate(2050, 3, 13)}
+
+	tests := []struct {
+		name     string
+		start    Date
+		end      Date
+		expected bool
+	}{
+		{"same-nights", NewDate(2050, 3, 10), NewDate(2050, 3, 13), true},
+		{"inside", NewDate(2050, 3, 11), NewDate(2050, 3, 12), true},
+		{"across-the-start", NewDate(2050, 3, 8), NewDate(2050, 3, 11), true},
+		{"leaves-as-it-arrives", NewDate(2050, 3, 8), NewDate(2050, 3, 10), false},
+		{"arrives-as-it-leaves", NewDate(2050, 3, 13), NewDate(2050, 3, 15), false},
+	}
+
+	for _, e := range tests {
+		if got := entry.Overlaps(e.start, e.end); got != e.expected {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestWaitlistEntry_OfferOpen(t *testing.T) {
+	now := time.Date(2050, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		entry    WaitlistEntry
+		expected bool
+	}{
+		{"open", WaitlistEntry{Status: WaitlistOffered, OfferExpiresAt: now.Add(time.Hour)}, true},
+		{"run-out", WaitlistEntry{Status: WaitlistOffered, OfferExpiresAt: now.Add(-time.Hour)}, false},
+		{"booked", WaitlistEntry{Status: WaitlistBooked, OfferExpiresAt: now.Add(time.Hour)}, false},
+		{"waiting", WaitlistEntry{Status: WaitlistWaiting}, false},
+	}
+
+	for _, e := range tests {
+		if got := e.entry.OfferOpen(now); got != e.expected {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expected, got)
+		}
+	}
+}
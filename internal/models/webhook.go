@@ -0,0 +1,75 @@
+package models
+
+import "time"
+
+// Webhook events, named as they are sent
+const (
+	EventReservationCreated   = "reservation.created"
+	EventReservationUpdated   = "reservation.updated"
+	EventReservationCancelled = "reservation.cancelled"
+	EventBlockCreated         = "block.created"
+	EventBlockDeleted         = "block.deleted"
+)
+
+// WebhookEvents are the events a webhook can subscribe to, in the order they are offered
+var WebhookEvents = []string{
+	EventReservationCreated,
+	EventReservationUpdated,
+	EventReservationCancelled,
+	EventBlockCreated,
+	EventBlockDeleted,
+}
+
+// Webhook delivery statuses. A pending delivery is waiting for its next attempt; one that has
+// failed has run out of attempts.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is an address a property's events are posted to, so other tools can react when
+// bookings change
+type Webhook struct {
+	ID int
+	PropertyID int
+	URL string
+	// Secret signs every payload so the receiver can tell it came from us. It is kept out of
+	// JSON so it never reaches the audit log.
+	Secret string `json:"-"`
+	// Events are the events the webhook is sent
+	Events []string
+	Active bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Sends reports whether the webhook subscribes to event. Nothing is sent while it isn't Active.
+func (w Webhook) Sends(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is an event sent, or still to be sent, to a webhook. Failed attempts are
+// tried again later, so Response holds what the webhook said the last time.
+type WebhookDelivery struct {
+	ID int
+	WebhookID int
+	Webhook Webhook
+	// EventID is the same for every delivery of an event, so receivers can ignore repeats
+	EventID string
+	Event string
+	Payload string
+	Status string
+	Attempts int
+	ResponseCode int
+	Response string
+	NextAttemptAt time.Time
+	DeliveredAt time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
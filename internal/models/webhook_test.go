@@ -0,0 +1,36 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWebhook_Sends(t *testing.T) {
+	tests := []struct {
+		name     string
+		webhook  Webhook
+		event    string
+		expected bool
+	}{
+		{"subscribed", Webhook{Events: []string{EventReservationCreated, EventBlockCreated}}, EventBlockCreated, true},
+		{"not-subscribed", Webhook{Events: []string{EventReservationCreated}}, EventReservationCancelled, false},
+		{"no-events", Webhook{}, EventReservationUpdated, false},
+	}
+
+	for _, e := range tests {
+		if got := e.webhook.Sends(e.event); got != e.expected {
+			t.Errorf("%s: Sends(%q) = %v, expected %v", e.name, e.event, got, e.expected)
+		}
+	}
+}
+
+func TestWebhook_JSONHidesSecret(t *testing.T) {
+	out, err := json.Marshal(Webhook{URL: "https://hooks.example.com", Secret: "whsec_secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "whsec_secret") {
+		t.Errorf("expected the secret to be left out, got %s", out)
+	}
+}
@@ -0,0 +1,109 @@
+package payments
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrDeclined is returned when the provider refuses a payment, for example a declined card
+	ErrDeclined = errors.New("payment declined")
+	// ErrInvalidSignature is returned when a webhook does not carry a valid signature
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+)
+
+// Webhook event types the application acts on
+const (
+	EventPaymentSucceeded = "payment_intent.succeeded"
+	EventPaymentFailed    = "payment_intent.payment_failed"
+	EventPaymentCancelled = "payment_intent.canceled"
+	EventRefunded         = "charge.refunded"
+)
+
+// PaymentProvider takes card payments. Amounts are in the smallest unit of the currency.
+type PaymentProvider interface {
+	// Name identifies the provider on stored payment records
+	Name() string
+	// Authorize places a hold for the amount on the payment method without taking the money
+	Authorize(req AuthorizeRequest) (Charge, error)
+	// Capture takes up to the authorized amount of a payment
+	Capture(paymentID string, amount int) (Charge, error)
+	// Refund returns an amount of a captured payment
+	Refund(paymentID string, amount int) (Refund, error)
+	// VerifyWebhook checks the signature of a webhook call and returns the event it carries
+	VerifyWebhook(payload []byte, header http.Header) (Event, error)
+}
+
+// AuthorizeRequest describes a payment to authorize
+type AuthorizeRequest struct {
+	Amount int
+	Currency string
+	// PaymentMethod is the token for the card, created in the browser by the provider's script
+	PaymentMethod string
+	Description string
+	Email string
+	// IdempotencyKey makes retries of the same request safe
+	IdempotencyKey string
+}
+
+// Charge is the provider's view of a payment
+type Charge struct {
+	ID string
+	Status string
+	Amount int
+	AmountCaptured int
+}
+
+// Refund is a refund made against a payment
+type Refund struct {
+	ID string
+	Amount int
+	Status string
+}
+
+// Event is a verified webhook event about a payment
+type Event struct {
+	ID string
+	Type string
+	PaymentID string
+	AmountRefunded int
+}
+
+// Deposit returns the deposit taken at booking for a stay costing total
+func Deposit(total, percent int) int {
+	return percentOf(total, percent)
+}
+
+// percentOf returns percent of amount, rounded to the nearest unit
+func percentOf(amount, percent int) int {
+	if percent <= 0 {
+		return 0
+	}
+	if percent >= 100 {
+		return amount
+	}
+	return (amount*percent + 50) / 100
+}
+
+// RefundPolicy decides how much of a payment is returned when a reservation is cancelled
+type RefundPolicy struct {
+	// FreeCancellationDays is how many days before arrival a cancellation is refunded in full
+	FreeCancellationDays int
+	// LateRefundPercent is the share refunded for cancellations made after that
+	LateRefundPercent int
+}
+
+// RefundAmount returns how much of paid to refund for a reservation arriving on arrival that is
+// cancelled at now. Nothing is refunded once the arrival day has started.
+func (p RefundPolicy) RefundAmount(paid int, arrival, now time.Time) int {
+	if paid <= 0 || !now.Before(arrival) {
+		return 0
+	}
+
+	if !now.After(arrival.AddDate(0, 0, -p.FreeCancellationDays)) {
+		return paid
+	}
+
+	return percentOf(paid, p.LateRefundPercent)
+}
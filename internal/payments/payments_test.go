@@ -0,0 +1,51 @@
+package payments
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeposit(t *testing.T) {
+	tests := []struct {
+		total    int
+		percent  int
+		expected int
+	}{
+		{30000, 30, 9000},
+		{12345, 30, 3704},
+		{30000, 0, 0},
+		{30000, 100, 30000},
+		{30000, 150, 30000},
+	}
+
+	for _, e := range tests {
+		if got := Deposit(e.total, e.percent); got != e.expected {
+			t.Errorf("Deposit(%d, %d) = %d, wanted %d", e.total, e.percent, got, e.expected)
+		}
+	}
+}
+
+func TestRefundPolicy_RefundAmount(t *testing.T) {
+	policy := RefundPolicy{FreeCancellationDays: 7, LateRefundPercent: 50}
+	arrival := time.Date(2050, 6, 15, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		paid     int
+		expected int
+	}{
+		{"well-ahead", arrival.AddDate(0, -1, 0), 9000, 9000},
+		{"on-the-cutoff", arrival.AddDate(0, 0, -7), 9000, 9000},
+		{"after-the-cutoff", arrival.AddDate(0, 0, -7).Add(time.Minute), 9000, 4500},
+		{"day-before", arrival.AddDate(0, 0, -1), 9000, 4500},
+		{"arrival-day", arrival.Add(10 * time.Hour), 9000, 0},
+		{"nothing-paid", arrival.AddDate(0, -1, 0), 0, 0},
+	}
+
+	for _, e := range tests {
+		if got := policy.RefundAmount(e.paid, arrival, e.now); got != e.expected {
+			t.Errorf("%s: refund %d, wanted %d", e.name, got, e.expected)
+		}
+	}
+}
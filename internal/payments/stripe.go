@@ -0,0 +1,245 @@
+package payments
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stripeSignatureTolerance is how old a webhook signature may be before it is refused
+const stripeSignatureTolerance = 5 * time.Minute
+
+// Stripe is a PaymentProvider for the Stripe API, or any API compatible with it
+type Stripe struct {
+	SecretKey string
+	WebhookSecret string
+	BaseURL string
+	Client *http.Client
+	// now is the clock used to check webhook timestamps, replaced in tests
+	now func() time.Time
+}
+
+// NewStripe returns a provider that talks to the Stripe compatible API at baseURL
+func NewStripe(secretKey, webhookSecret, baseURL string) *Stripe {
+	return &Stripe{
+		SecretKey:     secretKey,
+		WebhookSecret: webhookSecret,
+		BaseURL:       strings.TrimRight(baseURL, "/"),
+		Client:        &http.Client{Timeout: 10 * time.Second},
+		now:           time.Now,
+	}
+}
+
+// stripePaymentIntent is the part of a payment intent the application reads
+type stripePaymentIntent struct {
+	ID string `json:"id"`
+	Status string `json:"status"`
+	Amount int `json:"amount"`
+	AmountReceived int `json:"amount_received"`
+}
+
+// stripeRefund is the part of a refund the application reads
+type stripeRefund struct {
+	ID string `json:"id"`
+	Amount int `json:"amount"`
+	Status string `json:"status"`
+}
+
+// stripeError is the body Stripe returns with a failed request
+type stripeError struct {
+	Error struct {
+		Type string `json:"type"`
+		Code string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// stripeEvent is the part of a webhook event the application reads
+type stripeEvent struct {
+	ID string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object struct {
+			ID string `json:"id"`
+			Object string `json:"object"`
+			PaymentIntent string `json:"payment_intent"`
+			AmountRefunded int `json:"amount_refunded"`
+		} `json:"object"`
+	} `json:"data"`
+}
+
+// Name identifies the provider on stored payment records
+func (s *Stripe) Name() string {
+	return "stripe"
+}
+
+// Authorize creates and confirms a payment intent that is captured later
+func (s *Stripe) Authorize(req AuthorizeRequest) (Charge, error) {
+	form := url.Values{}
+	form.Set("amount", strconv.Itoa(req.Amount))
+	form.Set("currency", strings.ToLower(req.Currency))
+	form.Set("payment_method", req.PaymentMethod)
+	form.Set("capture_method", "manual")
+	form.Set("confirm", "true")
+	form.Set("payment_method_types[]", "card")
+	if req.Description != "" {
+		form.Set("description", req.Description)
+	}
+	if req.Email != "" {
+		form.Set("receipt_email", req.Email)
+	}
+
+	var pi stripePaymentIntent
+	err := s.post("/v1/payment_intents", form, req.IdempotencyKey, &pi)
+	if err != nil {
+		return Charge{}, err
+	}
+
+	if pi.Status != "requires_capture" {
+		return Charge{ID: pi.ID, Status: pi.Status, Amount: pi.Amount}, fmt.Errorf("%w: the payment could not be authorized (%s)", ErrDeclined, pi.Status)
+	}
+
+	return Charge{ID: pi.ID, Status: pi.Status, Amount: pi.Amount}, nil
+}
+
+// Capture takes amount of an authorized payment intent
+func (s *Stripe) Capture(paymentID string, amount int) (Charge, error) {
+	form := url.Values{}
+	form.Set("amount_to_capture", strconv.Itoa(amount))
+
+	var pi stripePaymentIntent
+	err := s.post("/v1/payment_intents/"+url.PathEscape(paymentID)+"/capture", form, "capture-"+paymentID, &pi)
+	if err != nil {
+		return Charge{}, err
+	}
+
+	return Charge{ID: pi.ID, Status: pi.Status, Amount: pi.Amount, AmountCaptured: pi.AmountReceived}, nil
+}
+
+// Refund returns amount of a captured payment intent
+func (s *Stripe) Refund(paymentID string, amount int) (Refund, error) {
+	form := url.Values{}
+	form.Set("payment_intent", paymentID)
+	form.Set("amount", strconv.Itoa(amount))
+
+	var ref stripeRefund
+	err := s.post("/v1/refunds", form, "", &ref)
+	if err != nil {
+		return Refund{}, err
+	}
+
+	return Refund{ID: ref.ID, Amount: ref.Amount, Status: ref.Status}, nil
+}
+
+// VerifyWebhook checks the Stripe-Signature header of a webhook call and decodes its event
+func (s *Stripe) VerifyWebhook(payload []byte, header http.Header) (Event, error) {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header.Get("Stripe-Signature"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return Event{}, ErrInvalidSignature
+	}
+
+	age := s.now().Sub(time.Unix(ts, 0))
+	if age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return Event{}, ErrInvalidSignature
+	}
+
+	expected := s.sign(timestamp, payload)
+	valid := false
+	for _, sig := range signatures {
+		if hmac.Equal([]byte(sig), []byte(expected)) {
+			valid = true
+		}
+	}
+	if !valid {
+		return Event{}, ErrInvalidSignature
+	}
+
+	var ev stripeEvent
+	err = json.Unmarshal(payload, &ev)
+	if err != nil {
+		return Event{}, err
+	}
+
+	event := Event{
+		ID:             ev.ID,
+		Type:           ev.Type,
+		PaymentID:      ev.Data.Object.ID,
+		AmountRefunded: ev.Data.Object.AmountRefunded,
+	}
+	// refund events carry the charge, which points back at its payment intent
+	if ev.Data.Object.PaymentIntent != "" {
+		event.PaymentID = ev.Data.Object.PaymentIntent
+	}
+
+	return event, nil
+}
+
+// sign returns the hex HMAC Stripe computes for a webhook payload sent at timestamp
+func (s *Stripe) sign(timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(s.WebhookSecret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends a form encoded request to the API and decodes the JSON response into out
+func (s *Stripe) post(path string, form url.Values, idempotencyKey string, out interface{}) error {
+	req, err := http.NewRequest("POST", s.BaseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.SecretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		var se stripeError
+		_ = json.Unmarshal(body, &se)
+		if se.Error.Type == "card_error" {
+			return fmt.Errorf("%w: %s", ErrDeclined, se.Error.Message)
+		}
+		if se.Error.Message != "" {
+			return fmt.Errorf("payment provider returned %d: %s", resp.StatusCode, se.Error.Message)
+		}
+		return fmt.Errorf("payment provider returned %d", resp.StatusCode)
+	}
+
+	return json.Unmarshal(body, out)
+}
@@ -0,0 +1,224 @@
+package payments
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStripe is a small in-memory stand in for the parts of the Stripe API the provider uses
+type fakeStripe struct {
+	mu sync.Mutex
+	intents map[string]*stripePaymentIntent
+	idempotent map[string]string
+	refunded map[string]int
+	next int
+}
+
+func newFakeStripe() *httptest.Server {
+	f := &fakeStripe{
+		intents:    make(map[string]*stripePaymentIntent),
+		idempotent: make(map[string]string),
+		refunded:   make(map[string]int),
+	}
+	return httptest.NewServer(f)
+}
+
+func (f *fakeStripe) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer sk_test" {
+		writeStripeError(w, http.StatusUnauthorized, "invalid_request_error", "Invalid API Key provided")
+		return
+	}
+	_ = r.ParseForm()
+
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/v1/payment_intents":
+		if id, ok := f.idempotent[r.Header.Get("Idempotency-Key")]; ok && r.Header.Get("Idempotency-Key") != "" {
+			_ = json.NewEncoder(w).Encode(f.intents[id])
+			return
+		}
+		if r.Form.Get("capture_method") != "manual" || r.Form.Get("confirm") != "true" {
+			writeStripeError(w, http.StatusBadRequest, "invalid_request_error", "expected a manual capture")
+			return
+		}
+		switch r.Form.Get("payment_method") {
+		case "pm_card_chargeDeclined":
+			writeStripeError(w, http.StatusPaymentRequired, "card_error", "Your card was declined.")
+			return
+		case "pm_card_authenticationRequired":
+			f.next++
+			pi := &stripePaymentIntent{ID: fmt.Sprintf("pi_%d", f.next), Status: "requires_action"}
+			f.intents[pi.ID] = pi
+			_ = json.NewEncoder(w).Encode(pi)
+			return
+		}
+		amount, _ := strconv.Atoi(r.Form.Get("amount"))
+		f.next++
+		pi := &stripePaymentIntent{ID: fmt.Sprintf("pi_%d", f.next), Status: "requires_capture", Amount: amount}
+		f.intents[pi.ID] = pi
+		f.idempotent[r.Header.Get("Idempotency-Key")] = pi.ID
+		_ = json.NewEncoder(w).Encode(pi)
+
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/capture"):
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/payment_intents/"), "/capture")
+		pi, ok := f.intents[id]
+		if !ok {
+			writeStripeError(w, http.StatusNotFound, "invalid_request_error", "No such payment_intent")
+			return
+		}
+		amount, _ := strconv.Atoi(r.Form.Get("amount_to_capture"))
+		if amount > pi.Amount {
+			writeStripeError(w, http.StatusBadRequest, "invalid_request_error", "amount_to_capture is greater than the amount")
+			return
+		}
+		pi.Status = "succeeded"
+		pi.AmountReceived = amount
+		_ = json.NewEncoder(w).Encode(pi)
+
+	case r.Method == "POST" && r.URL.Path == "/v1/refunds":
+		id := r.Form.Get("payment_intent")
+		pi, ok := f.intents[id]
+		if !ok || pi.Status != "succeeded" {
+			writeStripeError(w, http.StatusBadRequest, "invalid_request_error", "This PaymentIntent has no charge to refund")
+			return
+		}
+		amount, _ := strconv.Atoi(r.Form.Get("amount"))
+		if f.refunded[id]+amount > pi.AmountReceived {
+			writeStripeError(w, http.StatusBadRequest, "invalid_request_error", "Refund is greater than the unrefunded amount")
+			return
+		}
+		f.refunded[id] += amount
+		f.next++
+		_ = json.NewEncoder(w).Encode(stripeRefund{ID: fmt.Sprintf("re_%d", f.next), Amount: amount, Status: "succeeded"})
+
+	default:
+		writeStripeError(w, http.StatusNotFound, "invalid_request_error", "Unrecognized request URL")
+	}
+}
+
+func writeStripeError(w http.ResponseWriter, status int, errType, message string) {
+	w.WriteHeader(status)
+	var se stripeError
+	se.Error.Type = errType
+	se.Error.Message = message
+	_ = json.NewEncoder(w).Encode(se)
+}
+
+func TestStripe_AuthorizeCaptureRefund(t *testing.T) {
+	srv := newFakeStripe()
+	defer srv.Close()
+
+	s := NewStripe("sk_test", "whsec_test", srv.URL)
+
+	charge, err := s.Authorize(AuthorizeRequest{Amount: 4500, Currency: "USD", PaymentMethod: "pm_card_visa", IdempotencyKey: "res-1"})
+	if err != nil {
+		t.Fatal("Authorize failed:", err)
+	}
+	if charge.ID == "" || charge.Amount != 4500 || charge.Status != "requires_capture" {
+		t.Errorf("unexpected authorization %+v", charge)
+	}
+
+	again, err := s.Authorize(AuthorizeRequest{Amount: 4500, Currency: "USD", PaymentMethod: "pm_card_visa", IdempotencyKey: "res-1"})
+	if err != nil || again.ID != charge.ID {
+		t.Errorf("retried Authorize should return the same payment, got %+v, %v", again, err)
+	}
+
+	captured, err := s.Capture(charge.ID, 4500)
+	if err != nil {
+		t.Fatal("Capture failed:", err)
+	}
+	if captured.AmountCaptured != 4500 || captured.Status != "succeeded" {
+		t.Errorf("unexpected capture %+v", captured)
+	}
+
+	refund, err := s.Refund(charge.ID, 2000)
+	if err != nil {
+		t.Fatal("Refund failed:", err)
+	}
+	if refund.ID == "" || refund.Amount != 2000 {
+		t.Errorf("unexpected refund %+v", refund)
+	}
+
+	_, err = s.Refund(charge.ID, 3000)
+	if err == nil {
+		t.Error("refunding more than was captured should fail")
+	}
+}
+
+func TestStripe_AuthorizeDeclined(t *testing.T) {
+	srv := newFakeStripe()
+	defer srv.Close()
+
+	s := NewStripe("sk_test", "whsec_test", srv.URL)
+
+	for _, pm := range []string{"pm_card_chargeDeclined", "pm_card_authenticationRequired"} {
+		_, err := s.Authorize(AuthorizeRequest{Amount: 4500, Currency: "usd", PaymentMethod: pm})
+		if !errors.Is(err, ErrDeclined) {
+			t.Errorf("%s: expected ErrDeclined, got %v", pm, err)
+		}
+	}
+}
+
+func TestStripe_BadKey(t *testing.T) {
+	srv := newFakeStripe()
+	defer srv.Close()
+
+	s := NewStripe("sk_wrong", "whsec_test", srv.URL)
+
+	_, err := s.Authorize(AuthorizeRequest{Amount: 4500, Currency: "usd", PaymentMethod: "pm_card_visa"})
+	if err == nil || errors.Is(err, ErrDeclined) {
+		t.Errorf("expected an API error that is not a decline, got %v", err)
+	}
+}
+
+func TestStripe_VerifyWebhook(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := NewStripe("sk_test", "whsec_test", "")
+	s.now = func() time.Time { return now }
+
+	payload := []byte(`{"id":"evt_1","type":"charge.refunded","data":{"object":{"id":"ch_1","object":"charge","payment_intent":"pi_1","amount_refunded":2000}}}`)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	valid := "t=" + ts + ",v1=" + s.sign(ts, payload)
+
+	tests := []struct {
+		name      string
+		signature string
+		payload   []byte
+		valid     bool
+	}{
+		{"valid", valid, payload, true},
+		{"extra-signature", valid + ",v1=deadbeef", payload, true},
+		{"missing", "", payload, false},
+		{"tampered", valid, []byte(strings.Replace(string(payload), "2000", "9000", 1)), false},
+		{"wrong-secret", "t=" + ts + ",v1=" + NewStripe("", "other", "").sign(ts, payload), payload, false},
+		{"too-old", "t=" + strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10) + ",v1=" + s.sign(strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10), payload), payload, false},
+	}
+
+	for _, e := range tests {
+		header := http.Header{}
+		header.Set("Stripe-Signature", e.signature)
+
+		ev, err := s.VerifyWebhook(e.payload, header)
+		if e.valid {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", e.name, err)
+				continue
+			}
+			if ev.Type != EventRefunded || ev.PaymentID != "pi_1" || ev.AmountRefunded != 2000 {
+				t.Errorf("%s: unexpected event %+v", e.name, ev)
+			}
+		} else if !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: expected ErrInvalidSignature, got %v", e.name, err)
+		}
+	}
+}
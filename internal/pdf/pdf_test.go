@@ -0,0 +1,95 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestDocument_Bytes(t *testing.T) {
+	doc := New()
+	p := doc.AddPage()
+	p.Text(50, 50, HelveticaBold, 18, "Invoice (copy)")
+	p.TextRight(545, 50, Helvetica, 10, "USD 150.00")
+	p.Line(50, 60, 545, 60, 0.5)
+	doc.AddPage().Text(50, 50, Helvetica, 10, "Page two")
+
+	out := doc.Bytes()
+
+	if !bytes.HasPrefix(out, []byte("%PDF-1.4\n")) {
+		t.Error("document does not start with a PDF header")
+	}
+	if !bytes.HasSuffix(out, []byte("%%EOF\n")) {
+		t.Error("document does not end with an EOF marker")
+	}
+	if !bytes.Contains(out, []byte(`(Invoice \(copy\)) Tj`)) {
+		t.Error("parentheses in text were not escaped")
+	}
+	if !bytes.Contains(out, []byte("/Count 2")) {
+		t.Error("expected two pages in the page tree")
+	}
+
+	// every entry in the cross reference table must point at the start of its object
+	m := regexp.MustCompile(`startxref\n(\d+)`).FindSubmatch(out)
+	if m == nil {
+		t.Fatal("no startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(out[xref:], []byte("xref\n")) {
+		t.Fatal("startxref does not point at the cross reference table")
+	}
+
+	entries := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(out[xref:], -1)
+	if len(entries) != 8 {
+		t.Errorf("expected 8 objects, got %d", len(entries))
+	}
+	for i, e := range entries {
+		off, _ := strconv.Atoi(string(e[1]))
+		want := fmt.Sprintf("%d 0 obj", i+1)
+		if !bytes.HasPrefix(out[off:], []byte(want)) {
+			t.Errorf("xref entry %d does not point at %q", i+1, want)
+		}
+	}
+}
+
+func TestTextWidth(t *testing.T) {
+	tests := []struct {
+		s        string
+		font     Font
+		size     float64
+		expected float64
+	}{
+		{"", Helvetica, 10, 0},
+		{"0", Helvetica, 10, 5.56},
+		{"Wi", Helvetica, 10, 11.66},
+		{"Wi", HelveticaBold, 10, 12.22},
+		{"€", Helvetica, 10, 5.56},
+	}
+
+	for _, e := range tests {
+		got := TextWidth(e.s, e.font, e.size)
+		if got < e.expected-0.001 || got > e.expected+0.001 {
+			t.Errorf("TextWidth(%q) = %v, wanted %v", e.s, got, e.expected)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"Major's Suite", "Major's Suite"},
+		{"Café", "Caf\xe9"},
+		{"€10", "\x8010"},
+		{"東京", "??"},
+	}
+
+	for _, e := range tests {
+		if got := encode(e.in); got != e.expected {
+			t.Errorf("encode(%q) = %q, wanted %q", e.in, got, e.expected)
+		}
+	}
+}
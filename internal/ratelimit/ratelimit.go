@@ -0,0 +1,137 @@
+// Package ratelimit limits how often a client can call the public endpoints that query the
+// database, with a token bucket per client address and route
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is a token bucket: a client can make Burst requests at once, and the bucket refills at
+// Rate requests a second. A zero Limit doesn't limit anything.
+type Limit struct {
+	Rate float64
+	Burst int
+}
+
+// PerMinute returns a limit of n requests a minute, with up to burst at once
+func PerMinute(n, burst int) Limit {
+	return Limit{Rate: float64(n) / 60, Burst: burst}
+}
+
+// Enabled reports whether the limit limits anything
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// ErrInvalidLimit is returned for a limit that can't be parsed
+var ErrInvalidLimit = errors.New("invalid rate limit, expected requests/period[,burst] such as 30/m,10")
+
+// periods are the units a limit can be given per
+var periods = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+// ParseLimit reads a limit written as requests/period with an optional burst, such as "30/m" or
+// "30/m,10", where the period is s, m or h. The burst defaults to the number of requests. "0" or
+// an empty string is no limit.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return Limit{}, nil
+	}
+
+	rate, burst, hasBurst := strings.Cut(s, ",")
+	count, unit, ok := strings.Cut(rate, "/")
+	period, known := periods[strings.TrimSpace(unit)]
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if !ok || !known || err != nil || n <= 0 {
+		return Limit{}, ErrInvalidLimit
+	}
+
+	l := Limit{Rate: float64(n) / period.Seconds(), Burst: n}
+	if hasBurst {
+		l.Burst, err = strconv.Atoi(strings.TrimSpace(burst))
+		if err != nil || l.Burst <= 0 {
+			return Limit{}, ErrInvalidLimit
+		}
+	}
+	return l, nil
+}
+
+// String writes the limit as requests a minute with its burst
+func (l Limit) String() string {
+	if !l.Enabled() {
+		return "no limit"
+	}
+	return fmt.Sprintf("%g/m,%d", l.Rate*60, l.Burst)
+}
+
+// Result is what a store decided about a request
+type Result struct {
+	Allowed bool
+	// Remaining is how many more requests can be made straight away
+	Remaining int
+	// RetryAfter is how long until a request will be allowed again, when this one wasn't
+	RetryAfter time.Duration
+}
+
+// Store keeps a token bucket for each key. MemoryStore keeps them in the process, so each
+// instance of the site limits on its own; a store shared between instances can take its place.
+type Store interface {
+	Take(key string, limit Limit, now time.Time) (Result, error)
+}
+
+// Limiter limits requests by client address with the buckets in Store
+type Limiter struct {
+	Store Store
+	// Proxies are the reverse proxies trusted to say which client a request came from
+	Proxies TrustedProxies
+	// ErrorLog reports a store that can't be reached, in which case requests are let through
+	ErrorLog *log.Logger
+}
+
+// New returns a limiter keeping its buckets in store
+func New(store Store, proxies TrustedProxies, errorLog *log.Logger) *Limiter {
+	return &Limiter{Store: store, Proxies: proxies, ErrorLog: errorLog}
+}
+
+// Middleware limits each client to limit across the routes it wraps, which share the bucket
+// called name. Requests over the limit are answered with 429 Too Many Requests and a Retry-After
+// header. A nil Limiter or a zero limit lets every request through.
+func (l *Limiter) Middleware(name string, limit Limit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if l == nil || !limit.Enabled() {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result, err := l.Store.Take(name+"|"+l.Proxies.ClientIP(r), limit, time.Now())
+			if err != nil {
+				if l.ErrorLog != nil {
+					l.ErrorLog.Println("Error checking rate limit:", err)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("X-RateLimit-Limit", limit.String())
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			if !result.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+				http.Error(w, "Too many requests, please wait a moment and try again", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
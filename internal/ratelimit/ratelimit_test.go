@@ -0,0 +1,184 @@
+package ratelimit
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected Limit
+		valid    bool
+	}{
+		{"", Limit{}, true},
+		{"0", Limit{}, true},
+		{"30/m", Limit{Rate: 0.5, Burst: 30}, true},
+		{"30/m,10", Limit{Rate: 0.5, Burst: 10}, true},
+		{"5/s", Limit{Rate: 5, Burst: 5}, true},
+		{" 3600/h , 20 ", Limit{Rate: 1, Burst: 20}, true},
+		{"30", Limit{}, false},
+		{"30/d", Limit{}, false},
+		{"-1/m", Limit{}, false},
+		{"30/m,0", Limit{}, false},
+	}
+
+	for _, e := range tests {
+		got, err := ParseLimit(e.in)
+		if e.valid && (err != nil || got != e.expected) {
+			t.Errorf("ParseLimit(%q) = %+v, %v, expected %+v", e.in, got, err, e.expected)
+		}
+		if !e.valid && !errors.Is(err, ErrInvalidLimit) {
+			t.Errorf("ParseLimit(%q): expected ErrInvalidLimit, got %v", e.in, err)
+		}
+	}
+}
+
+func TestMemoryStore_Take(t *testing.T) {
+	s := NewMemoryStore()
+	limit := Limit{Rate: 1, Burst: 3}
+	now := time.Unix(1700000000, 0)
+
+	// the burst is allowed straight away
+	for i := 2; i >= 0; i-- {
+		result, _ := s.Take("a", limit, now)
+		if !result.Allowed || result.Remaining != i {
+			t.Fatalf("expected request to be allowed with %d remaining, got %+v", i, result)
+		}
+	}
+
+	result, _ := s.Take("a", limit, now)
+	if result.Allowed || result.RetryAfter != time.Second {
+		t.Errorf("expected the next request to wait a second, got %+v", result)
+	}
+
+	// other keys have their own buckets
+	if result, _ := s.Take("b", limit, now); !result.Allowed {
+		t.Errorf("expected another key to be allowed, got %+v", result)
+	}
+
+	// the bucket refills at the rate
+	if result, _ := s.Take("a", limit, now.Add(1500*time.Millisecond)); !result.Allowed {
+		t.Errorf("expected a request to be allowed once a token refilled, got %+v", result)
+	}
+	if result, _ := s.Take("a", limit, now.Add(1600*time.Millisecond)); result.Allowed || result.RetryAfter.Round(time.Millisecond) != 400*time.Millisecond {
+		t.Errorf("expected to wait for the rest of the next token, got %+v", result)
+	}
+
+	// buckets that have filled up again are forgotten
+	s.Take("c", limit, now.Add(time.Hour))
+	if s.Len() != 1 {
+		t.Errorf("expected only the new bucket to be kept, got %d", s.Len())
+	}
+}
+
+func TestTrustedProxies_ClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies("10.0.0.0/8, 192.0.2.1, ::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		realIP       string
+		expected     string
+	}{
+		{"direct", "203.0.113.5:4000", nil, "", "203.0.113.5"},
+		{"untrusted-header", "203.0.113.5:4000", []string{"198.51.100.1"}, "", "203.0.113.5"},
+		{"trusted-proxy", "10.1.2.3:4000", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"spoofed-left", "10.1.2.3:4000", []string{"1.2.3.4, 198.51.100.1"}, "", "198.51.100.1"},
+		{"proxy-chain", "192.0.2.1:4000", []string{"198.51.100.1, 10.9.9.9"}, "", "198.51.100.1"},
+		{"several-headers", "10.1.2.3:4000", []string{"1.2.3.4", "198.51.100.1"}, "", "198.51.100.1"},
+		{"garbage", "10.1.2.3:4000", []string{"198.51.100.1, nonsense"}, "", "10.1.2.3"},
+		{"real-ip", "[::1]:4000", nil, "198.51.100.2", "198.51.100.2"},
+		{"real-ip-untrusted", "203.0.113.5:4000", nil, "198.51.100.2", "203.0.113.5"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = e.remoteAddr
+		for _, h := range e.forwardedFor {
+			req.Header.Add("X-Forwarded-For", h)
+		}
+		if e.realIP != "" {
+			req.Header.Set("X-Real-IP", e.realIP)
+		}
+
+		if got := proxies.ClientIP(req); got != e.expected {
+			t.Errorf("%s: expected %s, got %s", e.name, e.expected, got)
+		}
+	}
+
+	if _, err := ParseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("expected an invalid range to be refused")
+	}
+	if _, err := ParseTrustedProxies("proxy.local"); err == nil {
+		t.Error("expected a hostname to be refused")
+	}
+}
+
+// failingStore is a store that can't be reached
+type failingStore struct{}
+
+func (failingStore) Take(key string, limit Limit, now time.Time) (Result, error) {
+	return Result{}, errors.New("store unavailable")
+}
+
+func TestLimiter_Middleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	l := New(NewMemoryStore(), nil, nil)
+	search := l.Middleware("search", Limit{Rate: 0.1, Burst: 2})(ok)
+	reserve := l.Middleware("reserve", Limit{Rate: 0.1, Burst: 2})(ok)
+
+	do := func(h http.Handler, addr string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 0; i < 2; i++ {
+		if rr := do(search, "203.0.113.5:4000"); rr.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, rr.Code)
+		}
+	}
+
+	rr := do(search, "203.0.113.5:4001")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429, got %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "10" {
+		t.Errorf("expected Retry-After of 10 seconds, got %q", rr.Header().Get("Retry-After"))
+	}
+
+	// routes and clients have their own buckets
+	if rr := do(reserve, "203.0.113.5:4000"); rr.Code != http.StatusOK {
+		t.Errorf("expected another route to be allowed, got %d", rr.Code)
+	}
+	if rr := do(search, "203.0.113.6:4000"); rr.Code != http.StatusOK {
+		t.Errorf("expected another client to be allowed, got %d", rr.Code)
+	}
+
+	// no limiter, no limit, or a store that is down let requests through
+	var none *Limiter
+	for name, h := range map[string]http.Handler{
+		"nil-limiter":   none.Middleware("search", Limit{Rate: 1, Burst: 1})(ok),
+		"zero-limit":    l.Middleware("search", Limit{})(ok),
+		"failing-store": New(failingStore{}, nil, nil).Middleware("search", Limit{Rate: 1, Burst: 1})(ok),
+	} {
+		for i := 0; i < 3; i++ {
+			if rr := do(h, "203.0.113.5:4000"); rr.Code != http.StatusOK {
+				t.Errorf("%s: expected 200, got %d", name, rr.Code)
+			}
+		}
+	}
+}
@@ -7,9 +7,10 @@ import (
 	"log"
 	"net/http"
 	"path/filepath"
-	"time"
+	"strings"
 
 	"github.com/ashparshp/bookings/internal/config"
+	"github.com/ashparshp/bookings/internal/helpers"
 	"github.com/ashparshp/bookings/internal/models"
 	"github.com/justinas/nosurf"
 )
@@ -79,6 +80,7 @@ var functions = template.FuncMap{
 	"formatDate": FormatDate,
 	"iterate": Iterate,
 	"add": Add,
+	"formatMoney": FormatMoney,
 }
 
 var app *config.AppConfig
@@ -87,6 +89,16 @@ var pathToTemplates = "./templates"
 func Add(a, b int) int {
 	return a + b
 }
+
+// FormatMoney formats an amount in the smallest unit of currency, such as cents, for display
+func FormatMoney(amount int, currency string) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s %s%d.%02d", strings.ToUpper(currency), sign, amount/100, amount%100)
+}
 // Iterate is a helper function to iterate over a number of items
 func Iterate(count int) []int {
 	var i int
@@ -102,12 +114,17 @@ func NewRenderer(a *config.AppConfig) {
 	app = a
 }
 
+// dateFormatter is a time.Time or a models.Date, so templates can format either
+type dateFormatter interface {
+	Format(layout string) string
+}
+
 // HumanDate returns time in "YYYY-MM-DD" format
-func HumanDate(t time.Time) string {
+func HumanDate(t dateFormatter) string {
 	return t.Format("2006-01-02")
 }
 
-func FormatDate(t time.Time, f string) string {
+func FormatDate(t dateFormatter, f string) string {
 	return t.Format(f)
 }
 
@@ -116,9 +133,16 @@ func AddDefaultData(td *models.TemplateData, r *http.Request) *models.TemplateDa
 	td.Error = app.Session.PopString(r.Context(), "error")
 	td.Warning = app.Session.PopString(r.Context(), "warning")
 	td.CSRFToken = nosurf.Token(r)
+	td.CSPNonce = helpers.CSPNonce(r)
 	if app.Session.Exists(r.Context(), "user_id") {
 		td.IsAuthenticated = 1
 	}
+	if app.Session.Exists(r.Context(), "guest_id") {
+		td.IsGuestAuthenticated = 1
+	}
+	td.Property = helpers.CurrentProperty(r)
+	td.Properties = helpers.AllowedProperties(r)
+	td.Today = models.Today(td.Property.Location())
 	return td
 }
 
@@ -2,8 +2,12 @@ package render
 
 import (
 	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
 	"testing"
 
+	"github.com/ashparshp/bookings/internal/helpers"
 	"github.com/ashparshp/bookings/internal/models"
 )
 
@@ -16,12 +20,45 @@ func TestAddDefaultData(t *testing.T) {
 	}
 
 	session.Put(r.Context(), "flash", "some-flash-message")
+	r = r.WithContext(helpers.WithCSPNonce(r.Context(), "some-nonce"))
 
 	result := AddDefaultData(&td, r)
 
 	if result.Flash != "some-flash-message" {
 		t.Error("failed to get flash message")
 	}
+	if result.CSPNonce != "some-nonce" {
+		t.Error("failed to get the CSP nonce")
+	}
+}
+
+// TestTemplatesAllowedByCSP checks the templates only run scripts the Content-Security-Policy
+// allows: inline scripts need the request's nonce, and inline event handlers are always blocked
+func TestTemplatesAllowedByCSP(t *testing.T) {
+	files, err := filepath.Glob("./../../templates/*.tmpl")
+	if err != nil || len(files) == 0 {
+		t.Fatal("failed to find templates")
+	}
+
+	inlineScript := regexp.MustCompile(`<script(\s[^>]*)?>`)
+	eventHandler := regexp.MustCompile(`<[^>]*\son[a-z]+\s*=`)
+
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := string(b)
+
+		for _, tag := range inlineScript.FindAllString(src, -1) {
+			if !regexp.MustCompile(`\s(src|nonce)=`).MatchString(tag) {
+				t.Errorf("%s: inline script without a nonce: %s", filepath.Base(file), tag)
+			}
+		}
+		if m := eventHandler.FindString(src); m != "" {
+			t.Errorf("%s: inline event handler: %s", filepath.Base(file), m)
+		}
+	}
 }
 
 func TestRenderTemplate(t *testing.T) {
@@ -77,4 +114,22 @@ func TestCreateTemplateCache(t *testing.T) {
 	if err != nil {
 		t.Error("failed to create template cache")
 	}
-}
\ No newline at end of file
+}
+func TestFormatMoney(t *testing.T) {
+	tests := []struct {
+		amount   int
+		currency string
+		expected string
+	}{
+		{15000, "usd", "USD 150.00"},
+		{4505, "eur", "EUR 45.05"},
+		{7, "gbp", "GBP 0.07"},
+		{-9050, "usd", "USD -90.50"},
+	}
+
+	for _, e := range tests {
+		if got := FormatMoney(e.amount, e.currency); got != e.expected {
+			t.Errorf("FormatMoney(%d, %s) = %s, wanted %s", e.amount, e.currency, got, e.expected)
+		}
+	}
+}
@@ -0,0 +1,736 @@
+package dbrepo
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/config"
+	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/repository"
+)
+
+// auditedDBRepo records every change made through a repository in the audit log as made by
+// actor, so changes made by the background workers are logged as well as those made by staff
+// and guests. Logs and bookkeeping, such as sign in attempts, sync logs, webhook deliveries and
+// sign in tokens, are not audited.
+type auditedDBRepo struct {
+	repository.DatabaseRepo
+	App *config.AppConfig
+	actor models.AuditActor
+}
+
+// twoFactorAudit is what the audit log records when staff change their two-factor
+// authentication, leaving out the secret and the codes
+type twoFactorAudit struct {
+	TwoFactorEnabled bool
+	RecoveryCodes int
+}
+
+// As returns the repository recording changes as made by actor
+func (a *auditedDBRepo) As(actor models.AuditActor) repository.DatabaseRepo {
+	return &auditedDBRepo{DatabaseRepo: a.DatabaseRepo, App: a.App, actor: actor}
+}
+
+// record writes an entry to the audit log. before and after are stored as JSON and may be nil
+// for entities that are created or deleted. A failure to write the log is reported but does not
+// fail the change, since it has already been made.
+func (a *auditedDBRepo) record(action, entityType string, entityID int, before, after interface{}) {
+	entry := models.AuditEntry{
+		UserID:     a.actor.UserID,
+		Actor:      a.actor.Actor,
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Before:     auditJSON(before),
+		After:      auditJSON(after),
+		IPAddress:  a.actor.IPAddress,
+		RequestID:  a.actor.RequestID,
+	}
+	// staff accounts and settings apply to every property
+	if entityType != models.EntityUser && entityType != models.EntitySettings {
+		entry.PropertyID = a.propertyOf(after, before)
+	}
+
+	err := a.DatabaseRepo.InsertAuditEntry(entry)
+	if err != nil && a.App != nil && a.App.ErrorLog != nil {
+		a.App.ErrorLog.Println("Error writing audit log:", err)
+	}
+}
+
+// propertyOf returns the property the first of values that belongs to one is at, falling back to
+// the property the actor is working on
+func (a *auditedDBRepo) propertyOf(values ...interface{}) int {
+	for _, v := range values {
+		switch v := v.(type) {
+		case models.Reservation:
+			if v.Room.PropertyID > 0 {
+				return v.Room.PropertyID
+			}
+		case models.Property:
+			return v.ID
+		case models.Room:
+			return v.PropertyID
+		case models.Channel:
+			return v.PropertyID
+		case models.Webhook:
+			return v.PropertyID
+		case models.WaitlistEntry:
+			return v.PropertyID
+		case models.ChargeRule:
+			return v.PropertyID
+		case models.PromoCode:
+			return v.PropertyID
+		case models.Invoice:
+			return v.PropertyID
+		}
+	}
+	return a.actor.PropertyID
+}
+
+// auditJSON encodes v for the audit log, returning "" for nil
+func auditJSON(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+
+	out, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+
+	return string(out)
+}
+
+// The functions below return an entity as it is now for an audit entry, or nil when it can't
+// be read
+
+func (a *auditedDBRepo) reservation(id int) interface{} {
+	res, err := a.DatabaseRepo.GetReservationByID(id)
+	if err != nil {
+		return nil
+	}
+	return res
+}
+
+func (a *auditedDBRepo) restriction(id int) interface{} {
+	r, err := a.DatabaseRepo.GetRestrictionByID(id)
+	if err != nil {
+		return nil
+	}
+	return r
+}
+
+func (a *auditedDBRepo) guest(id int) interface{} {
+	g, err := a.DatabaseRepo.GetGuestByID(id)
+	if err != nil {
+		return nil
+	}
+	return g
+}
+
+func (a *auditedDBRepo) chargeRule(id int) interface{} {
+	c, err := a.DatabaseRepo.GetChargeRuleByID(id)
+	if err != nil {
+		return nil
+	}
+	return c
+}
+
+func (a *auditedDBRepo) promoCode(id int) interface{} {
+	p, err := a.DatabaseRepo.GetPromoCodeByID(id)
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+func (a *auditedDBRepo) property(id int) interface{} {
+	p, err := a.DatabaseRepo.GetPropertyByID(id)
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+func (a *auditedDBRepo) waitlistEntry(id int) interface{} {
+	e, err := a.DatabaseRepo.GetWaitlistEntryByID(id)
+	if err != nil {
+		return nil
+	}
+	return e
+}
+
+func (a *auditedDBRepo) roomHold(id int) interface{} {
+	h, err := a.DatabaseRepo.GetRoomHoldByID(id)
+	if err != nil {
+		return nil
+	}
+	return h
+}
+
+func (a *auditedDBRepo) channel(id int) interface{} {
+	c, err := a.DatabaseRepo.GetChannelByID(id)
+	if err != nil {
+		return nil
+	}
+	return c
+}
+
+func (a *auditedDBRepo) webhook(id int) interface{} {
+	w, err := a.DatabaseRepo.GetWebhookByID(id)
+	if err != nil {
+		return nil
+	}
+	return w
+}
+
+// user leaves out the password hash, which has no place in the audit log
+func (a *auditedDBRepo) user(id int) interface{} {
+	u, err := a.DatabaseRepo.GetUserByID(id)
+	if err != nil {
+		return nil
+	}
+	u.Password = ""
+	return u
+}
+
+// InsertReservation inserts a reservation and records its creation
+func (a *auditedDBRepo) InsertReservation(res models.Reservation) (int, error) {
+	id, err := a.DatabaseRepo.InsertReservation(res)
+	if err != nil {
+		return id, err
+	}
+	a.record(models.AuditCreate, models.EntityReservation, id, nil, a.reservation(id))
+	return id, nil
+}
+
+// InsertRoomRestriction inserts a room restriction and records its creation
+func (a *auditedDBRepo) InsertRoomRestriction(r models.RoomRestriction) (int, error) {
+	id, err := a.DatabaseRepo.InsertRoomRestriction(r)
+	if err != nil {
+		return id, err
+	}
+	r.ID = id
+	a.record(models.AuditCreate, models.EntityRoomRestriction, id, nil, r)
+	return id, nil
+}
+
+// UpdateUser updates a user and records the change
+func (a *auditedDBRepo) UpdateUser(u models.User) error {
+	before := a.user(u.ID)
+	err := a.DatabaseRepo.UpdateUser(u)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditUpdate, models.EntityUser, u.ID, before, a.user(u.ID))
+	return nil
+}
+
+// UpdateReservation updates a reservation and records the change
+func (a *auditedDBRepo) UpdateReservation(u models.Reservation, id int) error {
+	before := a.reservation(id)
+	err := a.DatabaseRepo.UpdateReservation(u, id)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditUpdate, models.EntityReservation, id, before, a.reservation(id))
+	return nil
+}
+
+// DeleteReservation moves a reservation to the trash and records it
+func (a *auditedDBRepo) DeleteReservation(id, userID int) error {
+	before := a.reservation(id)
+	err := a.DatabaseRepo.DeleteReservation(id, userID)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditDelete, models.EntityReservation, id, before, a.reservation(id))
+	return nil
+}
+
+// RestoreReservation takes a reservation out of the trash and records it
+func (a *auditedDBRepo) RestoreReservation(id int) error {
+	before := a.reservation(id)
+	err := a.DatabaseRepo.RestoreReservation(id)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditRestore, models.EntityReservation, id, before, a.reservation(id))
+	return nil
+}
+
+// PurgeDeletedReservations permanently removes reservations from the trash and records how many
+func (a *auditedDBRepo) PurgeDeletedReservations(before time.Time) (int64, error) {
+	n, err := a.DatabaseRepo.PurgeDeletedReservations(before)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	a.record(models.AuditPurge, models.EntityReservation, 0,
+		map[string]interface{}{"deleted_before": before.Format(time.RFC3339), "count": n}, nil)
+	return n, nil
+}
+
+// UpdateReservationStatus moves a reservation to a new status and records it
+func (a *auditedDBRepo) UpdateReservationStatus(id int, status models.ReservationStatus) error {
+	before := a.reservation(id)
+	err := a.DatabaseRepo.UpdateReservationStatus(id, status)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditStatus, models.EntityReservation, id, before, a.reservation(id))
+	return nil
+}
+
+// InsertBlockForRoom inserts a block and records its creation
+func (a *auditedDBRepo) InsertBlockForRoom(r models.RoomRestriction) (int, error) {
+	id, err := a.DatabaseRepo.InsertBlockForRoom(r)
+	if err != nil {
+		return id, err
+	}
+	r.ID = id
+	a.record(models.AuditCreate, models.EntityBlock, id, nil, r)
+	return id, nil
+}
+
+// ApplyBlockChanges deletes and inserts blocks, recording each of them
+func (a *auditedDBRepo) ApplyBlockChanges(propertyID int, removeIDs []int, adds []models.RoomRestriction) ([]models.RoomRestriction, []models.RoomRestriction, error) {
+	removed, added, err := a.DatabaseRepo.ApplyBlockChanges(propertyID, removeIDs, adds)
+	if err != nil {
+		return removed, added, err
+	}
+	for _, block := range removed {
+		a.record(models.AuditDelete, models.EntityBlock, block.ID, block, nil)
+	}
+	for _, block := range added {
+		a.record(models.AuditCreate, models.EntityBlock, block.ID, nil, block)
+	}
+	return removed, added, nil
+}
+
+// InsertRestriction inserts a restriction type and records its creation
+func (a *auditedDBRepo) InsertRestriction(r models.Restriction) (int, error) {
+	id, err := a.DatabaseRepo.InsertRestriction(r)
+	if err != nil {
+		return id, err
+	}
+	r.ID = id
+	a.record(models.AuditCreate, models.EntityRestriction, id, nil, r)
+	return id, nil
+}
+
+// UpdateRestriction updates a restriction type and records the change
+func (a *auditedDBRepo) UpdateRestriction(r models.Restriction) error {
+	before := a.restriction(r.ID)
+	err := a.DatabaseRepo.UpdateRestriction(r)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditUpdate, models.EntityRestriction, r.ID, before, a.restriction(r.ID))
+	return nil
+}
+
+// DeleteRestriction deletes a restriction type and records it
+func (a *auditedDBRepo) DeleteRestriction(id int) error {
+	before := a.restriction(id)
+	err := a.DatabaseRepo.DeleteRestriction(id)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditDelete, models.EntityRestriction, id, before, nil)
+	return nil
+}
+
+// MoveReservation moves a reservation to another room or dates and records it
+func (a *auditedDBRepo) MoveReservation(change models.ReservationChange) error {
+	before := a.reservation(change.ReservationID)
+	err := a.DatabaseRepo.MoveReservation(change)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditMove, models.EntityReservation, change.ReservationID, before, a.reservation(change.ReservationID))
+	return nil
+}
+
+// UpdateGuest updates a guest and records the change
+func (a *auditedDBRepo) UpdateGuest(g models.Guest) error {
+	before := a.guest(g.ID)
+	err := a.DatabaseRepo.UpdateGuest(g)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditUpdate, models.EntityGuest, g.ID, before, a.guest(g.ID))
+	return nil
+}
+
+// MergeGuests merges a duplicate guest into another, recording the deletion of the duplicate
+// and the merge
+func (a *auditedDBRepo) MergeGuests(targetID, duplicateID int) error {
+	target := a.guest(targetID)
+	duplicate := a.guest(duplicateID)
+	err := a.DatabaseRepo.MergeGuests(targetID, duplicateID)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditDelete, models.EntityGuest, duplicateID, duplicate, nil)
+	a.record(models.AuditMerge, models.EntityGuest, targetID, target, map[string]int{"MergedGuestID": duplicateID})
+	return nil
+}
+
+// InsertGuest inserts a guest and records their creation
+func (a *auditedDBRepo) InsertGuest(g models.Guest) (int, error) {
+	id, err := a.DatabaseRepo.InsertGuest(g)
+	if err != nil {
+		return id, err
+	}
+	a.record(models.AuditCreate, models.EntityGuest, id, nil, a.guest(id))
+	return id, nil
+}
+
+// InsertPayment inserts a payment and records its creation
+func (a *auditedDBRepo) InsertPayment(p models.Payment) (int, error) {
+	id, err := a.DatabaseRepo.InsertPayment(p)
+	if err != nil {
+		return id, err
+	}
+	p.ID = id
+	a.record(models.AuditCreate, models.EntityPayment, id, nil, p)
+	return id, nil
+}
+
+// UpdatePayment updates a payment and records the change, as a refund when more of it has
+// been refunded
+func (a *auditedDBRepo) UpdatePayment(p models.Payment) error {
+	action := models.AuditUpdate
+	var before interface{}
+	if stored, err := a.DatabaseRepo.GetPaymentByProviderID(p.Provider, p.ProviderPaymentID); err == nil {
+		before = stored
+		if p.RefundedAmount > stored.RefundedAmount {
+			action = models.AuditRefund
+		}
+	}
+
+	err := a.DatabaseRepo.UpdatePayment(p)
+	if err != nil {
+		return err
+	}
+	a.record(action, models.EntityPayment, p.ID, before, p)
+	return nil
+}
+
+// CreateInvoice issues an invoice and records it
+func (a *auditedDBRepo) CreateInvoice(inv models.Invoice) (models.Invoice, error) {
+	inv, err := a.DatabaseRepo.CreateInvoice(inv)
+	if err != nil {
+		return inv, err
+	}
+	a.record(models.AuditCreate, models.EntityInvoice, inv.ID, nil, inv)
+	return inv, nil
+}
+
+// InsertChargeRule inserts a charge rule and records its creation
+func (a *auditedDBRepo) InsertChargeRule(c models.ChargeRule) (int, error) {
+	id, err := a.DatabaseRepo.InsertChargeRule(c)
+	if err != nil {
+		return id, err
+	}
+	c.ID = id
+	a.record(models.AuditCreate, models.EntityChargeRule, id, nil, c)
+	return id, nil
+}
+
+// SetChargeRuleActive turns a charge rule on or off and records the change
+func (a *auditedDBRepo) SetChargeRuleActive(id int, active bool) error {
+	before := a.chargeRule(id)
+	err := a.DatabaseRepo.SetChargeRuleActive(id, active)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditUpdate, models.EntityChargeRule, id, before, a.chargeRule(id))
+	return nil
+}
+
+// InsertPromoCode inserts a promo code and records its creation
+func (a *auditedDBRepo) InsertPromoCode(p models.PromoCode) (int, error) {
+	id, err := a.DatabaseRepo.InsertPromoCode(p)
+	if err != nil {
+		return id, err
+	}
+	p.ID = id
+	a.record(models.AuditCreate, models.EntityPromoCode, id, nil, p)
+	return id, nil
+}
+
+// SetPromoCodeActive turns a promo code on or off and records the change
+func (a *auditedDBRepo) SetPromoCodeActive(id int, active bool) error {
+	before := a.promoCode(id)
+	err := a.DatabaseRepo.SetPromoCodeActive(id, active)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditUpdate, models.EntityPromoCode, id, before, a.promoCode(id))
+	return nil
+}
+
+// InsertProperty inserts a property and records its creation
+func (a *auditedDBRepo) InsertProperty(p models.Property, userID int) (int, error) {
+	id, err := a.DatabaseRepo.InsertProperty(p, userID)
+	if err != nil {
+		return id, err
+	}
+	a.record(models.AuditCreate, models.EntityProperty, id, nil, a.property(id))
+	return id, nil
+}
+
+// UpdateProperty updates a property and records the change
+func (a *auditedDBRepo) UpdateProperty(p models.Property) error {
+	before := a.property(p.ID)
+	err := a.DatabaseRepo.UpdateProperty(p)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditUpdate, models.EntityProperty, p.ID, before, a.property(p.ID))
+	return nil
+}
+
+// SetPropertyStaff sets the staff of a property and records the change
+func (a *auditedDBRepo) SetPropertyStaff(propertyID int, userIDs []int) error {
+	before, err := a.DatabaseRepo.GetPropertyStaffIDs(propertyID)
+	if err != nil {
+		return err
+	}
+	err = a.DatabaseRepo.SetPropertyStaff(propertyID, userIDs)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditUpdate, models.EntityProperty, propertyID,
+		map[string][]int{"staff": before}, map[string][]int{"staff": userIDs})
+	return nil
+}
+
+// InsertWaitlistEntry puts a guest on the waitlist and records it
+func (a *auditedDBRepo) InsertWaitlistEntry(e models.WaitlistEntry) (int, error) {
+	id, err := a.DatabaseRepo.InsertWaitlistEntry(e)
+	if err != nil {
+		return id, err
+	}
+	a.record(models.AuditCreate, models.EntityWaitlistEntry, id, nil, a.waitlistEntry(id))
+	return id, nil
+}
+
+// OfferWaitlistEntry offers a room to a guest on the waitlist and records it
+func (a *auditedDBRepo) OfferWaitlistEntry(id, roomID int, tokenHash string, expiresAt time.Time) error {
+	before := a.waitlistEntry(id)
+	err := a.DatabaseRepo.OfferWaitlistEntry(id, roomID, tokenHash, expiresAt)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditStatus, models.EntityWaitlistEntry, id, before, a.waitlistEntry(id))
+	return nil
+}
+
+// UpdateWaitlistStatus moves a waitlist entry to status and records it
+func (a *auditedDBRepo) UpdateWaitlistStatus(id int, status models.WaitlistStatus) error {
+	before := a.waitlistEntry(id)
+	err := a.DatabaseRepo.UpdateWaitlistStatus(id, status)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditStatus, models.EntityWaitlistEntry, id, before, a.waitlistEntry(id))
+	return nil
+}
+
+// ExpireWaitlistOffers expires the offers that have run out and records each of them
+func (a *auditedDBRepo) ExpireWaitlistOffers(now time.Time) ([]models.WaitlistEntry, error) {
+	expired, err := a.DatabaseRepo.ExpireWaitlistOffers(now)
+	for _, e := range expired {
+		before := e
+		before.Status = models.WaitlistOffered
+		a.record(models.AuditStatus, models.EntityWaitlistEntry, e.ID, before, e)
+	}
+	return expired, err
+}
+
+// InsertRoomHold holds a room and records it
+func (a *auditedDBRepo) InsertRoomHold(hold models.RoomHold) (int, error) {
+	id, err := a.DatabaseRepo.InsertRoomHold(hold)
+	if err != nil {
+		return id, err
+	}
+	hold.ID = id
+	a.record(models.AuditCreate, models.EntityRoomHold, id, nil, hold)
+	return id, nil
+}
+
+// DeleteRoomHold releases a hold and records it
+func (a *auditedDBRepo) DeleteRoomHold(id int) error {
+	before := a.roomHold(id)
+	err := a.DatabaseRepo.DeleteRoomHold(id)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditDelete, models.EntityRoomHold, id, before, nil)
+	return nil
+}
+
+// DeleteExpiredRoomHolds removes the holds that ran out and records how many
+func (a *auditedDBRepo) DeleteExpiredRoomHolds(before time.Time) (int64, error) {
+	n, err := a.DatabaseRepo.DeleteExpiredRoomHolds(before)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	a.record(models.AuditPurge, models.EntityRoomHold, 0,
+		map[string]interface{}{"expired_before": before.Format(time.RFC3339), "count": n}, nil)
+	return n, nil
+}
+
+// CancelUnpaidReservations cancels the reservations left unpaid and records each cancellation
+func (a *auditedDBRepo) CancelUnpaidReservations(before time.Time) ([]models.Reservation, error) {
+	cancelled, err := a.DatabaseRepo.CancelUnpaidReservations(before)
+	for _, res := range cancelled {
+		a.record(models.AuditStatus, models.EntityReservation, res.ID,
+			map[string]interface{}{"status": models.StatusPending}, res)
+	}
+	return cancelled, err
+}
+
+// InsertChannel inserts a channel and records its creation
+func (a *auditedDBRepo) InsertChannel(c models.Channel) (int, error) {
+	id, err := a.DatabaseRepo.InsertChannel(c)
+	if err != nil {
+		return id, err
+	}
+	a.record(models.AuditCreate, models.EntityChannel, id, nil, a.channel(id))
+	return id, nil
+}
+
+// UpdateChannel updates a channel and records the change
+func (a *auditedDBRepo) UpdateChannel(c models.Channel) error {
+	before := a.channel(c.ID)
+	err := a.DatabaseRepo.UpdateChannel(c)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditUpdate, models.EntityChannel, c.ID, before, a.channel(c.ID))
+	return nil
+}
+
+// ImportChannelReservation books a reservation from a channel and records its creation
+func (a *auditedDBRepo) ImportChannelReservation(channelID int, externalID string, res models.Reservation) (int, error) {
+	id, err := a.DatabaseRepo.ImportChannelReservation(channelID, externalID, res)
+	if err != nil {
+		return id, err
+	}
+	a.record(models.AuditCreate, models.EntityReservation, id, nil, a.reservation(id))
+	return id, nil
+}
+
+// InsertWebhook inserts a webhook and records its creation
+func (a *auditedDBRepo) InsertWebhook(w models.Webhook) (int, error) {
+	id, err := a.DatabaseRepo.InsertWebhook(w)
+	if err != nil {
+		return id, err
+	}
+	a.record(models.AuditCreate, models.EntityWebhook, id, nil, a.webhook(id))
+	return id, nil
+}
+
+// UpdateWebhook updates a webhook and records the change
+func (a *auditedDBRepo) UpdateWebhook(w models.Webhook) error {
+	before := a.webhook(w.ID)
+	err := a.DatabaseRepo.UpdateWebhook(w)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditUpdate, models.EntityWebhook, w.ID, before, a.webhook(w.ID))
+	return nil
+}
+
+// DeleteWebhook deletes a webhook and records it
+func (a *auditedDBRepo) DeleteWebhook(id int) error {
+	before := a.webhook(id)
+	err := a.DatabaseRepo.DeleteWebhook(id)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditDelete, models.EntityWebhook, id, before, nil)
+	return nil
+}
+
+// EnableTwoFactor turns on a user's two-factor authentication and records it
+func (a *auditedDBRepo) EnableTwoFactor(userID int, secret string, step int64, codeHashes []string) error {
+	err := a.DatabaseRepo.EnableTwoFactor(userID, secret, step, codeHashes)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditUpdate, models.EntityUser, userID,
+		twoFactorAudit{}, twoFactorAudit{TwoFactorEnabled: true, RecoveryCodes: len(codeHashes)})
+	return nil
+}
+
+// DisableTwoFactor turns off a user's two-factor authentication and records it
+func (a *auditedDBRepo) DisableTwoFactor(userID int) error {
+	err := a.DatabaseRepo.DisableTwoFactor(userID)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditUpdate, models.EntityUser, userID, twoFactorAudit{TwoFactorEnabled: true}, twoFactorAudit{})
+	return nil
+}
+
+// ReplaceRecoveryCodes replaces a user's recovery codes and records it
+func (a *auditedDBRepo) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	err := a.DatabaseRepo.ReplaceRecoveryCodes(userID, codeHashes)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditUpdate, models.EntityUser, userID,
+		twoFactorAudit{TwoFactorEnabled: true}, twoFactorAudit{TwoFactorEnabled: true, RecoveryCodes: len(codeHashes)})
+	return nil
+}
+
+// UpdateSecuritySettings saves the sign in rules and records the change
+func (a *auditedDBRepo) UpdateSecuritySettings(s models.SecuritySettings) error {
+	before, err := a.DatabaseRepo.GetSecuritySettings()
+	if err != nil {
+		return err
+	}
+	err = a.DatabaseRepo.UpdateSecuritySettings(s)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditUpdate, models.EntitySettings, 0, before, s)
+	return nil
+}
+
+// ClearLoginFailures unlocks the account with email and records it
+func (a *auditedDBRepo) ClearLoginFailures(email string) error {
+	err := a.DatabaseRepo.ClearLoginFailures(email)
+	if err != nil {
+		return err
+	}
+	// failures are kept for addresses without an account too, which have no user to record
+	if u, err := a.DatabaseRepo.GetUserByEmail(email); err == nil {
+		a.record(models.AuditUnlock, models.EntityUser, u.ID, nil, nil)
+	}
+	return nil
+}
+
+// RevokeSession signs a user out of one session and records it
+func (a *auditedDBRepo) RevokeSession(userID, id int) error {
+	err := a.DatabaseRepo.RevokeSession(userID, id)
+	if err != nil {
+		return err
+	}
+	a.record(models.AuditRevoke, models.EntityUser, userID, nil, map[string]int{"sessions": 1})
+	return nil
+}
+
+// RevokeUserSessions signs a user out everywhere and records how many sessions ended
+func (a *auditedDBRepo) RevokeUserSessions(userID int) (int64, error) {
+	n, err := a.DatabaseRepo.RevokeUserSessions(userID)
+	if err != nil {
+		return n, err
+	}
+	a.record(models.AuditRevoke, models.EntityUser, userID, nil, map[string]int64{"sessions": n})
+	return n, nil
+}
@@ -0,0 +1,75 @@
+package dbrepo
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/models"
+)
+
+// recordingRepo is the test repository keeping the audit entries written to it
+type recordingRepo struct {
+	*testDBRepo
+	entries []models.AuditEntry
+}
+
+func (m *recordingRepo) InsertAuditEntry(e models.AuditEntry) error {
+	m.entries = append(m.entries, e)
+	return nil
+}
+
+func TestAuditedDBRepo(t *testing.T) {
+	inner := &recordingRepo{testDBRepo: &testDBRepo{}}
+	system := &auditedDBRepo{DatabaseRepo: inner, actor: models.SystemActor}
+	staff := system.As(models.AuditActor{UserID: 2, Actor: "staff", IPAddress: "203.0.113.5", RequestID: "req-1", PropertyID: 2})
+
+	// workers go through the repository as the system
+	if _, err := system.DeleteExpiredRoomHolds(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := staff.InsertBlockForRoom(models.RoomRestriction{RoomID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := staff.UpdateReservationStatus(1, models.StatusConfirmed); err != nil {
+		t.Fatal(err)
+	}
+	if err := staff.EnableTwoFactor(2, "JBSWY3DPEHPK3PXP", 1, make([]string, 10)); err != nil {
+		t.Fatal(err)
+	}
+	// a failed change isn't recorded
+	if err := staff.UpdateReservationStatus(101, models.StatusConfirmed); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	expected := []struct {
+		actor      string
+		userID     int
+		action     string
+		entityType string
+		entityID   int
+		propertyID int
+	}{
+		{"system", 0, models.AuditPurge, models.EntityRoomHold, 0, 0},
+		{"staff", 2, models.AuditCreate, models.EntityBlock, 1, 2},
+		{"staff", 2, models.AuditStatus, models.EntityReservation, 1, models.DefaultPropertyID},
+		{"staff", 2, models.AuditUpdate, models.EntityUser, 2, 0},
+	}
+	if len(inner.entries) != len(expected) {
+		t.Fatalf("expected %d audit entries, got %d: %+v", len(expected), len(inner.entries), inner.entries)
+	}
+	for i, e := range expected {
+		got := inner.entries[i]
+		if got.Actor != e.actor || got.UserID != e.userID || got.Action != e.action ||
+			got.EntityType != e.entityType || got.EntityID != e.entityID || got.PropertyID != e.propertyID {
+			t.Errorf("entry %d: expected %+v, got %+v", i, e, got)
+		}
+	}
+
+	if inner.entries[1].IPAddress != "203.0.113.5" || inner.entries[1].RequestID != "req-1" {
+		t.Errorf("expected the staff member's address and request, got %+v", inner.entries[1])
+	}
+	if strings.Contains(inner.entries[3].After, "JBSWY3DPEHPK3PXP") {
+		t.Errorf("two-factor secret reached the audit log: %s", inner.entries[3].After)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 
 	"github.com/ashparshp/bookings/internal/config"
+	"github.com/ashparshp/bookings/internal/models"
 	"github.com/ashparshp/bookings/internal/repository"
 )
 
@@ -17,15 +18,29 @@ type testDBRepo struct {
 	DB  *sql.DB
 }
 
+// NewPostgresRepo returns the repository for conn. Changes made through it are recorded in the
+// audit log as made by the system, until As is used to say who makes them.
 func NewPostgresRepo(conn *sql.DB, a *config.AppConfig) repository.DatabaseRepo {
-	return &postgresDBRepo{
+	repo := &postgresDBRepo{
 		App: a,
 		DB:  conn,
 	}
+	return repo.As(models.SystemActor)
 }
 
 func NewTestRepo(a *config.AppConfig) repository.DatabaseRepo {
-	return &testDBRepo{
+	repo := &testDBRepo{
 		App: a,
 	}
+	return repo.As(models.SystemActor)
+}
+
+// As returns the repository recording changes as made by actor
+func (m *postgresDBRepo) As(actor models.AuditActor) repository.DatabaseRepo {
+	return &auditedDBRepo{DatabaseRepo: m, App: m.App, actor: actor}
+}
+
+// As returns the repository recording changes as made by actor
+func (m *testDBRepo) As(actor models.AuditActor) repository.DatabaseRepo {
+	return &auditedDBRepo{DatabaseRepo: m, App: m.App, actor: actor}
 }
\ No newline at end of file
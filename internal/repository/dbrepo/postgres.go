@@ -2,58 +2,187 @@ package dbrepo
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/repository"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// unavailableWhere matches room_restrictions rows (aliased rr, joined to
+// restrictions as res) that stop a stay from $1 to $2: anything that blocks
+// a night in the range, a closed-to-arrival rule on the arrival date and a
+// closed-to-departure rule on the departure date
+const unavailableWhere = `(coalesce(res.blocks_stay, true) and $1 < rr.end_date and $2 > rr.start_date)
+		or (res.closed_to_arrival and rr.start_date <= $1 and $1 < rr.end_date)
+		or (res.closed_to_departure and rr.start_date <= $2 and $2 < rr.end_date)`
+
+// heldWhere matches room_holds rows (aliased h) that keep a night from $1 to $2 for a guest
+// who is still booking it
+const heldWhere = `h.expires_at > now() and $1 < h.end_date and $2 > h.start_date`
+
 func (m *postgresDBRepo) AllUsers() bool {
 	return true
 }
 
-// InsertReservation inserts a reservation into the database
+// InsertReservation inserts a reservation into the database with its charges, linking it to
+// the matching guest or creating one, and counts a use of its promo code
 func (m *postgresDBRepo) InsertReservation(res models.Reservation) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	newID, err := insertReservation(ctx, tx, res)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// insertReservation inserts a reservation with its charges in tx, linking it to the matching
+// guest or creating one, and counts a use of its promo code
+func insertReservation(ctx context.Context, tx *sql.Tx, res models.Reservation) (int, error) {
+	var err error
+	guestID := res.GuestID
+	if guestID == 0 {
+		guestID, err = findOrCreateGuest(ctx, tx, res)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// the usage limit is checked again here, as the code may have been used up since the form was checked
+	var promoCodeID sql.NullInt64
+	if res.PromoCodeID > 0 {
+		result, err := tx.ExecContext(ctx, `UPDATE promo_codes SET uses = uses + 1, updated_at = $1
+			WHERE id = $2 AND (max_uses = 0 OR uses < max_uses)`, time.Now(), res.PromoCodeID)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return 0, models.ErrPromoUsedUp
+		}
+		promoCodeID = sql.NullInt64{Int64: int64(res.PromoCodeID), Valid: true}
+	}
+
+	guests := res.Guests
+	if guests < 1 {
+		guests = 1
+	}
+
+	var paymentDueAt sql.NullTime
+	if !res.PaymentDueAt.IsZero() {
+		paymentDueAt = sql.NullTime{Time: res.PaymentDueAt, Valid: true}
+	}
+
 	var newID int
-	stmt := `INSERT INTO reservations (first_name, last_name, email, phone, start_date, end_date, room_id, created_at, updated_at)
-	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+	stmt := `INSERT INTO reservations (first_name, last_name, email, phone, start_date, end_date, room_id, guest_id,
+		guests, promo_code_id, payment_due_at, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) returning id`
 
-	err := m.DB.QueryRowContext(ctx, stmt, res.FirstName, res.LastName, res.Email, res.Phone, res.StartDate, res.EndDate, res.RoomID, time.Now(), time.Now()).Scan(&newID)
+	err = tx.QueryRowContext(ctx, stmt, res.FirstName, res.LastName, res.Email, res.Phone, res.StartDate, res.EndDate, res.RoomID, guestID,
+		guests, promoCodeID, paymentDueAt, time.Now(), time.Now()).Scan(&newID)
 	if err != nil {
 		return 0, err
 	}
 
+	stmt = `INSERT INTO reservation_charges (reservation_id, kind, description, quantity, unit_amount, amount, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	for _, c := range res.Charges {
+		_, err = tx.ExecContext(ctx, stmt, newID, c.Kind, c.Description, c.Quantity, c.UnitAmount, c.Amount, time.Now(), time.Now())
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	return newID, nil
 }
 
-// InsertRoomRestriction inserts a room restriction into the database
-func (m *postgresDBRepo) InsertRoomRestriction(r models.RoomRestriction) error {
+// findOrCreateGuest returns the guest a reservation belongs to, matched on normalized email
+// and then on normalized phone, creating a guest when neither matches
+func findOrCreateGuest(ctx context.Context, tx *sql.Tx, res models.Reservation) (int, error) {
+	email := models.NormalizeEmail(res.Email)
+	phone := models.NormalizePhone(res.Phone)
+
+	var id int
+	var guestPhone string
+	query := `SELECT id, phone_normalized FROM guests
+		WHERE (email_normalized = $1 AND $1 <> '') OR (phone_normalized = $2 AND $2 <> '')
+		ORDER BY (email_normalized = $1) DESC, id
+		LIMIT 1 FOR UPDATE`
+	err := tx.QueryRowContext(ctx, query, email, phone).Scan(&id, &guestPhone)
+	if err == nil {
+		// fill in a phone number the guest didn't have, but never overwrite one
+		if guestPhone == "" && phone != "" {
+			_, err = tx.ExecContext(ctx, `UPDATE guests SET phone = $1, phone_normalized = $2, updated_at = $3 WHERE id = $4`,
+				res.Phone, phone, time.Now(), id)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return id, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	stmt := `INSERT INTO guests (first_name, last_name, email, phone, email_normalized, phone_normalized, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (email_normalized) WHERE email_normalized <> '' DO UPDATE SET updated_at = excluded.updated_at
+		RETURNING id`
+	err = tx.QueryRowContext(ctx, stmt, res.FirstName, res.LastName, strings.TrimSpace(res.Email), res.Phone,
+		email, phone, time.Now(), time.Now()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// InsertRoomRestriction inserts a room restriction into the database and returns its ID
+func (m *postgresDBRepo) InsertRoomRestriction(r models.RoomRestriction) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	var newID int
+
 	stmt := `INSERT INTO room_restrictions (start_date, end_date, room_id, reservation_id, restriction_id, created_at, updated_at)
-	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
 
-	_, err := m.DB.ExecContext(ctx, stmt, r.StartDate, r.EndDate, r.RoomID, r.ReservationID, r.RestrictionID, time.Now(), time.Now())
+	err := m.DB.QueryRowContext(ctx, stmt, r.StartDate, r.EndDate, r.RoomID, r.ReservationID, r.RestrictionID, time.Now(), time.Now()).Scan(&newID)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	return newID, nil
 }
 
 // SearchAvailabilityByDatesByRoomID returns true if there are available rooms for the given dates
-func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time, roomID int) (bool, error) {
+func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start, end models.Date, roomID int) (bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	query := `select count(id) from room_restrictions where room_id = $1 and $2 < end_date and $3 > start_date`
+	query := `select (select count(rr.id) from room_restrictions rr
+		left join restrictions res on (res.id = rr.restriction_id)
+		where rr.room_id = $3 and (` + unavailableWhere + `))
+		+ (select count(h.id) from room_holds h where h.room_id = $3 and ` + heldWhere + `)`
 	var numRows int
-	row := m.DB.QueryRowContext(ctx, query, roomID, start, end)
+	row := m.DB.QueryRowContext(ctx, query, start, end, roomID)
 	err := row.Scan(&numRows)
 	if err != nil {
 		return false, err
@@ -65,18 +194,21 @@ func (m *postgresDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time,
 	return false, nil
 }
 
-// SearchAvailabilityForAllRooms returns a slice of available rooms for the given dates
-func (m *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error) {
+// SearchAvailabilityForAllRooms returns the rooms of a property available for the given dates
+func (m *postgresDBRepo) SearchAvailabilityForAllRooms(start, end models.Date, propertyID int) ([]models.Room, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	var rooms []models.Room
 
-	query := `select r.id, r.room_name from rooms r
-	where r.id not in
-	(select room_id from room_restrictions rr where $1 < rr.end_date and $2 > rr.start_date)`
+	query := `select r.id, r.room_name, r.price, r.property_id from rooms r
+	where r.property_id = $3 and r.id not in
+	(select rr.room_id from room_restrictions rr
+		left join restrictions res on (res.id = rr.restriction_id)
+		where ` + unavailableWhere + `)
+	and r.id not in (select h.room_id from room_holds h where ` + heldWhere + `)`
 
-	rows, err := m.DB.QueryContext(ctx, query, start, end)
+	rows, err := m.DB.QueryContext(ctx, query, start, end, propertyID)
 	if err != nil {
 		return rooms, err
 	}
@@ -84,7 +216,7 @@ func (m *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]
 
 	for rows.Next() {
 		var room models.Room
-		err := rows.Scan(&room.ID, &room.RoomName)
+		err := rows.Scan(&room.ID, &room.RoomName, &room.Price, &room.PropertyID)
 		if err != nil {
 			return rooms, err
 		}
@@ -98,15 +230,64 @@ func (m *postgresDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]
 	return rooms, nil
 }
 
+// RoomNights returns what each room of a property allows on every date from start to end,
+// worked out for all the rooms and dates in one query
+func (m *postgresDBRepo) RoomNights(start, end models.Date, propertyID int) ([]models.RoomNight, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var grid []models.RoomNight
+
+	// each night is checked as a one night stay, so the rules match unavailableWhere and heldWhere
+	query := `select r.id, r.room_name, r.price, r.property_id, d.day,
+		not exists (select 1 from room_restrictions rr
+			left join restrictions res on (res.id = rr.restriction_id)
+			where rr.room_id = r.id and coalesce(res.blocks_stay, true) and rr.start_date <= d.day and d.day < rr.end_date)
+		and not exists (select 1 from room_holds h
+			where h.room_id = r.id and h.expires_at > now() and h.start_date <= d.day and d.day < h.end_date),
+		exists (select 1 from room_restrictions rr
+			join restrictions res on (res.id = rr.restriction_id)
+			where rr.room_id = r.id and res.closed_to_arrival and rr.start_date <= d.day and d.day < rr.end_date),
+		exists (select 1 from room_restrictions rr
+			join restrictions res on (res.id = rr.restriction_id)
+			where rr.room_id = r.id and res.closed_to_departure and rr.start_date <= d.day and d.day < rr.end_date)
+	from rooms r
+	cross join (select generate_series($1::date, $2::date, interval '1 day')::date as day) d
+	where r.property_id = $3
+	order by r.id, d.day`
+
+	rows, err := m.DB.QueryContext(ctx, query, start, end, propertyID)
+	if err != nil {
+		return grid, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var n models.RoomNight
+		err := rows.Scan(&n.Room.ID, &n.Room.RoomName, &n.Room.Price, &n.Room.PropertyID, &n.Date,
+			&n.Free, &n.ClosedToArrival, &n.ClosedToDeparture)
+		if err != nil {
+			return grid, err
+		}
+		grid = append(grid, n)
+	}
+
+	if err = rows.Err(); err != nil {
+		return grid, err
+	}
+
+	return grid, nil
+}
+
 // GetRoomByID returns a room by its ID
 func (m *postgresDBRepo) GetRoomByID(id int) (models.Room, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	var room models.Room
-	query := `select id, room_name, created_at, updated_at from rooms where id = $1`
+	query := `select id, room_name, price, property_id, created_at, updated_at from rooms where id = $1`
 	row := m.DB.QueryRowContext(ctx, query, id)
-	err := row.Scan(&room.ID, &room.RoomName, &room.CreatedAt, &room.UpdatedAt)
+	err := row.Scan(&room.ID, &room.RoomName, &room.Price, &room.PropertyID, &room.CreatedAt, &room.UpdatedAt)
 	if err != nil {
 		return room, err
 	}
@@ -120,14 +301,16 @@ func (m *postgresDBRepo) GetUserByID(id int) (models.User, error) {
 	defer cancel()
 
 	var user models.User
-	query := `select id, first_name, last_name, email, password, access_level, created_at, updated_at from users where id = $1`
+	var twoFactorEnabledAt sql.NullTime
+	query := `select id, first_name, last_name, email, password, access_level, totp_secret, two_factor_enabled_at, created_at, updated_at from users where id = $1`
 	
 	row := m.DB.QueryRowContext(ctx, query, id)
 	
-	err := row.Scan(&user.ID, &user.FirstName, &user.LastName, &user.Email, &user.Password, &user.AccessLevel, &user.CreatedAt, &user.UpdatedAt)
+	err := row.Scan(&user.ID, &user.FirstName, &user.LastName, &user.Email, &user.Password, &user.AccessLevel, &user.TOTPSecret, &twoFactorEnabledAt, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		return user, err
 	}
+	user.TwoFactorEnabledAt = twoFactorEnabledAt.Time
 	return user, nil
 }
 
@@ -146,7 +329,12 @@ func (m *postgresDBRepo) UpdateUser(u models.User) error {
 	return nil
 }
 
-// AuthenticateUser checks if the user exists and verifies the password
+// unknownUserHash is compared with the password given for an email that has no account, so
+// signing in takes as long as it does for a wrong password and can't reveal which emails exist
+const unknownUserHash = "$2a$12$Ove9PXZKaJVQjWuNHjmkleS0uPghedqeEJ76abnaJuTS62YUgtTrW"
+
+// AuthenticateUser checks if the user exists and verifies the password, returning
+// repository.ErrInvalidCredentials whether the email or the password was wrong
 func (m *postgresDBRepo) AuthenticateUser(email, testPassword string) (int, string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -158,21 +346,25 @@ func (m *postgresDBRepo) AuthenticateUser(email, testPassword string) (int, stri
 	row := m.DB.QueryRowContext(ctx, query, email)
 
 	err := row.Scan(&id, &hashedPassword)
+	if errors.Is(err, sql.ErrNoRows) {
+		_ = bcrypt.CompareHashAndPassword([]byte(unknownUserHash), []byte(testPassword))
+		return 0, "", repository.ErrInvalidCredentials
+	}
 	if err != nil {
 		return 0, "", err
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
 	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return 0, "", errors.New("incorrect password")
+		return 0, "", repository.ErrInvalidCredentials
 	} else if err != nil {
 		return 0, "", err
 	}
 	return id, hashedPassword, nil
 }
 
-// AllReservations returns all reservations from the database
-func (m *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
+// AllReservations returns all reservations for the rooms of a property
+func (m *postgresDBRepo) AllReservations(propertyID int) ([]models.Reservation, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -182,14 +374,15 @@ func (m *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
 		SELECT 
 			r.id, r.first_name, r.last_name, r.email, r.phone, 
 			r.start_date, r.end_date, r.room_id, 
-			r.created_at, r.updated_at, r.processed,
+			r.created_at, r.updated_at, r.status,
 			rm.id, rm.room_name
 		FROM reservations r
 		LEFT JOIN rooms rm ON r.room_id = rm.id
+		WHERE r.deleted_at IS NULL AND rm.property_id = $1
 		ORDER BY r.start_date ASC
 	`
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.DB.QueryContext(ctx, query, propertyID)
 	if err != nil {
 		return nil, err
 	}
@@ -208,7 +401,7 @@ func (m *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
 			&res.RoomID,
 			&res.CreatedAt,
 			&res.UpdatedAt,
-			&res.Processed,
+			&res.Status,
 			&res.Room.ID,
 			&res.Room.RoomName,
 		)
@@ -225,8 +418,8 @@ func (m *postgresDBRepo) AllReservations() ([]models.Reservation, error) {
 	return reservations, nil
 }
 
-// AllNewReservations returns all new reservations that have not been processed
-func (m *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
+// AllNewReservations returns the reservations for the rooms of a property that are still pending
+func (m *postgresDBRepo) AllNewReservations(propertyID int) ([]models.Reservation, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -236,15 +429,15 @@ func (m *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
 		SELECT 
 			r.id, r.first_name, r.last_name, r.email, r.phone, 
 			r.start_date, r.end_date, r.room_id, 
-			r.created_at, r.updated_at,
+			r.created_at, r.updated_at, r.status,
 			rm.id, rm.room_name
 		FROM reservations r
 		LEFT JOIN rooms rm ON r.room_id = rm.id
-		WHERE processed = 0
+		WHERE r.status = 'pending' AND r.deleted_at IS NULL AND rm.property_id = $1
 		ORDER BY r.start_date ASC
 	`
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.DB.QueryContext(ctx, query, propertyID)
 	if err != nil {
 		return nil, err
 	}
@@ -263,6 +456,7 @@ func (m *postgresDBRepo) AllNewReservations() ([]models.Reservation, error) {
 			&res.RoomID,
 			&res.CreatedAt,
 			&res.UpdatedAt,
+			&res.Status,
 			&res.Room.ID,
 			&res.Room.RoomName,
 		)
@@ -289,13 +483,18 @@ func (m *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error)
 		SELECT 
 			r.id, r.first_name, r.last_name, r.email, r.phone, 
 			r.start_date, r.end_date, r.room_id, 
-			r.created_at, r.updated_at, r.processed,
-			rm.id, rm.room_name
+			r.created_at, r.updated_at, r.status,
+			r.confirmed_at, r.checked_in_at, r.checked_out_at, r.cancelled_at, r.no_show_at,
+			r.deleted_at, coalesce(r.deleted_by, 0), coalesce(r.guest_id, 0),
+			r.guests, coalesce(r.promo_code_id, 0), r.payment_due_at,
+			rm.id, rm.room_name, rm.property_id
 		FROM reservations r
 		LEFT JOIN rooms rm ON r.room_id = rm.id
 		WHERE r.id = $1
 	`
 
+	var confirmedAt, checkedInAt, checkedOutAt, cancelledAt, noShowAt, deletedAt, paymentDueAt sql.NullTime
+
 	row := m.DB.QueryRowContext(ctx, query, id)
 	err := row.Scan(
 		&res.ID,
@@ -308,14 +507,34 @@ func (m *postgresDBRepo) GetReservationByID(id int) (models.Reservation, error)
 		&res.RoomID,
 		&res.CreatedAt,
 		&res.UpdatedAt,
-		&res.Processed,
+		&res.Status,
+		&confirmedAt,
+		&checkedInAt,
+		&checkedOutAt,
+		&cancelledAt,
+		&noShowAt,
+		&deletedAt,
+		&res.DeletedBy,
+		&res.GuestID,
+		&res.Guests,
+		&res.PromoCodeID,
+		&paymentDueAt,
 		&res.Room.ID,
 		&res.Room.RoomName,
+		&res.Room.PropertyID,
 	)
 	if err != nil {
 		return res, err
 	}
 
+	res.ConfirmedAt = confirmedAt.Time
+	res.CheckedInAt = checkedInAt.Time
+	res.CheckedOutAt = checkedOutAt.Time
+	res.CancelledAt = cancelledAt.Time
+	res.NoShowAt = noShowAt.Time
+	res.DeletedAt = deletedAt.Time
+	res.PaymentDueAt = paymentDueAt.Time
+
 	return res, nil
 }
 
@@ -334,46 +553,238 @@ func (m *postgresDBRepo) UpdateReservation(u models.Reservation, id int) error {
 	return nil
 }
 
-// DeleteReservation deletes a reservation from the database
-func (m *postgresDBRepo) DeleteReservation(id int) error {
+// DeleteReservation moves a reservation to the trash, recording who deleted it, and releases its room
+func (m *postgresDBRepo) DeleteReservation(id, userID int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `DELETE FROM reservations WHERE id = $1`
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `UPDATE reservations SET deleted_at = $1, deleted_by = $2 WHERE id = $3 AND deleted_at IS NULL`
 
-	_, err := m.DB.ExecContext(ctx, stmt, id)
+	result, err := tx.ExecContext(ctx, stmt, time.Now(), sql.NullInt64{Int64: int64(userID), Valid: userID > 0}, id)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("reservation does not exist or is already deleted")
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM room_restrictions WHERE reservation_id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AllDeletedReservations returns the reservations of a property in the trash, most recently
+// deleted first
+func (m *postgresDBRepo) AllDeletedReservations(propertyID int) ([]models.Reservation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var reservations []models.Reservation
+
+	query := `
+		SELECT 
+			r.id, r.first_name, r.last_name, r.email, r.phone, 
+			r.start_date, r.end_date, r.room_id, 
+			r.created_at, r.updated_at, r.status,
+			r.deleted_at, coalesce(r.deleted_by, 0),
+			rm.id, rm.room_name,
+			coalesce(u.first_name, ''), coalesce(u.last_name, '')
+		FROM reservations r
+		LEFT JOIN rooms rm ON r.room_id = rm.id
+		LEFT JOIN users u ON r.deleted_by = u.id
+		WHERE r.deleted_at IS NOT NULL AND rm.property_id = $1
+		ORDER BY r.deleted_at DESC
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, propertyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var res models.Reservation
+		err := rows.Scan(
+			&res.ID,
+			&res.FirstName,
+			&res.LastName,
+			&res.Email,
+			&res.Phone,
+			&res.StartDate,
+			&res.EndDate,
+			&res.RoomID,
+			&res.CreatedAt,
+			&res.UpdatedAt,
+			&res.Status,
+			&res.DeletedAt,
+			&res.DeletedBy,
+			&res.Room.ID,
+			&res.Room.RoomName,
+			&res.DeletedByUser.FirstName,
+			&res.DeletedByUser.LastName,
+		)
+		if err != nil {
+			return nil, err
+		}
+		res.DeletedByUser.ID = res.DeletedBy
+		reservations = append(reservations, res)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reservations, nil
 }
 
-// UpdateProcessedForReservation updates the processed status of a reservation
-func (m *postgresDBRepo) UpdateProcessedForReservation(id, processed int) error {
+// RestoreReservation takes a reservation out of the trash. Unless it was cancelled or a no-show,
+// its room must still be free for its dates, and the room restriction is created again.
+func (m *postgresDBRepo) RestoreReservation(id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `UPDATE reservations SET processed = $1 WHERE id = $2`
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	_, err := m.DB.ExecContext(ctx, stmt, processed, id)
+	var res models.Reservation
+	query := `SELECT room_id, start_date, end_date, status FROM reservations
+		WHERE id = $1 AND deleted_at IS NOT NULL FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, id).Scan(&res.RoomID, &res.StartDate, &res.EndDate, &res.Status)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if !res.Status.ReleasesInventory() {
+		// lock the room so a new booking can't take it while the check runs
+		var roomID int
+		err = tx.QueryRowContext(ctx, `SELECT id FROM rooms WHERE id = $1 FOR UPDATE`, res.RoomID).Scan(&roomID)
+		if err != nil {
+			return err
+		}
+
+		query = `select (select count(rr.id) from room_restrictions rr
+			left join restrictions res on (res.id = rr.restriction_id)
+			where rr.room_id = $3 and (` + unavailableWhere + `))
+			+ (select count(h.id) from room_holds h where h.room_id = $3 and ` + heldWhere + `)`
+		var numRows int
+		err = tx.QueryRowContext(ctx, query, res.StartDate, res.EndDate, res.RoomID).Scan(&numRows)
+		if err != nil {
+			return err
+		}
+		if numRows > 0 {
+			return repository.ErrRoomUnavailable
+		}
+
+		stmt := `INSERT INTO room_restrictions (start_date, end_date, room_id, reservation_id, restriction_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+		_, err = tx.ExecContext(ctx, stmt, res.StartDate, res.EndDate, res.RoomID, id, models.RestrictionReservation, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE reservations SET deleted_at = NULL, deleted_by = NULL, updated_at = $1 WHERE id = $2`, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PurgeDeletedReservations permanently removes reservations that were moved to the trash
+// before the given time, returning how many were removed
+func (m *postgresDBRepo) PurgeDeletedReservations(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM reservations WHERE deleted_at IS NOT NULL AND deleted_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// statusTimestampColumns maps each status to the column recording when a reservation entered it
+var statusTimestampColumns = map[models.ReservationStatus]string{
+	models.StatusConfirmed:  "confirmed_at",
+	models.StatusCheckedIn:  "checked_in_at",
+	models.StatusCheckedOut: "checked_out_at",
+	models.StatusCancelled:  "cancelled_at",
+	models.StatusNoShow:     "no_show_at",
+}
+
+// UpdateReservationStatus moves a reservation to a new status if the transition is allowed,
+// stamping the time of the transition. Cancelled and no-show reservations release their room.
+func (m *postgresDBRepo) UpdateReservationStatus(id int, status models.ReservationStatus) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	column, ok := statusTimestampColumns[status]
+	if !ok {
+		return repository.ErrInvalidTransition
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current models.ReservationStatus
+	err = tx.QueryRowContext(ctx, `SELECT status FROM reservations WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`, id).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	if !current.CanTransitionTo(status) {
+		return repository.ErrInvalidTransition
+	}
+
+	stmt := `UPDATE reservations SET status = $1, ` + column + ` = $2, updated_at = $2 WHERE id = $3`
+	_, err = tx.ExecContext(ctx, stmt, status, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	if status.ReleasesInventory() {
+		_, err = tx.ExecContext(ctx, `DELETE FROM room_restrictions WHERE reservation_id = $1`, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
 }
 
-// AllRooms returns all rooms from the database
-func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
+// AllRooms returns the rooms of a property
+func (m *postgresDBRepo) AllRooms(propertyID int) ([]models.Room, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	var rooms []models.Room
 
-	query := `SELECT id, room_name, created_at, updated_at FROM rooms ORDER BY room_name`
+	query := `SELECT id, room_name, price, property_id, created_at, updated_at FROM rooms
+		WHERE property_id = $1 ORDER BY room_name`
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.DB.QueryContext(ctx, query, propertyID)
 	if err != nil {
 		return nil, err
 	}
@@ -381,7 +792,7 @@ func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
 
 	for rows.Next() {
 		var room models.Room
-		err := rows.Scan(&room.ID, &room.RoomName, &room.CreatedAt, &room.UpdatedAt)
+		err := rows.Scan(&room.ID, &room.RoomName, &room.Price, &room.PropertyID, &room.CreatedAt, &room.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -395,18 +806,24 @@ func (m *postgresDBRepo) AllRooms() ([]models.Room, error) {
 	return rooms, nil
 }
 
-// GetRestrictionsForRoomByDate returns room restrictions for a specific room and date
-func (m *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error) {
+// GetRestrictionsByDate returns the room restrictions of every room that overlap a date range
+func (m *postgresDBRepo) GetRestrictionsByDate(start, end models.Date) ([]models.RoomRestriction, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	var restrictions []models.RoomRestriction
 
-	query := `SELECT id, start_date, end_date, room_id, coalesce(reservation_id, 0), restriction_id, created_at, updated_at 
-		FROM room_restrictions 
-		WHERE room_id = $1 AND $2 < end_date AND $3 > start_date`
+	query := `SELECT rr.id, rr.start_date, rr.end_date, rr.room_id, coalesce(rr.reservation_id, 0), rr.restriction_id,
+			rr.notes, rr.created_at, rr.updated_at,
+			res.id, res.restriction_name, res.color, res.blocks_stay, res.closed_to_arrival, res.closed_to_departure,
+			coalesce(r.first_name, ''), coalesce(r.last_name, '')
+		FROM room_restrictions rr
+		LEFT JOIN restrictions res ON (res.id = rr.restriction_id)
+		LEFT JOIN reservations r ON (r.id = rr.reservation_id)
+		WHERE $1 < rr.end_date AND $2 > rr.start_date
+		ORDER BY rr.room_id, rr.start_date`
 
-	rows, err := m.DB.QueryContext(ctx, query, roomID, start, end)
+	rows, err := m.DB.QueryContext(ctx, query, start, end)
 	if err != nil {
 		return nil, err
 	}
@@ -416,10 +833,18 @@ func (m *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end tim
 		var restriction models.RoomRestriction
 		err := rows.Scan(&restriction.ID, &restriction.StartDate, &restriction.EndDate,
 			&restriction.RoomID, &restriction.ReservationID,
-			&restriction.RestrictionID, &restriction.CreatedAt, &restriction.UpdatedAt)
+			&restriction.RestrictionID, &restriction.Notes, &restriction.CreatedAt, &restriction.UpdatedAt,
+			&restriction.Restriction.ID, &restriction.Restriction.RestrictionName, &restriction.Restriction.Color,
+			&restriction.Restriction.BlocksStay, &restriction.Restriction.ClosedToArrival,
+			&restriction.Restriction.ClosedToDeparture,
+			&restriction.Reservation.FirstName, &restriction.Reservation.LastName)
 		if err != nil {
 			return nil, err
 		}
+		restriction.Reservation.ID = restriction.ReservationID
+		restriction.Reservation.RoomID = restriction.RoomID
+		restriction.Reservation.StartDate = restriction.StartDate
+		restriction.Reservation.EndDate = restriction.EndDate
 		restrictions = append(restrictions, restriction)
 	}
 
@@ -430,33 +855,2794 @@ func (m *postgresDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end tim
 	return restrictions, nil
 }
 
-// InsertBlockForRoom inserts a block for a room in the database
-func (m *postgresDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
+// InsertBlockForRoom inserts a block of any restriction type for a room in the database and
+// returns its ID
+func (m *postgresDBRepo) InsertBlockForRoom(r models.RoomRestriction) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `INSERT INTO room_restrictions (start_date, end_date, room_id, restriction_id, created_at, updated_at)
-	VALUES ($1, $2, $3, $4, $5, $6)`
+	if r.RestrictionID == 0 {
+		r.RestrictionID = models.RestrictionOwnerBlock
+	}
+	if !r.EndDate.After(r.StartDate) {
+		r.EndDate = r.StartDate.AddDate(0, 0, 1)
+	}
+
+	var newID int
+
+	stmt := `INSERT INTO room_restrictions (start_date, end_date, room_id, restriction_id, notes, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
 
-	_, err := m.DB.ExecContext(ctx, stmt, startDate, startDate.AddDate(0, 0, 1), id, 2, time.Now(), time.Now())
+	err := m.DB.QueryRowContext(ctx, stmt, r.StartDate, r.EndDate, r.RoomID, r.RestrictionID, r.Notes, time.Now(), time.Now()).Scan(&newID)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	return newID, nil
+}
+
+// ApplyBlockChanges deletes the blocks with removeIDs and inserts adds in one transaction, so
+// either every change is made or none is. Only blocks on the rooms of propertyID are deleted. It
+// returns the deleted blocks and the inserted ones with their IDs
+func (m *postgresDBRepo) ApplyBlockChanges(propertyID int, removeIDs []int, adds []models.RoomRestriction) ([]models.RoomRestriction, []models.RoomRestriction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var removed []models.RoomRestriction
+	for _, id := range removeIDs {
+		var block models.RoomRestriction
+		err := tx.QueryRowContext(ctx, `DELETE FROM room_restrictions WHERE id = $1 AND reservation_id IS NULL
+			AND room_id IN (SELECT id FROM rooms WHERE property_id = $2)
+			RETURNING id, start_date, end_date, room_id, restriction_id, notes, created_at, updated_at`, id, propertyID).Scan(
+			&block.ID,
+			&block.StartDate,
+			&block.EndDate,
+			&block.RoomID,
+			&block.RestrictionID,
+			&block.Notes,
+			&block.CreatedAt,
+			&block.UpdatedAt,
+		)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, errors.New("block does not exist")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		removed = append(removed, block)
+	}
+
+	var added []models.RoomRestriction
+	for _, r := range adds {
+		if r.RestrictionID == 0 {
+			r.RestrictionID = models.RestrictionOwnerBlock
+		}
+		if !r.EndDate.After(r.StartDate) {
+			r.EndDate = r.StartDate.AddDate(0, 0, 1)
+		}
+		r.CreatedAt = time.Now()
+		r.UpdatedAt = r.CreatedAt
+
+		err := tx.QueryRowContext(ctx, `INSERT INTO room_restrictions (start_date, end_date, room_id, restriction_id, notes, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+			r.StartDate, r.EndDate, r.RoomID, r.RestrictionID, r.Notes, r.CreatedAt, r.UpdatedAt).Scan(&r.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		added = append(added, r)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	return removed, added, nil
 }
 
-// DeleteBlockByID deletes a block by its ID
-func (m *postgresDBRepo) DeleteBlockByID(id int) error {
+// AllRestrictions returns all restriction types
+func (m *postgresDBRepo) AllRestrictions() ([]models.Restriction, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `DELETE FROM room_restrictions WHERE id = $1`
+	var restrictions []models.Restriction
+
+	query := `SELECT id, restriction_name, color, blocks_stay, closed_to_arrival, closed_to_departure, created_at, updated_at
+		FROM restrictions ORDER BY id`
 
-	_, err := m.DB.ExecContext(ctx, stmt, id)
+	rows, err := m.DB.QueryContext(ctx, query)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r models.Restriction
+		err := rows.Scan(&r.ID, &r.RestrictionName, &r.Color, &r.BlocksStay, &r.ClosedToArrival,
+			&r.ClosedToDeparture, &r.CreatedAt, &r.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		restrictions = append(restrictions, r)
 	}
 
-	return nil
-}
\ No newline at end of file
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return restrictions, nil
+}
+
+// GetRestrictionByID returns a restriction type by its ID
+func (m *postgresDBRepo) GetRestrictionByID(id int) (models.Restriction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var r models.Restriction
+	query := `SELECT id, restriction_name, color, blocks_stay, closed_to_arrival, closed_to_departure, created_at, updated_at
+		FROM restrictions WHERE id = $1`
+
+	row := m.DB.QueryRowContext(ctx, query, id)
+	err := row.Scan(&r.ID, &r.RestrictionName, &r.Color, &r.BlocksStay, &r.ClosedToArrival,
+		&r.ClosedToDeparture, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// InsertRestriction inserts a restriction type and returns its ID
+func (m *postgresDBRepo) InsertRestriction(r models.Restriction) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+	stmt := `INSERT INTO restrictions (restriction_name, color, blocks_stay, closed_to_arrival, closed_to_departure, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt, r.RestrictionName, r.Color, r.BlocksStay, r.ClosedToArrival,
+		r.ClosedToDeparture, time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// UpdateRestriction updates a restriction type
+func (m *postgresDBRepo) UpdateRestriction(r models.Restriction) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE restrictions SET restriction_name = $1, color = $2, blocks_stay = $3, closed_to_arrival = $4,
+		closed_to_departure = $5, updated_at = $6 WHERE id = $7`
+
+	_, err := m.DB.ExecContext(ctx, stmt, r.RestrictionName, r.Color, r.BlocksStay, r.ClosedToArrival,
+		r.ClosedToDeparture, time.Now(), r.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteRestriction deletes a restriction type that is not used by any room restriction
+func (m *postgresDBRepo) DeleteRestriction(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `DELETE FROM restrictions WHERE id = $1
+		AND NOT EXISTS (SELECT 1 FROM room_restrictions WHERE restriction_id = $1)`
+
+	result, err := m.DB.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("restriction is in use or does not exist")
+	}
+
+	return nil
+}
+
+// MoveReservation moves a reservation to the room and dates in change. Availability is checked
+// against every other restriction on the new room, and the reservation, its room restriction
+// and the change history are written in a single transaction.
+func (m *postgresDBRepo) MoveReservation(change models.ReservationChange) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// lock the reservation while it is moved
+	var status models.ReservationStatus
+	query := `SELECT room_id, start_date, end_date, status FROM reservations WHERE id = $1 AND deleted_at IS NULL FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, change.ReservationID).Scan(&change.OldRoomID, &change.OldStartDate, &change.OldEndDate, &status)
+	if err != nil {
+		return err
+	}
+
+	// a reservation that gave up its room has no restriction to move, and moving it would
+	// only change the record of where the guest didn't stay
+	if status.ReleasesInventory() {
+		return repository.ErrReservationReleased
+	}
+
+	// lock the target room so two moves into it can't both pass the availability check
+	var roomID int
+	err = tx.QueryRowContext(ctx, `SELECT id FROM rooms WHERE id = $1 FOR UPDATE`, change.NewRoomID).Scan(&roomID)
+	if err != nil {
+		return err
+	}
+
+	query = `select (select count(rr.id) from room_restrictions rr
+		left join restrictions res on (res.id = rr.restriction_id)
+		where rr.room_id = $3 and coalesce(rr.reservation_id, 0) <> $4 and (` + unavailableWhere + `))
+		+ (select count(h.id) from room_holds h where h.room_id = $3 and ` + heldWhere + `)`
+	var numRows int
+	err = tx.QueryRowContext(ctx, query, change.NewStartDate, change.NewEndDate, change.NewRoomID, change.ReservationID).Scan(&numRows)
+	if err != nil {
+		return err
+	}
+	if numRows > 0 {
+		return repository.ErrRoomUnavailable
+	}
+
+	stmt := `UPDATE reservations SET room_id = $1, start_date = $2, end_date = $3, updated_at = $4 WHERE id = $5`
+	_, err = tx.ExecContext(ctx, stmt, change.NewRoomID, change.NewStartDate, change.NewEndDate, time.Now(), change.ReservationID)
+	if err != nil {
+		return err
+	}
+
+	stmt = `UPDATE room_restrictions SET room_id = $1, start_date = $2, end_date = $3, updated_at = $4 WHERE reservation_id = $5`
+	_, err = tx.ExecContext(ctx, stmt, change.NewRoomID, change.NewStartDate, change.NewEndDate, time.Now(), change.ReservationID)
+	if err != nil {
+		return err
+	}
+
+	var userID sql.NullInt64
+	if change.UserID > 0 {
+		userID = sql.NullInt64{Int64: int64(change.UserID), Valid: true}
+	}
+
+	stmt = `INSERT INTO reservation_changes (reservation_id, user_id, old_room_id, new_room_id, old_start_date, old_end_date,
+		new_start_date, new_end_date, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	_, err = tx.ExecContext(ctx, stmt, change.ReservationID, userID, change.OldRoomID, change.NewRoomID,
+		change.OldStartDate, change.OldEndDate, change.NewStartDate, change.NewEndDate, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetReservationChanges returns the room and date changes made to a reservation, newest first
+func (m *postgresDBRepo) GetReservationChanges(reservationID int) ([]models.ReservationChange, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var changes []models.ReservationChange
+
+	query := `SELECT c.id, c.reservation_id, coalesce(c.user_id, 0), c.old_room_id, c.new_room_id,
+			c.old_start_date, c.old_end_date, c.new_start_date, c.new_end_date, c.created_at, c.updated_at,
+			coalesce(o.room_name, ''), coalesce(n.room_name, ''),
+			coalesce(u.first_name, ''), coalesce(u.last_name, '')
+		FROM reservation_changes c
+		LEFT JOIN rooms o ON (o.id = c.old_room_id)
+		LEFT JOIN rooms n ON (n.id = c.new_room_id)
+		LEFT JOIN users u ON (u.id = c.user_id)
+		WHERE c.reservation_id = $1
+		ORDER BY c.created_at DESC`
+
+	rows, err := m.DB.QueryContext(ctx, query, reservationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c models.ReservationChange
+		err := rows.Scan(&c.ID, &c.ReservationID, &c.UserID, &c.OldRoomID, &c.NewRoomID,
+			&c.OldStartDate, &c.OldEndDate, &c.NewStartDate, &c.NewEndDate, &c.CreatedAt, &c.UpdatedAt,
+			&c.OldRoom.RoomName, &c.NewRoom.RoomName, &c.User.FirstName, &c.User.LastName)
+		if err != nil {
+			return nil, err
+		}
+		c.OldRoom.ID = c.OldRoomID
+		c.NewRoom.ID = c.NewRoomID
+		c.User.ID = c.UserID
+		changes = append(changes, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// InsertAuditEntry appends an entry to the audit log
+func (m *postgresDBRepo) InsertAuditEntry(e models.AuditEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO audit_log (user_id, actor, action, entity_type, entity_id, property_id, before_data, after_data,
+			ip_address, request_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		sql.NullInt64{Int64: int64(e.UserID), Valid: e.UserID > 0},
+		e.Actor,
+		e.Action,
+		e.EntityType,
+		e.EntityID,
+		sql.NullInt64{Int64: int64(e.PropertyID), Valid: e.PropertyID > 0},
+		sql.NullString{String: e.Before, Valid: e.Before != ""},
+		sql.NullString{String: e.After, Valid: e.After != ""},
+		e.IPAddress,
+		e.RequestID,
+		time.Now(),
+		time.Now(),
+	)
+
+	return err
+}
+
+// auditSelect is the select list shared by the audit log queries
+const auditSelect = `SELECT a.id, coalesce(a.user_id, 0), a.actor, a.action, a.entity_type, a.entity_id,
+		coalesce(a.property_id, 0), coalesce(a.before_data::text, ''), coalesce(a.after_data::text, ''), a.ip_address, a.request_id, a.created_at,
+		coalesce(u.first_name, ''), coalesce(u.last_name, ''), coalesce(u.email, '')
+	FROM audit_log a
+	LEFT JOIN users u ON (u.id = a.user_id)`
+
+// SearchAuditEntries returns audit log entries matching the filter, newest first
+func (m *postgresDBRepo) SearchAuditEntries(f models.AuditFilter) ([]models.AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if f.Query != "" {
+		p := arg("%" + f.Query + "%")
+		where = append(where, fmt.Sprintf(`(a.actor ILIKE %[1]s OR a.ip_address ILIKE %[1]s OR a.request_id ILIKE %[1]s
+			OR u.email ILIKE %[1]s OR a.before_data::text ILIKE %[1]s OR a.after_data::text ILIKE %[1]s)`, p))
+	}
+	if f.Action != "" {
+		where = append(where, "a.action = "+arg(f.Action))
+	}
+	if f.EntityType != "" {
+		where = append(where, "a.entity_type = "+arg(f.EntityType))
+	}
+	if f.EntityID > 0 {
+		where = append(where, "a.entity_id = "+arg(f.EntityID))
+	}
+	if !f.From.IsZero() {
+		where = append(where, "a.created_at >= "+arg(f.From))
+	}
+	if !f.To.IsZero() {
+		where = append(where, "a.created_at < "+arg(f.To))
+	}
+	if f.Unscoped {
+		where = append(where, "(a.property_id = "+arg(f.PropertyID)+" OR a.property_id IS NULL)")
+	} else {
+		where = append(where, "a.property_id = "+arg(f.PropertyID))
+	}
+
+	query := auditSelect
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY a.created_at DESC, a.id DESC"
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = 200
+	}
+	query += " LIMIT " + arg(limit)
+
+	return m.queryAuditEntries(ctx, query, args...)
+}
+
+// GetAuditEntriesForEntity returns the audit history of one entity, newest first
+func (m *postgresDBRepo) GetAuditEntriesForEntity(entityType string, entityID int) ([]models.AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := auditSelect + ` WHERE a.entity_type = $1 AND a.entity_id = $2 ORDER BY a.created_at DESC, a.id DESC`
+
+	return m.queryAuditEntries(ctx, query, entityType, entityID)
+}
+
+// queryAuditEntries runs an audit log query built on auditSelect
+func (m *postgresDBRepo) queryAuditEntries(ctx context.Context, query string, args ...interface{}) ([]models.AuditEntry, error) {
+	var entries []models.AuditEntry
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e models.AuditEntry
+		err := rows.Scan(&e.ID, &e.UserID, &e.Actor, &e.Action, &e.EntityType, &e.EntityID, &e.PropertyID,
+			&e.Before, &e.After, &e.IPAddress, &e.RequestID, &e.CreatedAt,
+			&e.User.FirstName, &e.User.LastName, &e.User.Email)
+		if err != nil {
+			return nil, err
+		}
+		e.User.ID = e.UserID
+		entries = append(entries, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// guestSelect is the select list shared by the guest queries, with each guest's stays and
+// nights counted over reservations that weren't cancelled, no-shows or deleted
+const guestSelect = `SELECT g.id, g.first_name, g.last_name, g.email, g.phone, g.notes, g.tags, g.created_at, g.updated_at,
+		g.password <> '', s.stays, s.nights, s.last_stay
+	FROM guests g
+	LEFT JOIN LATERAL (
+		SELECT count(r.id) AS stays, coalesce(sum(r.end_date - r.start_date), 0) AS nights, max(r.start_date) AS last_stay
+		FROM reservations r
+		WHERE r.guest_id = g.id AND r.deleted_at IS NULL AND r.status NOT IN ('cancelled', 'no_show')
+	) s ON true`
+
+// scanGuest scans a row selected with guestSelect
+func scanGuest(row interface{ Scan(...interface{}) error }) (models.Guest, error) {
+	var g models.Guest
+	var tags string
+	var lastStay sql.NullTime
+
+	err := row.Scan(&g.ID, &g.FirstName, &g.LastName, &g.Email, &g.Phone, &g.Notes, &tags, &g.CreatedAt, &g.UpdatedAt,
+		&g.HasAccount, &g.Stays, &g.TotalNights, &lastStay)
+	if err != nil {
+		return g, err
+	}
+
+	g.Tags = models.ParseTags(tags)
+	g.LastStay = lastStay.Time
+
+	return g, nil
+}
+
+// AllGuests returns the guests who have booked at a property whose name, email, phone or tags
+// contain search, or all of them when search is empty
+func (m *postgresDBRepo) AllGuests(propertyID int, search string) ([]models.Guest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var guests []models.Guest
+
+	query := guestSelect + `
+		WHERE EXISTS (SELECT 1 FROM reservations r JOIN rooms rm ON rm.id = r.room_id
+				WHERE r.guest_id = g.id AND rm.property_id = $3)
+			AND ($1 = '' OR g.first_name || ' ' || g.last_name ILIKE '%' || $1 || '%'
+				OR g.email_normalized LIKE '%' || lower($1) || '%'
+				OR ($2 <> '' AND g.phone_normalized LIKE '%' || $2 || '%')
+				OR g.tags ILIKE '%' || $1 || '%')
+		ORDER BY g.last_name, g.first_name, g.id`
+
+	rows, err := m.DB.QueryContext(ctx, query, search, models.NormalizePhone(search), propertyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		g, err := scanGuest(rows)
+		if err != nil {
+			return nil, err
+		}
+		guests = append(guests, g)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return guests, nil
+}
+
+// GetGuestByID returns a guest by its ID
+func (m *postgresDBRepo) GetGuestByID(id int) (models.Guest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanGuest(m.DB.QueryRowContext(ctx, guestSelect+` WHERE g.id = $1`, id))
+}
+
+// GetReservationsForGuest returns a guest's reservations, newest stay first, including
+// cancelled and deleted ones
+func (m *postgresDBRepo) GetReservationsForGuest(guestID int) ([]models.Reservation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var reservations []models.Reservation
+
+	query := `
+		SELECT r.id, r.first_name, r.last_name, r.email, r.phone, r.start_date, r.end_date, r.room_id,
+			r.created_at, r.updated_at, r.status, r.deleted_at, rm.id, rm.room_name, rm.property_id
+		FROM reservations r
+		LEFT JOIN rooms rm ON r.room_id = rm.id
+		WHERE r.guest_id = $1
+		ORDER BY r.start_date DESC
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, guestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var res models.Reservation
+		var deletedAt sql.NullTime
+		err := rows.Scan(&res.ID, &res.FirstName, &res.LastName, &res.Email, &res.Phone, &res.StartDate, &res.EndDate,
+			&res.RoomID, &res.CreatedAt, &res.UpdatedAt, &res.Status, &deletedAt, &res.Room.ID, &res.Room.RoomName,
+			&res.Room.PropertyID)
+		if err != nil {
+			return nil, err
+		}
+		res.DeletedAt = deletedAt.Time
+		res.GuestID = guestID
+		reservations = append(reservations, res)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reservations, nil
+}
+
+// GetGuestPropertyIDs returns the properties a guest has booked at, including with reservations
+// that were cancelled or deleted
+func (m *postgresDBRepo) GetGuestPropertyIDs(guestID int) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `SELECT DISTINCT rm.property_id FROM reservations r JOIN rooms rm ON rm.id = r.room_id
+		WHERE r.guest_id = $1 ORDER BY rm.property_id`
+
+	rows, err := m.DB.QueryContext(ctx, query, guestID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// UpdateGuest updates a guest's details, notes and tags, and copies the contact details onto
+// the guest's reservations so they stay in step
+func (m *postgresDBRepo) UpdateGuest(g models.Guest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	email := models.NormalizeEmail(g.Email)
+	if email != "" {
+		var n int
+		err = tx.QueryRowContext(ctx, `SELECT count(id) FROM guests WHERE email_normalized = $1 AND id <> $2`, email, g.ID).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return repository.ErrGuestExists
+		}
+	}
+
+	stmt := `UPDATE guests SET first_name = $1, last_name = $2, email = $3, phone = $4, email_normalized = $5,
+		phone_normalized = $6, notes = $7, tags = $8, updated_at = $9 WHERE id = $10`
+	result, err := tx.ExecContext(ctx, stmt, g.FirstName, g.LastName, strings.TrimSpace(g.Email), g.Phone, email,
+		models.NormalizePhone(g.Phone), g.Notes, strings.Join(g.Tags, ","), time.Now(), g.ID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	stmt = `UPDATE reservations SET first_name = $1, last_name = $2, email = $3, phone = $4, updated_at = $5 WHERE guest_id = $6`
+	_, err = tx.ExecContext(ctx, stmt, g.FirstName, g.LastName, strings.TrimSpace(g.Email), g.Phone, time.Now(), g.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MergeGuests folds the duplicate guest into the target: the duplicate's reservations move to
+// the target, its notes and tags are added to the target's, contact details the target lacks
+// are copied over, and the duplicate is deleted
+func (m *postgresDBRepo) MergeGuests(targetID, duplicateID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if targetID == duplicateID {
+		return errors.New("can't merge a guest into itself")
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT email, phone, email_normalized, phone_normalized, notes, tags FROM guests WHERE id = $1 FOR UPDATE`
+
+	var target, duplicate models.Guest
+	var targetEmail, targetPhone, dupEmail, dupPhone, targetTags, dupTags string
+	err = tx.QueryRowContext(ctx, query, targetID).Scan(&target.Email, &target.Phone, &targetEmail, &targetPhone, &target.Notes, &targetTags)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRowContext(ctx, query, duplicateID).Scan(&duplicate.Email, &duplicate.Phone, &dupEmail, &dupPhone, &duplicate.Notes, &dupTags)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE reservations SET guest_id = $1, updated_at = $2 WHERE guest_id = $3`, targetID, time.Now(), duplicateID)
+	if err != nil {
+		return err
+	}
+
+	// the duplicate goes first so its email is free for the target to take
+	_, err = tx.ExecContext(ctx, `DELETE FROM guests WHERE id = $1`, duplicateID)
+	if err != nil {
+		return err
+	}
+
+	if targetEmail == "" {
+		target.Email, targetEmail = duplicate.Email, dupEmail
+	}
+	if targetPhone == "" {
+		target.Phone, targetPhone = duplicate.Phone, dupPhone
+	}
+
+	notes := strings.TrimSpace(target.Notes)
+	if n := strings.TrimSpace(duplicate.Notes); n != "" {
+		if notes != "" {
+			notes += "\n\n"
+		}
+		notes += n
+	}
+
+	tags := models.ParseTags(targetTags + "," + dupTags)
+
+	stmt := `UPDATE guests SET email = $1, phone = $2, email_normalized = $3, phone_normalized = $4, notes = $5, tags = $6,
+		updated_at = $7 WHERE id = $8`
+	_, err = tx.ExecContext(ctx, stmt, target.Email, target.Phone, targetEmail, targetPhone, notes, strings.Join(tags, ","), time.Now(), targetID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetGuestByEmail returns the guest with the given email address
+func (m *postgresDBRepo) GetGuestByEmail(email string) (models.Guest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanGuest(m.DB.QueryRowContext(ctx, guestSelect+` WHERE g.email_normalized = $1`, models.NormalizeEmail(email)))
+}
+
+// InsertGuest inserts a guest into the database
+func (m *postgresDBRepo) InsertGuest(g models.Guest) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+	stmt := `INSERT INTO guests (first_name, last_name, email, phone, email_normalized, phone_normalized, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+
+	err := m.DB.QueryRowContext(ctx, stmt, g.FirstName, g.LastName, strings.TrimSpace(g.Email), g.Phone,
+		models.NormalizeEmail(g.Email), models.NormalizePhone(g.Phone), time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// AuthenticateGuest checks a guest's email and password, returning the guest's ID
+func (m *postgresDBRepo) AuthenticateGuest(email, testPassword string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	var hashedPassword string
+
+	query := `SELECT id, password FROM guests WHERE email_normalized = $1 AND password <> ''`
+	err := m.DB.QueryRowContext(ctx, query, models.NormalizeEmail(email)).Scan(&id, &hashedPassword)
+	if err != nil {
+		return 0, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return 0, errors.New("incorrect password")
+	} else if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// InsertGuestToken stores the hash of a sign in link for a guest. A link sent to confirm a
+// sign up carries the hashed password, which is only set once the link is used.
+func (m *postgresDBRepo) InsertGuestToken(guestID int, tokenHash, passwordHash string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO guest_tokens (guest_id, token_hash, password, expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+
+	_, err := m.DB.ExecContext(ctx, stmt, guestID, tokenHash, passwordHash, expiresAt, time.Now(), time.Now())
+	return err
+}
+
+// ConsumeGuestToken marks a sign in link as used, applies any password it carries, and returns
+// the guest it signs in
+func (m *postgresDBRepo) ConsumeGuestToken(tokenHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id, guestID int
+	var passwordHash string
+	query := `SELECT id, guest_id, password FROM guest_tokens
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2 FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, tokenHash, time.Now()).Scan(&id, &guestID, &passwordHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, repository.ErrInvalidToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE guest_tokens SET used_at = $1, updated_at = $1 WHERE id = $2`, time.Now(), id)
+	if err != nil {
+		return 0, err
+	}
+
+	if passwordHash != "" {
+		_, err = tx.ExecContext(ctx, `UPDATE guests SET password = $1, updated_at = $2 WHERE id = $3`, passwordHash, time.Now(), guestID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return guestID, nil
+}
+
+// paymentSelect is the column list read by scanPayment
+const paymentSelect = `SELECT id, coalesce(reservation_id, 0), provider, provider_payment_id, amount,
+	refunded_amount, currency, status, created_at, updated_at FROM payments`
+
+// scanPayment reads a row selected with paymentSelect
+func scanPayment(row interface{ Scan(...interface{}) error }) (models.Payment, error) {
+	var p models.Payment
+	err := row.Scan(&p.ID, &p.ReservationID, &p.Provider, &p.ProviderPaymentID, &p.Amount,
+		&p.RefundedAmount, &p.Currency, &p.Status, &p.CreatedAt, &p.UpdatedAt)
+	return p, err
+}
+
+// InsertPayment records a payment taken for a reservation
+func (m *postgresDBRepo) InsertPayment(p models.Payment) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	stmt := `INSERT INTO payments (reservation_id, provider, provider_payment_id, amount, refunded_amount,
+			currency, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`
+
+	err := m.DB.QueryRowContext(ctx, stmt, p.ReservationID, p.Provider, p.ProviderPaymentID, p.Amount,
+		p.RefundedAmount, p.Currency, p.Status, time.Now(), time.Now()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// UpdatePayment saves the status and refunded amount of a payment
+func (m *postgresDBRepo) UpdatePayment(p models.Payment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE payments SET status = $1, refunded_amount = $2, updated_at = $3 WHERE id = $4`
+
+	_, err := m.DB.ExecContext(ctx, stmt, p.Status, p.RefundedAmount, time.Now(), p.ID)
+	return err
+}
+
+// GetPaymentsForReservation returns the payments taken for a reservation, oldest first
+func (m *postgresDBRepo) GetPaymentsForReservation(reservationID int) ([]models.Payment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var payments []models.Payment
+
+	rows, err := m.DB.QueryContext(ctx, paymentSelect+` WHERE reservation_id = $1 ORDER BY created_at, id`, reservationID)
+	if err != nil {
+		return payments, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanPayment(rows)
+		if err != nil {
+			return payments, err
+		}
+		payments = append(payments, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return payments, err
+	}
+
+	return payments, nil
+}
+
+// GetPaymentByProviderID returns the payment a provider knows by providerPaymentID
+func (m *postgresDBRepo) GetPaymentByProviderID(provider, providerPaymentID string) (models.Payment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	row := m.DB.QueryRowContext(ctx, paymentSelect+` WHERE provider = $1 AND provider_payment_id = $2`, provider, providerPaymentID)
+	return scanPayment(row)
+}
+
+// CreateInvoice issues an invoice, giving it the next number in its property's sequence for
+// the year it is issued in at the property. A reservation has one invoice: if another request
+// issued it first, that invoice is returned and no number is used up.
+func (m *postgresDBRepo) CreateInvoice(inv models.Invoice) (models.Invoice, error) {
+	property, err := m.GetPropertyByID(inv.PropertyID)
+	if err != nil {
+		return inv, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if inv.IssuedAt.IsZero() {
+		inv.IssuedAt = time.Now()
+	}
+	inv.Year = inv.IssuedAt.In(property.Location()).Year()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return inv, err
+	}
+	defer tx.Rollback()
+
+	stmt := `INSERT INTO invoice_sequences (property_id, year, last_number, created_at, updated_at)
+		VALUES ($1, $2, 1, $3, $3)
+		ON CONFLICT (property_id, year)
+		DO UPDATE SET last_number = invoice_sequences.last_number + 1, updated_at = $3
+		RETURNING last_number`
+
+	err = tx.QueryRowContext(ctx, stmt, inv.PropertyID, inv.Year, time.Now()).Scan(&inv.Sequence)
+	if err != nil {
+		return inv, err
+	}
+
+	stmt = `INSERT INTO invoices (reservation_id, property_id, year, sequence, currency, bill_to_name,
+			bill_to_email, issued_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (reservation_id) DO NOTHING
+		RETURNING id, created_at, updated_at`
+
+	err = tx.QueryRowContext(ctx, stmt, inv.ReservationID, inv.PropertyID, inv.Year, inv.Sequence,
+		inv.Currency, inv.BillToName, inv.BillToEmail, inv.IssuedAt, time.Now(), time.Now()).
+		Scan(&inv.ID, &inv.CreatedAt, &inv.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		return m.GetInvoiceByReservationID(inv.ReservationID)
+	}
+	if err != nil {
+		return inv, err
+	}
+
+	stmt = `INSERT INTO invoice_lines (invoice_id, kind, description, quantity, unit_amount, amount,
+			created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+
+	for i := range inv.Lines {
+		l := &inv.Lines[i]
+		l.InvoiceID = inv.ID
+		err = tx.QueryRowContext(ctx, stmt, l.InvoiceID, l.Kind, l.Description, l.Quantity, l.UnitAmount,
+			l.Amount, time.Now(), time.Now()).Scan(&l.ID)
+		if err != nil {
+			return inv, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return inv, err
+	}
+
+	return inv, nil
+}
+
+// GetInvoiceByReservationID returns the invoice issued for a reservation with its lines
+func (m *postgresDBRepo) GetInvoiceByReservationID(reservationID int) (models.Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var inv models.Invoice
+
+	query := `SELECT id, coalesce(reservation_id, 0), property_id, year, sequence, currency, bill_to_name,
+			bill_to_email, issued_at, created_at, updated_at
+		FROM invoices WHERE reservation_id = $1`
+
+	err := m.DB.QueryRowContext(ctx, query, reservationID).Scan(&inv.ID, &inv.ReservationID, &inv.PropertyID,
+		&inv.Year, &inv.Sequence, &inv.Currency, &inv.BillToName, &inv.BillToEmail, &inv.IssuedAt,
+		&inv.CreatedAt, &inv.UpdatedAt)
+	if err != nil {
+		return inv, err
+	}
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, invoice_id, kind, description, quantity, unit_amount, amount
+		FROM invoice_lines WHERE invoice_id = $1 ORDER BY id`, inv.ID)
+	if err != nil {
+		return inv, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l models.InvoiceLine
+		err = rows.Scan(&l.ID, &l.InvoiceID, &l.Kind, &l.Description, &l.Quantity, &l.UnitAmount, &l.Amount)
+		if err != nil {
+			return inv, err
+		}
+		inv.Lines = append(inv.Lines, l)
+	}
+
+	if err = rows.Err(); err != nil {
+		return inv, err
+	}
+
+	return inv, nil
+}
+
+// AllChargeRules returns the tax and fee rules of a property, fees first, optionally only the
+// active ones
+func (m *postgresDBRepo) AllChargeRules(propertyID int, activeOnly bool) ([]models.ChargeRule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var rules []models.ChargeRule
+
+	query := `SELECT id, property_id, name, kind, basis, per, amount, active, created_at, updated_at
+		FROM charge_rules WHERE property_id = $1 AND (active OR NOT $2) ORDER BY kind, id`
+
+	rows, err := m.DB.QueryContext(ctx, query, propertyID, activeOnly)
+	if err != nil {
+		return rules, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c models.ChargeRule
+		err := rows.Scan(&c.ID, &c.PropertyID, &c.Name, &c.Kind, &c.Basis, &c.Per, &c.Amount, &c.Active, &c.CreatedAt, &c.UpdatedAt)
+		if err != nil {
+			return rules, err
+		}
+		rules = append(rules, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return rules, err
+	}
+
+	return rules, nil
+}
+
+// GetChargeRuleByID returns a tax or fee rule
+func (m *postgresDBRepo) GetChargeRuleByID(id int) (models.ChargeRule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var c models.ChargeRule
+
+	query := `SELECT id, property_id, name, kind, basis, per, amount, active, created_at, updated_at
+		FROM charge_rules WHERE id = $1`
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&c.ID, &c.PropertyID, &c.Name, &c.Kind, &c.Basis, &c.Per, &c.Amount,
+		&c.Active, &c.CreatedAt, &c.UpdatedAt)
+	return c, err
+}
+
+// InsertChargeRule adds a tax or fee rule
+func (m *postgresDBRepo) InsertChargeRule(c models.ChargeRule) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	stmt := `INSERT INTO charge_rules (property_id, name, kind, basis, per, amount, active, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`
+
+	err := m.DB.QueryRowContext(ctx, stmt, c.PropertyID, c.Name, c.Kind, c.Basis, c.Per, c.Amount, c.Active,
+		time.Now(), time.Now()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// SetChargeRuleActive turns a tax or fee rule on or off for new bookings
+func (m *postgresDBRepo) SetChargeRuleActive(id int, active bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `UPDATE charge_rules SET active = $1, updated_at = $2 WHERE id = $3`,
+		active, time.Now(), id)
+	return err
+}
+
+// promoCodeSelect is the column list read by scanPromoCode
+const promoCodeSelect = `SELECT id, property_id, code, description, percent_off, amount_off, valid_from, valid_until,
+	max_uses, uses, active, created_at, updated_at FROM promo_codes`
+
+// scanPromoCode reads a row selected with promoCodeSelect
+func scanPromoCode(row interface{ Scan(...interface{}) error }) (models.PromoCode, error) {
+	var p models.PromoCode
+
+	// a null end of the validity window scans as the zero Date
+	err := row.Scan(&p.ID, &p.PropertyID, &p.Code, &p.Description, &p.PercentOff, &p.AmountOff, &p.ValidFrom, &p.ValidUntil,
+		&p.MaxUses, &p.Uses, &p.Active, &p.CreatedAt, &p.UpdatedAt)
+	return p, err
+}
+
+// promoCodeRooms returns the rooms a promo code is limited to
+func (m *postgresDBRepo) promoCodeRooms(ctx context.Context, promoCodeID int) ([]int, error) {
+	var roomIDs []int
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT room_id FROM promo_code_rooms WHERE promo_code_id = $1 ORDER BY room_id`, promoCodeID)
+	if err != nil {
+		return roomIDs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return roomIDs, err
+		}
+		roomIDs = append(roomIDs, id)
+	}
+
+	return roomIDs, rows.Err()
+}
+
+// AllPromoCodes returns the promo codes of a property with the rooms they are limited to,
+// newest first
+func (m *postgresDBRepo) AllPromoCodes(propertyID int) ([]models.PromoCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var codes []models.PromoCode
+
+	rows, err := m.DB.QueryContext(ctx, promoCodeSelect+` WHERE property_id = $1 ORDER BY id DESC`, propertyID)
+	if err != nil {
+		return codes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanPromoCode(rows)
+		if err != nil {
+			return codes, err
+		}
+		codes = append(codes, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return codes, err
+	}
+
+	for i := range codes {
+		codes[i].RoomIDs, err = m.promoCodeRooms(ctx, codes[i].ID)
+		if err != nil {
+			return codes, err
+		}
+	}
+
+	return codes, nil
+}
+
+// GetPromoCodeByCode returns the promo code of a property a guest typed, with the rooms it is
+// limited to
+func (m *postgresDBRepo) GetPromoCodeByCode(propertyID int, code string) (models.PromoCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	p, err := scanPromoCode(m.DB.QueryRowContext(ctx, promoCodeSelect+` WHERE property_id = $1 AND code = $2`,
+		propertyID, models.NormalizePromoCode(code)))
+	if err != nil {
+		return p, err
+	}
+
+	p.RoomIDs, err = m.promoCodeRooms(ctx, p.ID)
+	return p, err
+}
+
+// GetPromoCodeByID returns a promo code with the rooms it is limited to
+func (m *postgresDBRepo) GetPromoCodeByID(id int) (models.PromoCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	p, err := scanPromoCode(m.DB.QueryRowContext(ctx, promoCodeSelect+` WHERE id = $1`, id))
+	if err != nil {
+		return p, err
+	}
+
+	p.RoomIDs, err = m.promoCodeRooms(ctx, p.ID)
+	return p, err
+}
+
+// InsertPromoCode adds a promo code and the rooms it is limited to
+func (m *postgresDBRepo) InsertPromoCode(p models.PromoCode) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	stmt := `INSERT INTO promo_codes (property_id, code, description, percent_off, amount_off, valid_from, valid_until,
+			max_uses, uses, active, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 0, $9, $10, $11) RETURNING id`
+
+	err = tx.QueryRowContext(ctx, stmt, p.PropertyID, models.NormalizePromoCode(p.Code), p.Description, p.PercentOff, p.AmountOff,
+		p.ValidFrom, p.ValidUntil, p.MaxUses, p.Active, time.Now(), time.Now()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, roomID := range p.RoomIDs {
+		_, err = tx.ExecContext(ctx, `INSERT INTO promo_code_rooms (promo_code_id, room_id, created_at, updated_at)
+			VALUES ($1, $2, $3, $4)`, id, roomID, time.Now(), time.Now())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// SetPromoCodeActive turns a promo code on or off
+func (m *postgresDBRepo) SetPromoCodeActive(id int, active bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `UPDATE promo_codes SET active = $1, updated_at = $2 WHERE id = $3`,
+		active, time.Now(), id)
+	return err
+}
+
+// GetReservationCharges returns the price of a reservation line by line as it was booked
+func (m *postgresDBRepo) GetReservationCharges(reservationID int) ([]models.Charge, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var charges []models.Charge
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT kind, description, quantity, unit_amount, amount
+		FROM reservation_charges WHERE reservation_id = $1 ORDER BY id`, reservationID)
+	if err != nil {
+		return charges, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c models.Charge
+		if err := rows.Scan(&c.Kind, &c.Description, &c.Quantity, &c.UnitAmount, &c.Amount); err != nil {
+			return charges, err
+		}
+		charges = append(charges, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return charges, err
+	}
+
+	return charges, nil
+}
+
+const propertySelect = `SELECT id, name, slug, hostname, currency, timezone, notify_email, brand_color, logo_url,
+	created_at, updated_at FROM properties`
+
+// scanProperty reads a property selected with propertySelect
+func scanProperty(row interface{ Scan(...interface{}) error }) (models.Property, error) {
+	var p models.Property
+	err := row.Scan(&p.ID, &p.Name, &p.Slug, &p.Hostname, &p.Currency, &p.Timezone, &p.NotifyEmail,
+		&p.BrandColor, &p.LogoURL, &p.CreatedAt, &p.UpdatedAt)
+	return p, err
+}
+
+// queryProperties returns the properties selected by query, which starts with propertySelect
+func (m *postgresDBRepo) queryProperties(query string, args ...interface{}) ([]models.Property, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var properties []models.Property
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return properties, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanProperty(rows)
+		if err != nil {
+			return properties, err
+		}
+		properties = append(properties, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return properties, err
+	}
+
+	return properties, nil
+}
+
+// AllProperties returns every property, oldest first
+func (m *postgresDBRepo) AllProperties() ([]models.Property, error) {
+	return m.queryProperties(propertySelect + ` ORDER BY id`)
+}
+
+// GetPropertyByID returns a property by id
+func (m *postgresDBRepo) GetPropertyByID(id int) (models.Property, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanProperty(m.DB.QueryRowContext(ctx, propertySelect+` WHERE id = $1`, id))
+}
+
+// GetPropertyBySlug returns the property with the path prefix slug
+func (m *postgresDBRepo) GetPropertyBySlug(slug string) (models.Property, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanProperty(m.DB.QueryRowContext(ctx, propertySelect+` WHERE slug = $1`, strings.ToLower(slug)))
+}
+
+// GetPropertyByHostname returns the property served on host
+func (m *postgresDBRepo) GetPropertyByHostname(host string) (models.Property, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	host = models.NormalizeHostname(host)
+	if host == "" {
+		return models.Property{}, sql.ErrNoRows
+	}
+
+	return scanProperty(m.DB.QueryRowContext(ctx, propertySelect+` WHERE hostname = $1`, host))
+}
+
+// PropertiesForUser returns the properties a staff member has access to, oldest first
+func (m *postgresDBRepo) PropertiesForUser(userID int) ([]models.Property, error) {
+	return m.queryProperties(propertySelect+` WHERE id IN
+		(SELECT property_id FROM property_users WHERE user_id = $1) ORDER BY id`, userID)
+}
+
+// propertyTaken reports whether a property other than p already uses p's slug or hostname
+func propertyTaken(ctx context.Context, tx *sql.Tx, p models.Property) (bool, error) {
+	var n int
+	err := tx.QueryRowContext(ctx, `SELECT count(id) FROM properties
+		WHERE id <> $1 AND (slug = $2 OR ($3 <> '' AND hostname = $3))`,
+		p.ID, p.Slug, p.Hostname).Scan(&n)
+	return n > 0, err
+}
+
+// InsertProperty adds a property and gives the staff member who created it access to it
+func (m *postgresDBRepo) InsertProperty(p models.Property, userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	p.Slug = strings.ToLower(p.Slug)
+	p.Hostname = models.NormalizeHostname(p.Hostname)
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	taken, err := propertyTaken(ctx, tx, p)
+	if err != nil {
+		return 0, err
+	}
+	if taken {
+		return 0, repository.ErrPropertyExists
+	}
+
+	var id int
+	stmt := `INSERT INTO properties (name, slug, hostname, currency, timezone, notify_email, brand_color, logo_url,
+			created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`
+
+	err = tx.QueryRowContext(ctx, stmt, p.Name, p.Slug, p.Hostname, p.Currency, p.Timezone, p.NotifyEmail,
+		p.BrandColor, p.LogoURL, time.Now(), time.Now()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO property_users (property_id, user_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4)`, id, userID, time.Now(), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// UpdateProperty saves a property's settings
+func (m *postgresDBRepo) UpdateProperty(p models.Property) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	p.Slug = strings.ToLower(p.Slug)
+	p.Hostname = models.NormalizeHostname(p.Hostname)
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	taken, err := propertyTaken(ctx, tx, p)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return repository.ErrPropertyExists
+	}
+
+	stmt := `UPDATE properties SET name = $1, slug = $2, hostname = $3, currency = $4, timezone = $5,
+			notify_email = $6, brand_color = $7, logo_url = $8, updated_at = $9
+		WHERE id = $10`
+
+	_, err = tx.ExecContext(ctx, stmt, p.Name, p.Slug, p.Hostname, p.Currency, p.Timezone, p.NotifyEmail,
+		p.BrandColor, p.LogoURL, time.Now(), p.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AllStaff returns every staff user, by name
+func (m *postgresDBRepo) AllStaff() ([]models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var users []models.User
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT id, first_name, last_name, email, access_level, two_factor_enabled_at, created_at, updated_at
+		FROM users ORDER BY last_name, first_name`)
+	if err != nil {
+		return users, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u models.User
+		var twoFactorEnabledAt sql.NullTime
+		if err := rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.AccessLevel, &twoFactorEnabledAt, &u.CreatedAt, &u.UpdatedAt); err != nil {
+			return users, err
+		}
+		u.TwoFactorEnabledAt = twoFactorEnabledAt.Time
+		users = append(users, u)
+	}
+
+	if err = rows.Err(); err != nil {
+		return users, err
+	}
+
+	return users, nil
+}
+
+// GetPropertyStaffIDs returns the ids of the staff users with access to a property
+func (m *postgresDBRepo) GetPropertyStaffIDs(propertyID int) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var ids []int
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT user_id FROM property_users WHERE property_id = $1 ORDER BY user_id`,
+		propertyID)
+	if err != nil {
+		return ids, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err = rows.Err(); err != nil {
+		return ids, err
+	}
+
+	return ids, nil
+}
+
+// SetPropertyStaff replaces the staff users with access to a property
+func (m *postgresDBRepo) SetPropertyStaff(propertyID int, userIDs []int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM property_users WHERE property_id = $1`, propertyID)
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		_, err = tx.ExecContext(ctx, `INSERT INTO property_users (property_id, user_id, created_at, updated_at)
+			VALUES ($1, $2, $3, $4) ON CONFLICT (property_id, user_id) DO NOTHING`,
+			propertyID, userID, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+const waitlistSelect = `SELECT w.id, w.property_id, coalesce(w.room_id, 0), coalesce(r.room_name, ''),
+	w.start_date, w.end_date, w.first_name, w.last_name, w.email, w.phone, w.status,
+	coalesce(w.offered_room_id, 0), coalesce(o.room_name, ''), w.offer_expires_at, w.created_at, w.updated_at
+	FROM waitlist_entries w
+	LEFT JOIN rooms r ON r.id = w.room_id
+	LEFT JOIN rooms o ON o.id = w.offered_room_id`
+
+// scanWaitlistEntry reads a row selected with waitlistSelect
+func scanWaitlistEntry(row interface{ Scan(...interface{}) error }) (models.WaitlistEntry, error) {
+	var e models.WaitlistEntry
+	var offerExpiresAt sql.NullTime
+
+	err := row.Scan(&e.ID, &e.PropertyID, &e.RoomID, &e.Room.RoomName,
+		&e.StartDate, &e.EndDate, &e.FirstName, &e.LastName, &e.Email, &e.Phone, &e.Status,
+		&e.OfferedRoomID, &e.OfferedRoom.RoomName, &offerExpiresAt, &e.CreatedAt, &e.UpdatedAt)
+	e.Room.ID = e.RoomID
+	e.OfferedRoom.ID = e.OfferedRoomID
+	e.OfferExpiresAt = offerExpiresAt.Time
+	return e, err
+}
+
+// InsertWaitlistEntry puts a guest on the waitlist
+func (m *postgresDBRepo) InsertWaitlistEntry(e models.WaitlistEntry) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO waitlist_entries (property_id, room_id, start_date, end_date, first_name, last_name,
+			email, phone, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, stmt, e.PropertyID, sql.NullInt64{Int64: int64(e.RoomID), Valid: e.RoomID > 0},
+		e.StartDate, e.EndDate, e.FirstName, e.LastName, strings.TrimSpace(e.Email), e.Phone, models.WaitlistWaiting,
+		time.Now(), time.Now()).Scan(&id)
+	return id, err
+}
+
+// GetWaitlistEntryByID returns a waitlist entry
+func (m *postgresDBRepo) GetWaitlistEntryByID(id int) (models.WaitlistEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanWaitlistEntry(m.DB.QueryRowContext(ctx, waitlistSelect+` WHERE w.id = $1`, id))
+}
+
+// GetWaitlistEntryByToken returns the waitlist entry an offer link was sent to
+func (m *postgresDBRepo) GetWaitlistEntryByToken(tokenHash string) (models.WaitlistEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanWaitlistEntry(m.DB.QueryRowContext(ctx, waitlistSelect+` WHERE w.token_hash = $1`, tokenHash))
+}
+
+// AllWaitlistEntries returns the waitlist of a property in the order guests joined it
+func (m *postgresDBRepo) AllWaitlistEntries(propertyID int) ([]models.WaitlistEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var entries []models.WaitlistEntry
+
+	rows, err := m.DB.QueryContext(ctx, waitlistSelect+` WHERE w.property_id = $1 ORDER BY w.created_at, w.id`, propertyID)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanWaitlistEntry(rows)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return entries, err
+	}
+
+	return entries, nil
+}
+
+// OfferWaitlistEntry records that a guest has been sent a link to book roomID until expiresAt
+func (m *postgresDBRepo) OfferWaitlistEntry(id, roomID int, tokenHash string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE waitlist_entries SET status = $1, offered_room_id = $2, token_hash = $3, offer_expires_at = $4,
+		updated_at = $5 WHERE id = $6`
+
+	_, err := m.DB.ExecContext(ctx, stmt, models.WaitlistOffered, roomID, tokenHash, expiresAt, time.Now(), id)
+	return err
+}
+
+// UpdateWaitlistStatus moves a waitlist entry to status. Any offer link stops working unless the
+// entry is still on offer.
+func (m *postgresDBRepo) UpdateWaitlistStatus(id int, status models.WaitlistStatus) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE waitlist_entries SET status = $1, updated_at = $2,
+		token_hash = CASE WHEN $1 = 'offered' THEN token_hash END WHERE id = $3`
+
+	_, err := m.DB.ExecContext(ctx, stmt, status, time.Now(), id)
+	return err
+}
+
+// ExpireWaitlistOffers marks the offers that ran out before now as expired and returns them
+func (m *postgresDBRepo) ExpireWaitlistOffers(now time.Time) ([]models.WaitlistEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var entries []models.WaitlistEntry
+
+	stmt := `UPDATE waitlist_entries SET status = $1, token_hash = NULL, updated_at = $2
+		WHERE status = $3 AND offer_expires_at <= $2
+		RETURNING id, property_id, coalesce(room_id, 0), start_date, end_date, email, coalesce(offered_room_id, 0)`
+
+	rows, err := m.DB.QueryContext(ctx, stmt, models.WaitlistExpired, now, models.WaitlistOffered)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := models.WaitlistEntry{Status: models.WaitlistExpired}
+		err := rows.Scan(&e.ID, &e.PropertyID, &e.RoomID, &e.StartDate, &e.EndDate, &e.Email, &e.OfferedRoomID)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return entries, err
+	}
+
+	return entries, nil
+}
+
+// InsertRoomHold holds a room for a stay until the hold's ExpiresAt, returning
+// repository.ErrRoomUnavailable when the room is booked, blocked or held by another guest for
+// any of its nights
+func (m *postgresDBRepo) InsertRoomHold(hold models.RoomHold) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// lock the room so two guests can't both pass the availability check
+	var roomID int
+	err = tx.QueryRowContext(ctx, `SELECT id FROM rooms WHERE id = $1 FOR UPDATE`, hold.RoomID).Scan(&roomID)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `select (select count(rr.id) from room_restrictions rr
+		left join restrictions res on (res.id = rr.restriction_id)
+		where rr.room_id = $3 and (` + unavailableWhere + `))
+		+ (select count(h.id) from room_holds h where h.room_id = $3 and ` + heldWhere + `)`
+	var numRows int
+	err = tx.QueryRowContext(ctx, query, hold.StartDate, hold.EndDate, hold.RoomID).Scan(&numRows)
+	if err != nil {
+		return 0, err
+	}
+	if numRows > 0 {
+		return 0, repository.ErrRoomUnavailable
+	}
+
+	var newID int
+	stmt := `INSERT INTO room_holds (room_id, start_date, end_date, expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+	err = tx.QueryRowContext(ctx, stmt, hold.RoomID, hold.StartDate, hold.EndDate, hold.ExpiresAt, time.Now(), time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, tx.Commit()
+}
+
+// GetRoomHoldByID returns a hold by its ID, whether or not it has run out
+func (m *postgresDBRepo) GetRoomHoldByID(id int) (models.RoomHold, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var hold models.RoomHold
+	query := `SELECT id, room_id, start_date, end_date, expires_at, created_at, updated_at FROM room_holds WHERE id = $1`
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&hold.ID, &hold.RoomID, &hold.StartDate, &hold.EndDate,
+		&hold.ExpiresAt, &hold.CreatedAt, &hold.UpdatedAt)
+	if err != nil {
+		return hold, err
+	}
+
+	return hold, nil
+}
+
+// DeleteRoomHold releases a hold
+func (m *postgresDBRepo) DeleteRoomHold(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM room_holds WHERE id = $1`, id)
+	return err
+}
+
+// DeleteExpiredRoomHolds removes the holds that ran out before the given time and returns how
+// many were removed
+func (m *postgresDBRepo) DeleteExpiredRoomHolds(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM room_holds WHERE expires_at <= $1`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// CancelUnpaidReservations cancels the pending reservations whose deposit was due before the
+// given time and hasn't been paid, releasing their rooms. It returns the reservations it cancelled.
+func (m *postgresDBRepo) CancelUnpaidReservations(before time.Time) ([]models.Reservation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// a payment that has been authorized is being completed, so its reservation is left alone
+	query := `UPDATE reservations r SET status = $1, cancelled_at = $2, updated_at = $2
+		WHERE r.status = $3 AND r.payment_due_at <= $4 AND r.deleted_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM payments p WHERE p.reservation_id = r.id AND p.status <> $5 AND p.status <> $6)
+		RETURNING r.id`
+
+	rows, err := tx.QueryContext(ctx, query, models.StatusCancelled, time.Now(), models.StatusPending, before,
+		models.PaymentFailed, models.PaymentCancelled)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		_, err = tx.ExecContext(ctx, `DELETE FROM room_restrictions WHERE reservation_id = $1`, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	var cancelled []models.Reservation
+	for _, id := range ids {
+		res, err := m.GetReservationByID(id)
+		if err != nil {
+			return cancelled, err
+		}
+		cancelled = append(cancelled, res)
+	}
+	return cancelled, nil
+}
+
+const channelSelect = `SELECT id, property_id, name, kind, base_url, api_key, active, last_pulled_at,
+	created_at, updated_at FROM channels`
+
+// scanChannel reads a channel selected with channelSelect
+func scanChannel(row interface{ Scan(...interface{}) error }) (models.Channel, error) {
+	var c models.Channel
+	var lastPulledAt sql.NullTime
+	err := row.Scan(&c.ID, &c.PropertyID, &c.Name, &c.Kind, &c.BaseURL, &c.APIKey, &c.Active, &lastPulledAt,
+		&c.CreatedAt, &c.UpdatedAt)
+	c.LastPulledAt = lastPulledAt.Time
+	return c, err
+}
+
+// channelRooms returns the rooms mapped on a channel, by room ID
+func (m *postgresDBRepo) channelRooms(ctx context.Context, channelID int) (map[int]string, error) {
+	rooms := make(map[int]string)
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT room_id, external_room_id FROM channel_rooms WHERE channel_id = $1`, channelID)
+	if err != nil {
+		return rooms, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var roomID int
+		var externalID string
+		if err := rows.Scan(&roomID, &externalID); err != nil {
+			return rooms, err
+		}
+		rooms[roomID] = externalID
+	}
+
+	return rooms, rows.Err()
+}
+
+// AllChannels returns the channels of a property with their rooms, by name
+func (m *postgresDBRepo) AllChannels(propertyID int) ([]models.Channel, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var channels []models.Channel
+
+	rows, err := m.DB.QueryContext(ctx, channelSelect+` WHERE property_id = $1 ORDER BY name, id`, propertyID)
+	if err != nil {
+		return channels, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c, err := scanChannel(rows)
+		if err != nil {
+			return channels, err
+		}
+		channels = append(channels, c)
+	}
+	if err = rows.Err(); err != nil {
+		return channels, err
+	}
+
+	for i := range channels {
+		channels[i].Rooms, err = m.channelRooms(ctx, channels[i].ID)
+		if err != nil {
+			return channels, err
+		}
+	}
+
+	return channels, nil
+}
+
+// GetChannelByID returns a channel with its rooms
+func (m *postgresDBRepo) GetChannelByID(id int) (models.Channel, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	c, err := scanChannel(m.DB.QueryRowContext(ctx, channelSelect+` WHERE id = $1`, id))
+	if err != nil {
+		return c, err
+	}
+
+	c.Rooms, err = m.channelRooms(ctx, id)
+	return c, err
+}
+
+// saveChannelRooms replaces the rooms mapped on a channel with c.Rooms, leaving out rooms with
+// no channel ID
+func saveChannelRooms(ctx context.Context, tx *sql.Tx, c models.Channel) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM channel_rooms WHERE channel_id = $1`, c.ID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `INSERT INTO channel_rooms (channel_id, room_id, external_room_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5)`
+	for roomID, externalID := range c.Rooms {
+		if externalID == "" {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, stmt, c.ID, roomID, externalID, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InsertChannel adds a channel and the rooms sold on it
+func (m *postgresDBRepo) InsertChannel(c models.Channel) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `INSERT INTO channels (property_id, name, kind, base_url, api_key, active, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+	err = tx.QueryRowContext(ctx, stmt, c.PropertyID, c.Name, c.Kind, c.BaseURL, c.APIKey, c.Active,
+		time.Now(), time.Now()).Scan(&c.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = saveChannelRooms(ctx, tx, c); err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return c.ID, nil
+}
+
+// UpdateChannel saves a channel's settings and the rooms sold on it. An empty APIKey keeps the
+// key already saved.
+func (m *postgresDBRepo) UpdateChannel(c models.Channel) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `UPDATE channels SET name = $1, kind = $2, base_url = $3,
+			api_key = CASE WHEN $4 = '' THEN api_key ELSE $4 END, active = $5, updated_at = $6
+		WHERE id = $7`
+	_, err = tx.ExecContext(ctx, stmt, c.Name, c.Kind, c.BaseURL, c.APIKey, c.Active, time.Now(), c.ID)
+	if err != nil {
+		return err
+	}
+
+	if err = saveChannelRooms(ctx, tx, c); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetChannelPulledAt records when a channel's bookings were last pulled in full
+func (m *postgresDBRepo) SetChannelPulledAt(id int, at time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `UPDATE channels SET last_pulled_at = $1 WHERE id = $2`, at, id)
+	return err
+}
+
+// GetChannelBooking returns what was done with a booking from a channel
+func (m *postgresDBRepo) GetChannelBooking(channelID int, externalID string) (models.ChannelBooking, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var b models.ChannelBooking
+	query := `SELECT id, channel_id, external_id, coalesce(reservation_id, 0), status, created_at, updated_at
+		FROM channel_bookings WHERE channel_id = $1 AND external_id = $2`
+	err := m.DB.QueryRowContext(ctx, query, channelID, externalID).Scan(&b.ID, &b.ChannelID, &b.ExternalID,
+		&b.ReservationID, &b.Status, &b.CreatedAt, &b.UpdatedAt)
+	return b, err
+}
+
+// ImportChannelReservation books res for a booking made on a channel, confirmed and with the
+// room taken, in a single transaction. It returns repository.ErrChannelBookingExists when the
+// booking has already been imported and repository.ErrRoomUnavailable when the room is taken
+// for any of its nights.
+func (m *postgresDBRepo) ImportChannelReservation(channelID int, externalID string, res models.Reservation) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// claim the booking first, so two syncs running at once can't both import it
+	var bookingID int
+	stmt := `INSERT INTO channel_bookings (channel_id, external_id, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (channel_id, external_id) DO NOTHING RETURNING id`
+	err = tx.QueryRowContext(ctx, stmt, channelID, externalID, models.ChannelBookingImported, time.Now(), time.Now()).Scan(&bookingID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, repository.ErrChannelBookingExists
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// lock the room so a guest booking on the site can't take it at the same time
+	var roomID int
+	err = tx.QueryRowContext(ctx, `SELECT id FROM rooms WHERE id = $1 FOR UPDATE`, res.RoomID).Scan(&roomID)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `select (select count(rr.id) from room_restrictions rr
+		left join restrictions res on (res.id = rr.restriction_id)
+		where rr.room_id = $3 and (` + unavailableWhere + `))
+		+ (select count(h.id) from room_holds h where h.room_id = $3 and ` + heldWhere + `)`
+	var numRows int
+	err = tx.QueryRowContext(ctx, query, res.StartDate, res.EndDate, res.RoomID).Scan(&numRows)
+	if err != nil {
+		return 0, err
+	}
+	if numRows > 0 {
+		return 0, repository.ErrRoomUnavailable
+	}
+
+	newID, err := insertReservation(ctx, tx, res)
+	if err != nil {
+		return 0, err
+	}
+
+	// the channel has already taken the booking, so it is confirmed straight away
+	_, err = tx.ExecContext(ctx, `UPDATE reservations SET status = $1, confirmed_at = $2 WHERE id = $3`,
+		models.StatusConfirmed, time.Now(), newID)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `INSERT INTO room_restrictions (start_date, end_date, room_id, reservation_id, restriction_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err = tx.ExecContext(ctx, stmt, res.StartDate, res.EndDate, res.RoomID, newID, models.RestrictionReservation,
+		time.Now(), time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE channel_bookings SET reservation_id = $1 WHERE id = $2`, newID, bookingID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// SaveChannelBooking records what was done with a booking from a channel, replacing what was
+// recorded for it before
+func (m *postgresDBRepo) SaveChannelBooking(b models.ChannelBooking) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO channel_bookings (channel_id, external_id, reservation_id, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (channel_id, external_id) DO UPDATE
+		SET reservation_id = excluded.reservation_id, status = excluded.status, updated_at = excluded.updated_at`
+
+	_, err := m.DB.ExecContext(ctx, stmt, b.ChannelID, b.ExternalID,
+		sql.NullInt64{Int64: int64(b.ReservationID), Valid: b.ReservationID > 0}, b.Status, time.Now(), time.Now())
+	return err
+}
+
+// InsertChannelSyncLog adds an entry to a channel's sync log
+func (m *postgresDBRepo) InsertChannelSyncLog(l models.ChannelSyncLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO channel_sync_logs (channel_id, direction, status, external_id, message, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err := m.DB.ExecContext(ctx, stmt, l.ChannelID, l.Direction, l.Status, l.ExternalID, l.Message, time.Now(), time.Now())
+	return err
+}
+
+// GetChannelSyncLogs returns the latest entries of a channel's sync log, newest first
+func (m *postgresDBRepo) GetChannelSyncLogs(channelID, limit int) ([]models.ChannelSyncLog, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var logs []models.ChannelSyncLog
+
+	query := `SELECT id, channel_id, direction, status, external_id, message, created_at
+		FROM channel_sync_logs WHERE channel_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2`
+	rows, err := m.DB.QueryContext(ctx, query, channelID, limit)
+	if err != nil {
+		return logs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l models.ChannelSyncLog
+		err := rows.Scan(&l.ID, &l.ChannelID, &l.Direction, &l.Status, &l.ExternalID, &l.Message, &l.CreatedAt)
+		if err != nil {
+			return logs, err
+		}
+		logs = append(logs, l)
+	}
+
+	if err = rows.Err(); err != nil {
+		return logs, err
+	}
+
+	return logs, nil
+}
+
+// webhookEvents reads the events column of a webhook, where they are kept comma separated
+func webhookEvents(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// AllWebhooks returns the webhooks of a property
+func (m *postgresDBRepo) AllWebhooks(propertyID int) ([]models.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var webhooks []models.Webhook
+
+	query := `SELECT id, property_id, url, secret, events, active, created_at, updated_at
+		FROM webhooks WHERE property_id = $1 ORDER BY id`
+	rows, err := m.DB.QueryContext(ctx, query, propertyID)
+	if err != nil {
+		return webhooks, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var w models.Webhook
+		var events string
+		err := rows.Scan(&w.ID, &w.PropertyID, &w.URL, &w.Secret, &events, &w.Active, &w.CreatedAt, &w.UpdatedAt)
+		if err != nil {
+			return webhooks, err
+		}
+		w.Events = webhookEvents(events)
+		webhooks = append(webhooks, w)
+	}
+
+	if err = rows.Err(); err != nil {
+		return webhooks, err
+	}
+
+	return webhooks, nil
+}
+
+// GetWebhookByID returns a webhook
+func (m *postgresDBRepo) GetWebhookByID(id int) (models.Webhook, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var w models.Webhook
+	var events string
+
+	query := `SELECT id, property_id, url, secret, events, active, created_at, updated_at
+		FROM webhooks WHERE id = $1`
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&w.ID, &w.PropertyID, &w.URL, &w.Secret, &events,
+		&w.Active, &w.CreatedAt, &w.UpdatedAt)
+	if err != nil {
+		return w, err
+	}
+	w.Events = webhookEvents(events)
+
+	return w, nil
+}
+
+// InsertWebhook adds a webhook and returns its ID
+func (m *postgresDBRepo) InsertWebhook(w models.Webhook) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	stmt := `INSERT INTO webhooks (property_id, url, secret, events, active, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+	err := m.DB.QueryRowContext(ctx, stmt, w.PropertyID, w.URL, w.Secret, strings.Join(w.Events, ","), w.Active,
+		time.Now(), time.Now()).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// UpdateWebhook saves a webhook's settings. An empty Secret keeps the secret already saved.
+func (m *postgresDBRepo) UpdateWebhook(w models.Webhook) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE webhooks SET url = $1, secret = CASE WHEN $2 = '' THEN secret ELSE $2 END, events = $3,
+			active = $4, updated_at = $5
+		WHERE id = $6`
+	_, err := m.DB.ExecContext(ctx, stmt, w.URL, w.Secret, strings.Join(w.Events, ","), w.Active, time.Now(), w.ID)
+	return err
+}
+
+// DeleteWebhook removes a webhook and its delivery log
+func (m *postgresDBRepo) DeleteWebhook(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	return err
+}
+
+// InsertWebhookDeliveries queues an event for every active webhook of a property that is sent
+// it, returning how many were queued
+func (m *postgresDBRepo) InsertWebhookDeliveries(propertyID int, eventID, event, payload string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO webhook_deliveries (webhook_id, event_id, event, payload, status, next_attempt_at,
+			created_at, updated_at)
+		SELECT id, $2, $3, $4, $5, $6, $6, $6 FROM webhooks
+		WHERE property_id = $1 AND active AND $3 = ANY(string_to_array(events, ','))`
+	result, err := m.DB.ExecContext(ctx, stmt, propertyID, eventID, event, payload, models.DeliveryPending, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// ClaimWebhookDeliveries returns up to limit pending deliveries that are due, oldest first,
+// with their webhooks. Their next attempt is put back by lease, so other workers leave them
+// alone while they are sent, and they are tried again if the worker stops before saving them.
+func (m *postgresDBRepo) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var deliveries []models.WebhookDelivery
+
+	now := time.Now()
+	query := `WITH due AS (
+			SELECT d.id FROM webhook_deliveries d
+			WHERE d.status = $1 AND d.next_attempt_at <= $2
+			ORDER BY d.next_attempt_at, d.id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE webhook_deliveries d SET next_attempt_at = $4
+		FROM due, webhooks w
+		WHERE d.id = due.id AND w.id = d.webhook_id
+		RETURNING d.id, d.webhook_id, d.event_id, d.event, d.payload, d.status, d.attempts, d.response_code,
+			d.response, d.created_at, w.id, w.property_id, w.url, w.secret, w.active`
+	rows, err := m.DB.QueryContext(ctx, query, models.DeliveryPending, now, limit, now.Add(lease))
+	if err != nil {
+		return deliveries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d models.WebhookDelivery
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+			&d.ResponseCode, &d.Response, &d.CreatedAt,
+			&d.Webhook.ID, &d.Webhook.PropertyID, &d.Webhook.URL, &d.Webhook.Secret, &d.Webhook.Active)
+		if err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return deliveries, err
+	}
+
+	return deliveries, nil
+}
+
+// SaveWebhookAttempt records the outcome of an attempt to send a delivery
+func (m *postgresDBRepo) SaveWebhookAttempt(d models.WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var deliveredAt sql.NullTime
+	if !d.DeliveredAt.IsZero() {
+		deliveredAt = sql.NullTime{Time: d.DeliveredAt, Valid: true}
+	}
+
+	stmt := `UPDATE webhook_deliveries SET status = $1, attempts = $2, response_code = $3, response = $4,
+			next_attempt_at = $5, delivered_at = $6, updated_at = $7
+		WHERE id = $8`
+	_, err := m.DB.ExecContext(ctx, stmt, d.Status, d.Attempts, d.ResponseCode, d.Response, d.NextAttemptAt,
+		deliveredAt, time.Now(), d.ID)
+	return err
+}
+
+// webhookDeliveryColumns are the columns scanned by scanWebhookDelivery, for a query on
+// webhook_deliveries aliased d
+const webhookDeliveryColumns = `d.id, d.webhook_id, d.event_id, d.event, d.payload, d.status, d.attempts,
+	d.response_code, d.response, d.next_attempt_at, d.delivered_at, d.created_at, d.updated_at`
+
+// scanWebhookDelivery reads a row of webhookDeliveryColumns
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }) (models.WebhookDelivery, error) {
+	var d models.WebhookDelivery
+	var deliveredAt sql.NullTime
+
+	err := row.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.Event, &d.Payload, &d.Status, &d.Attempts,
+		&d.ResponseCode, &d.Response, &d.NextAttemptAt, &deliveredAt, &d.CreatedAt, &d.UpdatedAt)
+	if deliveredAt.Valid {
+		d.DeliveredAt = deliveredAt.Time
+	}
+	return d, err
+}
+
+// GetWebhookDeliveryByID returns a delivery with its webhook
+func (m *postgresDBRepo) GetWebhookDeliveryByID(id int) (models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries d WHERE d.id = $1`
+	d, err := scanWebhookDelivery(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return d, err
+	}
+
+	d.Webhook, err = m.GetWebhookByID(d.WebhookID)
+	return d, err
+}
+
+// GetWebhookDeliveries returns the latest deliveries to a webhook, newest first
+func (m *postgresDBRepo) GetWebhookDeliveries(webhookID, limit int) ([]models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var deliveries []models.WebhookDelivery
+
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries d
+		WHERE d.webhook_id = $1 ORDER BY d.created_at DESC, d.id DESC LIMIT $2`
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, limit)
+	if err != nil {
+		return deliveries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return deliveries, err
+	}
+
+	return deliveries, nil
+}
+
+// RedeliverWebhookDelivery queues a delivery's event to be sent to its webhook again, as a new
+// delivery due now, and returns the new delivery's ID. The event keeps its ID, so the webhook
+// can tell it has seen it before.
+func (m *postgresDBRepo) RedeliverWebhookDelivery(id int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var newID int
+	stmt := `INSERT INTO webhook_deliveries (webhook_id, event_id, event, payload, status, next_attempt_at,
+			created_at, updated_at)
+		SELECT webhook_id, event_id, event, payload, $2, $3, $3, $3 FROM webhook_deliveries WHERE id = $1
+		RETURNING id`
+	err := m.DB.QueryRowContext(ctx, stmt, id, models.DeliveryPending, time.Now()).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// insertRecoveryCodes replaces a user's recovery codes within tx
+func insertRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, codeHashes []string) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM user_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range codeHashes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO user_recovery_codes (user_id, code_hash, created_at, updated_at)
+			VALUES ($1, $2, $3, $4)`, userID, hash, time.Now(), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EnableTwoFactor turns on two-factor authentication for a user with the secret they confirmed
+// with a code from step, replacing their recovery codes
+func (m *postgresDBRepo) EnableTwoFactor(userID int, secret string, step int64, codeHashes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET totp_secret = $2, two_factor_enabled_at = $3, totp_last_step = $4,
+		updated_at = $3 WHERE id = $1`, userID, secret, time.Now(), step)
+	if err != nil {
+		return err
+	}
+
+	if err = insertRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DisableTwoFactor turns off two-factor authentication for a user and removes their recovery codes
+func (m *postgresDBRepo) DisableTwoFactor(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE users SET totp_secret = '', two_factor_enabled_at = NULL, totp_last_step = 0,
+		updated_at = $2 WHERE id = $1`, userID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if err = insertRecoveryCodes(ctx, tx, userID, nil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a user signed in with the code for step, returning false when a code
+// for that step or a later one has already been used, so a code can't be replayed
+func (m *postgresDBRepo) UseTOTPStep(userID int, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `UPDATE users SET totp_last_step = $2 WHERE id = $1 AND totp_last_step < $2`,
+		userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// UseRecoveryCode marks one of a user's recovery codes as used, returning false when the user has
+// no unused code with that hash
+func (m *postgresDBRepo) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `UPDATE user_recovery_codes SET used_at = $3, updated_at = $3
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`, userID, codeHash, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ReplaceRecoveryCodes gives a user a new set of recovery codes, so the old ones stop working
+func (m *postgresDBRepo) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = insertRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CountRecoveryCodes returns how many of a user's recovery codes haven't been used
+func (m *postgresDBRepo) CountRecoveryCodes(userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, `SELECT count(*) FROM user_recovery_codes WHERE user_id = $1 AND used_at IS NULL`,
+		userID).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// settingRequireTwoFactor is the settings row for SecuritySettings.RequireTwoFactor
+const settingRequireTwoFactor = "require_two_factor"
+
+// GetSecuritySettings returns the sign in rules, with settings that were never saved left off
+func (m *postgresDBRepo) GetSecuritySettings() (models.SecuritySettings, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var s models.SecuritySettings
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT name, value FROM settings WHERE name = $1`, settingRequireTwoFactor)
+	if err != nil {
+		return s, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return s, err
+		}
+		switch name {
+		case settingRequireTwoFactor:
+			s.RequireTwoFactor = value == "true"
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return s, err
+	}
+
+	return s, nil
+}
+
+// UpdateSecuritySettings saves the sign in rules
+func (m *postgresDBRepo) UpdateSecuritySettings(s models.SecuritySettings) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `INSERT INTO settings (name, value, created_at, updated_at) VALUES ($1, $2, $3, $3)
+		ON CONFLICT (name) DO UPDATE SET value = excluded.value, updated_at = excluded.updated_at`,
+		settingRequireTwoFactor, fmt.Sprint(s.RequireTwoFactor), time.Now())
+	return err
+}
+
+// GetUserByEmail returns the staff user with an email, ignoring case
+func (m *postgresDBRepo) GetUserByEmail(email string) (models.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var u models.User
+	err := m.DB.QueryRowContext(ctx, `SELECT id, first_name, last_name, email, access_level, created_at, updated_at
+		FROM users WHERE lower(email) = lower($1)`, email).
+		Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.AccessLevel, &u.CreatedAt, &u.UpdatedAt)
+	if err != nil {
+		return u, err
+	}
+
+	return u, nil
+}
+
+// InsertLoginAttempt records a staff sign in. A successful one clears the failed sign ins to
+// the account before it, so they no longer count towards a lockout.
+func (m *postgresDBRepo) InsertLoginAttempt(a models.LoginAttempt) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if a.Succeeded {
+		_, err = tx.ExecContext(ctx, `UPDATE login_attempts SET cleared = true, updated_at = $2
+			WHERE email = $1 AND NOT succeeded AND NOT cleared`, a.Email, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO login_attempts (email, ip_address, succeeded, cleared, created_at, updated_at)
+		VALUES ($1, $2, $3, $3, $4, $4)`, a.Email, a.IPAddress, a.Succeeded, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetLoginFailures counts the failed sign ins to an account since it last signed in, and those
+// from an address, within their windows before now
+func (m *postgresDBRepo) GetLoginFailures(email, ip string, now time.Time) (models.LoginFailures, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var f models.LoginFailures
+	var accountLast, ipLast sql.NullTime
+
+	err := m.DB.QueryRowContext(ctx, `SELECT count(*), max(created_at) FROM login_attempts
+		WHERE email = $1 AND NOT succeeded AND NOT cleared AND created_at > $2`,
+		email, now.Add(-models.LoginAccountWindow)).Scan(&f.Account, &accountLast)
+	if err != nil {
+		return f, err
+	}
+
+	err = m.DB.QueryRowContext(ctx, `SELECT count(*), max(created_at) FROM login_attempts
+		WHERE ip_address = $1 AND NOT succeeded AND created_at > $2`,
+		ip, now.Add(-models.LoginIPWindow)).Scan(&f.IP, &ipLast)
+	if err != nil {
+		return f, err
+	}
+
+	f.AccountLastAt = accountLast.Time
+	f.IPLastAt = ipLast.Time
+	return f, nil
+}
+
+// ClearLoginFailures unlocks an account by clearing its failed sign ins
+func (m *postgresDBRepo) ClearLoginFailures(email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `UPDATE login_attempts SET cleared = true, updated_at = $2
+		WHERE email = $1 AND NOT succeeded AND NOT cleared`, email, time.Now())
+	return err
+}
+
+// LockedAccounts returns the staff accounts that are locked at now, most recently locked first
+func (m *postgresDBRepo) LockedAccounts(now time.Time) ([]models.LockedAccount, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var accounts []models.LockedAccount
+
+	query := `
+		SELECT u.id, u.first_name, u.last_name, u.email, u.access_level, f.failures, f.last_at,
+			(SELECT la.ip_address FROM login_attempts la WHERE la.email = f.email AND NOT la.succeeded
+				ORDER BY la.created_at DESC LIMIT 1)
+		FROM (
+			SELECT email, count(*) AS failures, max(created_at) AS last_at FROM login_attempts
+			WHERE NOT succeeded AND NOT cleared AND created_at > $1
+			GROUP BY email HAVING count(*) >= $2
+		) f
+		JOIN users u ON lower(u.email) = f.email
+		WHERE f.last_at > $3
+		ORDER BY f.last_at DESC`
+
+	rows, err := m.DB.QueryContext(ctx, query, now.Add(-models.LoginAccountWindow), models.LoginLockoutAttempts,
+		now.Add(-models.LoginLockoutPeriod))
+	if err != nil {
+		return accounts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a models.LockedAccount
+		err := rows.Scan(&a.User.ID, &a.User.FirstName, &a.User.LastName, &a.User.Email, &a.User.AccessLevel,
+			&a.Failures, &a.LastAttemptAt, &a.IPAddress)
+		if err != nil {
+			return accounts, err
+		}
+		accounts = append(accounts, a)
+	}
+
+	if err = rows.Err(); err != nil {
+		return accounts, err
+	}
+
+	return accounts, nil
+}
+
+// UserSessions returns a staff user's sessions that haven't expired at now, most recently active
+// first, marking the one with currentToken
+func (m *postgresDBRepo) UserSessions(userID int, currentToken string, now time.Time) ([]models.Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var sessions []models.Session
+
+	query := `
+		SELECT id, user_id, token, ip_address, user_agent, created_at, updated_at, expiry
+		FROM sessions WHERE user_id = $1 AND expiry > $2
+		ORDER BY updated_at DESC`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, now)
+	if err != nil {
+		return sessions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s models.Session
+		var token string
+		err := rows.Scan(&s.ID, &s.UserID, &token, &s.IPAddress, &s.UserAgent, &s.CreatedAt, &s.LastActiveAt, &s.Expiry)
+		if err != nil {
+			return sessions, err
+		}
+		s.Current = token == currentToken
+		sessions = append(sessions, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return sessions, err
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession signs a staff user's session out, returning sql.ErrNoRows when the user has no
+// session with id
+func (m *postgresDBRepo) RevokeSession(userID, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM sessions WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RevokeUserSessions signs a staff user out everywhere and returns how many sessions were removed
+func (m *postgresDBRepo) RevokeUserSessions(userID int) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// DeleteExpiredSessions removes the sessions that expired before the given time and returns how
+// many were removed
+func (m *postgresDBRepo) DeleteExpiredSessions(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM sessions WHERE expiry <= $1`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
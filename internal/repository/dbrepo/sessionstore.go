@@ -0,0 +1,90 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/ashparshp/bookings/internal/models"
+)
+
+// SessionStore keeps sessions in the sessions table, so they survive restarts and are shared by
+// every instance of the site. It implements scs.CtxStore.
+type SessionStore struct {
+	DB *sql.DB
+	// Codec reads the session data to find the staff user it belongs to, and must be the codec the
+	// session manager encodes with
+	Codec scs.Codec
+}
+
+// NewSessionStore returns a store using conn, for a session manager with the default codec
+func NewSessionStore(conn *sql.DB) *SessionStore {
+	return &SessionStore{DB: conn, Codec: scs.GobCodec{}}
+}
+
+// FindCtx returns the data of the session with token, unless it has expired
+func (s *SessionStore) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var b []byte
+	err := s.DB.QueryRowContext(ctx, `SELECT data FROM sessions WHERE token = $1 AND expiry > $2`,
+		token, time.Now()).Scan(&b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+// CommitCtx saves the session with token, recording the staff user it belongs to
+func (s *SessionStore) CommitCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var userID sql.NullInt64
+	var ip, userAgent string
+	if _, values, err := s.Codec.Decode(b); err == nil {
+		var id int
+		id, ip, userAgent = models.SessionOwner(values)
+		userID = sql.NullInt64{Int64: int64(id), Valid: id != 0}
+	}
+
+	stmt := `
+		INSERT INTO sessions (token, data, expiry, user_id, ip_address, user_agent, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+		ON CONFLICT (token) DO UPDATE SET data = EXCLUDED.data, expiry = EXCLUDED.expiry,
+			user_id = EXCLUDED.user_id, ip_address = EXCLUDED.ip_address, user_agent = EXCLUDED.user_agent,
+			updated_at = EXCLUDED.updated_at`
+
+	_, err := s.DB.ExecContext(ctx, stmt, token, b, expiry, userID, ip, userAgent, time.Now())
+	return err
+}
+
+// DeleteCtx removes the session with token
+func (s *SessionStore) DeleteCtx(ctx context.Context, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM sessions WHERE token = $1`, token)
+	return err
+}
+
+// Find returns the data of the session with token, unless it has expired
+func (s *SessionStore) Find(token string) ([]byte, bool, error) {
+	return s.FindCtx(context.Background(), token)
+}
+
+// Commit saves the session with token
+func (s *SessionStore) Commit(token string, b []byte, expiry time.Time) error {
+	return s.CommitCtx(context.Background(), token, b, expiry)
+}
+
+// Delete removes the session with token
+func (s *SessionStore) Delete(token string) error {
+	return s.DeleteCtx(context.Background(), token)
+}
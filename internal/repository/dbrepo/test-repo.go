@@ -1,10 +1,16 @@
 package dbrepo
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/ashparshp/bookings/internal/models"
+	"github.com/ashparshp/bookings/internal/repository"
 )
 
 func (m *testDBRepo) AllUsers() bool {
@@ -17,34 +23,79 @@ func (m *testDBRepo) InsertReservation(res models.Reservation) (int, error) {
 }
 
 // InsertRoomRestriction inserts a room restriction into the database
-func (m *testDBRepo) InsertRoomRestriction(r models.RoomRestriction) error {
-	return nil
+func (m *testDBRepo) InsertRoomRestriction(r models.RoomRestriction) (int, error) {
+	return 1, nil
 }
 
 // SearchAvailabilityByDatesByRoomID returns true if there are available rooms for the given dates
-func (m *testDBRepo) SearchAvailabilityByDatesByRoomID(start, end time.Time, roomID int) (bool, error) {
-	return false, nil
+func (m *testDBRepo) SearchAvailabilityByDatesByRoomID(start, end models.Date, roomID int) (bool, error) {
+	return roomID == 1 && start.Year() == testFreeYear, nil
 }
 
+// testFreeYear is the year room 1 is free in; every room is booked up at other times
+const testFreeYear = 2050
+
 // SearchAvailabilityForAllRooms returns a slice of available rooms for the given dates
-func (m *testDBRepo) SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error) {
+func (m *testDBRepo) SearchAvailabilityForAllRooms(start, end models.Date, propertyID int) ([]models.Room, error) {
 	var rooms []models.Room
+	if propertyID == models.DefaultPropertyID && start.Year() == testFreeYear {
+		rooms = append(rooms, models.Room{ID: 1, RoomName: "General's Quarters", PropertyID: propertyID})
+	}
 	return rooms, nil
 }
 
+// RoomNights returns the nights of the test rooms from start to end. At the first property
+// room 1 is free for the first two nights asked about and room 2 from the third on; nothing is
+// free at the other properties.
+func (m *testDBRepo) RoomNights(start, end models.Date, propertyID int) ([]models.RoomNight, error) {
+	var grid []models.RoomNight
+	for _, roomID := range []int{1, 2} {
+		room := models.Room{ID: roomID, RoomName: fmt.Sprintf("Room %d", roomID), PropertyID: propertyID}
+		for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+			early := start.DaysUntil(d) < 2
+			grid = append(grid, models.RoomNight{
+				Room: room,
+				Date: d,
+				Free: propertyID == models.DefaultPropertyID && early == (roomID == 1),
+			})
+		}
+	}
+	return grid, nil
+}
+
 // GetRoomByID returns a room by its ID
 func (m *testDBRepo) GetRoomByID(id int) (models.Room, error) {
 	var room models.Room
 	if id > 2 {
 		return room, errors.New("some error")
 	}
+	room.ID = id
+	room.Price = 15000
+	room.PropertyID = models.DefaultPropertyID
 	return room, nil
 }
 
-// GetUserByID returns a user by its ID
+// testTOTPSecret is the authenticator secret of the test manager, who has two-factor
+// authentication turned on
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+// testUsers are the staff users: an owner and a front desk user without two-factor
+// authentication, and a manager with it
+var testUsers = []models.User{
+	{ID: 1, FirstName: "Admin", LastName: "User", Email: "admin@admin.com", AccessLevel: models.AccessOwner},
+	{ID: 2, FirstName: "Front", LastName: "Desk", Email: "desk@example.com", AccessLevel: models.AccessStaff},
+	{ID: 3, FirstName: "Mia", LastName: "Manager", Email: "manager@example.com", AccessLevel: models.AccessManager,
+		TOTPSecret: testTOTPSecret, TwoFactorEnabledAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)},
+}
+
+// GetUserByID returns one of the test users
 func (m *testDBRepo) GetUserByID(id int) (models.User, error) {
-	var user models.User
-	return user, nil
+	for _, u := range testUsers {
+		if u.ID == id {
+			return u, nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
 }
 
 // UpdateUser updates a user in the database
@@ -52,26 +103,56 @@ func (m *testDBRepo) UpdateUser(u models.User) error {
 	return nil
 }
 
-// AuthenticateUser authenticates a user by email and password
+// AuthenticateUser accepts the test users' emails with the password "password"
 func (m *testDBRepo) AuthenticateUser(email, testPassword string) (int, string, error) {
-	return 1, "", nil
+	for _, u := range testUsers {
+		if u.Email == email && testPassword == "password" {
+			return u.ID, "", nil
+		}
+	}
+	return 0, "", repository.ErrInvalidCredentials
 }
 
 // AllReservations returns all reservations
-func (m *testDBRepo) AllReservations() ([]models.Reservation, error) {
+func (m *testDBRepo) AllReservations(propertyID int) ([]models.Reservation, error) {
 	var reservations []models.Reservation
 	return reservations, nil
 }
 
 // AllNewReservations returns all new reservations
-func (m *testDBRepo) AllNewReservations() ([]models.Reservation, error) {
+func (m *testDBRepo) AllNewReservations(propertyID int) ([]models.Reservation, error) {
 	var reservations []models.Reservation
 	return reservations, nil
 }
 
-// GetReservationByID returns a reservation by its ID
+// GetReservationByID returns a reservation by its ID; reservation 99 belongs to a property the
+// test user can't manage and reservation 98 is cancelled
 func (m *testDBRepo) GetReservationByID(id int) (models.Reservation, error) {
 	var res models.Reservation
+	if id > 100 {
+		return res, errors.New("some error")
+	}
+	res = models.Reservation{
+		ID:        id,
+		FirstName: "John",
+		LastName:  "Smith",
+		Email:     "john@example.com",
+		StartDate: models.NewDate(2050, 1, 1),
+		EndDate:   models.NewDate(2050, 1, 3),
+		RoomID:    1,
+		Status:    models.StatusPending,
+		GuestID:   1,
+		Room:      models.Room{ID: 1, RoomName: "General's Quarters", PropertyID: models.DefaultPropertyID},
+	}
+	if id == 99 {
+		res.Room.PropertyID = 2
+	}
+	if id == 98 {
+		res.Status = models.StatusCancelled
+	}
+	if id == 97 {
+		res.PaymentDueAt = time.Now().Add(-time.Minute)
+	}
 	return res, nil
 }
 
@@ -80,30 +161,1050 @@ func (m *testDBRepo) UpdateReservation(u models.Reservation, id int) error {
 	return nil
 }
 
-// DeleteReservation deletes a reservation from the database
-func (m *testDBRepo) DeleteReservation(id int) error {
+// DeleteReservation moves a reservation to the trash
+func (m *testDBRepo) DeleteReservation(id, userID int) error {
+	if id > 100 {
+		return errors.New("some error")
+	}
 	return nil
 }
 
-// UpdateProcessedForReservation updates the processed status for a reservation
-func (m *testDBRepo) UpdateProcessedForReservation(id, processed int) error {
+// AllDeletedReservations returns the reservations in the trash
+func (m *testDBRepo) AllDeletedReservations(propertyID int) ([]models.Reservation, error) {
+	start := models.NewDate(2050, 1, 1)
+	reservations := []models.Reservation{
+		{
+			ID:            2,
+			FirstName:     "Jane",
+			LastName:      "Doe",
+			StartDate:     start,
+			EndDate:       start.AddDate(0, 0, 2),
+			RoomID:        1,
+			Status:        models.StatusPending,
+			DeletedAt:     time.Now(),
+			DeletedBy:     1,
+			Room:          models.Room{ID: 1, RoomName: "General's Quarters", PropertyID: models.DefaultPropertyID},
+			DeletedByUser: models.User{ID: 1, FirstName: "Admin", LastName: "User"},
+		},
+	}
+	return reservations, nil
+}
+
+// RestoreReservation takes a reservation out of the trash; reservation 2 clashes with another booking
+func (m *testDBRepo) RestoreReservation(id int) error {
+	if id == 2 {
+		return repository.ErrRoomUnavailable
+	}
+	if id > 100 {
+		return errors.New("some error")
+	}
 	return nil
 }
 
-func (m *testDBRepo) AllRooms() ([]models.Room, error) {
-	var rooms []models.Room
+// PurgeDeletedReservations permanently removes reservations deleted before the given time
+func (m *testDBRepo) PurgeDeletedReservations(before time.Time) (int64, error) {
+	return 1, nil
+}
+
+// UpdateReservationStatus moves a reservation to a new status; the test reservation is always pending
+func (m *testDBRepo) UpdateReservationStatus(id int, status models.ReservationStatus) error {
+	if id > 100 {
+		return errors.New("some error")
+	}
+	if !models.StatusPending.CanTransitionTo(status) {
+		return repository.ErrInvalidTransition
+	}
+	return nil
+}
+
+// AllRooms returns the two test rooms
+func (m *testDBRepo) AllRooms(propertyID int) ([]models.Room, error) {
+	rooms := []models.Room{
+		{ID: 1, RoomName: "General's Quarters", PropertyID: models.DefaultPropertyID},
+		{ID: 2, RoomName: "Major's Suite", PropertyID: models.DefaultPropertyID},
+	}
 	return rooms, nil
 }
 
-func (m *testDBRepo) GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error){
-	var restrictions []models.RoomRestriction
+// GetRestrictionsByDate returns a reservation and a three night owner block for room 1 starting
+// on the given date
+func (m *testDBRepo) GetRestrictionsByDate(start, end models.Date) ([]models.RoomRestriction, error) {
+	restrictions := []models.RoomRestriction{
+		{
+			ID:            1,
+			StartDate:     start,
+			EndDate:       start.AddDate(0, 0, 2),
+			RoomID:        1,
+			ReservationID: 1,
+			RestrictionID: models.RestrictionReservation,
+			Restriction:   models.Restriction{ID: models.RestrictionReservation, BlocksStay: true},
+		},
+		{
+			ID:            2,
+			StartDate:     start.AddDate(0, 0, 2),
+			EndDate:       start.AddDate(0, 0, 5),
+			RoomID:        1,
+			RestrictionID: models.RestrictionOwnerBlock,
+			Restriction:   models.Restriction{ID: models.RestrictionOwnerBlock, BlocksStay: true, Color: "#6c757d"},
+		},
+	}
 	return restrictions, nil
 }
 
-func (m *testDBRepo) InsertBlockForRoom(id int, startDate time.Time) error {
+func (m *testDBRepo) InsertBlockForRoom(r models.RoomRestriction) (int, error) {
+	if r.RoomID > 2 {
+		return 0, errors.New("some error")
+	}
+	return 1, nil
+}
+
+// ApplyBlockChanges fails as a whole if any remove or add would, or if the same night is added
+// twice for a room. Block 1 doesn't exist and block 99 is on a room of the second property.
+func (m *testDBRepo) ApplyBlockChanges(propertyID int, removeIDs []int, adds []models.RoomRestriction) ([]models.RoomRestriction, []models.RoomRestriction, error) {
+	var removed []models.RoomRestriction
+	for _, id := range removeIDs {
+		if id == 1 || (id == 99 && propertyID != 2) {
+			return nil, nil, errors.New("block does not exist")
+		}
+		removed = append(removed, models.RoomRestriction{ID: id, RoomID: 1, RestrictionID: models.RestrictionOwnerBlock})
+	}
+
+	var added []models.RoomRestriction
+	seen := make(map[string]bool)
+	for i, r := range adds {
+		key := fmt.Sprintf("%d_%s", r.RoomID, r.StartDate.Format("2006-01-02"))
+		if seen[key] {
+			return nil, nil, errors.New("duplicate block")
+		}
+		seen[key] = true
+		if _, err := m.InsertBlockForRoom(r); err != nil {
+			return nil, nil, err
+		}
+		r.ID = 100 + i
+		added = append(added, r)
+	}
+
+	return removed, added, nil
+}
+
+// AllRestrictions returns all restriction types
+func (m *testDBRepo) AllRestrictions() ([]models.Restriction, error) {
+	restrictions := []models.Restriction{
+		{ID: models.RestrictionReservation, RestrictionName: "Reservation", Color: "#0d6efd", BlocksStay: true},
+		{ID: models.RestrictionOwnerBlock, RestrictionName: "Owner's Block", Color: "#6c757d", BlocksStay: true},
+	}
+	return restrictions, nil
+}
+
+// GetRestrictionByID returns a restriction type by its ID
+func (m *testDBRepo) GetRestrictionByID(id int) (models.Restriction, error) {
+	var r models.Restriction
+	if id > 3 {
+		return r, errors.New("some error")
+	}
+	r.ID = id
+	return r, nil
+}
+
+// InsertRestriction inserts a restriction type
+func (m *testDBRepo) InsertRestriction(r models.Restriction) (int, error) {
+	return 3, nil
+}
+
+// UpdateRestriction updates a restriction type
+func (m *testDBRepo) UpdateRestriction(r models.Restriction) error {
+	return nil
+}
+
+// DeleteRestriction deletes a restriction type
+func (m *testDBRepo) DeleteRestriction(id int) error {
+	if id <= models.RestrictionOwnerBlock {
+		return errors.New("restriction is in use")
+	}
 	return nil
 }
 
-func (m *testDBRepo) DeleteBlockByID(id int) error {
+// MoveReservation moves a reservation to another room or dates; room 2 is always taken and
+// reservation 98 is cancelled
+func (m *testDBRepo) MoveReservation(change models.ReservationChange) error {
+	if change.ReservationID > 100 {
+		return errors.New("some error")
+	}
+	if change.ReservationID == 98 {
+		return repository.ErrReservationReleased
+	}
+	if change.NewRoomID == 2 {
+		return repository.ErrRoomUnavailable
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// GetReservationChanges returns the change history of a reservation
+func (m *testDBRepo) GetReservationChanges(reservationID int) ([]models.ReservationChange, error) {
+	var changes []models.ReservationChange
+	return changes, nil
+}
+
+// InsertAuditEntry appends an entry to the audit log
+func (m *testDBRepo) InsertAuditEntry(e models.AuditEntry) error {
+	return nil
+}
+
+// SearchAuditEntries returns audit log entries matching the filter
+func (m *testDBRepo) SearchAuditEntries(f models.AuditFilter) ([]models.AuditEntry, error) {
+	if f.Query == "error" {
+		return nil, errors.New("some error")
+	}
+	testEntries := []models.AuditEntry{
+		{
+			ID:         1,
+			UserID:     1,
+			Actor:      "staff",
+			Action:     models.AuditUpdate,
+			EntityType: models.EntityReservation,
+			EntityID:   1,
+			PropertyID: models.DefaultPropertyID,
+			Before:     `{"FirstName":"John"}`,
+			After:      `{"FirstName":"Jane"}`,
+			IPAddress:  "127.0.0.1",
+			RequestID:  "test/1",
+			CreatedAt:  time.Now(),
+		},
+		{
+			ID:         2,
+			UserID:     1,
+			Actor:      "staff",
+			Action:     models.AuditUpdate,
+			EntityType: models.EntitySettings,
+			After:      `{"RequireTwoFactor":true}`,
+			IPAddress:  "127.0.0.1",
+			RequestID:  "test/2",
+			CreatedAt:  time.Now(),
+		},
+		{
+			ID:         3,
+			Actor:      "system",
+			Action:     models.AuditStatus,
+			EntityType: models.EntityWaitlistEntry,
+			EntityID:   3,
+			PropertyID: 2,
+			RequestID:  "test/3",
+			CreatedAt:  time.Now(),
+		},
+	}
+
+	var entries []models.AuditEntry
+	for _, e := range testEntries {
+		if e.PropertyID == f.PropertyID || (e.PropertyID == 0 && f.Unscoped) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// GetAuditEntriesForEntity returns the audit history of one entity
+func (m *testDBRepo) GetAuditEntriesForEntity(entityType string, entityID int) ([]models.AuditEntry, error) {
+	var entries []models.AuditEntry
+	if entityID == 1 {
+		entries = append(entries, models.AuditEntry{
+			ID:         1,
+			Actor:      "guest",
+			Action:     models.AuditCreate,
+			EntityType: entityType,
+			EntityID:   entityID,
+			After:      `{"FirstName":"John","LastName":"Smith"}`,
+			CreatedAt:  time.Now(),
+		})
+	}
+	return entries, nil
+}
+
+// AllGuests returns the guests matching search, who have all booked at the first property
+func (m *testDBRepo) AllGuests(propertyID int, search string) ([]models.Guest, error) {
+	if search == "error" {
+		return nil, errors.New("some error")
+	}
+	if propertyID != models.DefaultPropertyID {
+		return nil, nil
+	}
+	guests := []models.Guest{
+		{ID: 1, FirstName: "John", LastName: "Smith", Email: "john@smith.com", Tags: []string{models.TagVIP}, Stays: 2, TotalNights: 5},
+		{ID: 2, FirstName: "Jon", LastName: "Smith", Email: "jon@smith.com", Tags: []string{models.TagDoNotRent}, Stays: 1, TotalNights: 1},
+	}
+	return guests, nil
+}
+
+// GetGuestByID returns a guest by its ID. There is no guest 3.
+func (m *testDBRepo) GetGuestByID(id int) (models.Guest, error) {
+	if id == 3 || id > 4 {
+		return models.Guest{}, errors.New("some error")
+	}
+	guest := models.Guest{
+		ID:          id,
+		FirstName:   "John",
+		LastName:    "Smith",
+		Email:       "john@smith.com",
+		Tags:        []string{models.TagVIP},
+		Stays:       2,
+		TotalNights: 5,
+	}
+	return guest, nil
+}
+
+// GetReservationsForGuest returns a guest's reservations
+func (m *testDBRepo) GetReservationsForGuest(guestID int) ([]models.Reservation, error) {
+	res, err := m.GetReservationByID(1)
+	if err != nil {
+		return nil, err
+	}
+	res.GuestID = guestID
+	return []models.Reservation{res}, nil
+}
+
+// GetGuestPropertyIDs returns the properties a guest has booked at; guest 4 has booked at both
+func (m *testDBRepo) GetGuestPropertyIDs(guestID int) ([]int, error) {
+	if guestID == 4 {
+		return []int{models.DefaultPropertyID, 2}, nil
+	}
+	return []int{models.DefaultPropertyID}, nil
+}
+
+// UpdateGuest updates a guest; the email taken@here.com belongs to another guest
+func (m *testDBRepo) UpdateGuest(g models.Guest) error {
+	if models.NormalizeEmail(g.Email) == "taken@here.com" {
+		return repository.ErrGuestExists
+	}
+	return nil
+}
+
+// MergeGuests folds the duplicate guest into the target
+func (m *testDBRepo) MergeGuests(targetID, duplicateID int) error {
+	if targetID == duplicateID {
+		return errors.New("can't merge a guest into itself")
+	}
+	return nil
+}
+
+// GetGuestByEmail returns the guest with the given email address; john@smith.com has an account
+// and jane@doe.com is a past guest without one
+func (m *testDBRepo) GetGuestByEmail(email string) (models.Guest, error) {
+	switch models.NormalizeEmail(email) {
+	case "john@smith.com":
+		return models.Guest{ID: 1, FirstName: "John", LastName: "Smith", Email: "john@smith.com", HasAccount: true}, nil
+	case "jane@doe.com":
+		return models.Guest{ID: 2, FirstName: "Jane", LastName: "Doe", Email: "jane@doe.com"}, nil
+	}
+	return models.Guest{}, sql.ErrNoRows
+}
+
+// InsertGuest inserts a guest
+func (m *testDBRepo) InsertGuest(g models.Guest) (int, error) {
+	return 3, nil
+}
+
+// AuthenticateGuest checks a guest's email and password
+func (m *testDBRepo) AuthenticateGuest(email, testPassword string) (int, error) {
+	if models.NormalizeEmail(email) == "john@smith.com" && testPassword == "password" {
+		return 1, nil
+	}
+	return 0, errors.New("incorrect password")
+}
+
+// InsertGuestToken stores the hash of a sign in link
+func (m *testDBRepo) InsertGuestToken(guestID int, tokenHash, passwordHash string, expiresAt time.Time) error {
+	return nil
+}
+
+// ConsumeGuestToken marks a sign in link as used; only the hash of "valid-token" is accepted
+func (m *testDBRepo) ConsumeGuestToken(tokenHash string) (int, error) {
+	sum := sha256.Sum256([]byte("valid-token"))
+	if tokenHash == hex.EncodeToString(sum[:]) {
+		return 1, nil
+	}
+	return 0, repository.ErrInvalidToken
+}
+
+// InsertPayment records a payment
+func (m *testDBRepo) InsertPayment(p models.Payment) (int, error) {
+	return 1, nil
+}
+
+// UpdatePayment saves a payment
+func (m *testDBRepo) UpdatePayment(p models.Payment) error {
+	return nil
+}
+
+// GetPaymentsForReservation returns a captured deposit for reservation 1 and nothing otherwise
+func (m *testDBRepo) GetPaymentsForReservation(reservationID int) ([]models.Payment, error) {
+	if reservationID != 1 {
+		return nil, nil
+	}
+	return []models.Payment{
+		{ID: 1, ReservationID: 1, Provider: "test", ProviderPaymentID: "pi_1", Amount: 9000, Currency: "usd", Status: models.PaymentCaptured},
+	}, nil
+}
+
+// GetPaymentByProviderID returns the payment known as pi_1
+func (m *testDBRepo) GetPaymentByProviderID(provider, providerPaymentID string) (models.Payment, error) {
+	if providerPaymentID != "pi_1" {
+		return models.Payment{}, sql.ErrNoRows
+	}
+	return models.Payment{ID: 1, ReservationID: 1, Provider: provider, ProviderPaymentID: "pi_1", Amount: 9000, Currency: "usd", Status: models.PaymentCaptured}, nil
+}
+
+// CreateInvoice issues the first invoice of the year
+func (m *testDBRepo) CreateInvoice(inv models.Invoice) (models.Invoice, error) {
+	if inv.IssuedAt.IsZero() {
+		inv.IssuedAt = time.Now()
+	}
+	inv.ID = 1
+	inv.Year = inv.IssuedAt.Year()
+	inv.Sequence = 1
+	return inv, nil
+}
+
+// GetInvoiceByReservationID returns no invoice, so one is issued when asked for
+func (m *testDBRepo) GetInvoiceByReservationID(reservationID int) (models.Invoice, error) {
+	return models.Invoice{}, sql.ErrNoRows
+}
+
+// AllChargeRules returns a cleaning fee that is switched off, so test prices are the room alone
+func (m *testDBRepo) AllChargeRules(propertyID int, activeOnly bool) ([]models.ChargeRule, error) {
+	if activeOnly {
+		return nil, nil
+	}
+	return []models.ChargeRule{
+		{ID: 1, PropertyID: models.DefaultPropertyID, Name: "Cleaning fee", Kind: models.ChargeFee, Basis: models.BasisFlat, Per: models.PerStay, Amount: 2500},
+	}, nil
+}
+
+// GetChargeRuleByID returns the cleaning fee for ID 1
+func (m *testDBRepo) GetChargeRuleByID(id int) (models.ChargeRule, error) {
+	if id != 1 {
+		return models.ChargeRule{}, sql.ErrNoRows
+	}
+	rules, _ := m.AllChargeRules(models.DefaultPropertyID, false)
+	return rules[0], nil
+}
+
+// InsertChargeRule adds a tax or fee rule
+func (m *testDBRepo) InsertChargeRule(c models.ChargeRule) (int, error) {
+	return 2, nil
+}
+
+// SetChargeRuleActive turns a tax or fee rule on or off
+func (m *testDBRepo) SetChargeRuleActive(id int, active bool) error {
+	return nil
+}
+
+// testPromoCodes are the promo codes known to the test repository
+var testPromoCodes = []models.PromoCode{
+	{ID: 1, PropertyID: models.DefaultPropertyID, Code: "WINTER", PercentOff: 20, Active: true},
+	{ID: 2, PropertyID: models.DefaultPropertyID, Code: "EXPIRED", PercentOff: 20, ValidUntil: models.NewDate(2020, 1, 1), Active: true},
+	{ID: 3, PropertyID: models.DefaultPropertyID, Code: "USEDUP", AmountOff: 1000, MaxUses: 5, Uses: 5, Active: true},
+	{ID: 4, PropertyID: models.DefaultPropertyID, Code: "SUITE", PercentOff: 10, RoomIDs: []int{2}, Active: true},
+}
+
+// AllPromoCodes returns the test promo codes
+func (m *testDBRepo) AllPromoCodes(propertyID int) ([]models.PromoCode, error) {
+	return testPromoCodes, nil
+}
+
+// GetPromoCodeByCode returns the test promo code of the property matching code
+func (m *testDBRepo) GetPromoCodeByCode(propertyID int, code string) (models.PromoCode, error) {
+	for _, p := range testPromoCodes {
+		if p.PropertyID == propertyID && p.Code == models.NormalizePromoCode(code) {
+			return p, nil
+		}
+	}
+	return models.PromoCode{}, sql.ErrNoRows
+}
+
+// GetPromoCodeByID returns the test promo code with id
+func (m *testDBRepo) GetPromoCodeByID(id int) (models.PromoCode, error) {
+	for _, p := range testPromoCodes {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return models.PromoCode{}, sql.ErrNoRows
+}
+
+// InsertPromoCode adds a promo code
+func (m *testDBRepo) InsertPromoCode(p models.PromoCode) (int, error) {
+	return 5, nil
+}
+
+// SetPromoCodeActive turns a promo code on or off
+func (m *testDBRepo) SetPromoCodeActive(id int, active bool) error {
+	return nil
+}
+
+// GetReservationCharges returns no charges, so they are worked out from the room
+func (m *testDBRepo) GetReservationCharges(reservationID int) ([]models.Charge, error) {
+	return nil, nil
+}
+
+// testProperties are the properties known to the test repository; the test user can only
+// manage the first
+var testProperties = []models.Property{
+	{ID: 1, Name: "Fort Smythe", Slug: "main", Currency: "usd", Timezone: "UTC", BrandColor: "#0d6efd"},
+	{ID: 2, Name: "Seaview House", Slug: "seaview", Hostname: "seaview.example.com", Currency: "eur",
+		Timezone: "Europe/Lisbon", NotifyEmail: "seaview@example.com", BrandColor: "#198754"},
+}
+
+// AllProperties returns the test properties
+func (m *testDBRepo) AllProperties() ([]models.Property, error) {
+	return testProperties, nil
+}
+
+// GetPropertyByID returns the test property with id
+func (m *testDBRepo) GetPropertyByID(id int) (models.Property, error) {
+	for _, p := range testProperties {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return models.Property{}, sql.ErrNoRows
+}
+
+// GetPropertyBySlug returns the test property with slug
+func (m *testDBRepo) GetPropertyBySlug(slug string) (models.Property, error) {
+	for _, p := range testProperties {
+		if p.Slug == slug {
+			return p, nil
+		}
+	}
+	return models.Property{}, sql.ErrNoRows
+}
+
+// GetPropertyByHostname returns the test property served on host
+func (m *testDBRepo) GetPropertyByHostname(host string) (models.Property, error) {
+	host = models.NormalizeHostname(host)
+	for _, p := range testProperties {
+		if p.Hostname != "" && p.Hostname == host {
+			return p, nil
+		}
+	}
+	return models.Property{}, sql.ErrNoRows
+}
+
+// PropertiesForUser returns the first test property
+func (m *testDBRepo) PropertiesForUser(userID int) ([]models.Property, error) {
+	return testProperties[:1], nil
+}
+
+// InsertProperty adds a property; the slug "seaview" is already taken
+func (m *testDBRepo) InsertProperty(p models.Property, userID int) (int, error) {
+	if p.Slug == "seaview" {
+		return 0, repository.ErrPropertyExists
+	}
+	return 3, nil
+}
+
+// UpdateProperty saves a property's settings; the slug "seaview" is already taken
+func (m *testDBRepo) UpdateProperty(p models.Property) error {
+	if p.ID != 2 && p.Slug == "seaview" {
+		return repository.ErrPropertyExists
+	}
+	return nil
+}
+
+// AllStaff returns the test users
+func (m *testDBRepo) AllStaff() ([]models.User, error) {
+	return testUsers, nil
+}
+
+// GetPropertyStaffIDs returns the test user
+func (m *testDBRepo) GetPropertyStaffIDs(propertyID int) ([]int, error) {
+	return []int{1}, nil
+}
+
+// SetPropertyStaff replaces the staff users with access to a property
+func (m *testDBRepo) SetPropertyStaff(propertyID int, userIDs []int) error {
+	return nil
+}
+
+// testTokenHash returns the hash stored for an offer link token
+func testTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// testWaitlist is waiting for the first nights room 1 is free, except entry 2, which has an
+// open offer sent with "offer-token", entry 3, whose offer sent with "expired-token" has run
+// out, and entry 4, which is at the second property
+var testWaitlist = []models.WaitlistEntry{
+	{ID: 1, PropertyID: models.DefaultPropertyID, StartDate: models.NewDate(testFreeYear, 2, 1), EndDate: models.NewDate(testFreeYear, 2, 3),
+		FirstName: "Wendy", LastName: "Wait", Email: "wendy@example.com", Status: models.WaitlistWaiting},
+	{ID: 2, PropertyID: models.DefaultPropertyID, RoomID: 1, Room: models.Room{ID: 1, RoomName: "General's Quarters"},
+		StartDate: models.NewDate(testFreeYear, 3, 1), EndDate: models.NewDate(testFreeYear, 3, 3),
+		FirstName: "Olly", LastName: "Offer", Email: "olly@example.com", Status: models.WaitlistOffered,
+		OfferedRoomID: 1, OfferedRoom: models.Room{ID: 1, RoomName: "General's Quarters"}, OfferExpiresAt: time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)},
+	{ID: 3, PropertyID: models.DefaultPropertyID, RoomID: 1, Room: models.Room{ID: 1, RoomName: "General's Quarters"},
+		StartDate: models.NewDate(testFreeYear, 4, 1), EndDate: models.NewDate(testFreeYear, 4, 3),
+		FirstName: "Eve", LastName: "Late", Email: "eve@example.com", Status: models.WaitlistOffered,
+		OfferedRoomID: 1, OfferedRoom: models.Room{ID: 1, RoomName: "General's Quarters"}, OfferExpiresAt: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)},
+	{ID: 4, PropertyID: 2, StartDate: models.NewDate(testFreeYear, 2, 1), EndDate: models.NewDate(testFreeYear, 2, 3),
+		FirstName: "Sam", LastName: "Sea", Email: "sam@example.com", Status: models.WaitlistWaiting},
+}
+
+// testWaitlistTokens maps offer link token hashes to the test waitlist entries they were sent to
+var testWaitlistTokens = map[string]int{
+	testTokenHash("offer-token"):   2,
+	testTokenHash("expired-token"): 3,
+}
+
+// InsertWaitlistEntry puts a guest on the waitlist
+func (m *testDBRepo) InsertWaitlistEntry(e models.WaitlistEntry) (int, error) {
+	return 5, nil
+}
+
+// GetWaitlistEntryByID returns the test waitlist entry with id
+func (m *testDBRepo) GetWaitlistEntryByID(id int) (models.WaitlistEntry, error) {
+	for _, e := range testWaitlist {
+		if e.ID == id {
+			return e, nil
+		}
+	}
+	return models.WaitlistEntry{}, sql.ErrNoRows
+}
+
+// GetWaitlistEntryByToken returns the test waitlist entry an offer link was sent to
+func (m *testDBRepo) GetWaitlistEntryByToken(tokenHash string) (models.WaitlistEntry, error) {
+	id, ok := testWaitlistTokens[tokenHash]
+	if !ok {
+		return models.WaitlistEntry{}, sql.ErrNoRows
+	}
+	return m.GetWaitlistEntryByID(id)
+}
+
+// AllWaitlistEntries returns the test waitlist of a property
+func (m *testDBRepo) AllWaitlistEntries(propertyID int) ([]models.WaitlistEntry, error) {
+	var entries []models.WaitlistEntry
+	for _, e := range testWaitlist {
+		if e.PropertyID == propertyID {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// OfferWaitlistEntry records an offer
+func (m *testDBRepo) OfferWaitlistEntry(id, roomID int, tokenHash string, expiresAt time.Time) error {
+	return nil
+}
+
+// UpdateWaitlistStatus moves a waitlist entry to status
+func (m *testDBRepo) UpdateWaitlistStatus(id int, status models.WaitlistStatus) error {
+	return nil
+}
+
+// ExpireWaitlistOffers returns the test entry whose offer has run out
+func (m *testDBRepo) ExpireWaitlistOffers(now time.Time) ([]models.WaitlistEntry, error) {
+	var entries []models.WaitlistEntry
+	for _, e := range testWaitlist {
+		if e.Status == models.WaitlistOffered && !now.Before(e.OfferExpiresAt) {
+			e.Status = models.WaitlistExpired
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// testHold is the hold on room 1 for the first nights of 2050, which runs until 2100
+var testHold = models.RoomHold{ID: 1, RoomID: 1, StartDate: models.NewDate(testFreeYear, 1, 1), EndDate: models.NewDate(testFreeYear, 1, 3),
+	ExpiresAt: time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+// InsertRoomHold holds a room; room 2 is always held by another guest
+func (m *testDBRepo) InsertRoomHold(hold models.RoomHold) (int, error) {
+	if hold.RoomID == 2 {
+		return 0, repository.ErrRoomUnavailable
+	}
+	return testHold.ID, nil
+}
+
+// GetRoomHoldByID returns the test hold
+func (m *testDBRepo) GetRoomHoldByID(id int) (models.RoomHold, error) {
+	if id != testHold.ID {
+		return models.RoomHold{}, sql.ErrNoRows
+	}
+	return testHold, nil
+}
+
+// DeleteRoomHold releases a hold
+func (m *testDBRepo) DeleteRoomHold(id int) error {
+	return nil
+}
+
+// DeleteExpiredRoomHolds removes the holds that ran out before the given time
+func (m *testDBRepo) DeleteExpiredRoomHolds(before time.Time) (int64, error) {
+	return 2, nil
+}
+
+// CancelUnpaidReservations cancels reservation 97, whose deposit was never paid
+func (m *testDBRepo) CancelUnpaidReservations(before time.Time) ([]models.Reservation, error) {
+	res, err := m.GetReservationByID(97)
+	if err != nil {
+		return nil, err
+	}
+	res.Status = models.StatusCancelled
+	return []models.Reservation{res}, nil
+}
+
+// testChannels are a channel selling both rooms of the first property and one for the second
+var testChannels = []models.Channel{
+	{ID: 1, PropertyID: models.DefaultPropertyID, Name: "Booking Site", Kind: "http", BaseURL: "https://channel.example.com",
+		APIKey: "key_test", Active: true, Rooms: map[int]string{1: "GQ", 2: "MS"}},
+	{ID: 2, PropertyID: 2, Name: "Harbour Lets", Kind: "http", BaseURL: "https://lets.example.com", Active: true,
+		Rooms: map[int]string{}},
+}
+
+// testChannelBookings are the bookings already pulled from channel 1, by their channel ID
+var testChannelBookings = map[string]models.ChannelBooking{
+	"B-OLD":    {ID: 1, ChannelID: 1, ExternalID: "B-OLD", ReservationID: 1, Status: models.ChannelBookingImported},
+	"B-MOVED":  {ID: 2, ChannelID: 1, ExternalID: "B-MOVED", ReservationID: 3, Status: models.ChannelBookingImported},
+	"B-CANCEL": {ID: 3, ChannelID: 1, ExternalID: "B-CANCEL", ReservationID: 4, Status: models.ChannelBookingImported},
+	"B-GONE":   {ID: 4, ChannelID: 1, ExternalID: "B-GONE", ReservationID: 2, Status: models.ChannelBookingCancelled},
+	"B-CLASH":  {ID: 5, ChannelID: 1, ExternalID: "B-CLASH", Status: models.ChannelBookingConflict},
+}
+
+// AllChannels returns the test channels of a property
+func (m *testDBRepo) AllChannels(propertyID int) ([]models.Channel, error) {
+	var channels []models.Channel
+	for _, c := range testChannels {
+		if c.PropertyID == propertyID {
+			channels = append(channels, c)
+		}
+	}
+	return channels, nil
+}
+
+// GetChannelByID returns the test channel with id
+func (m *testDBRepo) GetChannelByID(id int) (models.Channel, error) {
+	for _, c := range testChannels {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return models.Channel{}, sql.ErrNoRows
+}
+
+// InsertChannel adds a channel
+func (m *testDBRepo) InsertChannel(c models.Channel) (int, error) {
+	return 3, nil
+}
+
+// UpdateChannel saves a channel
+func (m *testDBRepo) UpdateChannel(c models.Channel) error {
+	return nil
+}
+
+// SetChannelPulledAt records when a channel was last pulled
+func (m *testDBRepo) SetChannelPulledAt(id int, at time.Time) error {
+	return nil
+}
+
+// GetChannelBooking returns a booking already pulled from channel 1
+func (m *testDBRepo) GetChannelBooking(channelID int, externalID string) (models.ChannelBooking, error) {
+	b, ok := testChannelBookings[externalID]
+	if !ok || b.ChannelID != channelID {
+		return models.ChannelBooking{}, sql.ErrNoRows
+	}
+	return b, nil
+}
+
+// ImportChannelReservation books a reservation for a channel booking; room 2 is always taken
+func (m *testDBRepo) ImportChannelReservation(channelID int, externalID string, res models.Reservation) (int, error) {
+	if _, ok := testChannelBookings[externalID]; ok {
+		return 0, repository.ErrChannelBookingExists
+	}
+	if res.RoomID == 2 {
+		return 0, repository.ErrRoomUnavailable
+	}
+	return 1, nil
+}
+
+// SaveChannelBooking records what was done with a channel booking
+func (m *testDBRepo) SaveChannelBooking(b models.ChannelBooking) error {
+	return nil
+}
+
+// InsertChannelSyncLog adds to a channel's sync log
+func (m *testDBRepo) InsertChannelSyncLog(l models.ChannelSyncLog) error {
+	return nil
+}
+
+// GetChannelSyncLogs returns a push and a conflict for channel 1
+func (m *testDBRepo) GetChannelSyncLogs(channelID, limit int) ([]models.ChannelSyncLog, error) {
+	var logs []models.ChannelSyncLog
+	if channelID == 1 {
+		logs = append(logs,
+			models.ChannelSyncLog{ID: 2, ChannelID: 1, Direction: models.SyncPull, Status: models.SyncConflict, ExternalID: "B-CLASH",
+				Message: "MS is already taken for some of those nights", CreatedAt: time.Now()},
+			models.ChannelSyncLog{ID: 1, ChannelID: 1, Direction: models.SyncPush, Status: models.SyncOK,
+				Message: "Sent 732 nights", CreatedAt: time.Now().Add(-time.Minute)},
+		)
+	}
+	return logs, nil
+}
+
+// testWebhooks are a webhook of the first property for new and cancelled reservations, and one
+// of the second property
+var testWebhooks = []models.Webhook{
+	{ID: 1, PropertyID: models.DefaultPropertyID, URL: "https://hooks.example.com/housekeeping", Secret: "whsec_test",
+		Events: []string{models.EventReservationCreated, models.EventReservationCancelled}, Active: true},
+	{ID: 2, PropertyID: 2, URL: "https://hooks.example.com/seaside", Secret: "whsec_seaside",
+		Events: []string{models.EventBlockCreated}, Active: true},
+}
+
+// testWebhookDeliveries are the log of webhook 1: a delivery that went through, one that is
+// being retried and one that failed for good, and a delivery to the second property's webhook
+var testWebhookDeliveries = []models.WebhookDelivery{
+	{ID: 3, WebhookID: 1, EventID: "evt_3", Event: models.EventReservationCancelled, Payload: `{"id":"evt_3"}`,
+		Status: models.DeliveryFailed, Attempts: 8, ResponseCode: 500, Response: "webhook returned 500"},
+	{ID: 2, WebhookID: 1, EventID: "evt_2", Event: models.EventReservationCreated, Payload: `{"id":"evt_2"}`,
+		Status: models.DeliveryPending, Attempts: 2, Response: "connection refused"},
+	{ID: 1, WebhookID: 1, EventID: "evt_1", Event: models.EventReservationCreated, Payload: `{"id":"evt_1"}`,
+		Status: models.DeliveryDelivered, Attempts: 1, ResponseCode: 200, Response: "ok"},
+	{ID: 4, WebhookID: 2, EventID: "evt_4", Event: models.EventBlockCreated, Payload: `{"id":"evt_4"}`,
+		Status: models.DeliveryDelivered, Attempts: 1, ResponseCode: 204},
+}
+
+// AllWebhooks returns the test webhooks of a property
+func (m *testDBRepo) AllWebhooks(propertyID int) ([]models.Webhook, error) {
+	var webhooks []models.Webhook
+	for _, w := range testWebhooks {
+		if w.PropertyID == propertyID {
+			webhooks = append(webhooks, w)
+		}
+	}
+	return webhooks, nil
+}
+
+// GetWebhookByID returns the test webhook with id
+func (m *testDBRepo) GetWebhookByID(id int) (models.Webhook, error) {
+	for _, w := range testWebhooks {
+		if w.ID == id {
+			return w, nil
+		}
+	}
+	return models.Webhook{}, sql.ErrNoRows
+}
+
+// InsertWebhook adds a webhook
+func (m *testDBRepo) InsertWebhook(w models.Webhook) (int, error) {
+	return 3, nil
+}
+
+// UpdateWebhook saves a webhook
+func (m *testDBRepo) UpdateWebhook(w models.Webhook) error {
+	return nil
+}
+
+// DeleteWebhook removes a webhook
+func (m *testDBRepo) DeleteWebhook(id int) error {
+	return nil
+}
+
+// InsertWebhookDeliveries queues an event, refusing payloads that aren't the event they are
+// queued as
+func (m *testDBRepo) InsertWebhookDeliveries(propertyID int, eventID, event, payload string) (int, error) {
+	var ev struct {
+		ID         string `json:"id"`
+		Type       string `json:"type"`
+		PropertyID int    `json:"property_id"`
+	}
+	err := json.Unmarshal([]byte(payload), &ev)
+	if err != nil {
+		return 0, err
+	}
+	if ev.ID != eventID || ev.Type != event || ev.PropertyID != propertyID {
+		return 0, errors.New("payload isn't the event queued")
+	}
+	return 1, nil
+}
+
+// ClaimWebhookDeliveries returns three deliveries due to webhook 1, sent to addresses that
+// accept them, fail once and fail for good
+func (m *testDBRepo) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	webhook := testWebhooks[0]
+	deliveries := []models.WebhookDelivery{
+		{ID: 5, WebhookID: 1, EventID: "evt_5", Event: models.EventReservationCreated, Payload: `{"id":"evt_5"}`,
+			Status: models.DeliveryPending, Webhook: webhook},
+		{ID: 6, WebhookID: 1, EventID: "evt_6", Event: models.EventReservationCreated, Payload: `{"id":"evt_6"}`,
+			Status: models.DeliveryPending, Webhook: webhook},
+		{ID: 7, WebhookID: 1, EventID: "evt_7", Event: models.EventReservationCancelled, Payload: `{"id":"evt_7"}`,
+			Status: models.DeliveryPending, Attempts: 7, Webhook: webhook},
+	}
+	deliveries[1].Webhook.URL = "https://hooks.example.com/down"
+	deliveries[2].Webhook.URL = "https://hooks.example.com/down"
+	return deliveries, nil
+}
+
+// SaveWebhookAttempt records an attempt to send a delivery
+func (m *testDBRepo) SaveWebhookAttempt(d models.WebhookDelivery) error {
+	return nil
+}
+
+// GetWebhookDeliveryByID returns a test delivery with its webhook
+func (m *testDBRepo) GetWebhookDeliveryByID(id int) (models.WebhookDelivery, error) {
+	for _, d := range testWebhookDeliveries {
+		if d.ID == id {
+			d.Webhook, _ = m.GetWebhookByID(d.WebhookID)
+			return d, nil
+		}
+	}
+	return models.WebhookDelivery{}, sql.ErrNoRows
+}
+
+// GetWebhookDeliveries returns the test deliveries to a webhook
+func (m *testDBRepo) GetWebhookDeliveries(webhookID, limit int) ([]models.WebhookDelivery, error) {
+	var deliveries []models.WebhookDelivery
+	for _, d := range testWebhookDeliveries {
+		if d.WebhookID == webhookID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, nil
+}
+
+// RedeliverWebhookDelivery queues a delivery again
+func (m *testDBRepo) RedeliverWebhookDelivery(id int) (int, error) {
+	return 8, nil
+}
+
+// EnableTwoFactor turns on two-factor authentication; it expects a secret and ten recovery codes
+func (m *testDBRepo) EnableTwoFactor(userID int, secret string, step int64, codeHashes []string) error {
+	if secret == "" || step == 0 || len(codeHashes) != 10 {
+		return errors.New("expected a secret, the step it was confirmed with and ten recovery codes")
+	}
+	return nil
+}
+
+// DisableTwoFactor turns off two-factor authentication
+func (m *testDBRepo) DisableTwoFactor(userID int) error {
+	return nil
+}
+
+// UseTOTPStep records a code's step; codes are never replays in the tests
+func (m *testDBRepo) UseTOTPStep(userID int, step int64) (bool, error) {
+	return true, nil
+}
+
+// UseRecoveryCode accepts only the hash of "abcde-12345" for the test manager
+func (m *testDBRepo) UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	return userID == 3 && codeHash == testTokenHash("abcde12345"), nil
+}
+
+// ReplaceRecoveryCodes gives a user new recovery codes; it expects ten of them
+func (m *testDBRepo) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	if len(codeHashes) != 10 {
+		return errors.New("expected ten recovery codes")
+	}
+	return nil
+}
+
+// CountRecoveryCodes returns seven unused codes for the test manager
+func (m *testDBRepo) CountRecoveryCodes(userID int) (int, error) {
+	if userID == 3 {
+		return 7, nil
+	}
+	return 0, nil
+}
+
+// GetSecuritySettings returns settings that make managers and owners use two-factor authentication
+func (m *testDBRepo) GetSecuritySettings() (models.SecuritySettings, error) {
+	return models.SecuritySettings{RequireTwoFactor: true}, nil
+}
+
+// UpdateSecuritySettings saves the sign in rules
+func (m *testDBRepo) UpdateSecuritySettings(s models.SecuritySettings) error {
+	return nil
+}
+
+// GetUserByEmail returns one of the test users
+func (m *testDBRepo) GetUserByEmail(email string) (models.User, error) {
+	for _, u := range testUsers {
+		if u.Email == models.NormalizeEmail(email) {
+			return u, nil
+		}
+	}
+	return models.User{}, sql.ErrNoRows
+}
+
+// InsertLoginAttempt records a sign in; it expects the email as it is stored and an address
+func (m *testDBRepo) InsertLoginAttempt(a models.LoginAttempt) error {
+	if a.Email != models.NormalizeEmail(a.Email) || a.IPAddress == "" {
+		return errors.New("expected a normalized email and an address")
+	}
+	return nil
+}
+
+// testThrottledIP is an address that has failed to sign in too many times
+const testThrottledIP = "203.0.113.66"
+
+// GetLoginFailures returns recent failures for a few emails: the front desk has failed nine times
+// in a row, but long enough ago to try again, "throttled@example.com" has to wait and
+// "locked@example.com" is locked. testThrottledIP has to wait whatever the email.
+func (m *testDBRepo) GetLoginFailures(email, ip string, now time.Time) (models.LoginFailures, error) {
+	var f models.LoginFailures
+	switch email {
+	case "desk@example.com":
+		f.Account, f.AccountLastAt = models.LoginLockoutAttempts-1, now.Add(-time.Hour)
+	case "throttled@example.com":
+		f.Account, f.AccountLastAt = 6, now.Add(-time.Second)
+	case "locked@example.com":
+		f.Account, f.AccountLastAt = models.LoginLockoutAttempts, now.Add(-time.Minute)
+	}
+	if ip == testThrottledIP {
+		f.IP, f.IPLastAt = 25, now
+	}
+	return f, nil
+}
+
+// ClearLoginFailures unlocks an account
+func (m *testDBRepo) ClearLoginFailures(email string) error {
+	return nil
+}
+
+// LockedAccounts returns the front desk user, locked five minutes ago
+func (m *testDBRepo) LockedAccounts(now time.Time) ([]models.LockedAccount, error) {
+	return []models.LockedAccount{
+		{User: testUsers[1], Failures: models.LoginLockoutAttempts, LastAttemptAt: now.Add(-5 * time.Minute), IPAddress: "198.51.100.7"},
+	}, nil
+}
+
+// UserSessions returns two sessions for the front desk user, the first of them current
+func (m *testDBRepo) UserSessions(userID int, currentToken string, now time.Time) ([]models.Session, error) {
+	if userID != 2 {
+		return nil, nil
+	}
+	return []models.Session{
+		{ID: 1, UserID: 2, IPAddress: "203.0.113.5", UserAgent: "Mozilla/5.0 (Windows NT 10.0)", CreatedAt: now.Add(-2 * time.Hour),
+			LastActiveAt: now.Add(-time.Minute), Expiry: now.Add(22 * time.Hour), Current: currentToken != ""},
+		{ID: 2, UserID: 2, IPAddress: "198.51.100.7", UserAgent: "Mozilla/5.0 (iPhone)", CreatedAt: now.Add(-20 * time.Hour),
+			LastActiveAt: now.Add(-3 * time.Hour), Expiry: now.Add(4 * time.Hour)},
+	}, nil
+}
+
+// RevokeSession revokes the front desk user's sessions 1 and 2
+func (m *testDBRepo) RevokeSession(userID, id int) error {
+	if userID != 2 || (id != 1 && id != 2) {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RevokeUserSessions revokes the front desk user's two sessions
+func (m *testDBRepo) RevokeUserSessions(userID int) (int64, error) {
+	if userID != 2 {
+		return 0, nil
+	}
+	return 2, nil
+}
+
+// DeleteExpiredSessions removes the sessions that expired before the given time
+func (m *testDBRepo) DeleteExpiredSessions(before time.Time) (int64, error) {
+	return 3, nil
+}
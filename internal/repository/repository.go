@@ -1,30 +1,173 @@
 package repository
 
 import (
+	"errors"
 	"time"
 
 	"github.com/ashparshp/bookings/internal/models"
 )
+
+// ErrRoomUnavailable is returned when a room is already taken for the requested dates
+var ErrRoomUnavailable = errors.New("room is not available for those dates")
+
+// ErrInvalidTransition is returned when a reservation can't move to the requested status
+var ErrInvalidTransition = errors.New("reservation can't move to that status")
+
+// ErrReservationReleased is returned when a cancelled or no-show reservation is moved
+var ErrReservationReleased = errors.New("cancelled and no-show reservations can't be moved")
+
+// ErrGuestExists is returned when a guest's email is already used by another guest
+var ErrGuestExists = errors.New("another guest already has that email address")
+
+// ErrInvalidToken is returned when a guest sign in link is unknown, used or expired
+var ErrInvalidToken = errors.New("sign in link is invalid or has expired")
+
+// ErrPropertyExists is returned when another property already uses a slug or hostname
+var ErrPropertyExists = errors.New("another property already uses that slug or hostname")
+
+// ErrChannelBookingExists is returned when a booking from a channel has already been imported
+var ErrChannelBookingExists = errors.New("channel booking has already been imported")
+
+// ErrInvalidCredentials is returned when an email and password don't match a staff account,
+// without saying which of them was wrong
+var ErrInvalidCredentials = errors.New("invalid email or password")
+
 type DatabaseRepo interface {
+	// As returns the repository recording the changes made through it in the audit log as made
+	// by actor
+	As(actor models.AuditActor) DatabaseRepo
+
 	AllUsers() bool
 
 	InsertReservation(res models.Reservation) (int, error)
-	InsertRoomRestriction(r models.RoomRestriction) error
-	SearchAvailabilityByDatesByRoomID(start, end time.Time, roomID int) (bool, error)
-	SearchAvailabilityForAllRooms(start, end time.Time) ([]models.Room, error)
+	InsertRoomRestriction(r models.RoomRestriction) (int, error)
+	SearchAvailabilityByDatesByRoomID(start, end models.Date, roomID int) (bool, error)
+	SearchAvailabilityForAllRooms(start, end models.Date, propertyID int) ([]models.Room, error)
+	RoomNights(start, end models.Date, propertyID int) ([]models.RoomNight, error)
 	GetRoomByID(id int) (models.Room, error)
 	GetUserByID(id int) (models.User, error)
 	UpdateUser(u models.User) error
 	AuthenticateUser(email, testPassword string) (int, string, error)
-	AllReservations() ([]models.Reservation, error)
-	AllNewReservations() ([]models.Reservation, error)
+	AllReservations(propertyID int) ([]models.Reservation, error)
+	AllNewReservations(propertyID int) ([]models.Reservation, error)
 	GetReservationByID(id int) (models.Reservation, error)
 	UpdateReservation(u models.Reservation, id int) error
-	DeleteReservation(id int) error
-	UpdateProcessedForReservation(id, processed int) error
-	AllRooms() ([]models.Room, error)
-	GetRestrictionsForRoomByDate(roomID int, start, end time.Time) ([]models.RoomRestriction, error)
-	InsertBlockForRoom(id int, stratDate time.Time) error
-	DeleteBlockByID(id int) error
+	DeleteReservation(id, userID int) error
+	AllDeletedReservations(propertyID int) ([]models.Reservation, error)
+	RestoreReservation(id int) error
+	PurgeDeletedReservations(before time.Time) (int64, error)
+	UpdateReservationStatus(id int, status models.ReservationStatus) error
+	AllRooms(propertyID int) ([]models.Room, error)
+	GetRestrictionsByDate(start, end models.Date) ([]models.RoomRestriction, error)
+	InsertBlockForRoom(r models.RoomRestriction) (int, error)
+	ApplyBlockChanges(propertyID int, removeIDs []int, adds []models.RoomRestriction) ([]models.RoomRestriction, []models.RoomRestriction, error)
+	AllRestrictions() ([]models.Restriction, error)
+	GetRestrictionByID(id int) (models.Restriction, error)
+	InsertRestriction(r models.Restriction) (int, error)
+	UpdateRestriction(r models.Restriction) error
+	DeleteRestriction(id int) error
+	MoveReservation(change models.ReservationChange) error
+	GetReservationChanges(reservationID int) ([]models.ReservationChange, error)
+	InsertAuditEntry(e models.AuditEntry) error
+	SearchAuditEntries(f models.AuditFilter) ([]models.AuditEntry, error)
+	GetAuditEntriesForEntity(entityType string, entityID int) ([]models.AuditEntry, error)
+	AllGuests(propertyID int, search string) ([]models.Guest, error)
+	GetGuestByID(id int) (models.Guest, error)
+	GetReservationsForGuest(guestID int) ([]models.Reservation, error)
+	GetGuestPropertyIDs(guestID int) ([]int, error)
+	UpdateGuest(g models.Guest) error
+	MergeGuests(targetID, duplicateID int) error
+	GetGuestByEmail(email string) (models.Guest, error)
+	InsertGuest(g models.Guest) (int, error)
+	AuthenticateGuest(email, testPassword string) (int, error)
+	InsertGuestToken(guestID int, tokenHash, passwordHash string, expiresAt time.Time) error
+	ConsumeGuestToken(tokenHash string) (int, error)
+
+	InsertPayment(p models.Payment) (int, error)
+	UpdatePayment(p models.Payment) error
+	GetPaymentsForReservation(reservationID int) ([]models.Payment, error)
+	GetPaymentByProviderID(provider, providerPaymentID string) (models.Payment, error)
+
+	CreateInvoice(inv models.Invoice) (models.Invoice, error)
+	GetInvoiceByReservationID(reservationID int) (models.Invoice, error)
+
+	AllChargeRules(propertyID int, activeOnly bool) ([]models.ChargeRule, error)
+	GetChargeRuleByID(id int) (models.ChargeRule, error)
+	InsertChargeRule(c models.ChargeRule) (int, error)
+	SetChargeRuleActive(id int, active bool) error
+	AllPromoCodes(propertyID int) ([]models.PromoCode, error)
+	GetPromoCodeByCode(propertyID int, code string) (models.PromoCode, error)
+	GetPromoCodeByID(id int) (models.PromoCode, error)
+	InsertPromoCode(p models.PromoCode) (int, error)
+	SetPromoCodeActive(id int, active bool) error
+	GetReservationCharges(reservationID int) ([]models.Charge, error)
+
+	AllProperties() ([]models.Property, error)
+	GetPropertyByID(id int) (models.Property, error)
+	GetPropertyBySlug(slug string) (models.Property, error)
+	GetPropertyByHostname(host string) (models.Property, error)
+	PropertiesForUser(userID int) ([]models.Property, error)
+	InsertProperty(p models.Property, userID int) (int, error)
+	UpdateProperty(p models.Property) error
+	AllStaff() ([]models.User, error)
+	GetPropertyStaffIDs(propertyID int) ([]int, error)
+	SetPropertyStaff(propertyID int, userIDs []int) error
+
+	InsertWaitlistEntry(e models.WaitlistEntry) (int, error)
+	GetWaitlistEntryByID(id int) (models.WaitlistEntry, error)
+	GetWaitlistEntryByToken(tokenHash string) (models.WaitlistEntry, error)
+	AllWaitlistEntries(propertyID int) ([]models.WaitlistEntry, error)
+	OfferWaitlistEntry(id, roomID int, tokenHash string, expiresAt time.Time) error
+	UpdateWaitlistStatus(id int, status models.WaitlistStatus) error
+	ExpireWaitlistOffers(now time.Time) ([]models.WaitlistEntry, error)
+
+	InsertRoomHold(hold models.RoomHold) (int, error)
+	GetRoomHoldByID(id int) (models.RoomHold, error)
+	DeleteRoomHold(id int) error
+	DeleteExpiredRoomHolds(before time.Time) (int64, error)
+	CancelUnpaidReservations(before time.Time) ([]models.Reservation, error)
+
+	AllChannels(propertyID int) ([]models.Channel, error)
+	GetChannelByID(id int) (models.Channel, error)
+	InsertChannel(c models.Channel) (int, error)
+	UpdateChannel(c models.Channel) error
+	SetChannelPulledAt(id int, at time.Time) error
+	GetChannelBooking(channelID int, externalID string) (models.ChannelBooking, error)
+	ImportChannelReservation(channelID int, externalID string, res models.Reservation) (int, error)
+	SaveChannelBooking(b models.ChannelBooking) error
+	InsertChannelSyncLog(l models.ChannelSyncLog) error
+	GetChannelSyncLogs(channelID, limit int) ([]models.ChannelSyncLog, error)
+
+	AllWebhooks(propertyID int) ([]models.Webhook, error)
+	GetWebhookByID(id int) (models.Webhook, error)
+	InsertWebhook(w models.Webhook) (int, error)
+	UpdateWebhook(w models.Webhook) error
+	DeleteWebhook(id int) error
+	InsertWebhookDeliveries(propertyID int, eventID, event, payload string) (int, error)
+	ClaimWebhookDeliveries(limit int, lease time.Duration) ([]models.WebhookDelivery, error)
+	SaveWebhookAttempt(d models.WebhookDelivery) error
+	GetWebhookDeliveryByID(id int) (models.WebhookDelivery, error)
+	GetWebhookDeliveries(webhookID, limit int) ([]models.WebhookDelivery, error)
+	RedeliverWebhookDelivery(id int) (int, error)
+
+	EnableTwoFactor(userID int, secret string, step int64, codeHashes []string) error
+	DisableTwoFactor(userID int) error
+	UseTOTPStep(userID int, step int64) (bool, error)
+	UseRecoveryCode(userID int, codeHash string) (bool, error)
+	ReplaceRecoveryCodes(userID int, codeHashes []string) error
+	CountRecoveryCodes(userID int) (int, error)
+	GetSecuritySettings() (models.SecuritySettings, error)
+	UpdateSecuritySettings(s models.SecuritySettings) error
+
+	GetUserByEmail(email string) (models.User, error)
+	InsertLoginAttempt(a models.LoginAttempt) error
+	GetLoginFailures(email, ip string, now time.Time) (models.LoginFailures, error)
+	ClearLoginFailures(email string) error
+	LockedAccounts(now time.Time) ([]models.LockedAccount, error)
+
+	UserSessions(userID int, currentToken string, now time.Time) ([]models.Session, error)
+	RevokeSession(userID, id int) error
+	RevokeUserSessions(userID int) (int64, error)
+	DeleteExpiredSessions(before time.Time) (int64, error)
 }
 
@@ -0,0 +1,98 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key from the RFC 6238 test vectors, "12345678901234567890", in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// the last six digits of the RFC 6238 SHA-1 vectors
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, e := range tests {
+		got, err := Code(rfcSecret, time.Unix(e.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != e.expected {
+			t.Errorf("at %d: expected %s, got %s", e.unix, e.expected, got)
+		}
+	}
+
+	if _, err := Code("not base32!", time.Now()); err != ErrInvalidSecret {
+		t.Errorf("expected ErrInvalidSecret, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		valid  bool
+		step   int64
+	}{
+		{"current", rfcSecret, "050471", true, Step(now)},
+		{"previous", rfcSecret, "081804", true, Step(now) - 1},
+		{"spaces-and-case", strings.ToLower(rfcSecret), " 050 471 ", true, Step(now)},
+		{"wrong", rfcSecret, "123456", false, 0},
+		{"too-short", rfcSecret, "05047", false, 0},
+		{"bad-secret", "!!", "050471", false, 0},
+	}
+
+	for _, e := range tests {
+		step, ok := Validate(e.secret, e.code, now)
+		if ok != e.valid || step != e.step {
+			t.Errorf("%s: expected %v at step %d, got %v at step %d", e.name, e.valid, e.step, ok, step)
+		}
+	}
+
+	old, _ := Code(rfcSecret, now.Add(-2*Period))
+	if _, ok := Validate(rfcSecret, old, now); ok {
+		t.Error("expected a code from two periods ago to be refused")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := GenerateSecret()
+	if a == b || len(a) != 32 {
+		t.Errorf("expected two different 32 character secrets, got %s and %s", a, b)
+	}
+
+	code, err := Code(a, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Validate(a, code, time.Now()); !ok {
+		t.Error("expected a code from a new secret to validate")
+	}
+}
+
+func TestURI(t *testing.T) {
+	got := URI("Fort Smythe", "admin@admin.com", "JBSWY3DPEHPK3PXP")
+	for _, want := range []string{"otpauth://totp/Fort%20Smythe:admin@admin.com?", "secret=JBSWY3DPEHPK3PXP",
+		"issuer=Fort+Smythe", "digits=6", "period=30"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %s in %s", want, got)
+		}
+	}
+}
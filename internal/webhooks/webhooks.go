@@ -0,0 +1,260 @@
+// Package webhooks builds, signs and sends the events posted to the webhooks staff register, so
+// tools such as housekeeping and accounting can react when bookings change
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/models"
+)
+
+// Headers sent with every delivery
+const (
+	SignatureHeader = "X-Bookings-Signature"
+	EventHeader     = "X-Bookings-Event"
+	DeliveryHeader  = "X-Bookings-Delivery"
+)
+
+// signatureTolerance is how old a signature may be before Verify refuses it
+const signatureTolerance = 5 * time.Minute
+
+// responseLimit is how much of a webhook's response is kept in the delivery log
+const responseLimit = 1000
+
+// ErrInvalidSignature is returned when a payload does not carry a valid signature
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// backoff is how long to wait before trying a delivery again after each failed attempt. A
+// delivery that fails once more after the last wait has failed for good.
+var backoff = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+	2 * time.Hour,
+	6 * time.Hour,
+	12 * time.Hour,
+	24 * time.Hour,
+}
+
+// MaxAttempts is how many times a delivery is tried before it is given up on
+var MaxAttempts = len(backoff) + 1
+
+// Backoff returns how long to wait before trying again after attempts failed attempts, and
+// false once the delivery has had all its attempts
+func Backoff(attempts int) (time.Duration, bool) {
+	if attempts < 1 || attempts > len(backoff) {
+		return 0, false
+	}
+	return backoff[attempts-1], true
+}
+
+// Event is the body posted to a webhook
+type Event struct {
+	ID string `json:"id"`
+	Type string `json:"type"`
+	PropertyID int `json:"property_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Data interface{} `json:"data"`
+}
+
+// NewEvent returns an event of eventType about data, with a new ID
+func NewEvent(eventType string, propertyID int, data interface{}) Event {
+	id := make([]byte, 12)
+	_, _ = rand.Read(id)
+
+	return Event{
+		ID:         "evt_" + hex.EncodeToString(id),
+		Type:       eventType,
+		PropertyID: propertyID,
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+		Data:       data,
+	}
+}
+
+// Reservation is a reservation as it is sent in events
+type Reservation struct {
+	ID int `json:"id"`
+	Status string `json:"status"`
+	RoomID int `json:"room_id"`
+	RoomName string `json:"room_name"`
+	StartDate models.Date `json:"start_date"`
+	EndDate models.Date `json:"end_date"`
+	Nights int `json:"nights"`
+	Guests int `json:"guests"`
+	FirstName string `json:"first_name"`
+	LastName string `json:"last_name"`
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+}
+
+// ReservationData returns res as it is sent in events
+func ReservationData(res models.Reservation) Reservation {
+	return Reservation{
+		ID:        res.ID,
+		Status:    string(res.Status),
+		RoomID:    res.RoomID,
+		RoomName:  res.Room.RoomName,
+		StartDate: res.StartDate,
+		EndDate:   res.EndDate,
+		Nights:    res.Nights(),
+		Guests:    res.Guests,
+		FirstName: res.FirstName,
+		LastName:  res.LastName,
+		Email:     res.Email,
+		Phone:     res.Phone,
+	}
+}
+
+// Block is a block on a room as it is sent in events. EndDate is the morning after the last
+// blocked night, as with reservations.
+type Block struct {
+	ID int `json:"id,omitempty"`
+	RoomID int `json:"room_id"`
+	RestrictionID int `json:"restriction_id"`
+	StartDate models.Date `json:"start_date"`
+	EndDate models.Date `json:"end_date"`
+	Notes string `json:"notes"`
+}
+
+// BlockData returns block as it is sent in events
+func BlockData(block models.RoomRestriction) Block {
+	return Block{
+		ID:            block.ID,
+		RoomID:        block.RoomID,
+		RestrictionID: block.RestrictionID,
+		StartDate:     block.StartDate,
+		EndDate:       block.EndDate,
+		Notes:         block.Notes,
+	}
+}
+
+// NewSecret returns a random secret for signing a webhook's payloads
+func NewSecret() string {
+	b := make([]byte, 24)
+	_, _ = rand.Read(b)
+	return "whsec_" + hex.EncodeToString(b)
+}
+
+// Sign returns the signature header for payload sent at timestamp: the Unix time and the hex
+// HMAC-SHA256 of the time and payload, written as t=<time>,v1=<hmac>
+func Sign(secret string, timestamp time.Time, payload []byte) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + ts + ",v1=" + sign(secret, ts, payload)
+}
+
+// sign returns the hex HMAC of a payload sent at timestamp
+func sign(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks that header is a signature of payload made with secret within the last few
+// minutes of now, as receivers should before trusting a delivery
+func Verify(secret, header string, payload []byte, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidSignature
+	}
+
+	age := now.Sub(time.Unix(ts, 0))
+	if age > signatureTolerance || age < -signatureTolerance {
+		return ErrInvalidSignature
+	}
+
+	expected := sign(secret, timestamp, payload)
+	for _, sig := range signatures {
+		if hmac.Equal([]byte(sig), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// Result is what a webhook made of a delivery
+type Result struct {
+	StatusCode int
+	// Response is the start of the response body, or why the webhook couldn't be reached
+	Response string
+}
+
+// OK reports whether the webhook accepted the delivery, which it does by answering with any
+// 2xx status
+func (r Result) OK() bool {
+	return r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// Sender posts deliveries to webhooks
+type Sender struct {
+	Client *http.Client
+}
+
+// NewSender returns a sender that gives webhooks timeout to answer
+func NewSender(timeout time.Duration) *Sender {
+	return &Sender{Client: &http.Client{Timeout: timeout}}
+}
+
+// Send posts a delivery's payload to its webhook, signed with the webhook's secret
+func (s *Sender) Send(d models.WebhookDelivery) Result {
+	req, err := http.NewRequest("POST", d.Webhook.URL, bytes.NewReader([]byte(d.Payload)))
+	if err != nil {
+		return Result{Response: err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Bookings-Webhooks/1.0")
+	req.Header.Set(EventHeader, d.Event)
+	req.Header.Set(DeliveryHeader, strconv.Itoa(d.ID))
+	req.Header.Set(SignatureHeader, Sign(d.Webhook.Secret, time.Now(), []byte(d.Payload)))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return Result{Response: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	// the body may be cut off in the middle of a character, which the log can't store
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, responseLimit))
+	result := Result{StatusCode: resp.StatusCode, Response: strings.ToValidUTF8(string(body), "")}
+	if result.Response == "" && !result.OK() {
+		result.Response = fmt.Sprintf("webhook returned %d", resp.StatusCode)
+	}
+	return result
+}
+
+// Payload encodes an event for delivery
+func Payload(ev Event) (string, error) {
+	out, err := json.Marshal(ev)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
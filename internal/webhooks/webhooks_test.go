@@ -0,0 +1,147 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ashparshp/bookings/internal/models"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	payload := []byte(`{"id":"evt_1","type":"reservation.created","property_id":1,"data":{"id":7}}`)
+	valid := Sign("whsec_test", now, payload)
+	old := now.Add(-10 * time.Minute)
+
+	tests := []struct {
+		name      string
+		signature string
+		payload   []byte
+		valid     bool
+	}{
+		{"valid", valid, payload, true},
+		{"extra-signature", valid + ",v1=deadbeef", payload, true},
+		{"missing", "", payload, false},
+		{"no-time", "v1=" + sign("whsec_test", "", payload), payload, false},
+		{"tampered", valid, []byte(strings.Replace(string(payload), `"id":7`, `"id":8`, 1)), false},
+		{"wrong-secret", Sign("whsec_other", now, payload), payload, false},
+		{"too-old", "t=" + strconv.FormatInt(old.Unix(), 10) + ",v1=" + sign("whsec_test", strconv.FormatInt(old.Unix(), 10), payload), payload, false},
+	}
+
+	for _, e := range tests {
+		err := Verify("whsec_test", e.signature, e.payload, now)
+		if e.valid && err != nil {
+			t.Errorf("%s: unexpected error %v", e.name, err)
+		}
+		if !e.valid && !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("%s: expected ErrInvalidSignature, got %v", e.name, err)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	wait, ok := Backoff(1)
+	if !ok || wait != time.Minute {
+		t.Errorf("expected a minute's wait after the first attempt, got %s %v", wait, ok)
+	}
+
+	// each wait is longer than the last until the attempts run out
+	var last time.Duration
+	for attempts := 1; attempts < MaxAttempts; attempts++ {
+		wait, ok := Backoff(attempts)
+		if !ok || wait <= last {
+			t.Errorf("attempt %d: expected a wait longer than %s, got %s %v", attempts, last, wait, ok)
+		}
+		last = wait
+	}
+
+	if _, ok := Backoff(MaxAttempts); ok {
+		t.Error("expected no more attempts after the last one")
+	}
+}
+
+func TestNewEvent(t *testing.T) {
+	res := models.Reservation{
+		ID:        7,
+		FirstName: "John",
+		Status:    models.StatusConfirmed,
+		RoomID:    1,
+		Room:      models.Room{RoomName: "General's Quarters"},
+		StartDate: models.NewDate(2050, 1, 1),
+		EndDate:   models.NewDate(2050, 1, 3),
+	}
+
+	a := NewEvent(models.EventReservationCreated, 1, ReservationData(res))
+	b := NewEvent(models.EventReservationCreated, 1, ReservationData(res))
+	if a.ID == b.ID || !strings.HasPrefix(a.ID, "evt_") {
+		t.Errorf("expected every event to get its own ID, got %s and %s", a.ID, b.ID)
+	}
+
+	payload, err := Payload(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"type":"reservation.created"`, `"property_id":1`, `"status":"confirmed"`,
+		`"room_name":"General's Quarters"`, `"start_date":"2050-01-01"`, `"nights":2`} {
+		if !strings.Contains(payload, want) {
+			t.Errorf("expected %s in the payload, got %s", want, payload)
+		}
+	}
+}
+
+func TestSender_Send(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		if strings.HasSuffix(r.URL.Path, "/broken") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"received":true}`))
+	}))
+	defer srv.Close()
+
+	payload, _ := json.Marshal(NewEvent(models.EventBlockCreated, 1, Block{RoomID: 1}))
+	d := models.WebhookDelivery{
+		ID:      42,
+		Event:   models.EventBlockCreated,
+		Payload: string(payload),
+		Webhook: models.Webhook{URL: srv.URL + "/hooks", Secret: "whsec_test"},
+	}
+
+	s := NewSender(time.Second)
+	result := s.Send(d)
+	if !result.OK() || result.Response != `{"received":true}` {
+		t.Fatalf("expected the delivery to be accepted, got %+v", result)
+	}
+	if got.Header.Get(EventHeader) != "block.created" || got.Header.Get(DeliveryHeader) != "42" {
+		t.Errorf("expected the event and delivery headers, got %v", got.Header)
+	}
+	if string(body) != d.Payload {
+		t.Errorf("expected the payload as it was stored, got %s", body)
+	}
+	if err := Verify("whsec_test", got.Header.Get(SignatureHeader), body, time.Now()); err != nil {
+		t.Errorf("expected a valid signature, got %v", err)
+	}
+
+	d.Webhook.URL = srv.URL + "/broken"
+	result = s.Send(d)
+	if result.OK() || result.StatusCode != http.StatusInternalServerError || result.Response != "webhook returned 500" {
+		t.Errorf("expected the delivery to fail with 500, got %+v", result)
+	}
+
+	d.Webhook.URL = "http://127.0.0.1:0/hooks"
+	result = s.Send(d)
+	if result.OK() || result.StatusCode != 0 || result.Response == "" {
+		t.Errorf("expected an unreachable webhook to fail with a reason, got %+v", result)
+	}
+}
@@ -0,0 +1 @@
+DELETE from restrictions where restriction_name in ('Maintenance', 'Owner Stay', 'Closed to Arrival', 'Closed to Departure');
@@ -0,0 +1,8 @@
+UPDATE public.restrictions SET color = '#0d6efd' WHERE id = 1;
+UPDATE public.restrictions SET color = '#6c757d' WHERE id = 2;
+
+INSERT INTO public.restrictions (restriction_name,color,blocks_stay,closed_to_arrival,closed_to_departure,created_at,updated_at) VALUES
+	 ('Maintenance','#fd7e14',true,false,false,'2026-10-19 00:00:00','2026-10-19 00:00:00'),
+	 ('Owner Stay','#6f42c1',true,false,false,'2026-10-19 00:00:00','2026-10-19 00:00:00'),
+	 ('Closed to Arrival','#dc3545',false,true,false,'2026-10-19 00:00:00','2026-10-19 00:00:00'),
+	 ('Closed to Departure','#e83e8c',false,false,true,'2026-10-19 00:00:00','2026-10-19 00:00:00');
@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS audit_log_no_update_or_delete ON audit_log;
+DROP FUNCTION IF EXISTS audit_log_append_only();
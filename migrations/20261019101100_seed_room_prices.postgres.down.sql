@@ -0,0 +1 @@
+UPDATE rooms SET price = 0;
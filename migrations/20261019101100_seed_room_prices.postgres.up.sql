@@ -0,0 +1,2 @@
+UPDATE rooms SET price = 15000 WHERE room_name = 'General''s Quaters';
+UPDATE rooms SET price = 22500 WHERE room_name = 'Major''s Suite';
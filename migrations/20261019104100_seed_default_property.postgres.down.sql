@@ -0,0 +1 @@
+DELETE FROM properties WHERE id = 1;
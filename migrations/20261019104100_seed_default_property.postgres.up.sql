@@ -0,0 +1,3 @@
+INSERT INTO properties (id, name, slug, hostname, currency, timezone, notify_email, brand_color, logo_url, created_at, updated_at)
+VALUES (1, 'Bookings', 'main', '', 'usd', 'UTC', '', '#0d6efd', '', now(), now());
+SELECT setval('properties_id_seq', (SELECT max(id) FROM properties));
@@ -0,0 +1 @@
+DELETE FROM property_users;
@@ -0,0 +1,2 @@
+INSERT INTO property_users (property_id, user_id, created_at, updated_at)
+SELECT 1, id, now(), now() FROM users;
@@ -116,7 +116,7 @@ function checkAvalbility(id, csfr_token) {
           const rp = new DateRangePicker(elem, {
             format: "yyyy-mm-dd",
             showOnFocus: true,
-            minDate: new Date(),
+            minDate: document.body.dataset.today || new Date(),
           });
         },
         didOpen: () => {
@@ -154,7 +154,7 @@ function checkAvalbility(id, csfr_token) {
                 });
               } else {
                 attention.error({
-                  msg: "No availability",
+                  msg: data.message || "No availability",
                 });
               }
             });
@@ -162,3 +162,164 @@ function checkAvalbility(id, csfr_token) {
       });
     });
 }
+
+// roomCalendar shows two months of a room's availability and prices in elem. Guests pick an
+// arrival and then a departure day, and are sent straight to book the room for those dates.
+function roomCalendar(elem, id) {
+  const weekdays = ["Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"];
+  const days = {};
+  let info = null;
+  let month = "";
+  let start = "";
+  let message = "";
+
+  const addDays = (date, n) => {
+    const d = new Date(date + "T00:00:00Z");
+    d.setUTCDate(d.getUTCDate() + n);
+    return d.toISOString().slice(0, 10);
+  };
+  const addMonths = (m, n) => {
+    const d = new Date(m + "-01T00:00:00Z");
+    d.setUTCMonth(d.getUTCMonth() + n);
+    return d.toISOString().slice(0, 7);
+  };
+  const nights = (from, to) =>
+    Math.round((Date.parse(to) - Date.parse(from)) / 86400000);
+
+  function load(m) {
+    const query = "?months=2" + (m ? "&month=" + m : "");
+    fetch("/rooms/" + id + "/calendar" + query)
+      .then((response) => response.json())
+      .then((data) => {
+        if (!data.ok) {
+          elem.innerHTML =
+            '<p class="text-muted text-center mb-0">' +
+            (data.message || "The calendar isn't available right now") +
+            "</p>";
+          return;
+        }
+        info = data;
+        data.days.forEach((d) => (days[d.date] = d));
+        month = m || data.today.slice(0, 7);
+        render();
+      });
+  }
+
+  // stayProblem explains why the stay from start to end can't be booked, or is empty when it can
+  function stayProblem(end) {
+    const n = nights(start, end);
+    if (n < info.min_stay) {
+      return "Stays must be at least " + info.min_stay + " nights";
+    }
+    if (info.max_stay > 0 && n > info.max_stay) {
+      return "Stays can be at most " + info.max_stay + " nights";
+    }
+    for (let d = start; d < end; d = addDays(d, 1)) {
+      if (!days[d] || !days[d].available) {
+        return "The room is taken on " + d;
+      }
+    }
+    if (!days[end] || !days[end].departure) {
+      return "Departures aren't possible on " + end;
+    }
+    return "";
+  }
+
+  function choose(date) {
+    const day = days[date];
+    if (start && date > start) {
+      message = stayProblem(date);
+      if (message === "") {
+        window.location =
+          "/book-room?id=" + id + "&s=" + start + "&e=" + date;
+        return;
+      }
+    } else if (day && day.arrival) {
+      start = date;
+      message = "";
+    } else {
+      message = "Stays can't start on " + date;
+    }
+    render();
+  }
+
+  function renderMonth(m) {
+    const first = new Date(m + "-01T00:00:00Z");
+    const title = first.toLocaleDateString(undefined, {
+      month: "long",
+      year: "numeric",
+      timeZone: "UTC",
+    });
+
+    let html =
+      '<div class="col-md-6 mb-3"><h5 class="text-center">' +
+      title +
+      '</h5><table class="table table-sm room-calendar-month mb-0"><thead><tr>';
+    weekdays.forEach((w) => (html += '<th class="text-center">' + w + "</th>"));
+    html += "</tr></thead><tbody><tr>";
+
+    for (let i = 0; i < first.getUTCDay(); i++) {
+      html += "<td></td>";
+    }
+    for (let d = m + "-01"; d.slice(0, 7) === m; d = addDays(d, 1)) {
+      const day = days[d];
+      const open =
+        day && (day.arrival || (start && d > start && day.departure));
+      let classes = "room-calendar-day text-center";
+      if (!day || !day.available) {
+        classes += " room-calendar-unavailable";
+      }
+      if (open) {
+        classes += " room-calendar-open";
+      }
+      if (d === start) {
+        classes += " room-calendar-start";
+      } else if (start && d > start && day && !stayProblem(d)) {
+        classes += " room-calendar-end";
+      }
+
+      html +=
+        '<td class="' + classes + '" data-date="' + d + '">' +
+        Number(d.slice(8)) +
+        (day && day.available
+          ? '<small class="d-block">' + day.price_label + "</small>"
+          : "") +
+        "</td>";
+      if (new Date(d + "T00:00:00Z").getUTCDay() === 6) {
+        html += "</tr><tr>";
+      }
+    }
+    return html + "</tr></tbody></table></div>";
+  }
+
+  function render() {
+    let hint = "Choose your arrival date";
+    if (start) {
+      hint =
+        "Arriving " + start + ", now choose your departure date" +
+        (info.min_stay > 1 ? " (at least " + info.min_stay + " nights)" : "");
+    }
+
+    elem.innerHTML =
+      '<div class="d-flex justify-content-between align-items-center mb-3">' +
+      '<button type="button" class="btn btn-outline-primary btn-sm" data-move="-1">&laquo; Earlier</button>' +
+      '<span class="text-muted">' + hint + "</span>" +
+      '<button type="button" class="btn btn-outline-primary btn-sm" data-move="1">Later &raquo;</button>' +
+      "</div>" +
+      (message ? '<div class="alert alert-warning py-2">' + message + "</div>" : "") +
+      '<div class="row">' + renderMonth(month) + renderMonth(addMonths(month, 1)) + "</div>";
+
+    elem.querySelectorAll("[data-move]").forEach((button) => {
+      const to = addMonths(month, Number(button.dataset.move));
+      if (to < info.today.slice(0, 7)) {
+        button.disabled = true;
+      }
+      button.addEventListener("click", () => load(to));
+    });
+    elem.querySelectorAll(".room-calendar-open").forEach((cell) => {
+      cell.addEventListener("click", () => choose(cell.dataset.date));
+    });
+  }
+
+  load("");
+}